@@ -29,9 +29,11 @@ type AppManifest struct {
 			URL  string `json:"url,omitempty"`
 		} `json:"developer"`
 
-		DefaultLocale string `json:"default_locale"`
-		Locales       map[string]struct {
-			Description string `json:"description"`
+		LongDescription string `json:"long_description,omitempty"`
+		DefaultLocale   string `json:"default_locale"`
+		Locales         map[string]struct {
+			Description     string `json:"description"`
+			LongDescription string `json:"long_description,omitempty"`
 		} `json:"locales"`
 
 		Version     string           `json:"version"`
@@ -49,6 +51,8 @@ type AppManifest struct {
 type AppOptions struct {
 	Slug      string
 	SourceURL string
+	// IamSure confirms the uninstallation of a protected application
+	IamSure bool
 }
 
 // InstallApp is used to install an application.
@@ -85,14 +89,22 @@ func (c *Client) UpdateApp(opts *AppOptions) (*AppManifest, error) {
 
 // UninstallApp is used to uninstall an application.
 func (c *Client) UninstallApp(opts *AppOptions) (*AppManifest, error) {
+	var queries url.Values
+	if opts.IamSure {
+		queries = url.Values{"IamSure": {opts.Slug}}
+	}
 	res, err := c.Req(&request.Options{
-		Method: "DELETE",
-		Path:   "/apps/" + url.QueryEscape(opts.Slug),
+		Method:  "DELETE",
+		Path:    "/apps/" + url.QueryEscape(opts.Slug),
+		Queries: queries,
+		Headers: request.Headers{
+			"Accept": "text/event-stream",
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
-	return readAppManifest(res)
+	return readAppManifestStream(res)
 }
 
 func readAppManifestStream(res *http.Response) (*AppManifest, error) {
@@ -122,11 +134,3 @@ func readAppManifestStream(res *http.Response) (*AppManifest, error) {
 	}
 	return app, nil
 }
-
-func readAppManifest(res *http.Response) (*AppManifest, error) {
-	app := &AppManifest{}
-	if err := readJSONAPI(res.Body, &app, nil); err != nil {
-		return nil, err
-	}
-	return app, nil
-}
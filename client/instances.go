@@ -27,14 +27,15 @@ type Instance struct {
 
 // InstanceOptions contains the options passed on instance creation.
 type InstanceOptions struct {
-	Domain     string
-	Locale     string
-	Timezone   string
-	Email      string
-	PublicName string
-	Apps       []string
-	Dev        bool
-	Passphrase string
+	Domain      string
+	Locale      string
+	Timezone    string
+	Email       string
+	PublicName  string
+	Apps        []string
+	Dev         bool
+	Passphrase  string
+	AppsChannel string
 }
 
 // TokenOptions is a struct holding all the options to generate a token.
@@ -71,14 +72,15 @@ func (c *Client) CreateInstance(opts *InstanceOptions) (*Instance, error) {
 		Method: "POST",
 		Path:   "/instances",
 		Queries: url.Values{
-			"Domain":     {opts.Domain},
-			"Locale":     {opts.Locale},
-			"Timezone":   {opts.Timezone},
-			"Email":      {opts.Email},
-			"PublicName": {opts.PublicName},
-			"Apps":       {strings.Join(opts.Apps, ",")},
-			"Dev":        {dev},
-			"Passphrase": {opts.Passphrase},
+			"Domain":      {opts.Domain},
+			"Locale":      {opts.Locale},
+			"Timezone":    {opts.Timezone},
+			"Email":       {opts.Email},
+			"PublicName":  {opts.PublicName},
+			"Apps":        {strings.Join(opts.Apps, ",")},
+			"Dev":         {dev},
+			"Passphrase":  {opts.Passphrase},
+			"AppsChannel": {opts.AppsChannel},
 		},
 	})
 	if err != nil {
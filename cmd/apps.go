@@ -16,6 +16,7 @@ var errAppsMissingDomain = errors.New("Missing --domain flag")
 
 var flagAppsDomain string
 var flagAllDomains bool
+var flagAppsIamSure bool
 
 var appsCmdGroup = &cobra.Command{
 	Use:   "apps [command]",
@@ -141,7 +142,10 @@ var uninstallAppCmd = &cobra.Command{
 			return cmd.Help()
 		}
 		c := newClient(flagAppsDomain, consts.Apps)
-		app, err := c.UninstallApp(&client.AppOptions{Slug: args[0]})
+		app, err := c.UninstallApp(&client.AppOptions{
+			Slug:    args[0],
+			IamSure: flagAppsIamSure,
+		})
 		if err != nil {
 			return err
 		}
@@ -178,6 +182,8 @@ func init() {
 	appsCmdGroup.PersistentFlags().StringVar(&flagAppsDomain, "domain", "", "specify the domain name of the instance")
 	appsCmdGroup.PersistentFlags().BoolVar(&flagAllDomains, "all-domains", false, "work on all domains iterativelly")
 
+	uninstallAppCmd.Flags().BoolVar(&flagAppsIamSure, "iamsure", false, "confirm the uninstallation of a protected application")
+
 	appsCmdGroup.AddCommand(installAppCmd)
 	appsCmdGroup.AddCommand(updateAppCmd)
 	appsCmdGroup.AddCommand(uninstallAppCmd)
@@ -53,8 +53,11 @@ example: cozy-stack config passwd ~/.cozy
 			return cmd.Help()
 		}
 
-		directory := filepath.Join(utils.AbsPath(args[0]))
-		err := os.MkdirAll(directory, 0700)
+		directory, err := utils.AbsPath(args[0])
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(directory, 0700)
 		if err != nil {
 			return err
 		}
@@ -21,6 +21,7 @@ var flagPublicName string
 var flagApps []string
 var flagDev bool
 var flagPassphrase string
+var flagAppsChannel string
 var flagForce bool
 var flagExpire time.Duration
 
@@ -59,14 +60,15 @@ given domain.
 		domain := args[0]
 		c := newAdminClient()
 		in, err := c.CreateInstance(&client.InstanceOptions{
-			Domain:     domain,
-			Apps:       flagApps,
-			Locale:     flagLocale,
-			Timezone:   flagTimezone,
-			Email:      flagEmail,
-			PublicName: flagPublicName,
-			Dev:        flagDev,
-			Passphrase: flagPassphrase,
+			Domain:      domain,
+			Apps:        flagApps,
+			Locale:      flagLocale,
+			Timezone:    flagTimezone,
+			Email:       flagEmail,
+			PublicName:  flagPublicName,
+			Dev:         flagDev,
+			Passphrase:  flagPassphrase,
+			AppsChannel: flagAppsChannel,
 		})
 		if err != nil {
 			log.Errorf("Failed to create instance for domain %s", domain)
@@ -238,6 +240,7 @@ func init() {
 	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
 	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance")
 	addInstanceCmd.Flags().StringVar(&flagPassphrase, "passphrase", "", "Register the instance with this passphrase (useful for tests)")
+	addInstanceCmd.Flags().StringVar(&flagAppsChannel, "apps-channel", "", "Channel of the releases of the apps: stable (default), beta or dev")
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
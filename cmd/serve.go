@@ -75,6 +75,9 @@ func init() {
 	flags.String("subdomains", "nested", "how to structure the subdomains for apps (can be nested or flat)")
 	checkNoErr(viper.BindPFlag("subdomains", flags.Lookup("subdomains")))
 
+	flags.Bool("gzip", false, "compress the HTTP responses with gzip when the client accepts it")
+	checkNoErr(viper.BindPFlag("gzip", flags.Lookup("gzip")))
+
 	flags.String("assets", "", "path to the directory with the assets (use the packed assets by default)")
 	checkNoErr(viper.BindPFlag("assets", flags.Lookup("assets")))
 
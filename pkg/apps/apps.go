@@ -1,8 +1,10 @@
 package apps
 
 import (
+	"encoding/json"
 	"io"
 	"net/url"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -23,19 +25,37 @@ const (
 // State is the state of the application
 type State string
 
+// The states of the applications. They can only be changed with Transition,
+// that follows the state machine described in states.go.
 const (
-	// Available state
+	// Available state, no longer used. NormalizeStates puts the applications
+	// in this state in the errored state.
 	Available State = "available"
 	// Installing state
 	Installing = "installing"
 	// Upgrading state
 	Upgrading = "upgrading"
-	// Uninstalling state
+	// Uninstalling state, no longer used, like Available
 	Uninstalling = "uninstalling"
 	// Errored state
 	Errored = "errored"
 	// Ready state
 	Ready = "ready"
+	// Replaced state, for an application that has been replaced by its
+	// successor: its document and its files are kept, but it can't be used
+	Replaced = "replaced"
+	// Inactive state, for an application disabled by the user: it is not
+	// served until it is made ready again
+	Inactive = "inactive"
+	// Trashed state, for an application that can only be deleted
+	Trashed = "trashed"
+	// Deleting state, while the files of an application are removed: it is
+	// not served anymore, and its document is deleted at the end
+	Deleting = "deleting"
+	// ErroredDeleting state, for an application whose deletion has failed in
+	// the middle: some of its files may be gone, so it can only be deleted
+	// again
+	ErroredDeleting = "errored-deleting"
 )
 
 // AppType is an enum to represent the type of application: webapp clientside
@@ -49,6 +69,38 @@ const (
 	Konnector
 )
 
+// OperationTimeout is the duration after which a pending operation on an
+// application is considered stale: the stack has probably crashed during the
+// operation, and a new one can start.
+var OperationTimeout = 10 * time.Minute
+
+// PendingOperation is recorded on the document of an application while an
+// installer works on it, to refuse the concurrent operations.
+type PendingOperation struct {
+	// ID identifies the attempt of the operation, like an install that is
+	// retried after a failure
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Fresh returns true if the operation has started less than OperationTimeout
+// ago.
+func (o *PendingOperation) Fresh() bool {
+	return o != nil && time.Since(o.StartedAt) < OperationTimeout
+}
+
+func newOperation(name, id string) *PendingOperation {
+	return &PendingOperation{ID: id, Name: name, StartedAt: time.Now()}
+}
+
+// CacheOrigin is recorded on the document of an application when it has been
+// installed from the source cache, because its source was not reachable.
+type CacheOrigin struct {
+	Version  string    `json:"version"`
+	CachedAt time.Time `json:"cached_at"`
+}
+
 // Developer is the name and url of a developer.
 type Developer struct {
 	Name string `json:"name"`
@@ -71,8 +123,50 @@ type Manifest interface {
 	Slug() string
 	State() State
 	Error() error
-	SetState(state State)
+	ErrorCode() string
+	LastTransition() *StateTransition
+	setState(state State, transition *StateTransition)
+	InstalledBy() *Subject
+	UpdatedBy() *Subject
+	setSubjects(installedBy, updatedBy *Subject)
+	AvailableVersion() string
+	CheckedAt() *time.Time
+	setAvailableVersion(version string, checkedAt *time.Time)
 	SetError(err error)
+	Operation() *PendingOperation
+	SetOperation(op *PendingOperation)
+	Size() (size int64, filesCount int)
+	SetSize(size int64, filesCount int)
+	FromCache() *CacheOrigin
+	SetFromCache(origin *CacheOrigin)
+	ResolvedSource() string
+	SetResolvedSource(u string)
+	Channel() string
+	SetChannel(channel string)
+	Extras() map[string]json.RawMessage
+	SetExtras(extras map[string]json.RawMessage)
+	SourceCommit() string
+	SetSourceCommit(commit string)
+	UpdatedAt() time.Time
+	SetUpdatedAt(t time.Time)
+	LastOperation() *OperationMetrics
+	SetLastOperation(metrics *OperationMetrics)
+	schemaVersion() int
+	setSchemaVersion(v int)
+	filesDir() string
+	setFilesDir(dir string)
+	namespaceLost() bool
+	setNamespaceLost(lost bool)
+	AutoUpdate() bool
+	SetAutoUpdate(enabled bool)
+	Protected() bool
+	SetProtected(protected bool)
+	Categories() []string
+	Tags() []string
+	InstallContext() map[string]interface{}
+	SetInstallContext(ctx map[string]interface{})
+	ReplacedBy() *Successor
+	SetReplacedBy(successor *Successor)
 }
 
 // GetBySlug returns an app manifest identified by its slug
@@ -91,6 +185,37 @@ func GetBySlug(db couchdb.Database, slug string, appType AppType) (Manifest, err
 	return man, nil
 }
 
+// appsPageSize is the number of documents of applications fetched at once
+// by the listings
+var appsPageSize = 100
+
+// getAllAppDocs fetches all the documents of a doctype of applications, by
+// pages, and unmarshals them in results, that must be a pointer to a slice.
+func getAllAppDocs(db couchdb.Database, doctype string, results interface{}) error {
+	var docs []json.RawMessage
+	for skip := 0; ; skip += appsPageSize {
+		var page []json.RawMessage
+		req := &couchdb.AllDocsRequest{Limit: appsPageSize, Skip: skip}
+		if err := couchdb.GetAllDocs(db, doctype, req, &page); err != nil {
+			return err
+		}
+		// The design docs are not returned, so a page can have less
+		// documents than its size without being the last one
+		if len(page) == 0 {
+			break
+		}
+		docs = append(docs, page...)
+	}
+	if docs == nil {
+		return nil
+	}
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, results)
+}
+
 func routeMatches(path, ctx []string) bool {
 	for i, part := range ctx {
 		if path[i] != part {
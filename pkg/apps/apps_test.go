@@ -1,11 +1,61 @@
 package apps
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/stretchr/testify/assert"
 )
 
+// createAppDocs creates n documents of ready applications of the tested
+// type, with the given prefix for their slugs, and returns a function to
+// delete them.
+func createAppDocs(t *testing.T, prefix string, n int) func() {
+	var docs []couchdb.Doc
+	for i := 0; i < n; i++ {
+		slug := fmt.Sprintf("%s%03d", prefix, i)
+		var doc couchdb.Doc
+		if installerType == Konnector {
+			doc = &konnManifest{DocSlug: slug, DocState: Ready, DocSchema: SchemaVersion}
+		} else {
+			doc = &WebappManifest{DocSlug: slug, DocState: Ready, DocSchema: SchemaVersion}
+		}
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, doc)) {
+			break
+		}
+		docs = append(docs, doc)
+	}
+	return func() {
+		for _, doc := range docs {
+			couchdb.DeleteDoc(db, doc)
+		}
+	}
+}
+
+func TestListAllPages(t *testing.T) {
+	pageSize := appsPageSize
+	appsPageSize = 2
+	defer func() { appsPageSize = pageSize }()
+	defer createAppDocs(t, "paged", 5)()
+
+	mans, err := listManifests(db, installerType)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var slugs []string
+	for _, man := range mans {
+		if strings.HasPrefix(man.Slug(), "paged") {
+			slugs = append(slugs, man.Slug())
+		}
+	}
+	assert.Equal(t, []string{"paged000", "paged001", "paged002", "paged003", "paged004"}, slugs)
+}
+
 func TestFindRoute(t *testing.T) {
 	manifest := &WebappManifest{}
 	manifest.Routes = make(Routes)
@@ -126,3 +176,241 @@ func TestFindIntent(t *testing.T) {
 	found = man.FindIntent("PICK", "io.cozy.files")
 	assert.Nil(t, found)
 }
+
+type fakeSubDomainer struct{ flat bool }
+
+func (f fakeSubDomainer) SubDomain(s string) *url.URL {
+	host := s + ".alice.example.com"
+	if f.flat {
+		host = "alice-" + s + ".example.com"
+	}
+	return &url.URL{Scheme: "https", Host: host, Path: "/"}
+}
+
+func TestWebappLinks(t *testing.T) {
+	manifest := &WebappManifest{DocSlug: "calendar", Icon: "icon.svg", DocState: Installing}
+	links := manifest.Links()
+	assert.Equal(t, "/apps/calendar", links.Self)
+	assert.Equal(t, "/apps/calendar/icon", links.Icon)
+	assert.Empty(t, links.Related)
+
+	manifest.DocState = Ready
+	manifest.Instance = fakeSubDomainer{flat: false}
+	links = manifest.Links()
+	assert.Equal(t, "https://calendar.alice.example.com/", links.Related)
+
+	manifest.Instance = fakeSubDomainer{flat: true}
+	links = manifest.Links()
+	assert.Equal(t, "https://alice-calendar.example.com/", links.Related)
+
+	manifest.Icon = ""
+	links = manifest.Links()
+	assert.Empty(t, links.Icon)
+}
+
+func TestWebappManifestValidation(t *testing.T) {
+	manifest := &WebappManifest{}
+	err := manifest.ReadManifest(strings.NewReader(`{
+  "routes": {
+    "admin": { "folder": "/admin" },
+    "/public": { "folder": "public" }
+  },
+  "intents": [{ "action": "PICK", "type": ["io.cozy.files"] }]
+}`), "mini", "git://github.com/cozy/mini.git")
+	assert.Error(t, err)
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) {
+		fields := make(map[string]string)
+		for _, e := range errs {
+			fields[e.Field] = e.Code
+		}
+		assert.Len(t, fields, 4)
+		assert.Equal(t, ManifestMissingField, fields["/name"])
+		assert.Equal(t, ManifestInvalidValue, fields["/routes/admin"])
+		assert.Equal(t, ManifestInvalidValue, fields["/routes/~1public/folder"])
+		assert.Equal(t, ManifestMissingField, fields["/intents/0/href"])
+	}
+
+	manifest = &WebappManifest{}
+	err = manifest.ReadManifest(strings.NewReader(`{"name": "mini"}`), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+}
+
+func TestManifestDoctypes(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Apps.StrictDoctypes
+	defer func() { cfg.Apps.StrictDoctypes = was }()
+	body := `{
+  "name": "mini",
+  "permissions": {
+    "files": { "type": "io.cozy.files" },
+    "notes": { "type": "com.example.notes" },
+    "typo": { "type": "io.cozy.fles" },
+    "bad": { "type": "files" }
+  }
+}`
+
+	cfg.Apps.StrictDoctypes = false
+	manifest := &WebappManifest{}
+	err := manifest.ReadManifest(strings.NewReader(body), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/permissions/bad/type: the doctype files is malformed",
+		"/permissions/typo/type: the doctype io.cozy.fles is unknown",
+	}, manifest.Warnings())
+
+	cfg.Apps.StrictDoctypes = true
+	manifest = &WebappManifest{}
+	err = manifest.ReadManifest(strings.NewReader(body), "mini", "git://github.com/cozy/mini.git")
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 2) {
+		assert.Equal(t, "/permissions/bad/type", errs[0].Field)
+		assert.Equal(t, ManifestInvalidDoctype, errs[0].Code)
+		assert.Equal(t, "/permissions/typo/type", errs[1].Field)
+		assert.Equal(t, ManifestUnknownDoctype, errs[1].Code)
+	}
+}
+
+func TestReadManifestBody(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Apps.ManifestMaxSize
+	defer func() { cfg.Apps.ManifestMaxSize = was }()
+	cfg.Apps.ManifestMaxSize = 32
+
+	b, err := readManifestBody(strings.NewReader(`{"name": "mini"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name": "mini"}`, string(b))
+
+	_, err = readManifestBody(strings.NewReader(`{"name": "mini", "description": "too long"}`))
+	assert.Equal(t, ErrManifestTooLarge, err)
+
+	// The maximal size is allowed, but not one more byte
+	exact := `{"name": "` + strings.Repeat("x", 20) + `"}`
+	b, err = readManifestBody(strings.NewReader(exact))
+	assert.NoError(t, err)
+	assert.Len(t, b, 32)
+	_, err = readManifestBody(strings.NewReader(exact + " "))
+	assert.Equal(t, ErrManifestTooLarge, err)
+
+	cfg.Apps.ManifestMaxSize = 0
+	deep := strings.Repeat("[", ManifestMaxDepth+1) + strings.Repeat("]", ManifestMaxDepth+1)
+	_, err = readManifestBody(strings.NewReader(deep))
+	assert.Equal(t, ErrManifestTooDeep, err)
+
+	_, err = readManifestBody(strings.NewReader(`{"name": `))
+	assert.Equal(t, ErrBadManifest, err)
+}
+
+func TestManifestSanitization(t *testing.T) {
+	manifest := &WebappManifest{}
+	err := manifest.ReadManifest(strings.NewReader(`{
+  "name": "mi\u0000ni\n\u001b[31m",
+  "description": "line 1\nline 2\r\u0007",
+  "locales": { "fr": { "description": "ligne\u0008 1" } }
+}`), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "mini[31m", manifest.Name)
+	assert.Equal(t, "line 1\nline 2", manifest.Description)
+	assert.Equal(t, "ligne 1", manifest.Locales["fr"].Description)
+}
+
+func TestKonnectorTerms(t *testing.T) {
+	body := func(version string) *strings.Reader {
+		return strings.NewReader(`{
+  "name": "bank101",
+  "type": "node",
+  "terms": { "url": "https://bank101.example/terms", "version": "` + version + `" }
+}`)
+	}
+	manifest := &konnManifest{}
+	assert.NoError(t, manifest.ReadManifest(body("1"), "bank101", "git://github.com/cozy/bank101.git"))
+	assert.True(t, manifest.DocNeedsTerms)
+
+	err := manifest.AcceptTerms("", time.Now())
+	if assert.IsType(t, &TermsError{}, err) {
+		assert.Equal(t, "https://bank101.example/terms", err.(*TermsError).URL)
+		assert.Equal(t, "1", err.(*TermsError).Version)
+	}
+	assert.Error(t, manifest.AcceptTerms("0", time.Now()))
+	assert.NoError(t, manifest.AcceptTerms("1", time.Now()))
+	assert.False(t, manifest.DocNeedsTerms)
+	assert.Equal(t, "1", manifest.DocTermsOK.Version)
+
+	// The acceptance is kept by an update with the same terms
+	assert.NoError(t, manifest.ReadManifest(body("1"), "bank101", "git://github.com/cozy/bank101.git"))
+	assert.False(t, manifest.DocNeedsTerms)
+	assert.NotNil(t, manifest.DocTermsOK)
+
+	// But a new version of the terms must be accepted again
+	assert.NoError(t, manifest.ReadManifest(body("2"), "bank101", "git://github.com/cozy/bank101.git"))
+	assert.True(t, manifest.DocNeedsTerms)
+	assert.Equal(t, "1", manifest.DocTermsOK.Version)
+
+	// The terms are just removed if the new manifest has none
+	err = manifest.ReadManifest(strings.NewReader(`{"name": "bank101", "type": "node"}`), "bank101", "git://github.com/cozy/bank101.git")
+	assert.NoError(t, err)
+	assert.Nil(t, manifest.Terms)
+	assert.False(t, manifest.DocNeedsTerms)
+	assert.NoError(t, manifest.AcceptTerms("", time.Now()))
+
+	manifest = &konnManifest{}
+	err = manifest.ReadManifest(strings.NewReader(`{
+  "name": "bank101",
+  "type": "node",
+  "terms": { "url": "javascript:alert(1)" }
+}`), "bank101", "git://github.com/cozy/bank101.git")
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) {
+		fields := make(map[string]string)
+		for _, e := range errs {
+			fields[e.Field] = e.Code
+		}
+		assert.Equal(t, ManifestInvalidValue, fields["/terms/url"])
+		assert.Equal(t, ManifestMissingField, fields["/terms/version"])
+	}
+}
+
+func TestManifestCategories(t *testing.T) {
+	manifest := &WebappManifest{}
+	err := manifest.ReadManifest(strings.NewReader(`{
+  "name": "mini",
+  "categories": ["Finance", " finance", "banking", ""],
+  "tags": ["bank", "bank", " "]
+}`), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"finance", "banking"}, manifest.Categories())
+	assert.Equal(t, []string{"bank"}, manifest.Tags())
+	assert.True(t, manifest.Valid("category", "FINANCE"))
+	assert.False(t, manifest.Valid("category", OthersCategory))
+
+	err = manifest.ReadManifest(strings.NewReader(`{"name": "mini"}`), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{OthersCategory}, manifest.DocCategories)
+	assert.Equal(t, []string{}, manifest.DocTags)
+	assert.True(t, manifest.Valid("category", OthersCategory))
+
+	// The documents saved before the categories are in the same bucket
+	konn := &konnManifest{}
+	assert.Equal(t, []string{OthersCategory}, konn.Categories())
+	assert.True(t, konn.Valid("category", OthersCategory))
+}
+
+func TestPeekSuccessor(t *testing.T) {
+	successor, err := peekSuccessor([]byte(`{"name": "mini"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, successor)
+
+	successor, err = peekSuccessor([]byte(`{"replaced_by": {"slug": "maxi", "source": "git://github.com/cozy/maxi.git"}}`))
+	if assert.NoError(t, err) && assert.NotNil(t, successor) {
+		assert.Equal(t, "maxi", successor.Slug)
+		assert.Equal(t, "git://github.com/cozy/maxi.git", successor.Source)
+	}
+
+	_, err = peekSuccessor([]byte(`{"replaced_by": {"slug": "Not a slug!", "source": ""}}`))
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) {
+		assert.Len(t, errs, 2)
+	}
+	_, err = peekSuccessor([]byte(`{"replaced_by": `))
+	assert.Equal(t, ErrBadManifest, err)
+}
@@ -0,0 +1,209 @@
+// Package apptest provides the fixtures to test the code that installs,
+// updates and deletes the applications without a real git remote: an HTTP
+// server that serves fixture applications as tarballs and manifests, and
+// helpers to check the files and the documents of the applications.
+package apptest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+)
+
+// App is a fixture application served by a Server
+type App struct {
+	// Manifest is the content of the manifest of the application
+	Manifest string
+	// ManifestName is the name of the manifest file, manifest.webapp by
+	// default (use apps.KonnectorManifestName for a konnector)
+	ManifestName string
+	// Files are the other files of the application, by path
+	Files map[string]string
+
+	// Latency is how long the server waits before each response
+	Latency time.Duration
+	// Status is the status code of the responses, if it is not 200
+	Status int
+	// FailAfter cuts the tarball after this number of bytes, as if the
+	// connection was lost in the middle of the download (0 to send it all)
+	FailAfter int
+	// Checksum adds the sha256 of the tarball to the source of the
+	// application, and BadChecksum adds a wrong one
+	Checksum    bool
+	BadChecksum bool
+}
+
+func (a *App) manifestName() string {
+	if a.ManifestName != "" {
+		return a.ManifestName
+	}
+	return apps.WebappManifestName
+}
+
+// Tree returns the files of the application, with its manifest, as they are
+// expected in its directory after an install (see AssertTree).
+func (a *App) Tree() map[string]string {
+	files := map[string]string{a.manifestName(): a.Manifest}
+	for name, content := range a.Files {
+		files[strings.TrimPrefix(name, "/")] = content
+	}
+	return files
+}
+
+// Tarball returns the gzipped tarball of the files of the application, with
+// its manifest.
+func (a *App) Tarball() []byte {
+	files := a.Tree()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		content := files[name]
+		tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+// Server is an in-process HTTP server that serves fixture applications, by
+// name. The tarball of an application is served at /<name>.tar.gz, and its
+// manifest at /<name>/<manifest name>, like for a git source.
+type Server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	apps     map[string]*App
+	requests map[string]int
+}
+
+// NewServer starts a server without any application. It must be closed at
+// the end of the test.
+func NewServer() *Server {
+	s := &Server{
+		apps:     make(map[string]*App),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Set adds or replaces a fixture application. Replacing it is how a new
+// version is published, as the updates use the same source.
+func (s *Server) Set(name string, app *App) {
+	s.mu.Lock()
+	s.apps[name] = app
+	s.mu.Unlock()
+}
+
+// Remove removes a fixture application: the server then responds to its
+// requests with a 404.
+func (s *Server) Remove(name string) {
+	s.mu.Lock()
+	delete(s.apps, name)
+	s.mu.Unlock()
+}
+
+// Source returns the tarball source of an application, to install it with
+// the installer or the POST /apps/:slug route.
+func (s *Server) Source(name string) string {
+	src := s.URL + "/" + name + ".tar.gz"
+	s.mu.Lock()
+	app := s.apps[name]
+	s.mu.Unlock()
+	if app == nil {
+		return src
+	}
+	switch {
+	case app.BadChecksum:
+		sum := sha256.Sum256([]byte("not the tarball"))
+		src += "#sha256=" + hex.EncodeToString(sum[:])
+	case app.Checksum:
+		sum := sha256.Sum256(app.Tarball())
+		src += "#sha256=" + hex.EncodeToString(sum[:])
+	}
+	return src
+}
+
+// GitSource returns a git source whose manifest is served by the server.
+// The clone of the repository fails, as the server is not a git server.
+func (s *Server) GitSource(name string) string {
+	u, _ := url.Parse(s.URL)
+	return "git://" + u.Host + "/" + name + "/"
+}
+
+// Requests returns the number of requests received for an application
+func (s *Server) Requests(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[name]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	name, file := strings.TrimPrefix(r.URL.Path, "/"), ""
+	if strings.HasSuffix(name, ".tar.gz") {
+		name = strings.TrimSuffix(name, ".tar.gz")
+	} else if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, file = name[:i], name[i+1:]
+	}
+
+	s.mu.Lock()
+	app := s.apps[name]
+	s.requests[name]++
+	s.mu.Unlock()
+	if app == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if app.Latency > 0 {
+		time.Sleep(app.Latency)
+	}
+	if app.Status != 0 && app.Status != http.StatusOK {
+		w.WriteHeader(app.Status)
+		return
+	}
+
+	if file != "" {
+		if file != app.manifestName() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(app.Manifest))
+		return
+	}
+
+	data := app.Tarball()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if app.FailAfter > 0 && app.FailAfter < len(data) {
+		// The response is shorter than its Content-Length, so the client
+		// sees an unexpected EOF
+		w.Write(data[:app.FailAfter])
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,123 @@
+package apptest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func readTarball(t *testing.T, data []byte) map[string]string {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(b)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	app := &App{
+		Manifest: `{"name": "Fixture"}`,
+		Files:    map[string]string{"index.html": "<html></html>", "/js/app.js": "alert(1)"},
+	}
+	srv.Set("fixture", app)
+
+	res, err := http.Get(srv.Source("fixture"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, app.Tree(), readTarball(t, data))
+	assert.Equal(t, map[string]string{
+		"manifest.webapp": `{"name": "Fixture"}`,
+		"index.html":      "<html></html>",
+		"js/app.js":       "alert(1)",
+	}, app.Tree())
+
+	res, err = http.Get(srv.URL + "/fixture/manifest.webapp")
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, `{"name": "Fixture"}`, string(b))
+	}
+	assert.Equal(t, 2, srv.Requests("fixture"))
+	assert.True(t, strings.HasPrefix(srv.GitSource("fixture"), "git://127.0.0.1:"))
+
+	res, err = http.Get(srv.Source("unknown"))
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 404, res.StatusCode)
+	}
+}
+
+func TestServerKnobs(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	app := &App{Manifest: `{"name": "Fixture"}`, Checksum: true}
+	srv.Set("fixture", app)
+	sum := sha256.Sum256(app.Tarball())
+	assert.Equal(t, srv.URL+"/fixture.tar.gz#sha256="+hex.EncodeToString(sum[:]), srv.Source("fixture"))
+	app.BadChecksum = true
+	assert.NotEqual(t, srv.URL+"/fixture.tar.gz#sha256="+hex.EncodeToString(sum[:]), srv.Source("fixture"))
+
+	srv.Set("failing", &App{Manifest: `{"name": "Fixture"}`, Status: 503})
+	res, err := http.Get(srv.Source("failing"))
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 503, res.StatusCode)
+	}
+
+	srv.Set("cut", &App{Manifest: `{"name": "Fixture"}`, FailAfter: 10})
+	res, err = http.Get(srv.Source("cut"))
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+
+	srv.Set("slow", &App{Manifest: `{"name": "Fixture"}`, Latency: 50 * time.Millisecond})
+	start := time.Now()
+	res, err = http.Get(srv.Source("slow"))
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	}
+}
+
+func TestReadTree(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/mini/index.html", []byte("<html></html>"), 0644)
+	afero.WriteFile(fs, "/mini/js/app.js", []byte("alert(1)"), 0644)
+	afero.WriteFile(fs, "/mini/.git/HEAD", []byte("ref"), 0644)
+	AssertTree(t, fs, "mini", map[string]string{
+		"index.html": "<html></html>",
+		"js/app.js":  "alert(1)",
+	})
+	AssertNoTree(t, fs, "other")
+}
@@ -0,0 +1,124 @@
+package apptest
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// WaitTimeout is how long WaitApp waits for an operation to finish
+var WaitTimeout = 10 * time.Second
+
+// WaitApp waits for the end of the pending operation of an application, like
+// an install or an update run in the background by the POST and PUT routes,
+// and returns its document.
+func WaitApp(t *testing.T, db couchdb.Database, appType apps.AppType, slug string) apps.Manifest {
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		man, err := apps.GetBySlug(db, slug, appType)
+		if err == nil && man.Operation() == nil &&
+			man.State() != apps.Installing && man.State() != apps.Upgrading {
+			return man
+		}
+		if err != nil && !couchdb.IsNotFoundError(err) {
+			assert.NoError(t, err)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("The operation on %s has not finished after %s", slug, WaitTimeout)
+			return man
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitNoApp waits for the deletion of an application, and returns false if
+// it is still installed after WaitTimeout.
+func WaitNoApp(t *testing.T, db couchdb.Database, appType apps.AppType, slug string) bool {
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		_, err := apps.GetBySlug(db, slug, appType)
+		if couchdb.IsNotFoundError(err) {
+			return true
+		}
+		if err != nil {
+			return assert.NoError(t, err)
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("%s has not been deleted after %s", slug, WaitTimeout)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AssertApp checks that the application is installed, in the given state, and
+// returns its document.
+func AssertApp(t *testing.T, db couchdb.Database, appType apps.AppType, slug string, state apps.State) apps.Manifest {
+	man, err := apps.GetBySlug(db, slug, appType)
+	if !assert.NoError(t, err, "%s is not installed", slug) {
+		return nil
+	}
+	assert.Equal(t, state, man.State(), "state of %s", slug)
+	return man
+}
+
+// AssertNoApp checks that the application has no document
+func AssertNoApp(t *testing.T, db couchdb.Database, appType apps.AppType, slug string) bool {
+	_, err := apps.GetBySlug(db, slug, appType)
+	return assert.True(t, couchdb.IsNotFoundError(err), "%s is still installed (%v)", slug, err)
+}
+
+// ReadTree returns the files of a directory of the apps filesystem, with
+// their content, by path relative to the directory. The .git directory is not
+// read.
+func ReadTree(fs afero.Fs, dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	dir = path.Join("/", dir)
+	err := afero.Walk(fs, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(p, dir+"/")
+		if info.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		b, err := afero.ReadFile(fs, p)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// AssertTree checks that a directory of the apps filesystem has exactly the
+// given files, with their content.
+func AssertTree(t *testing.T, fs afero.Fs, dir string, expected map[string]string) bool {
+	files, err := ReadTree(fs, dir)
+	if !assert.NoError(t, err) {
+		return false
+	}
+	return assert.Equal(t, expected, files, "files of %s", dir)
+}
+
+// AssertNoTree checks that a directory of the apps filesystem doesn't exist
+func AssertNoTree(t *testing.T, fs afero.Fs, dir string) bool {
+	exists, err := afero.Exists(fs, path.Join("/", dir))
+	return assert.NoError(t, err) && assert.False(t, exists, "%s still exists", dir)
+}
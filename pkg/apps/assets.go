@@ -0,0 +1,76 @@
+package apps
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// cleanAssetPath returns the path of an asset declared by a manifest, relative
+// to the directory of the application and without the leading slash, or false
+// if the path goes outside of this directory or in its .git directory.
+func cleanAssetPath(name string) (string, bool) {
+	p, err := utils.SafeJoinSlash("/", strings.TrimLeft(name, "/"))
+	if err != nil || p == "/" {
+		return "", false
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == ".git" || strings.HasPrefix(p, ".git/") {
+		return "", false
+	}
+	return p, true
+}
+
+// validateAssets checks the paths of the screenshots and of the assets of a
+// manifest: they must stay in the directory of the application.
+func validateAssets(m *WebappManifest, errs ManifestErrors) ManifestErrors {
+	check := func(field string, names []string) {
+		for i, name := range names {
+			if _, ok := cleanAssetPath(name); !ok {
+				errs = errs.add("/"+field+"/"+strconv.Itoa(i), ManifestInvalidValue,
+					"the path is outside of the directory of the application")
+			}
+		}
+	}
+	check("screenshots", m.Screenshots)
+	check("assets", m.Assets)
+	return errs
+}
+
+// buildAssetList returns the sorted paths of the files of a webapp that can
+// be served by the icon and assets routes: its icon, its screenshots and the
+// assets declared by its manifest. The paths that are not valid are left out.
+func buildAssetList(m *WebappManifest) []string {
+	names := make([]string, 0, 1+len(m.Screenshots)+len(m.Assets))
+	names = append(names, m.Icon)
+	names = append(names, m.Screenshots...)
+	names = append(names, m.Assets...)
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		if p, ok := cleanAssetPath(name); ok {
+			list = append(list, p)
+		}
+	}
+	list = utils.UniqueStrings(list)
+	sort.Strings(list)
+	return list
+}
+
+// ServesAsset returns true if the file at the given path, relative to the
+// directory of the webapp, has been declared by its manifest as an asset that
+// can be served. The list built at install is used when the document has one,
+// else it is built from the manifest.
+func (m *WebappManifest) ServesAsset(name string) bool {
+	p, ok := cleanAssetPath(name)
+	if !ok {
+		return false
+	}
+	list := m.DocAssets
+	if list == nil {
+		list = buildAssetList(m)
+	}
+	i := sort.SearchStrings(list, p)
+	return i < len(list) && list[i] == p
+}
@@ -0,0 +1,42 @@
+package apps
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssetList(t *testing.T) {
+	man := &WebappManifest{}
+	err := man.ReadManifest(bytes.NewReader([]byte(`{
+  "name": "Mini",
+  "icon": "/icon.svg",
+  "screenshots": ["screenshots/home.png", "./screenshots//home.png"],
+  "assets": ["/img/logo.png"]
+}`)), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"icon.svg", "img/logo.png", "screenshots/home.png"}, man.DocAssets)
+	assert.True(t, man.ServesAsset("/screenshots/home.png"))
+	assert.True(t, man.ServesAsset("icon.svg"))
+	assert.False(t, man.ServesAsset("index.html"))
+	assert.False(t, man.ServesAsset("img/../index.html"))
+	assert.False(t, man.ServesAsset("../other/icon.svg"))
+
+	// The list is built from the manifest for the documents that don't have
+	// one, like those of the webapps installed before it was added
+	man.DocAssets = nil
+	assert.True(t, man.ServesAsset("img/logo.png"))
+
+	man = &WebappManifest{}
+	err = man.ReadManifest(bytes.NewReader([]byte(`{
+  "name": "Mini",
+  "screenshots": ["../other/secret.png", ".git/config"]
+}`)), "mini", "git://github.com/cozy/mini.git")
+	if errs, ok := err.(ManifestErrors); assert.True(t, ok) && assert.Len(t, errs, 2) {
+		assert.Equal(t, "/screenshots/0", errs[0].Field)
+		assert.Equal(t, ManifestInvalidValue, errs[0].Code)
+		assert.Equal(t, "/screenshots/1", errs[1].Field)
+	}
+	assert.Empty(t, man.DocAssets)
+}
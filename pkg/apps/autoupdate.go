@@ -0,0 +1,434 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// autoUpdateMaxBackoff is the maximal delay before trying again to update
+// automatically an application whose last automatic updates have failed
+const autoUpdateMaxBackoff = 7 * 24 * time.Hour
+
+// AutoUpdateTarget is an instance whose applications can be updated
+// automatically
+type AutoUpdateTarget interface {
+	couchdb.Database
+	AppsFS(appType AppType) afero.Fs
+}
+
+// autoUpdatesPaused is the kill switch of the automatic updates (1 when they
+// are paused)
+var autoUpdatesPaused int32
+
+// PauseAutoUpdates stops (or restarts) the automatic updates for the whole
+// stack. The updates in progress are finished, but no new one is started.
+func PauseAutoUpdates(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&autoUpdatesPaused, v)
+}
+
+// AutoUpdatesPaused returns true if the automatic updates have been paused
+func AutoUpdatesPaused() bool {
+	return atomic.LoadInt32(&autoUpdatesPaused) == 1
+}
+
+// autoUpdateFailure is the number of consecutive failures of the automatic
+// updates of an application, and when they can be tried again
+type autoUpdateFailure struct {
+	count int
+	retry time.Time
+}
+
+// AutoUpdater checks periodically if there are new versions of the
+// applications of the instances, and updates the applications that have not
+// been opted out with auto_update: false. The instances are handled with a
+// bounded concurrency, and a random delay between them to spread the load.
+type AutoUpdater struct {
+	forEach     func(fn func(AutoUpdateTarget) error) error
+	interval    time.Duration
+	jitter      time.Duration
+	concurrency int
+	clock       utils.Clock
+
+	mu       sync.Mutex
+	failures map[string]*autoUpdateFailure
+	done     chan struct{}
+}
+
+// NewAutoUpdater returns an auto-updater configured with the apps.auto_update
+// section of the configuration. The forEach function iterates over the
+// instances.
+func NewAutoUpdater(forEach func(fn func(AutoUpdateTarget) error) error) *AutoUpdater {
+	cfg := config.GetConfig().Apps
+	return &AutoUpdater{
+		forEach:     forEach,
+		interval:    cfg.AutoUpdateInterval,
+		jitter:      cfg.AutoUpdateJitter,
+		concurrency: cfg.AutoUpdateConcurrency,
+		clock:       utils.RealClock,
+		failures:    make(map[string]*autoUpdateFailure),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start runs the automatic updates after each interval, until the context is
+// done. Nothing is done if no interval is configured.
+func (u *AutoUpdater) Start(ctx context.Context) {
+	if u.interval <= 0 {
+		close(u.done)
+		return
+	}
+	log.Infof("[apps] the automatic updates are checked every %s", u.interval)
+	go func() {
+		defer close(u.done)
+		utils.Every(ctx, u.interval, func(ctx context.Context) error {
+			u.Run(ctx)
+			return nil
+		})
+	}()
+}
+
+// Wait waits for the end of the automatic updates in progress, after the
+// context given to Start is done.
+func (u *AutoUpdater) Wait(ctx context.Context) error {
+	select {
+	case <-u.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run checks the updates of the applications of all the instances once
+func (u *AutoUpdater) Run(ctx context.Context) {
+	if AutoUpdatesPaused() {
+		log.Infof("[apps] the automatic updates are paused")
+		return
+	}
+	limit := u.concurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	err := u.forEach(func(target AutoUpdateTarget) error {
+		if err := utils.SleepCtx(ctx, utils.RandomDuration(u.jitter)); err != nil {
+			return err
+		}
+		if AutoUpdatesPaused() {
+			return ErrAutoUpdatesPaused
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			for _, appType := range []AppType{Webapp, Konnector} {
+				u.updateApps(ctx, target, appType)
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err != nil && err != ErrAutoUpdatesPaused && err != ctx.Err() {
+		log.Errorf("[apps] could not list the instances for the automatic updates: %s", err)
+	}
+}
+
+func (u *AutoUpdater) updateApps(ctx context.Context, target AutoUpdateTarget, appType AppType) {
+	domain := strings.TrimSuffix(target.Prefix(), "/")
+	mans, err := listManifests(target, appType)
+	if err != nil {
+		log.Errorf("[apps] could not list the %ss of %s for the automatic updates: %s",
+			appType, domain, err)
+		return
+	}
+	fs := target.AppsFS(appType)
+	for _, man := range mans {
+		if AutoUpdatesPaused() || ctx.Err() != nil {
+			return
+		}
+		if !checkable(man) {
+			continue
+		}
+		key := domain + "/" + string(appType) + "/" + man.Slug()
+		if !u.canTry(key) {
+			continue
+		}
+		// The check is recorded for all the applications, even the ones
+		// that are not updated automatically
+		now := u.clock.Now().UTC()
+		version, err := checkUpdate(target, fs, appType, man, now)
+		if err != nil {
+			u.failed(key)
+			log.Warnf("[apps] could not check the updates of %s %s on %s: %s",
+				appType, man.Slug(), domain, err)
+			continue
+		}
+		if version == "" || !man.AutoUpdate() || (man.State() != Ready && man.State() != Errored) {
+			u.succeeded(key)
+			continue
+		}
+		from := VersionOf(man)
+		to, err := u.updateApp(target, fs, appType, man)
+		if err != nil {
+			u.failed(key)
+			log.Warnf("[apps] automatic update of %s %s on %s has failed: %s",
+				appType, man.Slug(), domain, err)
+			continue
+		}
+		u.succeeded(key)
+		if to != "" {
+			log.Infof("[apps] automatic update of %s %s on %s: %s -> %s",
+				appType, man.Slug(), domain, from, to)
+		}
+	}
+}
+
+// updateApp updates the application to the newer version available at its
+// source, and returns the installed version (or an empty string if another
+// operation is in progress).
+func (u *AutoUpdater) updateApp(db couchdb.Database, fs afero.Fs, appType AppType, man Manifest) (string, error) {
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      appType,
+		Slug:      man.Slug(),
+		Subject:   SystemSubject,
+	})
+	if err != nil {
+		if _, ok := err.(*OperationInProgressError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+	RunInBackground(inst.Update)
+	updated, err := waitInstaller(inst)
+	if err != nil {
+		return "", err
+	}
+	return VersionOf(updated), nil
+}
+
+// checkable returns true if the source of the application can be checked for
+// a newer version: it must not be in the middle of an operation, nor be
+// replaced or trashed.
+func checkable(man Manifest) bool {
+	switch man.State() {
+	case Ready, Errored, Inactive:
+		return !man.Operation().Fresh()
+	}
+	return false
+}
+
+// checkUpdate fetches the manifest at the source of an installed application,
+// and records on its document if a newer version is available, with the date
+// of the check. It returns this version, or an empty string if there is none.
+func checkUpdate(db couchdb.Database, fs afero.Fs, appType AppType, man Manifest, now time.Time) (string, error) {
+	version, err := sourceVersion(db, fs, appType, man)
+	if err != nil {
+		return "", err
+	}
+	if !newerVersion(VersionOf(man), version) {
+		version = ""
+	}
+	man.setAvailableVersion(version, &now)
+	if err = couchdb.UpdateDoc(db, man); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// UpdatesReport is the result of the check of the updates of the
+// applications of an instance.
+type UpdatesReport struct {
+	// Available are the versions that can be installed, by slug
+	Available map[string]string `json:"available"`
+	// Failed are the errors of the applications whose source could not be
+	// checked, by slug
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// CheckUpdates checks the sources of the applications of the given type, and
+// records on their documents if a newer version is available, like the
+// automatic updates do. Nothing is installed.
+func CheckUpdates(db couchdb.Database, fs afero.Fs, appType AppType) (*UpdatesReport, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	report := &UpdatesReport{Available: make(map[string]string)}
+	now := time.Now().UTC()
+	for _, man := range mans {
+		if !checkable(man) {
+			continue
+		}
+		version, err := checkUpdate(db, fs, appType, man, now)
+		if err != nil {
+			if report.Failed == nil {
+				report.Failed = make(map[string]string)
+			}
+			report.Failed[man.Slug()] = err.Error()
+			continue
+		}
+		if version != "" {
+			report.Available[man.Slug()] = version
+		}
+	}
+	return report, nil
+}
+
+// canTry returns false if the last automatic updates of the application have
+// failed, and the delay before trying again has not passed.
+func (u *AutoUpdater) canTry(key string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f, ok := u.failures[key]
+	return !ok || !u.clock.Now().Before(f.retry)
+}
+
+// failed increases the delay before the next try: twice the interval after
+// the first failure, then doubled after each new failure.
+func (u *AutoUpdater) failed(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f, ok := u.failures[key]
+	if !ok {
+		f = &autoUpdateFailure{}
+		u.failures[key] = f
+	}
+	f.count++
+	delay := u.interval
+	for i := 0; i < f.count && delay < autoUpdateMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay <= 0 || delay > autoUpdateMaxBackoff {
+		delay = autoUpdateMaxBackoff
+	}
+	f.retry = u.clock.Now().Add(delay)
+}
+
+func (u *AutoUpdater) succeeded(key string) {
+	u.mu.Lock()
+	delete(u.failures, key)
+	u.mu.Unlock()
+}
+
+// sourceETag is the ETag of the archive of a tarball source, with the version
+// of its manifest, as seen by the last check of its version
+type sourceETag struct {
+	etag    string
+	version string
+}
+
+// sourceETags are the ETags of the archives of the tarball sources, by URL.
+// They are used to check the versions of these sources with conditional
+// requests, so that an archive that has not changed is not downloaded again.
+var (
+	sourceETagsMu sync.Mutex
+	sourceETags   = make(map[string]sourceETag)
+)
+
+// sourceVersion fetches the manifest at the source of an installed
+// application, and returns its version. The application is not modified.
+// The archives that can't have changed are not downloaded: a signed or
+// checksummed archive has the installed version, an archive with the same
+// ETag as the last check has the same version, and a release source that is
+// resolved to the same archive as the installed version (its
+// resolved_source) has not changed.
+func sourceVersion(db couchdb.Database, fs afero.Fs, appType AppType, man Manifest) (string, error) {
+	src, err := url.Parse(man.Source())
+	if err != nil {
+		return "", err
+	}
+	manFilename := WebappManifestName
+	if appType == Konnector {
+		manFilename = KonnectorManifestName
+	}
+	fetcher, err := newFetcher(src, fs, sharedSourceCache(), manFilename, nil)
+	if err != nil {
+		return "", err
+	}
+	defer closeFetcher(fetcher)
+	var seen sourceETag
+	switch f := fetcher.(type) {
+	case *tarballFetcher:
+		if pinnedArchive(src) {
+			return VersionOf(man), nil
+		}
+		sourceETagsMu.Lock()
+		seen = sourceETags[src.String()]
+		sourceETagsMu.Unlock()
+		f.ifNoneMatch = seen.etag
+	case *releaseFetcher:
+		f.channel = defaultChannel(db)
+		if resolved := man.ResolvedSource(); resolved != "" {
+			u, err := f.resolve(src)
+			if err != nil {
+				return "", err
+			}
+			if u.String() == resolved {
+				return VersionOf(man), nil
+			}
+		}
+	}
+	r, err := fetcher.FetchManifest(src)
+	if err == errNotModified {
+		return seen.version, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := readManifestBody(r)
+	if err != nil {
+		return "", err
+	}
+	var doc struct {
+		Version string `json:"version"`
+	}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return "", ErrBadManifest
+	}
+	if f, ok := fetcher.(*tarballFetcher); ok && f.etag != "" {
+		sourceETagsMu.Lock()
+		sourceETags[src.String()] = sourceETag{etag: f.etag, version: doc.Version}
+		sourceETagsMu.Unlock()
+	}
+	return doc.Version, nil
+}
+
+// newerVersion returns true if the available version is newer than the
+// installed one, with the precedence of the semantic versions. Like for the
+// source cache (see SourceCache.Newest), a version that is not a semantic
+// version is older than the ones that are, and two of them are just
+// compared for equality.
+func newerVersion(installed, available string) bool {
+	if available == "" || available == installed {
+		return false
+	}
+	i, erri := utils.ParseVersion(installed)
+	a, erra := utils.ParseVersion(available)
+	switch {
+	case erri != nil && erra != nil:
+		return true
+	case erra != nil:
+		return false
+	case erri != nil:
+		return true
+	}
+	return i.LessThan(a)
+}
@@ -0,0 +1,179 @@
+package apps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+type autoUpdateTarget struct {
+	couchdb.Database
+	fs afero.Fs
+}
+
+func (t *autoUpdateTarget) AppsFS(appType AppType) afero.Fs { return t.fs }
+
+func TestNewerVersion(t *testing.T) {
+	assert.True(t, newerVersion("1.0.0", "1.0.1"))
+	assert.True(t, newerVersion("1.9.0", "v1.10.0"))
+	assert.True(t, newerVersion("nightly", "nightly-2"))
+	assert.False(t, newerVersion("1.0.1", "1.0.0"))
+	assert.False(t, newerVersion("1.0.0", "1.0.0"))
+	assert.False(t, newerVersion("1.0.0", ""))
+	assert.False(t, newerVersion("2.0.0", "2.0.0-beta.1"))
+	assert.False(t, newerVersion("1.0.0", "nightly"))
+	assert.True(t, newerVersion("nightly", "1.0.0"))
+}
+
+func TestAutoUpdateBackoff(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC))
+	u := &AutoUpdater{
+		interval: time.Hour,
+		clock:    clock,
+		failures: make(map[string]*autoUpdateFailure),
+	}
+	key := "alice.cozy.example/webapp/drive"
+	assert.True(t, u.canTry(key))
+
+	u.failed(key)
+	assert.False(t, u.canTry(key))
+	clock.Advance(2 * time.Hour)
+	assert.True(t, u.canTry(key))
+
+	u.failed(key)
+	clock.Advance(2 * time.Hour)
+	assert.False(t, u.canTry(key))
+	clock.Advance(2 * time.Hour)
+	assert.True(t, u.canTry(key))
+
+	for i := 0; i < 20; i++ {
+		u.failed(key)
+	}
+	clock.Advance(autoUpdateMaxBackoff)
+	assert.True(t, u.canTry(key))
+
+	u.succeeded(key)
+	assert.True(t, u.canTry(key))
+	assert.Len(t, u.failures, 0)
+}
+
+func TestAutoUpdateRun(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	archive := makeTarball(t, map[string]string{
+		WebappManifestName: `{"name": "auto", "version": "2.0.0"}`,
+		"index.html":       "<html></html>",
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer srv.Close()
+
+	off := false
+	on := &WebappManifest{DocSlug: "auto-on", DocState: Ready, DocSource: srv.URL + "/auto.tar.gz", Version: "1.0.0"}
+	opted := &WebappManifest{DocSlug: "auto-off", DocState: Ready, DocSource: srv.URL + "/auto.tar.gz", Version: "1.0.0", DocAutoUpdate: &off}
+	for _, man := range []*WebappManifest{on, opted} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+		defer func(slug string) {
+			if doc, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, doc)
+			}
+		}(man.DocSlug)
+	}
+
+	target := &autoUpdateTarget{Database: db, fs: afero.NewMemMapFs()}
+	u := &AutoUpdater{
+		forEach:     func(fn func(AutoUpdateTarget) error) error { return fn(target) },
+		interval:    time.Hour,
+		concurrency: 2,
+		clock:       utils.RealClock,
+		failures:    make(map[string]*autoUpdateFailure),
+	}
+
+	// The kill switch
+	PauseAutoUpdates(true)
+	u.Run(context.Background())
+	PauseAutoUpdates(false)
+	doc, err := GetWebappBySlug(db, "auto-on")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.0.0", doc.Version)
+	}
+
+	u.Run(context.Background())
+	doc, err = GetWebappBySlug(db, "auto-on")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2.0.0", doc.Version)
+		assert.Equal(t, State(Ready), doc.State())
+		assert.True(t, doc.AutoUpdate())
+	}
+	ok, _ := afero.Exists(target.fs, path.Join(filesDirOf("auto-on", Webapp), "index.html"))
+	assert.True(t, ok)
+	doc, err = GetWebappBySlug(db, "auto-off")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.0.0", doc.Version)
+		assert.False(t, doc.AutoUpdate())
+		// The update is only flagged as available
+		assert.True(t, doc.DocAvailable)
+		assert.Equal(t, "2.0.0", doc.AvailableVersion())
+		assert.NotNil(t, doc.DocCheckedAt)
+	}
+	doc, err = GetWebappBySlug(db, "auto-on")
+	if assert.NoError(t, err) {
+		assert.False(t, doc.DocAvailable)
+		assert.Equal(t, "", doc.AvailableVersion())
+		assert.NotNil(t, doc.DocCheckedAt)
+	}
+
+	report, err := CheckUpdates(db, target.fs, Webapp)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2.0.0", report.Available["auto-off"])
+		assert.NotContains(t, report.Available, "auto-on")
+	}
+}
+
+func TestTarballSourceVersion(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "tarball", "version": "1.1.0"}`})
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(archive)
+	}))
+	defer srv.Close()
+	afs := afero.NewMemMapFs()
+
+	// The archive is downloaded once, and then checked with its ETag
+	man := &WebappManifest{DocSlug: "tarball", DocSource: srv.URL + "/app.tar.gz", Version: "1.0.0"}
+	for i := 0; i < 2; i++ {
+		version, err := sourceVersion(db, afs, Webapp, man)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.1.0", version)
+	}
+	assert.EqualValues(t, 1, downloads)
+
+	// A checksummed archive can't change, and is not downloaded
+	sum := sha256.Sum256(archive)
+	man.DocSource = srv.URL + "/pinned.tar.gz#sha256=" + hex.EncodeToString(sum[:])
+	version, err := sourceVersion(db, afs, Webapp, man)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", version)
+	assert.EqualValues(t, 1, downloads)
+}
@@ -0,0 +1,168 @@
+package apps
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// The outcomes of the deletion of an application in a bulk delete
+const (
+	BulkDeleted  = "deleted"
+	BulkNotFound = "not_found"
+	BulkFailed   = "failed"
+)
+
+// BulkDeleteOptions are the applications to delete in a bulk delete: the
+// listed slugs, or all the installed applications with All. The protected
+// applications (see IsProtected) are only deleted if they are in Protected:
+// they are skipped by All, and they fail if they are listed in Slugs.
+type BulkDeleteOptions struct {
+	Slugs     []string
+	All       bool
+	Protected []string
+	// Force deletes the applications even if some of them have an operation
+	// in progress (these ones fail), and the konnectors used by some webapps.
+	Force bool
+}
+
+// BulkDeleteResult is the outcome of the deletion of an application in a bulk
+// delete
+type BulkDeleteResult struct {
+	Slug    string `json:"slug"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkInProgressError is used when a bulk delete is refused because some of
+// the applications have an operation in progress.
+type BulkInProgressError struct {
+	Slugs []string
+}
+
+func (e *BulkInProgressError) Error() string {
+	return fmt.Sprintf("The applications %s have an operation in progress",
+		strings.Join(e.Slugs, ", "))
+}
+
+// BulkInvalidSlugsError is used when a bulk delete is refused because some
+// of the slugs are not valid (see ValidInstalledSlug).
+type BulkInvalidSlugsError struct {
+	Slugs []string
+}
+
+func (e *BulkInvalidSlugsError) Error() string {
+	return fmt.Sprintf("The slugs %s are not valid", strings.Join(e.Slugs, ", "))
+}
+
+// BulkDelete deletes the applications one after the other, like DELETE on
+// each of them, and returns the outcome for each slug. Nothing is deleted if
+// one of the slugs is invalid, or if one of the applications has an
+// operation in progress, unless it is forced.
+func BulkDelete(db couchdb.Database, fs afero.Fs, appType AppType, opts *BulkDeleteOptions) ([]*BulkDeleteResult, error) {
+	slugs, err := bulkSlugs(db, appType, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var invalid []string
+	for _, slug := range slugs {
+		if !ValidInstalledSlug(slug) {
+			invalid = append(invalid, slug)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, &BulkInvalidSlugsError{Slugs: invalid}
+	}
+
+	if !opts.Force {
+		var busy []string
+		for _, slug := range slugs {
+			man, err := GetBySlug(db, slug, appType)
+			if err != nil {
+				continue
+			}
+			if man.Operation().Fresh() {
+				busy = append(busy, slug)
+			}
+		}
+		if len(busy) > 0 {
+			return nil, &BulkInProgressError{Slugs: busy}
+		}
+	}
+
+	results := make([]*BulkDeleteResult, 0, len(slugs))
+	for _, slug := range slugs {
+		result := &BulkDeleteResult{Slug: slug, Outcome: BulkDeleted}
+		iamSure := ""
+		if containsString(opts.Protected, slug) {
+			iamSure = slug
+		}
+		err := bulkDeleteOne(db, fs, appType, slug, iamSure, opts.Force)
+		if err == ErrNotFound {
+			result.Outcome = BulkNotFound
+		} else if err != nil {
+			result.Outcome = BulkFailed
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func bulkDeleteOne(db couchdb.Database, fs afero.Fs, appType AppType, slug, iamSure string, force bool) error {
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      appType,
+		Slug:      slug,
+		Force:     force,
+		IamSure:   iamSure,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = inst.Delete()
+	return err
+}
+
+// bulkSlugs returns the slugs of the applications to delete, without
+// duplicates. With All, the documents of the applications are listed by
+// pages, so that all of them are deleted.
+func bulkSlugs(db couchdb.Database, appType AppType, opts *BulkDeleteOptions) ([]string, error) {
+	var slugs []string
+	seen := make(map[string]bool)
+	add := func(slug string) {
+		slug = strings.ToLower(strings.TrimSpace(slug))
+		if slug != "" && !seen[slug] {
+			seen[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+	if !opts.All {
+		for _, slug := range opts.Slugs {
+			add(slug)
+		}
+		return slugs, nil
+	}
+
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]string, 0, len(mans))
+	for _, man := range mans {
+		slug := man.Slug()
+		if IsProtected(man) && !containsString(opts.Protected, slug) {
+			continue
+		}
+		all = append(all, slug)
+	}
+	sort.Strings(all)
+	for _, slug := range all {
+		add(slug)
+	}
+	return slugs, nil
+}
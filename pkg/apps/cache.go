@@ -0,0 +1,471 @@
+package apps
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/utils/archive"
+	"github.com/spf13/afero"
+)
+
+// SourceCacheMaxSize is the default maximal size in bytes of the files kept
+// in the source cache
+const SourceCacheMaxSize = 1 << 30
+
+// cacheMu protects the cache directory from the concurrent installations of
+// the instances served by this process
+var cacheMu sync.Mutex
+
+// cacheLockName is the name of the lock file in the cache directory, taken by
+// the writes to coordinate the processes sharing the directory (several
+// stacks, or a stack and an admin command).
+const cacheLockName = ".lock"
+
+// cacheLockTimeout is how long a write waits for the lock held by another
+// process
+const cacheLockTimeout = 30 * time.Second
+
+// SourceCache is a directory shared by all the instances, where the files of
+// the applications are kept after they have been fetched. The next
+// installations of the same version of an application can copy them from the
+// cache instead of downloading them again.
+//
+// Each entry is a tar archive of the application tree at a commit of a git
+// source (or the downloaded archive for the signed tarball sources), with a
+// JSON file for its metadata, including the SHA-256 of the data to check its
+// integrity.
+// When the cache is larger than its maximal size, the least recently used
+// entries are evicted.
+type SourceCache struct {
+	fs       afero.Fs
+	maxSize  int64
+	clock    utils.Clock
+	lockPath string // empty if the cache is not on the OS filesystem
+}
+
+// CacheEntry is the metadata of an entry of the source cache
+type CacheEntry struct {
+	Key       string    `json:"key"`
+	Source    string    `json:"source"`
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	Checksum  string    `json:"checksum"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// NewSourceCache returns a source cache that uses the given filesystem. The
+// clock is used for the dates of the entries, and can be nil for the real
+// clock.
+func NewSourceCache(fs afero.Fs, maxSize int64, clock utils.Clock) *SourceCache {
+	if maxSize <= 0 {
+		maxSize = SourceCacheMaxSize
+	}
+	return &SourceCache{fs: fs, maxSize: maxSize, clock: utils.OrRealClock(clock)}
+}
+
+// sharedSourceCache returns the source cache configured for the stack, or nil
+// if there is none or if it is bypassed.
+func sharedSourceCache() *SourceCache {
+	cfg := config.GetConfig().Apps
+	if cfg.CacheDir == "" || cfg.CacheBypass {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+		log.Warnf("[apps] Can't use the source cache %s: %s", cfg.CacheDir, err)
+		return nil
+	}
+	fs := afero.NewBasePathFs(afero.NewOsFs(), cfg.CacheDir)
+	cache := NewSourceCache(fs, cfg.CacheMaxSize, nil)
+	cache.lockPath = filepath.Join(cfg.CacheDir, cacheLockName)
+	return cache
+}
+
+// lock takes the lock of the cache for a write, and returns the function to
+// release it. The lock file is only taken when the cache is on the OS
+// filesystem, as the other processes can't see it else.
+func (c *SourceCache) lock() (func(), error) {
+	cacheMu.Lock()
+	if c.lockPath == "" {
+		return cacheMu.Unlock, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheLockTimeout)
+	defer cancel()
+	l := utils.NewFileLock(c.lockPath)
+	if err := l.Lock(ctx); err != nil {
+		cacheMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		if err := l.Close(); err != nil {
+			log.Warnf("[apps] Can't release the lock of the source cache: %s", err)
+		}
+		cacheMu.Unlock()
+	}, nil
+}
+
+// cacheKey returns the key of the entry for the given commit of a source, or
+// for the archive of a tarball source if the commit is empty. The key doesn't
+// depend on the version of the manifest, as it can stay the same between the
+// commits of a branch.
+func cacheKey(src *url.URL, commit string) string {
+	sum := sha256.Sum256([]byte(src.String() + "\n" + commit))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *SourceCache) dataName(key string) string  { return "/" + key + ".data" }
+func (c *SourceCache) entryName(key string) string { return "/" + key + ".json" }
+
+// Restore copies the files of the cached commit of a source in the given
+// directory. It returns false if the commit is not in the cache, or if the
+// entry is corrupted (in which case, it is removed).
+func (c *SourceCache) Restore(src *url.URL, commit string, fs afero.Fs, dir string) (bool, error) {
+	data, ok := c.get(cacheKey(src, commit))
+	if !ok {
+		return false, nil
+	}
+	if err := fs.RemoveAll(dir); err != nil {
+		return false, err
+	}
+	if err := archive.ExtractTar(bytes.NewReader(data), fs, dir, archive.Options{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Store adds the files of the given directory in the cache, as the given
+// commit of the source, with the version of its manifest. It evicts the least
+// recently used entries if the cache is then too large.
+func (c *SourceCache) Store(src *url.URL, version, commit string, fs afero.Fs, dir string) error {
+	data, err := packDir(fs, dir)
+	if err != nil {
+		return err
+	}
+	return c.put(cacheKey(src, commit), src, version, commit, bytes.NewReader(data))
+}
+
+// Newest returns the highest cached version of a source, or nil if no
+// version of this source is in the cache. The entries whose version is not a
+// valid semantic version are used only if there is no valid one, and the most
+// recently cached one wins in this case, or if the versions are equal.
+func (c *SourceCache) Newest(src *url.URL) *CacheEntry {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil
+	}
+	var newest *CacheEntry
+	var newestVersion utils.Version
+	newestValid := false
+	for _, entry := range entries {
+		// The entries without version are the archives of the tarballs
+		if entry.Source != src.String() || entry.Version == "" {
+			continue
+		}
+		version, err := utils.ParseVersion(entry.Version)
+		valid := err == nil
+		var cmp int
+		switch {
+		case newest == nil:
+			cmp = 1
+		case valid && newestValid:
+			cmp = version.Compare(newestVersion)
+		case valid != newestValid:
+			if valid {
+				cmp = 1
+			} else {
+				cmp = -1
+			}
+		}
+		if cmp > 0 || (cmp == 0 && entry.CreatedAt.After(newest.CreatedAt)) {
+			newest, newestVersion, newestValid = entry, version, valid
+		}
+	}
+	return newest
+}
+
+// ReadFile returns the content of a file at the root of a cached entry, like
+// the one returned by Newest.
+func (c *SourceCache) ReadFile(entry *CacheEntry, name string) ([]byte, error) {
+	data, ok := c.get(entry.Key)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// loadArchive writes the archive downloaded from a tarball source to w. It is
+// only used for the signed sources: their content can't change for the same
+// URL, as the signature is in it.
+func (c *SourceCache) loadArchive(src *url.URL, w io.Writer) bool {
+	return c.copyEntry(cacheKey(src, ""), w)
+}
+
+// storeArchive keeps the archive downloaded from a tarball source
+func (c *SourceCache) storeArchive(src *url.URL, r io.Reader) error {
+	return c.put(cacheKey(src, ""), src, "", "", r)
+}
+
+// get returns the content of an entry, after checking its integrity
+func (c *SourceCache) get(key string) ([]byte, bool) {
+	var buf bytes.Buffer
+	if !c.copyEntry(key, &buf) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// copyEntry writes the content of an entry to w, and checks its integrity
+// at the same time. It returns false if the entry is not in the cache or if
+// it is corrupted, and some bytes may have been written to w in this case.
+func (c *SourceCache) copyEntry(key string, w io.Writer) bool {
+	unlock, err := c.lock()
+	if err != nil {
+		log.Warnf("[apps] Can't lock the source cache: %s", err)
+		return false
+	}
+	defer unlock()
+
+	entry, err := c.readEntry(key)
+	if err != nil {
+		return false
+	}
+	f, err := c.fs.Open(c.dataName(key))
+	if err == nil {
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(w, h), f)
+		f.Close()
+		if err == nil && hex.EncodeToString(h.Sum(nil)) != entry.Checksum {
+			err = errCorruptedEntry
+		}
+	}
+	if err != nil {
+		log.Warnf("[apps] Removing corrupted cache entry for %s@%s", entry.Source, entry.Version)
+		c.remove(key)
+		return false
+	}
+	entry.LastUsed = c.clock.Now()
+	if err = c.writeEntry(entry); err != nil {
+		log.Warnf("[apps] Can't update the cache entry for %s@%s: %s", entry.Source, entry.Version, err)
+	}
+	return true
+}
+
+// errCorruptedEntry is used when the content of an entry doesn't match its
+// checksum
+var errCorruptedEntry = errors.New("The cache entry is corrupted")
+
+// put adds an entry to the cache, with the content read from r, and evicts
+// the least recently used entries if the cache is then too large.
+func (c *SourceCache) put(key string, src *url.URL, version, commit string, r io.Reader) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The files are written with a temporary name first, so that a partial
+	// file is never seen by another process using the same directory.
+	tmp := c.dataName(key) + ".tmp"
+	f, err := c.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		c.fs.Remove(tmp)
+		return err
+	}
+	if err := c.fs.Rename(tmp, c.dataName(key)); err != nil {
+		return err
+	}
+	now := c.clock.Now()
+	entry := &CacheEntry{
+		Key:       key,
+		Source:    src.String(),
+		Version:   version,
+		Commit:    commit,
+		Checksum:  hex.EncodeToString(h.Sum(nil)),
+		Size:      size,
+		CreatedAt: now,
+		LastUsed:  now,
+	}
+	if err := c.writeEntry(entry); err != nil {
+		return err
+	}
+	_, _, err = c.evict(key)
+	return err
+}
+
+// Entries returns the entries of the cache, from the most recently used
+func (c *SourceCache) Entries() ([]*CacheEntry, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	return c.entries()
+}
+
+func (c *SourceCache) entries() ([]*CacheEntry, error) {
+	infos, err := afero.ReadDir(c.fs, "/")
+	if err != nil {
+		return nil, err
+	}
+	var entries []*CacheEntry
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		entry, err := c.readEntry(strings.TrimSuffix(info.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(byLastUsed(entries))
+	return entries, nil
+}
+
+// Trim evicts the least recently used entries until the cache is not larger
+// than its maximal size, like after the maximal size has been lowered, and
+// removes the files of the writes interrupted by a crash. It returns the
+// number of entries evicted and the bytes reclaimed.
+func (c *SourceCache) Trim() (int, int64, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	infos, err := afero.ReadDir(c.fs, "/")
+	if err != nil {
+		return 0, 0, err
+	}
+	var reclaimed int64
+	for _, info := range infos {
+		name := info.Name()
+		// The writes are done with the lock, so a temporary file is a left
+		// over, and so is a data file without its entry
+		stale := strings.HasSuffix(name, ".tmp")
+		if key := strings.TrimSuffix(name, ".data"); key != name {
+			_, err := c.fs.Stat(c.entryName(key))
+			stale = os.IsNotExist(err)
+		}
+		if stale && c.fs.Remove("/"+name) == nil {
+			reclaimed += info.Size()
+		}
+	}
+	evicted, size, err := c.evict("")
+	return evicted, reclaimed + size, err
+}
+
+// evict removes the least recently used entries, except the given one, until
+// the cache is not larger than its maximal size. It returns the number of
+// entries removed and their size.
+func (c *SourceCache) evict(keep string) (int, int64, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	if total > c.maxSize {
+		log.Debugf("[apps] The source cache is %s, more than %s: evicting entries",
+			utils.FormatSize(total), utils.FormatSize(c.maxSize))
+	}
+	var evicted int
+	var size int64
+	for i := len(entries) - 1; i >= 0 && total > c.maxSize; i-- {
+		if entries[i].Key == keep {
+			continue
+		}
+		c.remove(entries[i].Key)
+		total -= entries[i].Size
+		evicted++
+		size += entries[i].Size
+	}
+	return evicted, size, nil
+}
+
+func (c *SourceCache) readEntry(key string) (*CacheEntry, error) {
+	b, err := afero.ReadFile(c.fs, c.entryName(key))
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	if err = json.Unmarshal(b, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (c *SourceCache) writeEntry(entry *CacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := c.entryName(entry.Key) + ".tmp"
+	if err = afero.WriteFile(c.fs, tmp, b, 0644); err != nil {
+		return err
+	}
+	return c.fs.Rename(tmp, c.entryName(entry.Key))
+}
+
+func (c *SourceCache) remove(key string) {
+	c.fs.Remove(c.entryName(key))
+	c.fs.Remove(c.dataName(key))
+}
+
+// packDir makes a tar archive with the files of the given directory
+func packDir(fs afero.Fs, dir string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := archive.CreateTar(fs, dir, buf, archive.Options{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type byLastUsed []*CacheEntry
+
+func (a byLastUsed) Len() int           { return len(a) }
+func (a byLastUsed) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastUsed) Less(i, j int) bool { return a[i].LastUsed.After(a[j].LastUsed) }
@@ -0,0 +1,397 @@
+package apps
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceCache(t *testing.T) {
+	cache := NewSourceCache(afero.NewMemMapFs(), 0, nil)
+	appFs := afero.NewMemMapFs()
+	afero.WriteFile(appFs, "/app/index.html", []byte("<html></html>"), 0644)
+	afero.WriteFile(appFs, "/app/js/app.js", []byte("alert(1)"), 0644)
+
+	src, _ := url.Parse("git://example.org/app.git")
+	ok, err := cache.Restore(src, "c1", appFs, "/restored")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, cache.Store(src, "1.0.0", "c1", appFs, "/app"))
+	ok, err = cache.Restore(src, "c1", appFs, "/restored")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	content, err := afero.ReadFile(appFs, "/restored/js/app.js")
+	assert.NoError(t, err)
+	assert.Equal(t, "alert(1)", string(content))
+
+	// A new commit of the branch is not in the cache, even if the version
+	// of its manifest has not changed
+	ok, _ = cache.Restore(src, "c2", appFs, "/other")
+	assert.False(t, ok)
+
+	// A corrupted entry is removed
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "1.0.0", entries[0].Version)
+		assert.Equal(t, "c1", entries[0].Commit)
+		content, err = cache.ReadFile(entries[0], "js/app.js")
+		assert.NoError(t, err)
+		assert.Equal(t, "alert(1)", string(content))
+		afero.WriteFile(cache.fs, cache.dataName(entries[0].Key), []byte("corrupted"), 0644)
+	}
+	ok, err = cache.Restore(src, "c1", appFs, "/restored")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	entries, _ = cache.Entries()
+	assert.Len(t, entries, 0)
+}
+
+func TestSourceCacheNewest(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	cache := NewSourceCache(afero.NewMemMapFs(), 0, clock)
+	appFs := afero.NewMemMapFs()
+	afero.WriteFile(appFs, "/app/index.html", []byte("<html></html>"), 0644)
+	store := func(src *url.URL, versions ...string) {
+		for _, version := range versions {
+			assert.NoError(t, cache.Store(src, version, "commit-"+version, appFs, "/app"))
+			clock.Advance(time.Minute)
+		}
+	}
+
+	// Some versions really seen in the manifests of the applications
+	src, _ := url.Parse("git://example.org/app.git")
+	assert.Nil(t, cache.Newest(src))
+	store(src, "1.9.3", "v1.10", "0.10.0-beta.2", "latest", "1.2")
+	assert.Equal(t, "v1.10", cache.Newest(src).Version)
+	store(src, "1.10.0")
+	assert.Equal(t, "1.10.0", cache.Newest(src).Version)
+	store(src, "2.0.0-beta.1")
+	assert.Equal(t, "2.0.0-beta.1", cache.Newest(src).Version)
+
+	other, _ := url.Parse("git://example.org/other.git")
+	store(other, "master", "dev")
+	assert.Equal(t, "dev", cache.Newest(other).Version)
+}
+
+func TestSourceCacheEviction(t *testing.T) {
+	appFs := afero.NewMemMapFs()
+	afero.WriteFile(appFs, "/app/index.html", []byte(strings.Repeat("x", 1000)), 0644)
+	archive, err := packDir(appFs, "/app")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// There is enough space for two entries
+	clock := utils.NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	cache := NewSourceCache(afero.NewMemMapFs(), int64(2*len(archive)), clock)
+	src, _ := url.Parse("git://example.org/app.git")
+	assert.NoError(t, cache.Store(src, "1.0.0", "c1", appFs, "/app"))
+	clock.Advance(time.Minute)
+	assert.NoError(t, cache.Store(src, "2.0.0", "c2", appFs, "/app"))
+	clock.Advance(time.Minute)
+	ok, _ := cache.Restore(src, "c1", appFs, "/restored")
+	assert.True(t, ok)
+	clock.Advance(time.Minute)
+	assert.NoError(t, cache.Store(src, "3.0.0", "c3", appFs, "/app"))
+
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	versions := make([]string, len(entries))
+	for i, entry := range entries {
+		versions[i] = entry.Version
+	}
+	assert.Equal(t, []string{"3.0.0", "1.0.0"}, versions)
+}
+
+func TestSourceCacheTrim(t *testing.T) {
+	appFs := afero.NewMemMapFs()
+	afero.WriteFile(appFs, "/app/index.html", []byte(strings.Repeat("x", 1000)), 0644)
+	archive, err := packDir(appFs, "/app")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	clock := utils.NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	cacheFs := afero.NewMemMapFs()
+	cache := NewSourceCache(cacheFs, 0, clock)
+	src, _ := url.Parse("git://example.org/app.git")
+	for _, version := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		assert.NoError(t, cache.Store(src, version, "commit-"+version, appFs, "/app"))
+		clock.Advance(time.Minute)
+	}
+	afero.WriteFile(cacheFs, "/interrupted.data.tmp", []byte("12345"), 0644)
+	afero.WriteFile(cacheFs, "/lost.data", []byte("1234567890"), 0644)
+
+	// The maximal size has been lowered to one entry
+	cache.maxSize = int64(len(archive))
+	evicted, reclaimed, err := cache.Trim()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, evicted)
+	assert.Equal(t, int64(2*len(archive)+15), reclaimed)
+
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "3.0.0", entries[0].Version)
+	}
+	exists, _ := afero.Exists(cacheFs, "/lost.data")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(cacheFs, "/interrupted.data.tmp")
+	assert.False(t, exists)
+}
+
+func TestSourceCacheFileLock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "cozy-source-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+	config.GetConfig().Apps.CacheDir = tmpdir
+	defer func() { config.GetConfig().Apps.CacheDir = "" }()
+	cache := sharedSourceCache()
+	if !assert.NotNil(t, cache) {
+		return
+	}
+	appFs := afero.NewMemMapFs()
+	afero.WriteFile(appFs, "/app/index.html", []byte("<html></html>"), 0644)
+	src, _ := url.Parse("git://example.org/app.git")
+
+	// Another process holds the lock
+	other := utils.NewFileLock(filepath.Join(tmpdir, cacheLockName))
+	ok, err := other.TryLock()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	done := make(chan error)
+	go func() { done <- cache.Store(src, "1.0.0", "c1", appFs, "/app") }()
+	select {
+	case <-done:
+		t.Fatal("the entry has been stored while the lock was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.NoError(t, other.Close())
+	assert.NoError(t, <-done)
+
+	ok, err = cache.Restore(src, "c1", appFs, "/restored")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestInstallFromSourceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-apps-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.GetConfig()
+	defer trustKey(trustedSeed)()
+	cfg.Apps.CacheDir = dir
+	defer func() { cfg.Apps.CacheDir = "" }()
+
+	// The signed tarballs are downloaded only once
+	archive := makeTarball(t, map[string]string{
+		manifestName: manifestGenerator(),
+		"index.html": "<html></html>",
+	})
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write(archive)
+	}))
+	defer srv.Close()
+	source := srv.URL + "/app.tar.gz#sig=" + signTarball(trustedSeed, archive)
+
+	install := func(slug, source string) {
+		inst, err := NewInstaller(db, fs, &InstallerOptions{
+			Operation: Install,
+			Type:      installerType,
+			Slug:      slug,
+			SourceURL: source,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		go inst.Install()
+		for {
+			_, done, err := inst.Poll()
+			if !assert.NoError(t, err) || done {
+				return
+			}
+		}
+	}
+
+	install("cached-tarball-1", source)
+	install("cached-tarball-2", source)
+	assert.EqualValues(t, 1, downloads)
+	ok, _ := afero.Exists(fs, "/cached-tarball-2/index.html")
+	assert.True(t, ok)
+
+	// The git sources are cached with their commit, and the version of
+	// their manifest
+	install("cached-git-1", "git://localhost/")
+	entries, err := sharedSourceCache().Entries()
+	assert.NoError(t, err)
+	found := false
+	for _, entry := range entries {
+		if entry.Source == "git://localhost/" && entry.Version == localVersion {
+			found = true
+			doc, err := GetBySlug(db, "cached-git-1", installerType)
+			if assert.NoError(t, err) {
+				assert.Equal(t, doc.SourceCommit(), entry.Commit)
+			}
+		}
+	}
+	assert.True(t, found)
+	install("cached-git-2", "git://localhost/")
+	ok, _ = afero.Exists(fs, "/cached-git-2/"+manifestName)
+	assert.True(t, ok)
+
+	// The cache can be bypassed
+	cfg.Apps.CacheBypass = true
+	defer func() { cfg.Apps.CacheBypass = false }()
+	install("cached-tarball-3", source)
+	assert.EqualValues(t, 2, downloads)
+}
+
+type unreachableTransport struct{}
+
+func (t *unreachableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("network is unreachable")
+}
+
+func TestOfflineInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-apps-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.GetConfig()
+	cfg.Apps.CacheDir = dir
+	defer func() { cfg.Apps.CacheDir = "" }()
+
+	install := func(slug string, offlineOk bool) (Manifest, error) {
+		inst, err := NewInstaller(db, fs, &InstallerOptions{
+			Operation: Install,
+			Type:      installerType,
+			Slug:      slug,
+			SourceURL: "git://localhost/",
+			OfflineOk: offlineOk,
+		})
+		if err != nil {
+			return nil, err
+		}
+		go inst.Install()
+		for {
+			man, done, err := inst.Poll()
+			if err != nil || done {
+				return man, err
+			}
+		}
+	}
+
+	// Nothing is cached yet
+	client := manifestClient
+	manifestClient = &http.Client{Transport: &unreachableTransport{}}
+	_, err = install("offline-1", true)
+	assert.Equal(t, ErrManifestNotReachable, err)
+	manifestClient = client
+
+	man, err := install("offline-2", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, man.FromCache())
+
+	manifestClient = &http.Client{Transport: &unreachableTransport{}}
+	defer func() { manifestClient = client }()
+	_, err = install("offline-3", false)
+	assert.Equal(t, ErrManifestNotReachable, err)
+
+	man, err = install("offline-4", true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.NotNil(t, man.FromCache()) {
+		assert.Equal(t, localVersion, man.FromCache().Version)
+	}
+	doc, err := GetBySlug(db, "offline-4", installerType)
+	if assert.NoError(t, err) && assert.NotNil(t, doc.FromCache()) {
+		assert.Equal(t, localVersion, doc.FromCache().Version)
+	}
+	ok, _ := afero.Exists(fs, "/offline-4/"+manifestName)
+	assert.True(t, ok)
+}
+
+// refusingFetcher is a fetcher that fails with the given error
+type refusingFetcher struct{ err error }
+
+func (f *refusingFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) { return nil, f.err }
+func (f *refusingFetcher) Fetch(src *url.URL, appDir string) error           { return f.err }
+
+func TestOfflineInstallRefusedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-apps-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.GetConfig()
+	cfg.Apps.CacheDir = dir
+	required := cfg.Apps.RequireSignatures
+	defer func() { cfg.Apps.CacheDir, cfg.Apps.RequireSignatures = "", required }()
+
+	newInstaller := func(slug string) *Installer {
+		inst, err := NewInstaller(db, fs, &InstallerOptions{
+			Operation: Install,
+			Type:      installerType,
+			Slug:      slug,
+			SourceURL: "git://localhost/",
+			OfflineOk: true,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return inst
+	}
+
+	// The version is cached by a first install
+	inst := newInstaller("offline-refused-1")
+	go inst.Install()
+	_, err = waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A git source has no signature, and the cached version can't be used
+	// when they are required
+	cfg.Apps.RequireSignatures = true
+	inst = newInstaller("offline-refused-2")
+	go inst.Install()
+	_, err = waitInstaller(inst)
+	assert.Equal(t, ErrMissingSignature, err)
+	cfg.Apps.RequireSignatures = required
+
+	// The same for a tampered signature, while an unreachable source can
+	// use the cache
+	inst = newInstaller("offline-refused-3")
+	inst.fetcher = &refusingFetcher{ErrInvalidSignature}
+	assert.Equal(t, ErrInvalidSignature, inst.ReadManifest(Installing, inst.man))
+	assert.Nil(t, inst.man.FromCache())
+	inst.fetcher = &refusingFetcher{ErrManifestNotReachable}
+	assert.NoError(t, inst.ReadManifest(Installing, inst.man))
+	assert.NotNil(t, inst.man.FromCache())
+}
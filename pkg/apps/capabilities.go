@@ -0,0 +1,51 @@
+package apps
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// sourceSchemes are the schemes of the sources that have a fetcher (see
+// newFetcher)
+var sourceSchemes = []string{"git", "http", "https", "github", "gitlab"}
+
+// signedSchemes are the schemes of the sources that can carry a signature,
+// the only ones accepted when the signatures are required
+var signedSchemes = []string{"http", "https", "github", "gitlab"}
+
+// Capabilities describes the sources that this stack accepts for the
+// installs and the updates of the applications, from its configuration, and
+// if the konnectors can be installed on the instance.
+type Capabilities struct {
+	SourceSchemes     []string `json:"source_schemes"`
+	FileSources       bool     `json:"file_sources"`
+	DevMode           bool     `json:"dev_mode"`
+	ManifestMaxSize   int64    `json:"manifest_max_size"`
+	TarballMaxSize    int64    `json:"tarball_max_size"`
+	RequireSignatures bool     `json:"require_signatures"`
+	TrustedKeys       int      `json:"trusted_keys"`
+	KonnectorsEnabled bool     `json:"konnectors_enabled"`
+}
+
+// GetCapabilities returns the capabilities of the installer, as configured
+// for this stack and the instance of the database. When the signatures are
+// required, the schemes of the sources that can't be signed are not listed.
+func GetCapabilities(db couchdb.Database) *Capabilities {
+	cfg := config.GetConfig().Apps
+	schemes := make([]string, 0, len(sourceSchemes))
+	for _, scheme := range sourceSchemes {
+		if !cfg.RequireSignatures || containsString(signedSchemes, scheme) {
+			schemes = append(schemes, scheme)
+		}
+	}
+	return &Capabilities{
+		SourceSchemes:     schemes,
+		FileSources:       containsString(schemes, "file"),
+		DevMode:           config.IsDevRelease(),
+		ManifestMaxSize:   ManifestSizeLimit(),
+		TarballMaxSize:    TarballMaxSize,
+		RequireSignatures: cfg.RequireSignatures,
+		TrustedKeys:       len(cfg.TrustedKeys),
+		KonnectorsEnabled: KonnectorsEnabled(db),
+	}
+}
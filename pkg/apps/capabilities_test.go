@@ -0,0 +1,45 @@
+package apps
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCapabilities(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Apps
+	defer func() { cfg.Apps = was }()
+	cfg.Apps.RequireSignatures = true
+	cfg.Apps.TrustedKeys = []string{"key1", "key2"}
+	cfg.Apps.ManifestMaxSize = 4096
+
+	// The git sources can't be signed
+	caps := GetCapabilities(db)
+	assert.Equal(t, []string{"http", "https", "github", "gitlab"}, caps.SourceSchemes)
+	assert.False(t, caps.FileSources)
+	assert.True(t, caps.RequireSignatures)
+	assert.Equal(t, 2, caps.TrustedKeys)
+	assert.EqualValues(t, 4096, caps.ManifestMaxSize)
+	assert.EqualValues(t, TarballMaxSize, caps.TarballMaxSize)
+	assert.True(t, caps.KonnectorsEnabled)
+	defer func(enabled bool) { cfg.Konnectors.Enabled = enabled }(cfg.Konnectors.Enabled)
+	cfg.Konnectors.Enabled = false
+	assert.False(t, GetCapabilities(db).KonnectorsEnabled)
+
+	// All the schemes of the capabilities have a fetcher
+	cfg.Apps.RequireSignatures = false
+	caps = GetCapabilities(db)
+	assert.Equal(t, []string{"git", "http", "https", "github", "gitlab"}, caps.SourceSchemes)
+	fs := afero.NewMemMapFs()
+	for _, scheme := range caps.SourceSchemes {
+		src := &url.URL{Scheme: scheme, Host: "example.org", Path: "/app"}
+		_, err := newFetcher(src, fs, nil, WebappManifestName, newProgressReporter())
+		assert.NoError(t, err, scheme)
+	}
+	_, err := newFetcher(&url.URL{Scheme: "file", Path: "/app"}, fs, nil, WebappManifestName, newProgressReporter())
+	assert.Equal(t, ErrNotSupportedSource, err)
+}
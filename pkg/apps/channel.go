@@ -0,0 +1,39 @@
+package apps
+
+import "github.com/cozy/cozy-stack/pkg/couchdb"
+
+// The channels of the releases of the applications: stable is the latest
+// release, beta is the latest release or pre-release, and dev is the default
+// branch of the repository.
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+	ChannelDev    = "dev"
+)
+
+// ChannelDefaulter is implemented by the instances, with the channel used for
+// the release sources that don't give a version or a channel (the
+// apps_channel setting).
+type ChannelDefaulter interface {
+	DefaultAppsChannel() string
+}
+
+// ValidChannel returns true if the channel is one of the known channels
+func ValidChannel(channel string) bool {
+	switch channel {
+	case ChannelStable, ChannelBeta, ChannelDev:
+		return true
+	}
+	return false
+}
+
+// defaultChannel returns the channel of the instance of the database, or the
+// stable one.
+func defaultChannel(db couchdb.Database) string {
+	if d, ok := db.(ChannelDefaulter); ok {
+		if channel := d.DefaultAppsChannel(); ValidChannel(channel) {
+			return channel
+		}
+	}
+	return ChannelStable
+}
@@ -0,0 +1,58 @@
+package apps
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ManifestSaveRetries is the number of times the document of an application
+// is saved again after a conflict, before the operation fails
+const ManifestSaveRetries = 3
+
+// updateDoc saves a document in CouchDB. It is replaced by the tests to
+// simulate the conflicts.
+var updateDoc = couchdb.UpdateDoc
+
+// saveManifestDoc saves the document of an application during the operation
+// with the given id. On a conflict, the current revision of the document is
+// fetched: if the application has not been deleted, and no other operation
+// has started on it meanwhile, the document is saved again with this
+// revision. The state, the version and the source are the ones of the
+// operation, but the changes made meanwhile by the user (like with PATCH
+// /apps/:slug) are kept.
+func saveManifestDoc(db couchdb.Database, man Manifest, opID string) error {
+	for attempt := 0; ; attempt++ {
+		err := updateDoc(db, man)
+		if !couchdb.IsConflictError(err) || attempt == ManifestSaveRetries {
+			return err
+		}
+		current, err := GetBySlug(db, man.Slug(), typeOf(man))
+		if couchdb.IsNotFoundError(err) {
+			return ErrManifestConflict
+		}
+		if err != nil {
+			return err
+		}
+		if op := current.Operation(); op.Fresh() && op.ID != opID {
+			return ErrManifestConflict
+		}
+		log.Infof("[apps] Conflict on the document of %s, saving it again with the revision %s",
+			man.Slug(), current.Rev())
+		man.SetRev(current.Rev())
+		keepUserChanges(man, current)
+	}
+}
+
+// keepUserChanges copies on the document of an operation the attributes of
+// the current document that are changed by the user, not by the operations.
+func keepUserChanges(man, current Manifest) {
+	if current.AutoUpdate() != man.AutoUpdate() {
+		man.SetAutoUpdate(current.AutoUpdate())
+	}
+	man.SetProtected(current.Protected())
+	if m, ok := man.(*WebappManifest); ok {
+		if c, ok := current.(*WebappManifest); ok {
+			m.Maintenance = c.Maintenance
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package apps
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/stretchr/testify/assert"
+)
+
+// conflictingUpdates makes the next n saves of a document fail with a
+// conflict, and counts the attempts. The returned function restores the
+// real storage.
+func conflictingUpdates(n int, attempts *int) func() {
+	updateDoc = func(db couchdb.Database, doc couchdb.Doc) error {
+		*attempts++
+		if *attempts <= n {
+			return &couchdb.Error{StatusCode: http.StatusConflict, Name: "conflict"}
+		}
+		return couchdb.UpdateDoc(db, doc)
+	}
+	return func() { updateDoc = couchdb.UpdateDoc }
+}
+
+func TestSaveManifestConflict(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the conflicts are the same for the konnectors")
+	}
+	stored := &WebappManifest{
+		DocSlug:      "mini-conflict",
+		DocState:     Upgrading,
+		DocOperation: newOperation("updating", "op-1"),
+		Version:      "1.0.0",
+		DocSchema:    SchemaVersion,
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, stored)) {
+		return
+	}
+	defer func() {
+		if man, err := GetWebappBySlug(db, "mini-conflict"); err == nil {
+			couchdb.DeleteDoc(db, man)
+		}
+	}()
+
+	// The document is changed by the user while the update is running
+	man := *stored
+	stored.Maintenance = "Back soon"
+	stored.SetProtected(true)
+	if !assert.NoError(t, couchdb.UpdateDoc(db, stored)) {
+		return
+	}
+	man.Version, man.DocState, man.DocOperation = "2.0.0", Ready, nil
+	attempts := 0
+	defer conflictingUpdates(1, &attempts)()
+	if !assert.NoError(t, saveManifestDoc(db, &man, "op-1")) {
+		return
+	}
+	// A conflict from the stub, a real one, and the save that works
+	assert.Equal(t, 3, attempts)
+	doc, err := GetWebappBySlug(db, "mini-conflict")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2.0.0", doc.Version)
+		assert.Equal(t, Ready, doc.State())
+		assert.Equal(t, "Back soon", doc.Maintenance)
+		assert.True(t, doc.Protected())
+	}
+
+	// The retries are bounded
+	attempts = 0
+	conflictingUpdates(100, &attempts)
+	err = saveManifestDoc(db, doc, "op-1")
+	assert.True(t, couchdb.IsConflictError(err))
+	assert.Equal(t, ManifestSaveRetries+1, attempts)
+
+	// Another operation has started on the application
+	other, _ := GetWebappBySlug(db, "mini-conflict")
+	other.DocOperation = newOperation("updating", "op-2")
+	assert.NoError(t, couchdb.UpdateDoc(db, other))
+	attempts = 0
+	conflictingUpdates(1, &attempts)
+	assert.Equal(t, ErrManifestConflict, saveManifestDoc(db, doc, "op-1"))
+
+	// The application has been deleted
+	assert.NoError(t, couchdb.DeleteDoc(db, other))
+	attempts = 0
+	conflictingUpdates(1, &attempts)
+	assert.Equal(t, ErrManifestConflict, saveManifestDoc(db, doc, "op-1"))
+	assert.Equal(t, "manifest_conflict", ErrorCode(ErrManifestConflict))
+}
+
+func TestAbortOperation(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the conflicts are the same for the konnectors")
+	}
+	stored := &WebappManifest{
+		DocSlug:   "mini-abort",
+		DocState:  Ready,
+		Version:   "1.0.0",
+		DocSchema: SchemaVersion,
+	}
+	assert.NoError(t, Transition(stored, Upgrading))
+	stored.SetOperation(newOperation("updating", "op-1"))
+	if !assert.NoError(t, createManifest(db, stored)) {
+		return
+	}
+	defer func() {
+		if man, err := GetWebappBySlug(db, "mini-abort"); err == nil {
+			deleteManifest(db, man)
+		}
+	}()
+
+	// The document of the new version can't be saved
+	man := *stored
+	man.Version, man.DocState, man.DocOperation = "2.0.0", Ready, nil
+	attempts := 0
+	restore := conflictingUpdates(100, &attempts)
+	err := updateManifest(db, &man, "op-1")
+	restore()
+	if !assert.Error(t, err) {
+		return
+	}
+	_, errp := permissions.GetForApp(db, "mini-abort")
+	assert.NoError(t, errp)
+
+	// The application goes back to its previous state, with the installed
+	// version and its permissions
+	inst := &Installer{db: db, slug: "mini-abort", typ: Webapp, op: Update, opID: "op-1"}
+	inst.abortOperation(err)
+	doc, err := GetWebappBySlug(db, "mini-abort")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.0.0", doc.Version)
+		assert.Equal(t, Ready, doc.State())
+		assert.Nil(t, doc.Operation())
+	}
+	_, errp = permissions.GetForApp(db, "mini-abort")
+	assert.NoError(t, errp)
+
+	// An install is errored
+	doc.DocState = Installing
+	doc.SetOperation(newOperation("installing", "op-2"))
+	assert.NoError(t, couchdb.UpdateDoc(db, doc))
+	inst = &Installer{db: db, slug: "mini-abort", typ: Webapp, op: Install, opID: "op-2"}
+	inst.abortOperation(ErrManifestConflict)
+	doc, err = GetWebappBySlug(db, "mini-abort")
+	if assert.NoError(t, err) {
+		assert.Equal(t, Errored, doc.State())
+		assert.Nil(t, doc.Operation())
+	}
+
+	// The operation of another installer is left as it is
+	doc.SetOperation(newOperation("updating", "op-3"))
+	assert.NoError(t, couchdb.UpdateDoc(db, doc))
+	inst.abortOperation(ErrManifestConflict)
+	doc, err = GetWebappBySlug(db, "mini-abort")
+	if assert.NoError(t, err) && assert.NotNil(t, doc.Operation()) {
+		assert.Equal(t, "op-3", doc.Operation().ID)
+	}
+}
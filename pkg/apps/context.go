@@ -0,0 +1,157 @@
+package apps
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The types of the values of an install context
+const (
+	ContextString  = "string"
+	ContextURL     = "url"
+	ContextNumber  = "number"
+	ContextBoolean = "boolean"
+)
+
+// ContextUnknownKey is the code for a key of the install context that is not
+// in the context schema of the manifest
+const ContextUnknownKey = "unknown_key"
+
+// ContextField is the description of a value of the install context, in the
+// context_schema of a manifest
+type ContextField struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// ContextSchema is the list of the values that can be given in the install
+// context of an application, by key
+type ContextSchema map[string]*ContextField
+
+// ContextError describes a value of the install context that doesn't match
+// the context schema of the manifest.
+type ContextError struct {
+	// Field is the JSON pointer to the value in the install context
+	Field  string
+	Code   string
+	Reason string
+}
+
+func (e *ContextError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ContextErrors is the list of the problems found while validating an
+// install context.
+type ContextErrors []*ContextError
+
+func (e ContextErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "The install context is invalid: " + strings.Join(msgs, ", ")
+}
+
+func (e ContextErrors) add(key, code, reason string) ContextErrors {
+	return append(e, &ContextError{Field: "/" + escapePointer(key), Code: code, Reason: reason})
+}
+
+// contextSchemaOf returns the context schema declared by the manifest
+func contextSchemaOf(man Manifest) ContextSchema {
+	switch m := man.(type) {
+	case *WebappManifest:
+		return m.ContextSchema
+	case *konnManifest:
+		return m.ContextSchema
+	}
+	return nil
+}
+
+// validateSchema checks the types of the context schema of a manifest
+func validateSchema(schema ContextSchema, errs ManifestErrors) ManifestErrors {
+	for _, key := range schema.keys() {
+		field := schema[key]
+		pointer := "/context_schema/" + escapePointer(key)
+		if field == nil {
+			errs = errs.add(pointer, ManifestInvalidValue, "the field must be an object")
+			continue
+		}
+		switch field.Type {
+		case ContextString, ContextURL, ContextNumber, ContextBoolean:
+		default:
+			errs = errs.add(pointer+"/type", ManifestInvalidValue,
+				"the type must be string, url, number or boolean")
+		}
+	}
+	return errs
+}
+
+// Validate checks an install context against the schema. Every context is
+// valid if the manifest has no schema.
+func (s ContextSchema) Validate(ctx map[string]interface{}) error {
+	if s == nil {
+		return nil
+	}
+	var errs ContextErrors
+	unknown := make([]string, 0)
+	for key := range ctx {
+		if _, ok := s[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = errs.add(key, ContextUnknownKey, "the key is not in the context schema")
+	}
+	for _, key := range s.keys() {
+		field := s[key]
+		value, ok := ctx[key]
+		if !ok || value == nil {
+			if field.Required {
+				errs = errs.add(key, ManifestMissingField, "the value is mandatory")
+			}
+			continue
+		}
+		if !field.accepts(value) {
+			errs = errs.add(key, ManifestInvalidValue, fmt.Sprintf("the value must be a %s", field.Type))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s ContextSchema) keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *ContextField) accepts(value interface{}) bool {
+	switch f.Type {
+	case ContextString:
+		_, ok := value.(string)
+		return ok
+	case ContextURL:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		u, err := url.Parse(s)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	case ContextNumber:
+		_, ok := value.(float64)
+		return ok
+	case ContextBoolean:
+		_, ok := value.(bool)
+		return ok
+	}
+	return false
+}
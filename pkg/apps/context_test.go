@@ -0,0 +1,69 @@
+package apps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextSchemaValidate(t *testing.T) {
+	schema := ContextSchema{
+		"brand_name":  {Type: ContextString, Required: true},
+		"support_url": {Type: ContextURL},
+		"max_users":   {Type: ContextNumber},
+		"beta":        {Type: ContextBoolean},
+	}
+	assert.NoError(t, schema.Validate(map[string]interface{}{
+		"brand_name":  "ACME",
+		"support_url": "https://support.acme.example/",
+		"max_users":   10.0,
+		"beta":        true,
+	}))
+	assert.NoError(t, schema.Validate(map[string]interface{}{"brand_name": "ACME"}))
+
+	err := schema.Validate(map[string]interface{}{
+		"support_url": "javascript:alert(1)",
+		"max_users":   "ten",
+		"color":       "red",
+	})
+	errs, ok := err.(ContextErrors)
+	if assert.True(t, ok) {
+		fields := make(map[string]string)
+		for _, e := range errs {
+			fields[e.Field] = e.Code
+		}
+		assert.Len(t, fields, 4)
+		assert.Equal(t, ContextUnknownKey, fields["/color"])
+		assert.Equal(t, ManifestMissingField, fields["/brand_name"])
+		assert.Equal(t, ManifestInvalidValue, fields["/support_url"])
+		assert.Equal(t, ManifestInvalidValue, fields["/max_users"])
+	}
+
+	var none ContextSchema
+	assert.NoError(t, none.Validate(map[string]interface{}{"anything": []interface{}{1.0}}))
+}
+
+func TestManifestContextSchema(t *testing.T) {
+	manifest := &WebappManifest{}
+	err := manifest.ReadManifest(strings.NewReader(`{
+  "name": "mini",
+  "context_schema": { "brand_name": { "type": "text" }, "support_url": null }
+}`), "mini", "git://github.com/cozy/mini.git")
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 2) {
+		assert.Equal(t, "/context_schema/brand_name/type", errs[0].Field)
+		assert.Equal(t, "/context_schema/support_url", errs[1].Field)
+	}
+
+	// The install context is kept by an update
+	manifest = &WebappManifest{DocContext: map[string]interface{}{"brand_name": "ACME"}}
+	err = manifest.ReadManifest(strings.NewReader(`{
+  "name": "mini",
+  "install_context": { "brand_name": "Evil" },
+  "context_schema": { "brand_name": { "type": "string" } }
+}`), "mini", "git://github.com/cozy/mini.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "ACME", manifest.InstallContext()["brand_name"])
+	assert.NotNil(t, manifest.ContextSchema["brand_name"])
+}
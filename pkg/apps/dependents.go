@@ -0,0 +1,222 @@
+package apps
+
+import (
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// KonnectorDependents is the list of the webapps that declare a konnector in
+// their manifest. There is one document per konnector, with its slug as
+// identifier. It is updated when the webapps are installed, updated or
+// deleted, so that the deletion of a konnector doesn't have to read all the
+// manifests.
+type KonnectorDependents struct {
+	DocID   string   `json:"_id,omitempty"`
+	DocRev  string   `json:"_rev,omitempty"`
+	Webapps []string `json:"webapps"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (d *KonnectorDependents) ID() string { return d.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (d *KonnectorDependents) Rev() string { return d.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (d *KonnectorDependents) DocType() string { return consts.KonnectorDependents }
+
+// SetID is used to implement the couchdb.Doc interface
+func (d *KonnectorDependents) SetID(id string) { d.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (d *KonnectorDependents) SetRev(rev string) { d.DocRev = rev }
+
+// GetDependents returns the slugs of the installed webapps that declare the
+// konnector as a dependency.
+func GetDependents(db couchdb.Database, slug string) ([]string, error) {
+	deps := &KonnectorDependents{}
+	err := couchdb.GetDoc(db, consts.KonnectorDependents, slug, deps)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deps.Webapps, nil
+}
+
+// registerDependencies records the webapp as a dependent of the konnectors of
+// its manifest, and removes it from the konnectors it no longer declares.
+func registerDependencies(db couchdb.Database, webapp string, before, after []string) error {
+	for _, konn := range after {
+		if err := updateDependents(db, konn, webapp, true); err != nil {
+			return err
+		}
+	}
+	for _, konn := range before {
+		if !containsString(after, konn) {
+			if err := updateDependents(db, konn, webapp, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateDependents adds or removes a webapp of the dependents of a konnector.
+// The document is only written if the list has changed.
+func updateDependents(db couchdb.Database, konn, webapp string, add bool) error {
+	deps := &KonnectorDependents{}
+	err := couchdb.GetDoc(db, consts.KonnectorDependents, konn, deps)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	exists := err == nil
+	if containsString(deps.Webapps, webapp) == add {
+		return nil
+	}
+	if add {
+		deps.Webapps = append(deps.Webapps, webapp)
+		sort.Strings(deps.Webapps)
+	} else {
+		webapps := deps.Webapps[:0]
+		for _, w := range deps.Webapps {
+			if w != webapp {
+				webapps = append(webapps, w)
+			}
+		}
+		deps.Webapps = webapps
+	}
+	deps.DocID = konn
+	if exists {
+		return couchdb.UpdateDoc(db, deps)
+	}
+	return couchdb.CreateNamedDocWithDB(db, deps)
+}
+
+// dependentsBackfillID is the identifier of the document that tells that the
+// index of the dependents has been built from the webapps installed before
+// it. It can't be the slug of a konnector.
+const dependentsBackfillID = "backfill.done"
+
+// backfillDependents adds to the index of the dependents the konnectors of
+// the webapps installed before the index, and records that it has been done.
+// It is called before the index is read, so it is done only once per
+// instance, and it can be done again without harm if it is interrupted.
+func backfillDependents(db couchdb.Database) error {
+	marker := &KonnectorDependents{}
+	err := couchdb.GetDoc(db, consts.KonnectorDependents, dependentsBackfillID, marker)
+	if err == nil {
+		return nil
+	}
+	if !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	webapps, err := listWebappDocs(db)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	for _, webapp := range webapps {
+		if err = registerDependencies(db, webapp.DocSlug, nil, webapp.Konnectors); err != nil {
+			return err
+		}
+	}
+	marker = &KonnectorDependents{DocID: dependentsBackfillID, Webapps: []string{}}
+	err = couchdb.CreateNamedDocWithDB(db, marker)
+	if couchdb.IsConflictError(err) {
+		return nil
+	}
+	return err
+}
+
+// installedDependents returns the dependents of a konnector that are still
+// installed, as a webapp may have been deleted before the index was kept.
+func installedDependents(db couchdb.Database, konn string) ([]*WebappManifest, error) {
+	if err := backfillDependents(db); err != nil {
+		return nil, err
+	}
+	slugs, err := GetDependents(db, konn)
+	if err != nil {
+		return nil, err
+	}
+	webapps := make([]*WebappManifest, 0, len(slugs))
+	for _, slug := range slugs {
+		webapp, err := GetWebappBySlug(db, slug)
+		if couchdb.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if containsString(webapp.Konnectors, konn) {
+			webapps = append(webapps, webapp)
+		}
+	}
+	return webapps, nil
+}
+
+// flagMissingDependency sets the missing_dependency flag on the dependents of
+// a konnector that has been deleted.
+func flagMissingDependency(db couchdb.Database, webapps []*WebappManifest) error {
+	for _, webapp := range webapps {
+		if webapp.DocMissingDependency {
+			continue
+		}
+		webapp.DocMissingDependency = true
+		if err := couchdb.UpdateDoc(db, webapp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMissingDependency removes the missing_dependency flag of the
+// dependents of a konnector that has been installed, if all their konnectors
+// are installed.
+func refreshMissingDependency(db couchdb.Database, konn string) error {
+	webapps, err := installedDependents(db, konn)
+	if err != nil {
+		return err
+	}
+	for _, webapp := range webapps {
+		if !webapp.DocMissingDependency {
+			continue
+		}
+		missing, err := hasMissingKonnector(db, webapp)
+		if err != nil {
+			return err
+		}
+		if missing {
+			continue
+		}
+		webapp.DocMissingDependency = false
+		if err := couchdb.UpdateDoc(db, webapp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasMissingKonnector(db couchdb.Database, webapp *WebappManifest) (bool, error) {
+	for _, konn := range webapp.Konnectors {
+		_, err := GetKonnectorBySlug(db, konn)
+		if couchdb.IsNotFoundError(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package apps
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// The kinds of changes of a field between two versions of a manifest
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// ManifestChange is a change of a top-level field of the manifest between two
+// versions of an application. Before and After are only given for the scalar
+// fields (strings, numbers and booleans).
+type ManifestChange struct {
+	Field  string      `json:"field"`
+	Kind   string      `json:"kind"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// stateFields are the fields of the documents of the applications that are
+// not read from the manifest, and are ignored by the diff.
+var stateFields = []string{
+	"_id", "_rev", "slug", "source", "state", "error", "operation", "size",
+	"files_count", "installed_from_cache", "resolved_source", "source_commit",
+	"updated_at", "auto_update", "terms_accepted", "needs_terms_acceptance",
+	"deprecated", "install_context", "missing_dependency", "last_transition",
+	"installed_by", "updated_by", "update_available", "available_version",
+	"checked_at", "route_table", "protected", "error_code", "channel",
+	"served_assets", "last_operation", "schema_version", "files_dir",
+	"namespace_lost",
+}
+
+// DiffManifests compares the top-level fields of two manifests, decoded from
+// JSON, and returns the changes sorted by field. A field is added or removed
+// when it goes from or to an empty value (null, "", [] or {}).
+func DiffManifests(before, after map[string]interface{}) []*ManifestChange {
+	fields := make(map[string]struct{})
+	for field := range before {
+		fields[field] = struct{}{}
+	}
+	for field := range after {
+		fields[field] = struct{}{}
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []*ManifestChange{}
+	for _, field := range names {
+		b, a := before[field], after[field]
+		var kind string
+		switch {
+		case isEmptyValue(b) && isEmptyValue(a):
+			continue
+		case isEmptyValue(b):
+			kind = ChangeAdded
+		case isEmptyValue(a):
+			kind = ChangeRemoved
+		case reflect.DeepEqual(b, a):
+			continue
+		default:
+			kind = ChangeModified
+		}
+		change := &ManifestChange{Field: field, Kind: kind}
+		if isScalarValue(b) {
+			change.Before = b
+		}
+		if isScalarValue(a) {
+			change.After = a
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// manifestFields returns the fields of a manifest decoded from JSON, without
+// the fields that are not read from the manifest.
+func manifestFields(man Manifest) (map[string]interface{}, error) {
+	b, err := json.Marshal(man)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for _, field := range stateFields {
+		delete(fields, field)
+	}
+	return fields, nil
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func isScalarValue(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return !isEmptyValue(v)
+	}
+	return false
+}
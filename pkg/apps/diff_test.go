@@ -0,0 +1,89 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffManifests(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  map[string]interface{}
+		after   map[string]interface{}
+		changes []*ManifestChange
+	}{
+		{
+			name:    "same manifests",
+			before:  map[string]interface{}{"name": "mini", "version": "1.0.0"},
+			after:   map[string]interface{}{"name": "mini", "version": "1.0.0"},
+			changes: []*ManifestChange{},
+		},
+		{
+			name:   "new version",
+			before: map[string]interface{}{"version": "1.0.0"},
+			after:  map[string]interface{}{"version": "1.1.0"},
+			changes: []*ManifestChange{
+				{Field: "version", Kind: ChangeModified, Before: "1.0.0", After: "1.1.0"},
+			},
+		},
+		{
+			name:   "added and removed sections",
+			before: map[string]interface{}{"license": "MIT", "intents": nil},
+			after: map[string]interface{}{
+				"intents": []interface{}{map[string]interface{}{"action": "PICK"}},
+			},
+			changes: []*ManifestChange{
+				{Field: "intents", Kind: ChangeAdded},
+				{Field: "license", Kind: ChangeRemoved, Before: "MIT"},
+			},
+		},
+		{
+			name: "modified section",
+			before: map[string]interface{}{
+				"routes": map[string]interface{}{"/": map[string]interface{}{"folder": "/"}},
+			},
+			after: map[string]interface{}{
+				"routes": map[string]interface{}{"/": map[string]interface{}{"folder": "/build"}},
+			},
+			changes: []*ManifestChange{
+				{Field: "routes", Kind: ChangeModified},
+			},
+		},
+		{
+			name:    "empty values",
+			before:  map[string]interface{}{"konnectors": []interface{}{}, "description": ""},
+			after:   map[string]interface{}{"routes": map[string]interface{}{}},
+			changes: []*ManifestChange{},
+		},
+		{
+			name:   "booleans and numbers",
+			before: map[string]interface{}{"public": false, "priority": 1.0},
+			after:  map[string]interface{}{"public": true, "priority": 1.0},
+			changes: []*ManifestChange{
+				{Field: "public", Kind: ChangeModified, Before: false, After: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.changes, DiffManifests(test.before, test.after), test.name)
+	}
+}
+
+func TestManifestFields(t *testing.T) {
+	man := &WebappManifest{
+		Name:     "mini",
+		DocSlug:  "mini",
+		DocState: Ready,
+		DocSize:  1234,
+		Version:  "1.0.0",
+	}
+	fields, err := manifestFields(man)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mini", fields["name"])
+		assert.Equal(t, "1.0.0", fields["version"])
+		assert.NotContains(t, fields, "state")
+		assert.NotContains(t, fields, "size")
+		assert.NotContains(t, fields, "slug")
+	}
+}
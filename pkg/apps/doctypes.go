@@ -0,0 +1,87 @@
+package apps
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// ManifestInvalidDoctype is the code for a permission of the manifest on a
+// doctype that is malformed
+const ManifestInvalidDoctype = "invalid_doctype"
+
+// ManifestUnknownDoctype is the code for a permission of the manifest on a
+// doctype of the io.cozy namespace that is unknown
+const ManifestUnknownDoctype = "unknown_doctype"
+
+// doctypeReg is the pattern for a doctype: a reverse domain name, like
+// io.cozy.files or com.example.notes
+var doctypeReg = regexp.MustCompile(`^[a-z0-9]+(\.[a-z0-9][a-z0-9_\-]*){2,}$`)
+
+// knownDoctypes are the doctypes of the io.cozy namespace that an
+// application can ask: the ones of the stack, and the data doctypes of the
+// official applications.
+var knownDoctypes = map[string]bool{
+	consts.Apps:             true,
+	consts.Konnectors:       true,
+	consts.KonnectorResults: true,
+	consts.Archives:         true,
+	consts.Doctypes:         true,
+	consts.Files:            true,
+	consts.Intents:          true,
+	consts.Jobs:             true,
+	consts.Permissions:      true,
+	consts.Queues:           true,
+	consts.Recipients:       true,
+	consts.Settings:         true,
+	consts.Sharings:         true,
+	consts.Triggers:         true,
+
+	"io.cozy.accounts":        true,
+	"io.cozy.bank.accounts":   true,
+	"io.cozy.bank.operations": true,
+	"io.cozy.bills":           true,
+	"io.cozy.contacts":        true,
+	"io.cozy.events":          true,
+	"io.cozy.notifications":   true,
+	"io.cozy.photos.albums":   true,
+}
+
+// validateDoctypes checks the doctypes of the permissions of a manifest. A
+// malformed doctype, or an unknown doctype in the io.cozy namespace, is an
+// error with the apps.strict_doctypes configuration, and a warning else.
+func validateDoctypes(set permissions.Set, errs ManifestErrors) (ManifestErrors, []string) {
+	rules := make([]permissions.Rule, len(set))
+	copy(rules, set)
+	sort.Sort(byTitle(rules))
+
+	strict := config.GetConfig().Apps.StrictDoctypes
+	var warnings []string
+	for _, rule := range rules {
+		pointer := "/permissions/" + escapePointer(rule.Title) + "/type"
+		var code, reason string
+		if !doctypeReg.MatchString(rule.Type) {
+			code, reason = ManifestInvalidDoctype, "the doctype "+rule.Type+" is malformed"
+		} else if strings.HasPrefix(rule.Type, "io.cozy.") && !knownDoctypes[rule.Type] {
+			code, reason = ManifestUnknownDoctype, "the doctype "+rule.Type+" is unknown"
+		} else {
+			continue
+		}
+		if strict {
+			errs = errs.add(pointer, code, reason)
+		} else {
+			warnings = append(warnings, pointer+": "+reason)
+		}
+	}
+	return errs, warnings
+}
+
+type byTitle []permissions.Rule
+
+func (r byTitle) Len() int           { return len(r) }
+func (r byTitle) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byTitle) Less(i, j int) bool { return r[i].Title < r[j].Title }
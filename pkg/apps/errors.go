@@ -1,10 +1,18 @@
 package apps
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
 
 var (
-	// ErrInvalidSlugName is used when the given slug name is not valid
-	ErrInvalidSlugName = errors.New("Invalid slug name")
+	// ErrInvalidSlugName is used when the given slug name is not valid (see
+	// utils.ValidateSlug for the rules)
+	ErrInvalidSlugName = utils.ErrInvalidSlug
 	// ErrAlreadyExists is used when an application with the specified slug name
 	// is already installed.
 	ErrAlreadyExists = errors.New("Application with same slug already exists")
@@ -20,6 +28,9 @@ var (
 	// ErrSourceNotReachable is used when the given source for
 	// application is not reachable
 	ErrSourceNotReachable = errors.New("Application source is not reachable")
+	// ErrSourceNotAllowed is used when the source of an archive, or one of
+	// its redirections, targets a private or a loopback address
+	ErrSourceNotAllowed = errors.New("Application source targets an address that is not allowed")
 	// ErrBadManifest when the manifest is not valid or malformed
 	ErrBadManifest = errors.New("Application manifest is invalid or malformed")
 	// ErrBadState is used when trying to use the application while in a
@@ -28,4 +39,217 @@ var (
 	// ErrMissingSource is used when installing an application, but there is no
 	// source URL
 	ErrMissingSource = errors.New("The source URL for the app is missing")
+	// ErrMissingSignature is used when the configuration requires the
+	// applications to be signed, and the source has no signature
+	ErrMissingSignature = errors.New("The application archive is not signed")
+	// ErrInvalidSignature is used when the signature of the application
+	// archive can't be verified with the trusted keys
+	ErrInvalidSignature = errors.New("The signature of the application archive is invalid")
+	// ErrInvalidChecksum is used when the application archive doesn't match
+	// the checksum of its source
+	ErrInvalidChecksum = errors.New("The checksum of the application archive is invalid")
+	// ErrAutoUpdatesPaused is used when the automatic updates are stopped by
+	// the kill switch
+	ErrAutoUpdatesPaused = errors.New("The automatic updates are paused")
+	// ErrNoSuccessor is used when migrating an application that has not been
+	// replaced by a successor
+	ErrNoSuccessor = errors.New("Application has not been replaced by a successor")
+	// ErrInvalidSubDirectory is used when the subdirectory of a source is not
+	// a relative path inside the repository
+	ErrInvalidSubDirectory = errors.New("The subdirectory of the source is invalid")
+	// ErrSubDirectoryNotSupported is used when a subdirectory is given for a
+	// source that is not a git repository
+	ErrSubDirectoryNotSupported = errors.New("Only the git sources can have a subdirectory")
+	// ErrProtected is used when deleting a protected application without the
+	// confirmation
+	ErrProtected = errors.New("The application is protected against the deletion")
+	// ErrKonnectorLogNotFound is used when there is no log for the execution
+	// of a konnector
+	ErrKonnectorLogNotFound = errors.New("No log was found for the execution of the konnector")
+	// ErrManifestConflict is used when the document of an application can't
+	// be saved at the end of an operation, as it has been deleted or taken by
+	// another operation meanwhile
+	ErrManifestConflict = errors.New("The application has been modified by another operation")
+	// ErrKonnectorsDisabled is used when installing or updating a konnector
+	// on an instance where the konnectors are disabled
+	ErrKonnectorsDisabled = errors.New("The konnectors are disabled on this instance")
+)
+
+// RateLimitError is used when the API of GitHub or GitLab refuses to resolve
+// a release source, until the reset time (zero if it is not known).
+type RateLimitError struct {
+	Service string
+	Reset   time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Reset.IsZero() {
+		return fmt.Sprintf("The rate limit of the %s API is exceeded, retry later", e.Service)
+	}
+	return fmt.Sprintf("The rate limit of the %s API is exceeded, retry after %s",
+		e.Service, e.Reset.Format(time.RFC3339))
+}
+
+// OperationInProgressError is used when an operation on an application is
+// refused because another one is already in progress.
+type OperationInProgressError struct {
+	Operation *PendingOperation
+}
+
+func (e *OperationInProgressError) Error() string {
+	return fmt.Sprintf("Application is already %s since %s",
+		e.Operation.Name, e.Operation.StartedAt.Format(time.RFC3339))
+}
+
+// RevisionMismatchError is used when an update or a deletion expects a
+// revision of the document of the application that is no longer the current
+// one, like with the If-Match header of the clients.
+type RevisionMismatchError struct {
+	Expected string
+	Current  string
+}
+
+func (e *RevisionMismatchError) Error() string {
+	return fmt.Sprintf("Revision %s is not the current revision %s", e.Expected, e.Current)
+}
+
+// TermsError is used when a konnector is installed, but the user has not
+// accepted the current version of its terms.
+type TermsError struct {
+	URL     string
+	Version string
+}
+
+func (e *TermsError) Error() string {
+	return fmt.Sprintf("The version %s of the terms of the konnector must be accepted", e.Version)
+}
+
+// DependentsError is used when a konnector can't be deleted, as some
+// installed webapps declare it as a dependency.
+type DependentsError struct {
+	Slugs []string
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("The konnector is used by the applications %s", strings.Join(e.Slugs, ", "))
+}
+
+// NamespaceConflictError is used when an application claims a namespace of
+// the routes that is owned by another installed application.
+type NamespaceConflictError struct {
+	Namespace string
+	Slug      string
+}
+
+func (e *NamespaceConflictError) Error() string {
+	return fmt.Sprintf("The namespace %s is already used by the application %s", e.Namespace, e.Slug)
+}
+
+// SubDirectoryError is used when the subdirectory of a git source, or the
+// manifest in it, doesn't exist in the repository.
+type SubDirectoryError struct {
+	Dir  string
+	File string
+}
+
+func (e *SubDirectoryError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("The file %s was not found in the directory %s of the source", e.File, e.Dir)
+	}
+	return fmt.Sprintf("The directory %s was not found in the source", e.Dir)
+}
+
+const (
+	// ManifestMissingField is the code for a mandatory field of the manifest
+	// that is absent or empty
+	ManifestMissingField = "missing_field"
+	// ManifestInvalidValue is the code for a field of the manifest that has
+	// an invalid value
+	ManifestInvalidValue = "invalid_value"
 )
+
+// ManifestError describes a problem on a field of a manifest.
+type ManifestError struct {
+	// Field is the JSON pointer to the field in the manifest, like /name
+	Field  string
+	Code   string
+	Reason string
+}
+
+func (e *ManifestError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ManifestErrors is the list of problems found while validating a manifest.
+type ManifestErrors []*ManifestError
+
+func (e ManifestErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return ErrBadManifest.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+func (e ManifestErrors) add(field, code, reason string) ManifestErrors {
+	return append(e, &ManifestError{Field: field, Code: code, Reason: reason})
+}
+
+// withManifestErrors adds some problems to the error of the validation of a
+// manifest. An error that is not about the fields of the manifest is kept as
+// it is.
+func withManifestErrors(err error, errs ManifestErrors) error {
+	if len(errs) == 0 {
+		return err
+	}
+	if err == nil {
+		return errs
+	}
+	prev, ok := err.(ManifestErrors)
+	if !ok {
+		return err
+	}
+	return append(prev, errs...)
+}
+
+// escapePointer escapes a token of a JSON pointer (RFC 6901)
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// ErrorCode returns the code recorded with the error of an application in the
+// errored state, like the codes of the errors of the API for the installs and
+// the updates.
+func ErrorCode(err error) string {
+	switch err {
+	case ErrMissingFiles:
+		return "missing_files"
+	case ErrManifestNotReachable:
+		return "manifest_not_reachable"
+	case ErrSourceNotReachable:
+		return "source_not_reachable"
+	case ErrBadManifest, ErrManifestTooDeep, ErrManifestTooLarge:
+		return "bad_manifest"
+	case ErrTarballTooLarge:
+		return "source_too_large"
+	case ErrMissingSignature:
+		return "missing_signature"
+	case ErrInvalidSignature:
+		return "invalid_signature"
+	case ErrInvalidChecksum:
+		return "invalid_checksum"
+	case ErrManifestConflict:
+		return "manifest_conflict"
+	case ErrKonnectorsDisabled:
+		return "feature_disabled"
+	}
+	switch err.(type) {
+	case ManifestErrors:
+		return "bad_manifest"
+	case *HookError:
+		return "aborted_by_hook"
+	case *SubDirectoryError:
+		return "subdirectory_not_found"
+	}
+	return "internal_error"
+}
@@ -0,0 +1,90 @@
+package apps
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// ExtrasMaxSize is the maximal size in bytes of the extra fields of a
+// manifest, if it is not set in the configuration
+const ExtrasMaxSize = 16 << 10 // 16KiB
+
+// ManifestExtrasTooLarge is the code for the extra fields of a manifest that
+// are larger than the limit
+const ManifestExtrasTooLarge = "extras_too_large"
+
+// extraFieldPrefix is the prefix reserved for the fields of the manifests
+// added by the organizations, like x-cost-center
+const extraFieldPrefix = "x-"
+
+// ExtrasSizeLimit returns the maximal size in bytes of the extra fields of a
+// manifest, from the configuration or ExtrasMaxSize by default
+func ExtrasSizeLimit() int64 {
+	if size := config.GetConfig().Apps.ExtrasMaxSize; size > 0 {
+		return size
+	}
+	return ExtrasMaxSize
+}
+
+// isExtraField returns true if the top-level field of a manifest is kept in
+// its extras: it has the x- prefix, or it is in the apps.extra_fields list of
+// the configuration.
+func isExtraField(name string) bool {
+	if strings.HasPrefix(name, extraFieldPrefix) {
+		return true
+	}
+	for _, field := range config.GetConfig().Apps.ExtraFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readExtras returns the extra fields of the manifest, with their value as
+// they are in the source. The fields known by the stack are never extras. The
+// fields are taken by name, and the ones after the size limit are errors.
+func readExtras(b []byte, man Manifest) (map[string]json.RawMessage, ManifestErrors) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, nil
+	}
+	t := reflect.TypeOf(man)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fields := jsonFields(t)
+
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		if _, known := lookupField(fields, name); !known && isExtraField(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	limit := ExtrasSizeLimit()
+	extras := make(map[string]json.RawMessage, len(names))
+	var size int64
+	var errs ManifestErrors
+	for _, name := range names {
+		value := doc[name]
+		size += int64(len(name) + len(value))
+		if size > limit {
+			reason := fmt.Sprintf("the extra fields are larger than %s", utils.FormatSize(limit))
+			errs = errs.add("/"+escapePointer(name), ManifestExtrasTooLarge, reason)
+			continue
+		}
+		extras[name] = value
+	}
+	return extras, errs
+}
@@ -0,0 +1,45 @@
+package apps
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadExtras(t *testing.T) {
+	cfg := config.GetConfig()
+	fields, size := cfg.Apps.ExtraFields, cfg.Apps.ExtrasMaxSize
+	defer func() { cfg.Apps.ExtraFields, cfg.Apps.ExtrasMaxSize = fields, size }()
+	cfg.Apps.ExtraFields = []string{"cost_center", "name"}
+
+	b := []byte(`{
+  "name": "Mini",
+  "x-internal-id": {"id": 42, "tags": ["a", "b"]},
+  "cost_center": "R&D",
+  "editor": "Cozy"
+}`)
+	extras, errs := readExtras(b, &WebappManifest{})
+	assert.Empty(t, errs)
+	assert.Equal(t, map[string]json.RawMessage{
+		"cost_center":   json.RawMessage(`"R&D"`),
+		"x-internal-id": json.RawMessage(`{"id": 42, "tags": ["a", "b"]}`),
+	}, extras)
+
+	// The extra fields are not unknown
+	assert.Equal(t, []string{"/editor"}, unknownFields(b, &WebappManifest{}))
+
+	cfg.Apps.ExtrasMaxSize = 32
+	extras, errs = readExtras(b, &WebappManifest{})
+	assert.Len(t, extras, 1)
+	assert.Contains(t, extras, "cost_center")
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "/x-internal-id", errs[0].Field)
+		assert.Equal(t, ManifestExtrasTooLarge, errs[0].Code)
+	}
+
+	extras, errs = readExtras([]byte(`{"name": "Mini"}`), &konnManifest{})
+	assert.Nil(t, extras)
+	assert.Empty(t, errs)
+}
@@ -0,0 +1,22 @@
+package apps
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// KonnectorsEnabler is implemented by the instances, with their
+// konnectors_enabled setting
+type KonnectorsEnabler interface {
+	KonnectorsEnabled() bool
+}
+
+// KonnectorsEnabled returns true if the konnectors can be installed on the
+// instance of the database. For a database that is not an instance, it is
+// the default of the configuration.
+func KonnectorsEnabled(db couchdb.Database) bool {
+	if e, ok := db.(KonnectorsEnabler); ok {
+		return e.KonnectorsEnabled()
+	}
+	return config.GetConfig().Konnectors.Enabled
+}
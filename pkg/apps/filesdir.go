@@ -0,0 +1,139 @@
+package apps
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// PreviousFilesGracePeriod is the delay after an update before the files of
+// the previous version are removed, so that the requests that have read the
+// document of the application just before the update can still serve them.
+var PreviousFilesGracePeriod = time.Minute
+
+// FilesDir returns the directory of the files of the installed version of an
+// application, in the file system of its type. An update writes the files of
+// the new version in a staging directory (see stagingDir), that becomes the
+// directory of the application with the same write of its document as the
+// new version. So, the readers that resolve the files through this pointer
+// always see a complete version.
+func FilesDir(man Manifest) string {
+	if dir := man.filesDir(); dir != "" {
+		return dir
+	}
+	return path.Join("/", man.Slug())
+}
+
+// stagingDir returns the directory where the update with the given operation
+// id writes the files of the new version. The @ can't be in a slug, so the
+// directory can't be the one of another application.
+func stagingDir(slug, opID string) string {
+	return path.Join("/", slug+"@"+opID)
+}
+
+// slugOfDir returns the slug of the application of a top-level directory,
+// which can be a staging directory.
+func slugOfDir(name string) string {
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// moveGitDir moves the .git directory of an installed version in the
+// staging directory of an update, file by file, so that the repository is
+// just pulled without copying it. The files of the installed version can
+// still be served without it. If the update fails, the staging directory is
+// removed with the repository, and the next update clones it again.
+func moveGitDir(fs afero.Fs, src, dst string) error {
+	exists, err := afero.DirExists(fs, src)
+	if err != nil || !exists {
+		return err
+	}
+	err = afero.Walk(fs, src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return fs.MkdirAll(target, info.Mode()|0700)
+		}
+		return fs.Rename(name, target)
+	})
+	if err != nil {
+		return err
+	}
+	return fs.RemoveAll(src)
+}
+
+// copyFile copies a file in another place of the same file system.
+func copyFile(fs afero.Fs, src, dst string, mode os.FileMode) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = fs.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if errc := out.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// removeAppDirs removes all the directories of an application: the one of
+// its files, a previous version not yet released, and the staging
+// directories of the updates that have been interrupted.
+func removeAppDirs(fs afero.Fs, slug string) error {
+	infos, err := afero.ReadDir(fs, "/")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if name := info.Name(); info.IsDir() && slugOfDir(name) == slug {
+			if err = fs.RemoveAll(path.Join("/", name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseFilesDir removes the directory of the files of a previous version
+// once the grace period is over, unless it is used again, like by the
+// application installed again after a deletion. If the stack stops before,
+// the directory is an orphan for GarbageCollect.
+func releaseFilesDir(db couchdb.Database, fs afero.Fs, appType AppType, slug, dir string) {
+	time.AfterFunc(PreviousFilesGracePeriod, func() {
+		man, err := GetBySlug(db, slug, appType)
+		if err == nil && (FilesDir(man) == dir || man.Operation().Fresh()) {
+			return
+		}
+		if err != nil && !couchdb.IsNotFoundError(err) {
+			return
+		}
+		if err := fs.RemoveAll(dir); err != nil {
+			log.Warnf("[apps] Can't remove the previous files in %s: %s", dir, err)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesDir(t *testing.T) {
+	man := &WebappManifest{DocSlug: "mini"}
+	assert.Equal(t, "/mini", FilesDir(man))
+	man.setFilesDir(stagingDir("mini", "op-1"))
+	assert.Equal(t, "/mini@op-1", FilesDir(man))
+	assert.Equal(t, "mini", slugOfDir("mini@op-1"))
+	assert.Equal(t, "mini", slugOfDir("mini"))
+}
+
+func TestMoveGitAndRemoveAppDirs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/mini/index.html", []byte("<html></html>"), 0644)
+	afero.WriteFile(fs, "/mini/.git/HEAD", []byte("ref"), 0644)
+	afero.WriteFile(fs, "/mini/.git/refs/heads/master", []byte("abc"), 0644)
+	afero.WriteFile(fs, "/mini-other/index.html", []byte("<html></html>"), 0644)
+
+	// The repository is moved for the next fetch, and the files are kept
+	assert.NoError(t, moveGitDir(fs, "/mini/.git", "/mini@op-1/.git"))
+	content, err := afero.ReadFile(fs, "/mini@op-1/.git/refs/heads/master")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(content))
+	ok, _ := afero.Exists(fs, "/mini/.git")
+	assert.False(t, ok)
+	ok, _ = afero.Exists(fs, "/mini/index.html")
+	assert.True(t, ok)
+	assert.NoError(t, moveGitDir(fs, "/mini-other/.git", "/mini-other@op-1/.git"))
+
+	assert.NoError(t, copyFile(fs, "/mini/index.html", "/mini@op-1/index.html", 0644))
+	content, err = afero.ReadFile(fs, "/mini@op-1/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(content))
+
+	// All the directories of the application are removed, and only them
+	assert.NoError(t, removeAppDirs(fs, "mini"))
+	for _, dir := range []string{"/mini", "/mini@op-1"} {
+		ok, _ = afero.DirExists(fs, dir)
+		assert.False(t, ok, dir)
+	}
+	ok, _ = afero.DirExists(fs, "/mini-other")
+	assert.True(t, ok)
+	assert.NoError(t, removeAppDirs(afero.NewMemMapFs(), "mini"))
+}
@@ -0,0 +1,129 @@
+package apps
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// ErrMissingFiles is used for the applications whose directory has been lost
+var ErrMissingFiles = errors.New("The files of the application are missing")
+
+// GCReport is the list of the discrepancies between the directories of the
+// applications and their documents.
+type GCReport struct {
+	// OrphanDirs are the directories without an application document
+	OrphanDirs []string `json:"orphan_dirs"`
+	// MissingDirs are the slugs of the applications without a directory
+	MissingDirs []string `json:"missing_dirs"`
+	// Fixed is true if the orphan directories have been removed, and the
+	// applications without directory marked as errored.
+	Fixed bool `json:"fixed"`
+}
+
+// GarbageCollect compares the top-level directories of the given file system
+// with the documents of the applications of this type. Nothing is changed,
+// unless fix is true: the orphan directories are then removed, and the
+// applications with missing files are put in the errored state. The
+// applications with a fresh pending operation are ignored, as their
+// directory or their document may not have been created yet. The directory
+// of an application is the one of its document (see FilesDir): the
+// directories of the previous versions and the staging directories of the
+// interrupted updates are orphans.
+func GarbageCollect(db couchdb.Database, fs afero.Fs, appType AppType, fix bool) (*GCReport, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := afero.ReadDir(fs, "/")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var dirNames []string
+	for _, info := range infos {
+		if info.IsDir() {
+			dirNames = append(dirNames, info.Name())
+		}
+	}
+	dirs := utils.NewStringSet(dirNames...)
+
+	report := &GCReport{
+		MissingDirs: []string{},
+		Fixed:       fix,
+	}
+	used := make(utils.StringSet)
+	busy := make(utils.StringSet)
+	var missing []Manifest
+	for _, man := range mans {
+		slug := man.Slug()
+		dir := path.Base(FilesDir(man))
+		used.Add(dir)
+		if man.Operation().Fresh() {
+			busy.Add(slug)
+		} else if !dirs.Has(dir) {
+			report.MissingDirs = append(report.MissingDirs, slug)
+			missing = append(missing, man)
+		}
+	}
+	report.OrphanDirs = []string{}
+	for _, dir := range dirNames {
+		if !used.Has(dir) && !busy.Has(slugOfDir(dir)) {
+			report.OrphanDirs = append(report.OrphanDirs, dir)
+		}
+	}
+
+	if !fix {
+		return report, nil
+	}
+	for _, dir := range report.OrphanDirs {
+		if err := fs.RemoveAll(path.Join("/", dir)); err != nil {
+			return nil, err
+		}
+	}
+	for _, man := range missing {
+		// The checksums of the files that are gone can't be used for the
+		// next update
+		if err := deleteChecksums(db, appType, man.Slug()); err != nil {
+			return nil, err
+		}
+		// A replaced or trashed application is kept as it is
+		if err := Transition(man, Errored); err != nil {
+			continue
+		}
+		man.SetError(ErrMissingFiles)
+		if err := couchdb.UpdateDoc(db, man); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// listManifests returns the applications of the given type, or an empty list
+// if their database has not been created yet. The documents are not upgraded,
+// so that the maintenance tasks see them as they are, and that their dry-runs
+// don't write anything.
+func listManifests(db couchdb.Database, appType AppType) ([]Manifest, error) {
+	var mans []Manifest
+	switch appType {
+	case Webapp:
+		webapps, err := listWebappDocs(db)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return nil, err
+		}
+		for _, m := range webapps {
+			mans = append(mans, m)
+		}
+	case Konnector:
+		konnectors, err := listKonnectorDocs(db)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return nil, err
+		}
+		mans = konnectors
+	}
+	return mans, nil
+}
@@ -11,14 +11,16 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/spf13/afero"
 	gitFS "gopkg.in/src-d/go-billy.v2"
 	git "gopkg.in/src-d/go-git.v4"
 	gitPlumbing "gopkg.in/src-d/go-git.v4/plumbing"
 	gitObject "gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitTransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitClient "gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	gitStorage "gopkg.in/src-d/go-git.v4/storage/filesystem"
 )
 
@@ -35,15 +37,18 @@ const glRawManifestURL = "https://%s/%s/%s/raw/%s/%s"
 type gitFetcher struct {
 	fs          afero.Fs
 	manFilename string
+	progress    *progressReporter
+	commit      string // the hash of the commit checked out by Fetch
+	dir         string // the directory of the repository used as the app root
 }
 
-func newGitFetcher(fs afero.Fs, manFilename string) *gitFetcher {
-	return &gitFetcher{fs: fs, manFilename: manFilename}
+func newGitFetcher(fs afero.Fs, manFilename string, progress *progressReporter) *gitFetcher {
+	return &gitFetcher{fs: fs, manFilename: manFilename, progress: progress}
 }
 
-var manifestClient = &http.Client{
-	Timeout: 60 * time.Second,
-}
+// manifestClient can be set to replace the client of the installers for the
+// manifests of the git sources
+var manifestClient *http.Client
 
 func isGithub(src *url.URL) bool {
 	return src.Host == "github.com"
@@ -54,21 +59,43 @@ func isGitlab(src *url.URL) bool {
 }
 
 func (g *gitFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
-	var err error
+	// The git sources can't have a signature
+	if config.GetConfig().Apps.RequireSignatures {
+		return nil, ErrMissingSignature
+	}
+
+	dir, err := gitSubDirectory(src)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Join(dir, g.manFilename)
 
 	var u string
 	if isGithub(src) {
-		u, err = resolveGithubURL(src, g.manFilename)
+		u, err = resolveGithubURL(src, filename)
 	} else if isGitlab(src) {
-		u, err = resolveGitlabURL(src, g.manFilename)
+		u, err = resolveGitlabURL(src, filename)
 	} else {
-		u, err = resolveManifestURL(src, g.manFilename)
+		u, err = resolveManifestURL(src, filename)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := manifestClient.Get(u)
+	client := manifestClient
+	if client == nil {
+		if client, err = httpClient(manifestTimeout); err != nil {
+			return nil, err
+		}
+	}
+	res, err := client.Get(u)
+	if isSourceNotAllowed(err) {
+		return nil, ErrSourceNotAllowed
+	}
+	if err == nil && res.StatusCode == 404 && dir != "" {
+		res.Body.Close()
+		return nil, &SubDirectoryError{Dir: dir, File: g.manFilename}
+	}
 	if err != nil || res.StatusCode != 200 {
 		return nil, ErrManifestNotReachable
 	}
@@ -80,11 +107,40 @@ func (g *gitFetcher) Fetch(src *url.URL, baseDir string) error {
 	log.Debugf("[git] Fetch %s", src.String())
 	fs := g.fs
 
+	// The fragment of the source is removed for the gitlab repositories, so
+	// the subdirectory is read before
+	dir, err := gitSubDirectory(src)
+	if err != nil {
+		return err
+	}
+	g.dir = dir
+	if err = checkGitSource(src); err != nil {
+		return err
+	}
+	if err = installGitTransport(); err != nil {
+		return err
+	}
+
+	// The size of a repository is not known before it has been fetched, so
+	// only the phases and the bytes written are reported
+	g.progress.start(PhaseDownloading, 0)
+
 	gitDir := path.Join(baseDir, ".git")
 	exists, err := afero.DirExists(fs, gitDir)
 	if err != nil {
 		return err
 	}
+	// The bytes received by git are not known, so the downloaded bytes are
+	// the growth of the repository
+	var before int64
+	if exists {
+		before, _, _ = dirSize(fs, gitDir)
+	}
+	defer func() {
+		if after, _, err := dirSize(fs, gitDir); err == nil {
+			g.progress.addDownloaded(after - before)
+		}
+	}()
 	if exists {
 		return g.pull(baseDir, gitDir, src)
 	}
@@ -94,20 +150,95 @@ func (g *gitFetcher) Fetch(src *url.URL, baseDir string) error {
 	return g.clone(baseDir, gitDir, src)
 }
 
+// checkGitSource verifies the host of a git source with the policy of the
+// sources (see checkSourceURL). Over http(s), go-git uses the transport of
+// the installers, that checks the address really connected to, but it opens
+// the connections of the git protocol itself, so the host is checked before.
+func checkGitSource(src *url.URL) error {
+	return checkSourcePolicy(src, nil)
+}
+
 func getGitBranch(src *url.URL) string {
-	if src.Fragment != "" {
-		return "refs/heads/" + src.Fragment
+	if branch, _ := splitGitFragment(src); branch != "" {
+		return "refs/heads/" + branch
 	}
 	return "HEAD"
 }
 
 func getWebBranch(src *url.URL) string {
-	if src.Fragment != "" {
-		return src.Fragment
+	if branch, _ := splitGitFragment(src); branch != "" {
+		return branch
 	}
 	return "HEAD"
 }
 
+// gitDirSep separates the branch and the subdirectory in the fragment of a
+// git source, like git://example.org/mono.git#branch:/apps/drive for the
+// application in the apps/drive directory of a monorepo.
+const gitDirSep = ":"
+
+// splitGitFragment returns the branch and the subdirectory given in the
+// fragment of a git source. Both are optional.
+func splitGitFragment(src *url.URL) (branch, dir string) {
+	parts := strings.SplitN(src.Fragment, gitDirSep, 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// gitSubDirectory returns the validated subdirectory of a git source, or an
+// empty string if the application is at the root of the repository.
+func gitSubDirectory(src *url.URL) (string, error) {
+	_, dir := splitGitFragment(src)
+	return cleanSubDirectory(dir)
+}
+
+// cleanSubDirectory validates a subdirectory of a source, and returns it
+// without the leading and trailing slashes. It must stay in the repository,
+// and can't be its .git directory.
+func cleanSubDirectory(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(dir, "\\\x00") {
+		return "", ErrInvalidSubDirectory
+	}
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." || part == ".." || part == ".git" {
+			return "", ErrInvalidSubDirectory
+		}
+	}
+	return dir, nil
+}
+
+// withSubDirectory puts the subdirectory in the fragment of a git source, so
+// that it is kept in the source of the application for its updates.
+func withSubDirectory(src *url.URL, dir string) error {
+	if src.Scheme != "git" {
+		return ErrSubDirectoryNotSupported
+	}
+	dir, err := cleanSubDirectory(dir)
+	if err != nil {
+		return err
+	}
+	branch, current := splitGitFragment(src)
+	if current, err = cleanSubDirectory(current); err != nil {
+		return err
+	}
+	if current != "" && current != dir {
+		return ErrInvalidSubDirectory
+	}
+	if dir != "" {
+		src.Fragment = branch + gitDirSep + "/" + dir
+	}
+	return nil
+}
+
 // clone creates a new bare git repository and install all the files of the
 // last commit in the application tree.
 func (g *gitFetcher) clone(baseDir, gitDir string, src *url.URL) error {
@@ -163,6 +294,11 @@ func (g *gitFetcher) pull(baseDir, gitDir string, src *url.URL) error {
 		ReferenceName: gitPlumbing.ReferenceName(branch),
 	})
 	if err == git.NoErrAlreadyUpToDate {
+		ref, errh := rep.Head()
+		if errh != nil {
+			return errh
+		}
+		g.commit = ref.Hash().String()
 		return nil
 	}
 	if err != nil {
@@ -201,6 +337,72 @@ func (g *gitFetcher) pull(baseDir, gitDir string, src *url.URL) error {
 	return g.copyFiles(baseDir, rep)
 }
 
+// resolveCommit returns the hash of the commit of the branch of a git source
+// on the remote repository, without fetching it, like git ls-remote. It is
+// used as the key of the source cache, as the version in the manifest can
+// stay the same between the commits of a branch.
+func (g *gitFetcher) resolveCommit(src *url.URL) (string, error) {
+	u := *src
+	// XXX Gitlab doesn't support the git protocol
+	if isGitlab(&u) {
+		u.Scheme = "https"
+	}
+	u.Fragment = ""
+	if err := installGitTransport(); err != nil {
+		return "", err
+	}
+
+	ep, err := gitTransport.NewEndpoint(u.String())
+	if err != nil {
+		return "", err
+	}
+	cli, err := gitClient.NewClient(ep)
+	if err != nil {
+		return "", err
+	}
+	sess, err := cli.NewUploadPackSession(ep, nil)
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	refs, err := sess.AdvertisedReferences()
+	if err != nil {
+		return "", err
+	}
+
+	branch := getGitBranch(src)
+	if branch == "HEAD" {
+		if refs.Head == nil {
+			return "", ErrSourceNotReachable
+		}
+		return refs.Head.String(), nil
+	}
+	hash, ok := refs.References[branch]
+	if !ok {
+		return "", ErrSourceNotReachable
+	}
+	return hash.String(), nil
+}
+
+// headCommit returns the hash of the commit checked out in the repository of
+// an application directory, like one restored from the source cache, or an
+// empty string if it can't be read.
+func (g *gitFetcher) headCommit(baseDir string) string {
+	storage, err := gitStorage.NewStorage(newGFS(g.fs, path.Join(baseDir, ".git")))
+	if err != nil {
+		return ""
+	}
+	rep, err := git.Open(storage, nil)
+	if err != nil {
+		return ""
+	}
+	ref, err := rep.Head()
+	if err != nil {
+		return ""
+	}
+	return ref.Hash().String()
+}
+
 func (g *gitFetcher) copyFiles(baseDir string, rep *git.Repository) error {
 	fs := g.fs
 
@@ -213,14 +415,28 @@ func (g *gitFetcher) copyFiles(baseDir string, rep *git.Repository) error {
 	if err != nil {
 		return err
 	}
+	g.commit = ref.Hash().String()
 
 	files, err := commit.Files()
 	if err != nil {
 		return err
 	}
 
-	return files.ForEach(func(f *gitObject.File) error {
-		abs := path.Join(baseDir, f.Name)
+	g.progress.start(PhaseExtracting, 0)
+
+	// Only the files of the subdirectory are copied, at the root of the
+	// application directory
+	prefix := ""
+	if g.dir != "" {
+		prefix = g.dir + "/"
+	}
+	found := false
+	err = files.ForEach(func(f *gitObject.File) (err error) {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return nil
+		}
+		found = true
+		abs := path.Join(baseDir, strings.TrimPrefix(f.Name, prefix))
 		dir := path.Dir(abs)
 
 		if err := fs.MkdirAll(dir, 0755); err != nil {
@@ -244,10 +460,14 @@ func (g *gitFetcher) copyFiles(baseDir string, rep *git.Repository) error {
 		}
 
 		defer r.Close()
-		_, err = io.Copy(file, r)
+		_, err = io.Copy(io.MultiWriter(file, g.progress), r)
 
 		return err
 	})
+	if err == nil && !found && g.dir != "" {
+		return &SubDirectoryError{Dir: g.dir}
+	}
+	return err
 }
 
 func resolveGithubURL(src *url.URL, filename string) (string, error) {
@@ -0,0 +1,73 @@
+package apps
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitGitFragment(t *testing.T) {
+	tests := []struct {
+		source string
+		branch string
+		dir    string
+	}{
+		{"git://example.org/mono.git", "", ""},
+		{"git://example.org/mono.git#dev", "dev", ""},
+		{"git://example.org/mono.git#dev:/apps/drive", "dev", "/apps/drive"},
+		{"git://example.org/mono.git#:/apps/drive", "", "/apps/drive"},
+	}
+	for _, test := range tests {
+		src, err := url.Parse(test.source)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		branch, dir := splitGitFragment(src)
+		assert.Equal(t, test.branch, branch, test.source)
+		assert.Equal(t, test.dir, dir, test.source)
+	}
+	src, _ := url.Parse("git://example.org/mono.git#dev:/apps/drive")
+	assert.Equal(t, "refs/heads/dev", getGitBranch(src))
+	assert.Equal(t, "dev", getWebBranch(src))
+}
+
+func TestCleanSubDirectory(t *testing.T) {
+	valid := map[string]string{
+		"":             "",
+		"/":            "",
+		"apps/drive":   "apps/drive",
+		"/apps/drive/": "apps/drive",
+		"apps/.drive":  "apps/.drive",
+	}
+	for dir, expected := range valid {
+		cleaned, err := cleanSubDirectory(dir)
+		if assert.NoError(t, err, dir) {
+			assert.Equal(t, expected, cleaned)
+		}
+	}
+	invalid := []string{
+		"..", "../drive", "apps/../../drive", "apps/./drive", "apps//drive",
+		".git", "apps/.git/config", "apps\\drive", "apps/\x00",
+	}
+	for _, dir := range invalid {
+		_, err := cleanSubDirectory(dir)
+		assert.Equal(t, ErrInvalidSubDirectory, err, dir)
+	}
+}
+
+func TestWithSubDirectory(t *testing.T) {
+	src, _ := url.Parse("git://example.org/mono.git#dev")
+	assert.NoError(t, withSubDirectory(src, "/apps/drive"))
+	assert.Equal(t, "dev:/apps/drive", src.Fragment)
+
+	// The same subdirectory can be given twice
+	assert.NoError(t, withSubDirectory(src, "apps/drive"))
+	assert.Equal(t, ErrInvalidSubDirectory, withSubDirectory(src, "apps/photos"))
+
+	src, _ = url.Parse("git://example.org/mono.git")
+	assert.Equal(t, ErrInvalidSubDirectory, withSubDirectory(src, "../drive"))
+
+	src, _ = url.Parse("https://example.org/app.tar.gz")
+	assert.Equal(t, ErrSubDirectoryNotSupported, withSubDirectory(src, "apps/drive"))
+}
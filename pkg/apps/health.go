@@ -0,0 +1,67 @@
+package apps
+
+import (
+	"io"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// AppHealth is the result of the check of the files of an application
+type AppHealth struct {
+	Slug    string `json:"slug"`
+	State   State  `json:"state"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the result of the checks of the applications of a type
+type HealthReport struct {
+	Healthy bool         `json:"healthy"`
+	Apps    []*AppHealth `json:"apps"`
+}
+
+// CheckHealth verifies that the manifest file of every installed application
+// of the given type can be read on the file system. The applications with a
+// fresh pending operation are ignored, as their files may not have been
+// written yet.
+func CheckHealth(db couchdb.Database, fs afero.Fs, appType AppType) (*HealthReport, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	manFilename := WebappManifestName
+	if appType == Konnector {
+		manFilename = KonnectorManifestName
+	}
+
+	report := &HealthReport{Healthy: true, Apps: []*AppHealth{}}
+	for _, man := range mans {
+		if man.Operation().Fresh() {
+			continue
+		}
+		h := &AppHealth{Slug: man.Slug(), State: man.State(), Healthy: true}
+		if err := checkManifestFile(fs, path.Join(FilesDir(man), manFilename)); err != nil {
+			h.Healthy = false
+			h.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Apps = append(report.Apps, h)
+	}
+	return report, nil
+}
+
+func checkManifestFile(fs afero.Fs, name string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Reading a byte is enough to know that the content is accessible
+	var b [1]byte
+	if _, err = f.Read(b[:]); err == io.EOF {
+		return ErrBadManifest
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// HookPhase tells if a hook is called before or after an operation.
+type HookPhase string
+
+const (
+	// BeforeHook is the phase of the hooks called before an operation. If
+	// such a hook returns an error, the operation is aborted.
+	BeforeHook HookPhase = "before"
+	// AfterHook is the phase of the hooks called after an operation, even if
+	// it has failed. The errors of these hooks are only logged.
+	AfterHook HookPhase = "after"
+)
+
+// HookTimeout is the maximal duration of the execution of a hook
+var HookTimeout = 30 * time.Second
+
+// HookEvent describes the operation for which a hook is called.
+type HookEvent struct {
+	DB        couchdb.Database
+	Domain    string
+	Slug      string
+	Type      AppType
+	Operation Operation
+	Phase     HookPhase
+	// Err is the error of the operation, for the after hooks
+	Err error
+}
+
+// Hook is a function called before and after the operations on the
+// applications. The context has a deadline of HookTimeout.
+type Hook func(ctx context.Context, event *HookEvent) error
+
+// registeredHook wraps a hook, as the functions can't be compared to find
+// the one to unregister
+type registeredHook struct {
+	hook Hook
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   []*registeredHook
+)
+
+// RegisterHook adds a hook that will be called before and after each install,
+// update and deletion of an application. It returns a function to unregister
+// the hook, that can be called several times.
+func RegisterHook(hook Hook) func() {
+	r := &registeredHook{hook: hook}
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, r)
+	return func() {
+		hooksMu.Lock()
+		defer hooksMu.Unlock()
+		for i, h := range hooks {
+			if h == r {
+				hooks = append(hooks[:i], hooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// HookError is used when an operation has been aborted by a before hook.
+type HookError struct {
+	Operation Operation
+	Err       error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("The %s of the application has been aborted by a hook: %s",
+		e.Operation, e.Err)
+}
+
+// String returns the name of the operation, as used for the hooks
+func (o Operation) String() string {
+	switch o {
+	case Install:
+		return "install"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// String returns the name of the application type
+func (t AppType) String() string {
+	switch t {
+	case Webapp:
+		return "webapp"
+	case Konnector:
+		return "konnector"
+	}
+	return "unknown"
+}
+
+// runHooks calls the registered hooks, and then the executable of the hooks
+// directory for this phase and operation, if any. It stops at the first
+// error for the before hooks.
+func (i *Installer) runHooks(phase HookPhase, op Operation, opErr error) error {
+	event := &HookEvent{
+		DB:        i.db,
+		Domain:    strings.TrimSuffix(i.db.Prefix(), "/"),
+		Slug:      i.slug,
+		Type:      i.typ,
+		Operation: op,
+		Phase:     phase,
+		Err:       opErr,
+	}
+
+	hooksMu.RLock()
+	list := make([]Hook, len(hooks), len(hooks)+1)
+	for i, h := range hooks {
+		list[i] = h.hook
+	}
+	hooksMu.RUnlock()
+	if dir := config.GetConfig().Apps.HooksDir; dir != "" {
+		list = append(list, execHook(dir))
+	}
+
+	for _, hook := range list {
+		err := callHook(hook, event)
+		if err == nil {
+			continue
+		}
+		if phase == BeforeHook {
+			return &HookError{Operation: op, Err: err}
+		}
+		log.Errorf("[apps] %s-%s hook failed for %s: %s", phase, op, i.slug, err)
+	}
+	return nil
+}
+
+// callHook calls the hook with a deadline, and doesn't wait for it after
+// this deadline, even if the hook ignores its context.
+func callHook(hook Hook, event *HookEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- hook(ctx, event) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// execHook returns a hook that runs the executable named like
+// before-install or after-update in the given directory. The event is given
+// to the executable via environment variables.
+func execHook(dir string) Hook {
+	return func(ctx context.Context, event *HookEvent) error {
+		name := path.Join(dir, string(event.Phase)+"-"+event.Operation.String())
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return nil
+		}
+		cmd := exec.CommandContext(ctx, name) // #nosec
+		cmd.Env = []string{
+			"COZY_DOMAIN=" + event.Domain,
+			"COZY_APP_SLUG=" + event.Slug,
+			"COZY_APP_TYPE=" + event.Type.String(),
+			"COZY_OPERATION=" + event.Operation.String(),
+			"COZY_PHASE=" + string(event.Phase),
+		}
+		if event.Err != nil {
+			cmd.Env = append(cmd.Env, "COZY_ERROR="+event.Err.Error())
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return context.DeadlineExceeded
+			}
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				return fmt.Errorf("%s: %s", err, msg)
+			}
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,216 @@
+package apps
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	gitClient "gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	gitHTTP "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// The timeouts of the requests made to fetch the applications: a manifest is
+// small, but an archive can take some time to download.
+const (
+	manifestTimeout = 60 * time.Second
+	tarballTimeout  = 5 * time.Minute
+)
+
+// maxIdleConnsPerHost is the number of idle connections kept for a host, as
+// the applications are often installed from the same few registries.
+const maxIdleConnsPerHost = 8
+
+var (
+	transportMu     sync.Mutex
+	sharedTr        *http.Transport
+	sharedTrOptions string          // the proxy and CA bundle of sharedTr
+	gitTr           *http.Transport // the transport installed for go-git
+)
+
+// httpClient returns a client for the requests of the installers, with the
+// given timeout. All the clients share the same transport, to reuse the
+// connections, and it is configured with the proxy and the CA bundle of the
+// configuration.
+func httpClient(timeout time.Duration) (*http.Client, error) {
+	t, err := sharedTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t, Timeout: timeout}, nil
+}
+
+// sharedTransport returns the transport of the installers. It is created
+// again when the proxy or the CA bundle of the configuration has changed.
+func sharedTransport() (*http.Transport, error) {
+	cfg := config.GetConfig().Apps
+	key := cfg.HTTPProxy + "\x00" + cfg.CABundle
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if sharedTr != nil && sharedTrOptions == key {
+		return sharedTr, nil
+	}
+	t, err := newTransport(cfg.HTTPProxy, cfg.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	if sharedTr != nil {
+		sharedTr.CloseIdleConnections()
+	}
+	sharedTr, sharedTrOptions = t, key
+	return t, nil
+}
+
+// installGitTransport makes go-git use the transport of the installers for
+// the git sources over http(s), like the clones and the pulls, so that they
+// go through the proxy and trust the CA bundle of the configuration too. The
+// protocols of go-git are global, so they are installed again only when the
+// transport has changed.
+func installGitTransport() error {
+	t, err := sharedTransport()
+	if err != nil {
+		return err
+	}
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if gitTr == t {
+		return nil
+	}
+	c := gitHTTP.NewClient(&http.Client{Transport: t, Timeout: tarballTimeout})
+	gitClient.InstallProtocol("http", c)
+	gitClient.InstallProtocol("https", c)
+	gitTr = t
+	return nil
+}
+
+func newTransport(proxy, caBundle string) (*http.Transport, error) {
+	d := &sourceDialer{
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		proxies: make(map[string]bool),
+	}
+	t := &http.Transport{
+		Proxy:                 d.proxy(http.ProxyFromEnvironment),
+		DialContext:           d.DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URL for the apps proxy %s: %s", proxy, err)
+		}
+		t.Proxy = d.proxy(http.ProxyURL(u))
+	}
+	if caBundle != "" {
+		pool, err := loadCABundle(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t, nil
+}
+
+// sourceDialer opens the connections of the transport of the installers. It
+// refuses the private and the loopback addresses, like checkSourceURL, but on
+// the address really connected to: a hostname can't be resolved to a public
+// address for the check of the source and to a private one for the request.
+// The proxies are not checked, as they are chosen by the administrator.
+type sourceDialer struct {
+	dialer  *net.Dialer
+	mu      sync.Mutex
+	proxies map[string]bool // the addresses of the proxies used by the transport
+}
+
+// proxy wraps the proxy function of the transport to know the addresses of
+// the proxies that will be dialed.
+func (d *sourceDialer) proxy(fn func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fn(req)
+		if u != nil && err == nil {
+			d.mu.Lock()
+			d.proxies[proxyAddr(u)] = true
+			d.mu.Unlock()
+		}
+		return u, err
+	}
+}
+
+// DialContext connects to the address, and checks the IP of the connection
+// with the policy of the sources. It returns ErrSourceNotAllowed if the IP
+// is not allowed.
+func (d *sourceDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	allowed := config.GetConfig().Apps.AllowPrivateSources
+	d.mu.Lock()
+	isProxy := d.proxies[addr]
+	d.mu.Unlock()
+	if allowed || isProxy {
+		return conn, nil
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || utils.CheckIP(tcpAddr.IP, utils.URLPolicy{}) != nil {
+		conn.Close()
+		return nil, ErrSourceNotAllowed
+	}
+	return conn, nil
+}
+
+// proxyAddr returns the address dialed by the transport for a proxy, with the
+// default port of its scheme if it has none.
+func proxyAddr(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(u.Host, "["), "]")
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isSourceNotAllowed returns true if the error of a request is a refused
+// connection to a private or loopback address, or a refused redirection.
+func isSourceNotAllowed(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	return err == ErrSourceNotAllowed
+}
+
+// loadCABundle returns the certificates of the system with the ones of the
+// given PEM file.
+func loadCABundle(filename string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the CA bundle %s: %s", filename, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificate found in the CA bundle %s", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,151 @@
+package apps
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func withAppsHTTPConfig(proxy, caBundle string) func() {
+	cfg := config.GetConfig()
+	oldProxy, oldCA := cfg.Apps.HTTPProxy, cfg.Apps.CABundle
+	cfg.Apps.HTTPProxy, cfg.Apps.CABundle = proxy, caBundle
+	return func() {
+		cfg.Apps.HTTPProxy, cfg.Apps.CABundle = oldProxy, oldCA
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "proxied"}`})
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxy receives the absolute URL of the request
+		proxied = append(proxied, r.URL.String())
+		w.Write(archive)
+	}))
+	defer proxy.Close()
+	defer withAppsHTTPConfig(proxy.URL, "")()
+
+	src, _ := url.Parse("http://registry.cozy.example/proxied.tar.gz")
+	r, err := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+	assert.Equal(t, []string{"http://registry.cozy.example/proxied.tar.gz"}, proxied)
+
+	// The clients share the same transport
+	c1, err := httpClient(manifestTimeout)
+	assert.NoError(t, err)
+	c2, err := httpClient(tarballTimeout)
+	assert.NoError(t, err)
+	assert.True(t, c1.Transport == c2.Transport)
+	assert.Equal(t, maxIdleConnsPerHost, c1.Transport.(*http.Transport).MaxIdleConnsPerHost)
+}
+
+func TestGitTransportProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+	defer withAppsHTTPConfig(proxy.URL, "")()
+
+	// The git sources over http go through the proxy too
+	src, _ := url.Parse("http://git.cozy.example/app.git")
+	_, err := newGitFetcher(afero.NewMemMapFs(), manifestName, nil).resolveCommit(src)
+	assert.Error(t, err)
+	if assert.NotEmpty(t, proxied) {
+		assert.Contains(t, proxied[0], "http://git.cozy.example/app.git/info/refs")
+	}
+}
+
+func TestHTTPClientCABundle(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "on-premise"}`})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer srv.Close()
+	src, _ := url.Parse(srv.URL + "/app.tar.gz")
+
+	// The certificate of the test server is not trusted by default
+	defer withAppsHTTPConfig("", "")()
+	_, err := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrSourceNotReachable, err)
+
+	bundle, err := ioutil.TempFile("", "cozy-ca-bundle")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(bundle.Name())
+	cert := srv.TLS.Certificates[0].Certificate[0]
+	assert.NoError(t, pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	bundle.Close()
+
+	config.GetConfig().Apps.CABundle = bundle.Name()
+	r, err := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+
+	// A bundle without certificates is an error
+	empty, err := ioutil.TempFile("", "cozy-ca-bundle")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(empty.Name())
+	empty.Close()
+	config.GetConfig().Apps.CABundle = empty.Name()
+	_, err = httpClient(manifestTimeout)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "No certificate found")
+	}
+}
+
+func TestSourceDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	defer withAppsHTTPConfig("", "")()
+	cfg := config.GetConfig()
+	defer func(allowed bool) { cfg.Apps.AllowPrivateSources = allowed }(cfg.Apps.AllowPrivateSources)
+	cfg.Apps.AllowPrivateSources = false
+
+	// The address connected to is checked, even if the URL was not (the test
+	// server listens on a loopback address)
+	client, err := httpClient(manifestTimeout)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.Get(srv.URL + "/manifest")
+	assert.True(t, isSourceNotAllowed(err), "%v", err)
+	u, _ := url.Parse("git://127.0.0.1/app.git")
+	assert.Equal(t, ErrSourceNotAllowed, newGitFetcher(afero.NewMemMapFs(), manifestName, nil).Fetch(u, "/app"))
+
+	// But a proxy can be on a private address
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+	cfg.Apps.HTTPProxy = proxy.URL
+	if client, err = httpClient(manifestTimeout); !assert.NoError(t, err) {
+		return
+	}
+	res, err := client.Get("http://registry.cozy.example/manifest")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	assert.Equal(t, []string{"http://registry.cozy.example/manifest"}, proxied)
+}
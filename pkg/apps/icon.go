@@ -0,0 +1,123 @@
+package apps
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	// The formats accepted for the icons
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/spf13/afero"
+)
+
+// IconMaxSize is the maximal width and height in pixels of the icon of an
+// application
+const IconMaxSize = 1024
+
+// ManifestInvalidIcon is the code for an icon of the manifest that is not a
+// valid image
+const ManifestInvalidIcon = "invalid_icon"
+
+var (
+	errIconMissing    = errors.New("the file is missing")
+	errIconOutside    = errors.New("the file is outside of the directory of the application")
+	errIconNotAnImage = errors.New("the file is not a PNG, JPEG, GIF or SVG image")
+)
+
+// warner is implemented by the manifests that can carry warnings
+type warner interface {
+	addWarning(warning string)
+}
+
+// iconOf returns the path of the icon declared by the manifest
+func iconOf(man Manifest) string {
+	switch m := man.(type) {
+	case *WebappManifest:
+		return m.Icon
+	case *konnManifest:
+		return m.Icon
+	}
+	return ""
+}
+
+// checkIcon verifies that the icon declared by the manifest is an image that
+// clients can display. With the apps.strict_icons configuration, an invalid
+// icon is an error on the /icon field of the manifest, else it is a warning.
+func checkIcon(fs afero.Fs, dir string, man Manifest) error {
+	icon := iconOf(man)
+	if icon == "" {
+		return nil
+	}
+	err := checkIconFile(fs, dir, icon)
+	if err == nil {
+		return nil
+	}
+	reason := icon + ": " + err.Error()
+	if !config.GetConfig().Apps.StrictIcons {
+		if w, ok := man.(warner); ok {
+			w.addWarning("/icon: " + reason)
+		}
+		return nil
+	}
+	return ManifestErrors{}.add("/icon", ManifestInvalidIcon, reason)
+}
+
+func checkIconFile(fs afero.Fs, dir, icon string) error {
+	name := path.Join(dir, icon)
+	if !strings.HasPrefix(name, dir+"/") {
+		return errIconOutside
+	}
+	f, err := fs.Open(name)
+	if os.IsNotExist(err) {
+		return errIconMissing
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err == nil {
+		if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > IconMaxSize || cfg.Height > IconMaxSize {
+			return fmt.Errorf("the image is %dx%d pixels, the maximum is %dx%d",
+				cfg.Width, cfg.Height, IconMaxSize, IconMaxSize)
+		}
+		return nil
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !isSVG(bufio.NewReader(f)) {
+		return errIconNotAnImage
+	}
+	return nil
+}
+
+// isSVG returns true if the first element of the XML document is an svg one
+func isSVG(r io.Reader) bool {
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t.Name.Local == "svg"
+		case xml.CharData:
+			if len(strings.TrimSpace(string(t))) > 0 {
+				return false
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package apps
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func pngIcon(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if !assert.NoError(t, png.Encode(&buf, img)) {
+		t.FailNow()
+	}
+	return buf.Bytes()
+}
+
+func TestCheckIconFile(t *testing.T) {
+	ifs := afero.NewMemMapFs()
+	files := map[string][]byte{
+		"/mini/icon.png":   pngIcon(t, 64, 64),
+		"/mini/huge.png":   pngIcon(t, 2048, 16),
+		"/mini/error.png":  []byte("<!DOCTYPE html><html><body>502 Bad Gateway</body></html>"),
+		"/mini/icon.svg":   []byte(`<?xml version="1.0"?>` + "\n" + `<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+		"/mini/broken.svg": []byte("not an image"),
+		"/other/icon.png":  pngIcon(t, 64, 64),
+	}
+	for name, content := range files {
+		assert.NoError(t, afero.WriteFile(ifs, name, content, 0644))
+	}
+
+	assert.NoError(t, checkIconFile(ifs, "/mini", "icon.png"))
+	assert.NoError(t, checkIconFile(ifs, "/mini", "/icon.svg"))
+	err := checkIconFile(ifs, "/mini", "huge.png")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2048x16")
+	}
+	assert.Equal(t, errIconNotAnImage, checkIconFile(ifs, "/mini", "error.png"))
+	assert.Equal(t, errIconNotAnImage, checkIconFile(ifs, "/mini", "broken.svg"))
+	assert.Equal(t, errIconMissing, checkIconFile(ifs, "/mini", "missing.png"))
+	assert.Equal(t, errIconOutside, checkIconFile(ifs, "/mini", "../other/icon.png"))
+}
+
+func TestCheckIcon(t *testing.T) {
+	ifs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(ifs, "/mini/icon.png", []byte("<html></html>"), 0644))
+	cfg := config.GetConfig()
+	was := cfg.Apps.StrictIcons
+	defer func() { cfg.Apps.StrictIcons = was }()
+
+	cfg.Apps.StrictIcons = true
+	man := &WebappManifest{DocSlug: "mini", Icon: "icon.png"}
+	err := checkIcon(ifs, "/mini", man)
+	errs, ok := err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "/icon", errs[0].Field)
+		assert.Equal(t, ManifestInvalidIcon, errs[0].Code)
+		assert.Contains(t, errs[0].Reason, "icon.png")
+	}
+	assert.NoError(t, checkIcon(ifs, "/mini", &WebappManifest{DocSlug: "mini"}))
+
+	cfg.Apps.StrictIcons = false
+	konn := &konnManifest{DocSlug: "mini", Icon: "icon.png"}
+	assert.NoError(t, checkIcon(ifs, "/mini", konn))
+	if assert.Len(t, konn.Warnings(), 1) {
+		assert.Contains(t, konn.Warnings()[0], "/icon: icon.png")
+	}
+}
@@ -1,18 +1,43 @@
 package apps
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path"
 	"regexp"
+	"sync"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/spf13/afero"
 )
 
-var slugReg = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+// ValidSlug returns true if the given slug is a valid name for a new
+// application (see utils.ValidateSlug for the rules).
+func ValidSlug(slug string) bool {
+	return utils.ValidateSlug(slug) == nil
+}
+
+// legacySlugReg is the rule of the slugs before utils.ValidateSlug
+var legacySlugReg = regexp.MustCompile(`^[a-z0-9\-]+$`)
+
+// ValidInstalledSlug returns true if the given slug can be the one of an
+// installed application. The applications installed before the rules of
+// ValidSlug can have a slug that is too short, too long, reserved or with
+// hyphens at its ends, and they can still be read, updated and deleted.
+func ValidInstalledSlug(slug string) bool {
+	return ValidSlug(slug) || legacySlugReg.MatchString(slug)
+}
 
 // Operation is the type of operation the installer is created for.
 type Operation int
@@ -29,16 +54,55 @@ const (
 // Installer is used to install or update applications.
 type Installer struct {
 	fetcher Fetcher
+	cache   *SourceCache
 	fs      afero.Fs
 	db      couchdb.Database
 
-	man  Manifest
-	src  *url.URL
-	slug string
+	man   Manifest
+	src   *url.URL
+	slug  string
+	typ   AppType
+	op    Operation
+	opID  string // the id of the pending operation, for this attempt
+	stale bool   // a stale operation was pending on the application
+
+	ifMatch string          // the revision expected by the operation, if any
+	claim   *namespaceClaim // the namespace claimed by an install, to undo if it fails
+
+	dir     string // where the files are written, the staging directory for an update
+	prevDir string // the directory of the installed version, for an update
+	staged  bool   // the staging directory of the update has been prepared
+
+	startedAt time.Time // when Install, Update or Uninstall has been called
+
+	successor *Successor        // declared by the manifest fetched for an update
+	changes   []*ManifestChange // between the installed and the new manifest
+
+	dependencies []string          // the konnectors of the webapp before an update
+	dependents   []*WebappManifest // the webapps that use the deleted konnector
+	warmUpReport *WarmUpReport     // nil if there was no warm-up
+
+	sync       *syncFs           // the filesystem given to the fetcher
+	syncReport *SyncReport       // nil if the files have not been fetched
+	checksums  map[string]string // of the files fetched, saved at the end
+
+	manFilename    string
+	offlineOk      bool
+	termsAccepted  string
+	installContext map[string]interface{}
+	force          bool
+	iamSure        string
+	skipWarmUp     bool
+	subject        *Subject
+	strict         bool
 
 	err  error
 	errc chan error
 	manc chan Manifest
+
+	progress *progressReporter
+	polled   Manifest  // the last manifest returned by PollProgress or PollThrottled
+	sentAt   time.Time // when PollThrottled has returned for the last time
 }
 
 // InstallerOptions provides the slug name of the application along with the
@@ -48,6 +112,45 @@ type InstallerOptions struct {
 	Operation Operation
 	Slug      string
 	SourceURL string
+	// OfflineOk allows to install the newest cached version of the source if
+	// it is not reachable
+	OfflineOk bool
+	// TermsAccepted is the version of the terms of the konnector that the user
+	// has accepted
+	TermsAccepted string
+	// InstallContext is given to the application, and validated against the
+	// context schema of its manifest. For an update, the stored context is
+	// kept if it is nil.
+	InstallContext map[string]interface{}
+	// Force allows to delete a konnector used by some webapps, that are then
+	// flagged with missing_dependency
+	Force bool
+	// IamSure confirms the deletion of a protected application: it must be
+	// its slug (see IsProtected)
+	IamSure string
+	// SkipWarmUp disables the warm-up of the application once it has been
+	// installed or updated (see RegisterWarmUp)
+	SkipWarmUp bool
+	// Subject is the author of the operation, recorded in the installed_by
+	// and updated_by fields of the application when it succeeds
+	Subject *Subject
+	// SubDirectory is the directory of a git source used as the root of the
+	// application, for the monorepos. It is added to the fragment of the
+	// source, like git://example.org/mono.git#branch:/apps/drive
+	SubDirectory string
+	// Strict makes the operation fail if the manifest has some unknown
+	// fields, like with the apps.strict_manifests configuration. Else, they
+	// are just warnings.
+	Strict bool
+	// TakeOver allows to install an application whose namespace is owned by
+	// another application, that is then flagged with namespace_lost (see
+	// claimNamespace)
+	TakeOver bool
+	// IfMatch is the revision of the document of the application expected by
+	// an update or a deletion. It is used for the write that starts the
+	// operation, so that it fails if the document has changed. It can be
+	// empty or "*" for any revision.
+	IfMatch string
 }
 
 // Fetcher interface should be implemented by the underlying transport
@@ -68,7 +171,7 @@ func NewInstaller(db couchdb.Database, fs afero.Fs, opts *InstallerOptions) (*In
 	}
 
 	slug := opts.Slug
-	if slug == "" || !slugReg.MatchString(slug) {
+	if opts.Operation == Install && !ValidSlug(slug) || !ValidInstalledSlug(slug) {
 		return nil, ErrInvalidSlugName
 	}
 
@@ -78,6 +181,11 @@ func NewInstaller(db couchdb.Database, fs afero.Fs, opts *InstallerOptions) (*In
 		manFilename = WebappManifestName
 	case Konnector:
 		manFilename = KonnectorManifestName
+		// The konnectors installed before they were disabled can still be
+		// deleted
+		if opts.Operation != Delete && !KonnectorsEnabled(db) {
+			return nil, ErrKonnectorsDisabled
+		}
 	default:
 		return nil, fmt.Errorf("unknown installer type %s", string(opts.Type))
 	}
@@ -102,6 +210,30 @@ func NewInstaller(db couchdb.Database, fs afero.Fs, opts *InstallerOptions) (*In
 	} else if err != nil {
 		return nil, err
 	}
+	ifMatch := opts.IfMatch
+	if ifMatch == "*" {
+		ifMatch = ""
+	}
+	if ifMatch != "" && man.Rev() != ifMatch {
+		return nil, &RevisionMismatchError{Expected: ifMatch, Current: man.Rev()}
+	}
+
+	stale := false
+	if opts.Operation != Install {
+		if op := man.Operation(); op.Fresh() {
+			return nil, &OperationInProgressError{op}
+		} else if op != nil {
+			stale = true
+		}
+	}
+	opID := utils.RandomString(16)
+
+	// The instance is used to build the JSON-API links of the webapps
+	if wm, ok := man.(*WebappManifest); ok {
+		if sd, ok := db.(SubDomainer); ok {
+			wm.Instance = sd
+		}
+	}
 
 	var src *url.URL
 	switch opts.Operation {
@@ -110,87 +242,442 @@ func NewInstaller(db couchdb.Database, fs afero.Fs, opts *InstallerOptions) (*In
 			return nil, ErrMissingSource
 		}
 		src, err = url.Parse(opts.SourceURL)
+		if err == nil && opts.SubDirectory != "" {
+			err = withSubDirectory(src, opts.SubDirectory)
+		}
 	case Update, Delete:
 		src, err = url.Parse(man.Source())
 	}
 	if err != nil {
 		return nil, err
 	}
+	if src.Scheme == "git" {
+		if _, err = gitSubDirectory(src); err != nil {
+			return nil, err
+		}
+	}
 
-	var fetcher Fetcher
-	switch src.Scheme {
-	case "git":
-		fetcher = newGitFetcher(fs, manFilename)
-	default:
-		return nil, ErrNotSupportedSource
+	// An update writes the files in a staging directory, and the installed
+	// version is served until the end of the update (see FilesDir)
+	dir, prevDir := path.Join("/", slug), ""
+	switch opts.Operation {
+	case Update:
+		dir, prevDir = stagingDir(slug, opID), FilesDir(man)
+	case Delete:
+		dir = FilesDir(man)
+	}
+
+	cache := sharedSourceCache()
+	progress := newProgressReporter()
+	sync := newSyncFs(fs, dir)
+	fetcher, err := newFetcher(src, sync, cache, manFilename, progress)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := fetcher.(*releaseFetcher); ok {
+		f.channel = defaultChannel(db)
+	}
+
+	// The operation is started once the installer can't fail to be built,
+	// so that an error doesn't leave the application locked
+	var claim *namespaceClaim
+	if opts.Operation == Install {
+		if claim, err = claimNamespace(db, slug, opts.Type, opts.TakeOver); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Operation == Update {
+		if err = startOperation(db, man, "updating", opID, ifMatch); err != nil {
+			return nil, err
+		}
 	}
 
 	return &Installer{
 		fetcher: fetcher,
+		cache:   cache,
 		db:      db,
 		fs:      fs,
 
-		man:  man,
-		src:  src,
-		slug: slug,
+		man:   man,
+		src:   src,
+		slug:  slug,
+		typ:   opts.Type,
+		op:    opts.Operation,
+		opID:  opID,
+		stale: stale,
+
+		ifMatch: ifMatch,
+		claim:   claim,
+
+		dir:     dir,
+		prevDir: prevDir,
+
+		manFilename:    manFilename,
+		offlineOk:      opts.OfflineOk || config.GetConfig().Apps.OfflineOk,
+		termsAccepted:  opts.TermsAccepted,
+		installContext: opts.InstallContext,
+		force:          opts.Force,
+		iamSure:        opts.IamSure,
+		skipWarmUp:     opts.SkipWarmUp,
+		subject:        opts.Subject,
+		strict:         opts.Strict || config.GetConfig().Apps.StrictManifests,
 
 		errc: make(chan error, 1),
 		manc: make(chan Manifest, 2),
+
+		progress: progress,
+		sync:     sync,
 	}, nil
 }
 
+// newFetcher returns the fetcher for the scheme of the source. The schemes
+// are listed in sourceSchemes for the capabilities.
+func newFetcher(src *url.URL, fs afero.Fs, cache *SourceCache, manFilename string, progress *progressReporter) (Fetcher, error) {
+	switch src.Scheme {
+	case "git":
+		return newGitFetcher(fs, manFilename, progress), nil
+	case "http", "https":
+		return newTarballFetcher(fs, cache, manFilename, progress), nil
+	case "github", "gitlab":
+		return newReleaseFetcher(fs, cache, manFilename, progress), nil
+	}
+	return nil, ErrNotSupportedSource
+}
+
+// closeFetcher removes the files kept by a fetcher for an operation, like the
+// downloaded archive of a tarball source
+func closeFetcher(f Fetcher) {
+	if c, ok := f.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warnf("[apps] Can't remove the files of the fetcher: %s", err)
+		}
+	}
+}
+
+// background tracks the installations and updates running in goroutines,
+// so that the shutdown of the stack can wait for them instead of interrupting
+// them in the middle of the copy of the files.
+var background sync.WaitGroup
+
+// RunInBackground runs an operation of an installer, like inst.Install or
+// inst.Update, in a goroutine tracked for WaitInstallers.
+func RunInBackground(op func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		op()
+	}()
+}
+
+// WaitInstallers waits for the operations started by RunInBackground to
+// finish, or returns the error of the context if it is done before.
+func WaitInstallers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Install will install the application linked to the installer. It will
 // report its progress or error (see Poll method).
 func (i *Installer) Install() {
-	defer i.endOfProc()
+	i.startedAt = time.Now()
+	defer holdOperation(i.db, i.typ, i.slug)()
+	defer trackOperation(i.opID, i.progress)()
+	defer closeFetcher(i.fetcher)
+	if err := i.runHooks(BeforeHook, Install, nil); err != nil {
+		i.man, i.err = nil, err
+		i.endOfProc()
+		return
+	}
 	i.man, i.err = i.install()
-	return
+	i.endOfProc()
+	i.runHooks(AfterHook, Install, i.err)
 }
 
 // Update will update the application linked to the installer. It will
 // report its progress or error (see Poll method).
 func (i *Installer) Update() {
-	defer i.endOfProc()
-	if state := i.man.State(); state != Ready && state != Errored {
-		i.man, i.err = nil, ErrBadState
-	} else {
-		i.man, i.err = i.update()
+	i.startedAt = time.Now()
+	defer holdOperation(i.db, i.typ, i.slug)()
+	defer trackOperation(i.opID, i.progress)()
+	defer closeFetcher(i.fetcher)
+	if state := i.man.State(); state != Ready && state != Errored && !i.stale {
+		i.abort(ErrBadState)
+		return
 	}
-	return
+	if err := i.runHooks(BeforeHook, Update, nil); err != nil {
+		i.abort(err)
+		return
+	}
+	i.man, i.err = i.update()
+	i.endOfProc()
+	i.runHooks(AfterHook, Update, i.err)
+}
+
+// abort stops an update before it has modified the application: the pending
+// operation is removed from its document, and the error is reported.
+func (i *Installer) abort(err error) {
+	i.man.SetOperation(nil)
+	couchdb.UpdateDoc(i.db, i.man)
+	i.man, i.err = nil, err
+	i.endOfProc()
 }
 
 // Delete will remove the application linked to the installer.
 func (i *Installer) Delete() (Manifest, error) {
-	if state := i.man.State(); state != Ready && state != Errored {
-		return nil, ErrBadState
-	}
-	if err := deleteManifest(i.db, i.man); err != nil {
+	defer holdOperation(i.db, i.typ, i.slug)()
+	if err := i.startDelete(); err != nil {
 		return nil, err
 	}
-	if err := i.fs.RemoveAll(i.baseDirName()); err != nil {
+	err := i.delete()
+	i.runHooks(AfterHook, Delete, err)
+	if err != nil {
 		return nil, err
 	}
 	return i.man, nil
 }
 
+// Uninstall is like Delete, but it reports its progress or error with Poll,
+// like Install and Update, for the deletions that take a long time: the
+// application is first returned in the deleting state, and then once it has
+// been deleted.
+func (i *Installer) Uninstall() {
+	i.startedAt = time.Now()
+	defer holdOperation(i.db, i.typ, i.slug)()
+	defer trackOperation(i.opID, i.progress)()
+	if err := i.startDelete(); err != nil {
+		i.errc <- err
+		return
+	}
+	// The poller gets a copy, as the manifest is changed by the deletion
+	snapshot, err := cloneManifest(i.man)
+	if err != nil {
+		snapshot = i.man
+	}
+	i.manc <- snapshot
+	err = i.delete()
+	i.runHooks(AfterHook, Delete, err)
+	if err != nil {
+		i.errc <- err
+		return
+	}
+	i.manc <- i.man
+}
+
+// startDelete checks that the application can be deleted, and puts it in the
+// deleting state, with a pending operation: it is no longer served, and
+// another operation can't start on it.
+func (i *Installer) startDelete() error {
+	if state := i.man.State(); state != Ready && state != Errored && state != Replaced &&
+		state != Inactive && state != Trashed && state != ErroredDeleting && !i.stale {
+		return ErrBadState
+	}
+	if IsProtected(i.man) && i.iamSure != i.slug {
+		return ErrProtected
+	}
+	if err := i.checkDependents(); err != nil {
+		return err
+	}
+	if err := i.runHooks(BeforeHook, Delete, nil); err != nil {
+		return err
+	}
+	// The operation interrupted on an application can have left it in any
+	// state, like installing
+	if from := i.man.State(); i.stale && !CanTransition(from, Deleting) {
+		i.man.setState(Deleting, &StateTransition{From: from, At: time.Now().UTC()})
+	} else if err := Transition(i.man, Deleting); err != nil {
+		return err
+	}
+	return startOperation(i.db, i.man, "deleting", i.opID, i.ifMatch)
+}
+
+// checkDependents refuses the deletion of a konnector used by some installed
+// webapps, unless it is forced.
+func (i *Installer) checkDependents() error {
+	if i.typ != Konnector {
+		return nil
+	}
+	dependents, err := installedDependents(i.db, i.slug)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 && !i.force {
+		slugs := make([]string, len(dependents))
+		for j, webapp := range dependents {
+			slugs[j] = webapp.DocSlug
+		}
+		return &DependentsError{Slugs: slugs}
+	}
+	i.dependents = dependents
+	return nil
+}
+
+// delete removes the files of the application, and then its document. If
+// it fails in the middle, the application is put in the errored-deleting
+// state, and the deletion can be tried again. The checksums are removed first, so that
+// an update of the errored application writes all its files again.
+func (i *Installer) delete() error {
+	err := deleteChecksums(i.db, i.typ, i.slug)
+	if err == nil {
+		err = removeAppDirs(i.fs, i.slug)
+	}
+	if err == nil {
+		err = i.deleteRelated()
+	}
+	if err == nil {
+		err = deleteManifest(i.db, i.man)
+	}
+	i.man.SetOperation(nil)
+	if err != nil {
+		Transition(i.man, ErroredDeleting)
+		i.man.SetError(err)
+		if errs := saveManifestDoc(i.db, i.man, i.opID); errs != nil {
+			log.Errorf("[apps] Can't save the document of %s: %s", i.slug, errs)
+		}
+	}
+	return err
+}
+
+// deleteRelated removes the links between the deleted application and the
+// other ones, its namespace, and the logs of a konnector.
+func (i *Installer) deleteRelated() error {
+	if err := releaseNamespace(i.db, i.slug, i.typ); err != nil {
+		return err
+	}
+	switch m := i.man.(type) {
+	case *WebappManifest:
+		return registerDependencies(i.db, m.DocSlug, m.Konnectors, nil)
+	case *konnManifest:
+		if err := flagMissingDependency(i.db, i.dependents); err != nil {
+			return err
+		}
+		return deleteKonnectorLogs(i.db, m.DocSlug)
+	}
+	return nil
+}
+
 func (i *Installer) endOfProc() {
 	man, err := i.man, i.err
-	if man == nil || err == ErrBadState {
+	if man == nil {
+		i.undoClaim(nil)
 		i.errc <- err
 		return
 	}
+	man.SetOperation(nil)
+	if err == nil {
+		err = Transition(man, Ready)
+	}
+	man.SetLastOperation(i.metrics(err == nil))
 	if err != nil {
-		man.SetState(Errored)
+		Transition(man, Errored)
 		man.SetError(err)
-		updateManifest(i.db, man)
+		i.undoClaim(man)
+		if errs := updateManifest(i.db, man, i.opID); errs != nil {
+			log.Errorf("[apps] Can't save the document of %s: %s", man.Slug(), errs)
+		}
+		i.removeStaged()
+		i.errc <- err
+		return
+	}
+	man.SetUpdatedAt(time.Now())
+	i.recordSubject(man)
+	if i.op == Update {
+		if err = refreshNamespace(i.db, man); err != nil {
+			log.Warnf("[apps] Can't claim the namespace of %s: %s", man.Slug(), err)
+		}
+	}
+	// The staged files become the files of the application with the same
+	// write as the new version
+	filesDir := man.filesDir()
+	if i.staged {
+		man.setFilesDir(i.dir)
+	}
+	if err = updateManifest(i.db, man, i.opID); err != nil {
+		log.Errorf("[apps] Can't save the document of %s: %s", man.Slug(), err)
+		man.setFilesDir(filesDir)
+		i.undoClaim(nil)
+		i.abortOperation(err)
+		i.removeStaged()
 		i.errc <- err
 		return
 	}
-	man.SetState(Ready)
-	updateManifest(i.db, man)
+	if i.staged {
+		releaseFilesDir(i.db, i.fs, i.typ, i.slug, i.prevDir)
+	}
+	if err = i.updateDependencies(man); err != nil {
+		log.Warnf("[apps] Can't update the dependencies of %s: %s", man.Slug(), err)
+	}
+	if i.checksums != nil {
+		if err = saveChecksums(i.db, i.typ, i.slug, i.checksums); err != nil {
+			log.Warnf("[apps] Can't save the checksums of %s: %s", man.Slug(), err)
+		}
+	}
+	i.warmUp(man)
 	i.manc <- i.man
 }
 
+// undoClaim gives the namespace claimed by a failed install back to its
+// previous owner. The document of the failed application, if any, is then
+// flagged with namespace_lost.
+func (i *Installer) undoClaim(man Manifest) {
+	if i.claim == nil {
+		return
+	}
+	if err := i.claim.undo(i.db); err != nil {
+		log.Warnf("[apps] Can't give the namespace of %s back: %s", i.slug, err)
+		return
+	}
+	if man != nil && i.claim.lost != nil {
+		man.setNamespaceLost(true)
+	}
+	i.claim = nil
+}
+
+// metrics returns the figures of the operation, that has just ended
+func (i *Installer) metrics(succeeded bool) *OperationMetrics {
+	now := time.Now()
+	return &OperationMetrics{
+		Name:            i.op.String(),
+		Succeeded:       succeeded,
+		EndedAt:         now,
+		DurationMs:      int64(now.Sub(i.startedAt) / time.Millisecond),
+		DownloadedBytes: i.progress.downloadedBytes(),
+	}
+}
+
+// recordSubject sets the author of a successful install or update on the
+// application. Nothing is changed if the installer has no subject.
+func (i *Installer) recordSubject(man Manifest) {
+	if i.subject == nil {
+		return
+	}
+	installedBy := man.InstalledBy()
+	if i.op == Install {
+		installedBy = i.subject
+	}
+	man.setSubjects(installedBy, i.subject)
+}
+
+// updateDependencies keeps the index of the konnectors used by the webapps in
+// sync with an installed or updated application.
+func (i *Installer) updateDependencies(man Manifest) error {
+	switch m := man.(type) {
+	case *WebappManifest:
+		return registerDependencies(i.db, m.DocSlug, i.dependencies, m.Konnectors)
+	case *konnManifest:
+		return refreshMissingDependency(i.db, m.DocSlug)
+	}
+	return nil
+}
+
 // install will perform the installation of an application. It returns the
 // freshly fetched manifest from the source along with a possible error in case
 // the installation went wrong.
@@ -202,7 +689,14 @@ func (i *Installer) install() (Manifest, error) {
 	if err := i.ReadManifest(Installing, man); err != nil {
 		return nil, err
 	}
+	if err := i.acceptTerms(man); err != nil {
+		return nil, err
+	}
+	if err := i.applyContext(man); err != nil {
+		return nil, err
+	}
 
+	man.SetOperation(newOperation("installing", i.opID))
 	if err := createManifest(i.db, man); err != nil {
 		return man, err
 	}
@@ -214,8 +708,18 @@ func (i *Installer) install() (Manifest, error) {
 		return man, err
 	}
 
-	err = i.fetcher.Fetch(i.src, i.baseDirName())
-	return man, err
+	if err = i.fetch(man); err != nil {
+		return man, err
+	}
+	if err = checkIcon(i.fs, i.baseDirName(), man); err != nil {
+		return man, err
+	}
+	if err = checkRoutes(i.fs, i.baseDirName(), man); err != nil {
+		return man, err
+	}
+	man.SetSourceCommit(i.sourceCommit())
+	i.progress.start(PhaseFinalizing, 0)
+	return man, i.setSize(man)
 }
 
 // update will perform the update of an already installed application. It
@@ -226,63 +730,575 @@ func (i *Installer) install() (Manifest, error) {
 // upgrading.
 func (i *Installer) update() (Manifest, error) {
 	man := i.man
+	prev, err := cloneManifest(man)
+	if err != nil {
+		return man, err
+	}
 
+	before, errb := manifestFields(man)
+	if wm, ok := man.(*WebappManifest); ok {
+		// ReadManifest reuses the slice of the konnectors
+		i.dependencies = append([]string(nil), wm.Konnectors...)
+	}
 	if err := i.ReadManifest(Upgrading, man); err != nil {
 		return man, err
 	}
+	// A replaced application is not updated, but only flagged as deprecated
+	if i.successor != nil {
+		return man, couchdb.UpdateDoc(i.db, man)
+	}
+	// An update is not refused if the terms have changed: the konnector is
+	// flagged with needs_terms_acceptance until they are accepted.
+	if i.termsAccepted != "" {
+		i.acceptTerms(man)
+	}
+	if i.installContext != nil {
+		if err := i.applyContext(man); err != nil {
+			i.cancelOperation()
+			return nil, err
+		}
+	}
+	// The new version may no longer use the deleted konnector
+	if wm, ok := man.(*WebappManifest); ok && wm.DocMissingDependency {
+		if missing, err := hasMissingKonnector(i.db, wm); err == nil {
+			wm.DocMissingDependency = missing
+		}
+	}
+	if after, erra := manifestFields(man); errb == nil && erra == nil {
+		i.changes = DiffManifests(before, after)
+	}
+	// The available update is no longer flagged once it is installed, with
+	// the same write as the new version
+	if available := man.AvailableVersion(); available != "" && !newerVersion(VersionOf(man), available) {
+		man.setAvailableVersion("", nil)
+	}
 
-	if err := updateManifest(i.db, man); err != nil {
+	// The document keeps the installed version until the end of the update,
+	// so that its files are served with the manifest that declares them.
+	// Only its state changes.
+	if err := Transition(prev, Upgrading); err != nil {
 		return man, err
 	}
+	if err := saveManifestDoc(i.db, prev, i.opID); err != nil {
+		return man, err
+	}
+	man.SetRev(prev.Rev())
 
 	i.manc <- man
 
-	err := i.fetcher.Fetch(i.src, i.baseDirName())
-	return man, err
+	if err := i.stage(); err != nil {
+		return man, err
+	}
+	if err := i.fetch(man); err != nil {
+		return man, err
+	}
+	if err := checkIcon(i.fs, i.baseDirName(), man); err != nil {
+		return man, err
+	}
+	if err := checkRoutes(i.fs, i.baseDirName(), man); err != nil {
+		return man, err
+	}
+	man.SetSourceCommit(i.sourceCommit())
+	i.progress.start(PhaseFinalizing, 0)
+	return man, i.setSize(man)
+}
+
+// acceptTerms records the acceptance of the terms of a konnector, or returns
+// a TermsError if they have not been accepted.
+func (i *Installer) acceptTerms(man Manifest) error {
+	if km, ok := man.(*konnManifest); ok {
+		return km.AcceptTerms(i.termsAccepted, time.Now().UTC())
+	}
+	return nil
+}
+
+// applyContext validates the install context given to the installer against
+// the context schema of the manifest, and keeps it on the document.
+func (i *Installer) applyContext(man Manifest) error {
+	if err := contextSchemaOf(man).Validate(i.installContext); err != nil {
+		return err
+	}
+	if i.installContext != nil {
+		man.SetInstallContext(i.installContext)
+	}
+	return nil
+}
+
+// cancelOperation removes the pending operation from the document of the
+// application, for an update refused before the application was modified.
+func (i *Installer) cancelOperation() {
+	if current, err := GetBySlug(i.db, i.slug, i.typ); err == nil {
+		current.SetOperation(nil)
+		couchdb.UpdateDoc(i.db, current)
+	}
+}
+
+// abortOperation removes the pending operation from the document of the
+// application, when the document of the new version could not be saved at
+// the end of the operation. An update leaves the installed version intact,
+// so the application goes back to its previous state (see
+// restoreInterrupted), and an install puts it in the errored state. The
+// document is left as it is if another operation has taken it over.
+func (i *Installer) abortOperation(cause error) {
+	current, err := GetBySlug(i.db, i.slug, i.typ)
+	if err != nil {
+		log.Errorf("[apps] Can't abort the operation on %s: %s", i.slug, err)
+		return
+	}
+	op := current.Operation()
+	if op == nil || op.ID != i.opID {
+		return
+	}
+	current.SetOperation(nil)
+	if !restoreInterrupted(current, op) && Transition(current, Errored) == nil {
+		current.SetError(cause)
+	}
+	if err = couchdb.UpdateDoc(i.db, current); err != nil {
+		log.Errorf("[apps] Can't abort the operation on %s: %s", i.slug, err)
+	}
+}
+
+// stage prepares the staging directory of the update, where the fetcher
+// writes the new version. The .git directory of the installed version is
+// moved in it, so that a git repository is just pulled, and the files that
+// have not changed are copied from the installed version once they have
+// been fetched (see syncFs). So, only the files that have changed are
+// written by the fetcher, and the other ones are copied once.
+func (i *Installer) stage() error {
+	if err := i.fs.RemoveAll(i.dir); err != nil {
+		return err
+	}
+	i.staged = true
+	if err := i.fs.MkdirAll(i.dir, 0755); err != nil {
+		return err
+	}
+	exists, err := afero.DirExists(i.fs, i.prevDir)
+	if err != nil || !exists {
+		return err
+	}
+	i.sync.from = i.prevDir
+	return moveGitDir(i.fs, path.Join(i.prevDir, ".git"), path.Join(i.dir, ".git"))
+}
+
+// removeStaged removes the staging directory of an update that has failed:
+// the installed version is kept.
+func (i *Installer) removeStaged() {
+	if !i.staged {
+		return
+	}
+	if err := i.fs.RemoveAll(i.dir); err != nil {
+		log.Warnf("[apps] Can't remove the staged files of %s: %s", i.slug, err)
+	}
+}
+
+// fetch puts the files of the application in its directory. For an update,
+// if the checksums of the files of the installed version are known, only the
+// files that have changed are written (see syncFs).
+func (i *Installer) fetch(man Manifest) error {
+	var before map[string]string
+	if i.op == Update {
+		sums, err := getChecksums(i.db, i.typ, i.slug)
+		if err != nil {
+			return err
+		}
+		if sums != nil {
+			// The checksums are removed while the files are modified, so that
+			// the update following a failed one makes a full copy
+			before = sums.Files
+			if err = couchdb.DeleteDoc(i.db, sums); err != nil {
+				return err
+			}
+		}
+	}
+	i.sync.begin(before)
+	if err := i.fetchFiles(man); err != nil {
+		return err
+	}
+	sums, err := i.sync.finish()
+	if err != nil {
+		return err
+	}
+	report := i.sync.report
+	i.checksums, i.syncReport = sums, &report
+	return nil
+}
+
+// fetchFiles copies the files from the source cache if the commit of the
+// git source is there, else they are fetched from the source and added to the
+// cache with the commit checked out. The source is not cached if its commit
+// can't be resolved. The tarball fetcher keeps the archives in the cache
+// itself.
+func (i *Installer) fetchFiles(man Manifest) error {
+	g, ok := i.fetcher.(*gitFetcher)
+	if i.cache == nil || !ok {
+		return i.fetcher.Fetch(i.src, i.baseDirName())
+	}
+	commit, err := g.resolveCommit(i.src)
+	if err != nil {
+		log.Debugf("[apps] Can't resolve the commit of %s, not using the source cache: %v", i.src, err)
+		return i.fetcher.Fetch(i.src, i.baseDirName())
+	}
+	version := VersionOf(man)
+	i.progress.start(PhaseExtracting, 0)
+	ok, err = i.cache.Restore(i.src, commit, i.sync, i.baseDirName())
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Debugf("[apps] %s@%s restored from the source cache", i.src, commit)
+		return nil
+	}
+	if err = i.fetcher.Fetch(i.src, i.baseDirName()); err != nil {
+		return err
+	}
+	if commit = i.sourceCommit(); commit == "" {
+		return nil
+	}
+	if err = i.cache.Store(i.src, version, commit, i.fs, i.baseDirName()); err != nil {
+		log.Warnf("[apps] Can't add %s@%s to the source cache: %s", i.src, commit, err)
+	}
+	return nil
+}
+
+// sourceCommit returns the hash of the commit checked out by the git
+// fetcher, or read from the repository restored from the source cache. It is
+// empty for the other sources.
+func (i *Installer) sourceCommit() string {
+	g, ok := i.fetcher.(*gitFetcher)
+	if !ok {
+		return ""
+	}
+	if g.commit != "" {
+		return g.commit
+	}
+	return g.headCommit(i.baseDirName())
+}
+
+// setSize computes the size of the files of the application, that are saved
+// on its document at the end of the operation.
+func (i *Installer) setSize(man Manifest) error {
+	size, count, err := dirSize(i.fs, i.baseDirName())
+	if err != nil {
+		return err
+	}
+	man.SetSize(size, count)
+	return nil
+}
+
+// ComputeSize computes the size and the number of files of an installed
+// application, and saves them on its document. It can be used for the
+// applications installed before the size was recorded.
+func ComputeSize(db couchdb.Database, fs afero.Fs, man Manifest) error {
+	size, count, err := dirSize(fs, FilesDir(man))
+	if err != nil {
+		return err
+	}
+	man.SetSize(size, count)
+	return couchdb.UpdateDoc(db, man)
+}
+
+// dirSize returns the total size in bytes and the number of files in the
+// given directory and its sub-directories.
+func dirSize(fs afero.Fs, dir string) (int64, int, error) {
+	var size int64
+	var count int
+	err := afero.Walk(fs, dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+	return size, count, err
 }
 
 func (i *Installer) baseDirName() string {
-	return path.Join("/", i.slug)
+	return i.dir
 }
 
 // ReadManifest will fetch the manifest and read its JSON content into the
 // passed manifest pointer.
 //
-// The State field of the manifest will be set to the specified state.
+// The State field of the manifest will be set to the specified state. The
+// extra fields of the manifest are kept, and the unknown fields and the texts
+// that are invalid or too long are errors in strict mode, and warnings else.
 func (i *Installer) ReadManifest(state State, man Manifest) error {
+	var origin *CacheOrigin
+	i.progress.start(PhaseResolving, 0)
 	r, err := i.fetcher.FetchManifest(i.src)
 	if err != nil {
-		return err
+		if !sourceUnreachable(err) {
+			return err
+		}
+		if origin, r = i.readCachedManifest(); r == nil {
+			return err
+		}
+		log.Infof("[apps] %s is not reachable, using the cached version %s",
+			i.src, origin.Version)
 	}
 	defer r.Close()
-	man.SetState(state)
-	return man.ReadManifest(io.LimitReader(r, ManifestMaxSize), i.slug, i.src.String())
+	i.progress.start(PhaseValidating, 0)
+	b, err := readManifestBody(r)
+	if err != nil {
+		return err
+	}
+	if err = Transition(man, state); err != nil {
+		return err
+	}
+	if state == Upgrading {
+		if i.successor, err = peekSuccessor(b); err != nil {
+			return err
+		}
+		if i.successor != nil {
+			man.SetReplacedBy(i.successor)
+			return nil
+		}
+	}
+	err = man.ReadManifest(bytes.NewReader(b), i.slug, i.src.String())
+	extras, errs := readExtras(b, man)
+	man.SetExtras(extras)
+	err = withManifestErrors(err, errs)
+	err = checkTexts(b, man, i.strict, err)
+	if err = checkUnknownFields(b, man, i.strict, err); err != nil {
+		return err
+	}
+	man.SetFromCache(origin)
+	// The concrete URL of a release source is kept, to know which archive
+	// has been installed, with the channel it comes from
+	resolved, channel := "", ""
+	if f, ok := i.fetcher.(*releaseFetcher); ok {
+		resolved, channel = f.ResolvedSource(), f.Channel()
+	}
+	man.SetResolvedSource(resolved)
+	man.SetChannel(channel)
+	return nil
+}
+
+// sourceUnreachable returns true if the error of a fetch means that the
+// source can't be reached for now, like a network error. The other errors,
+// like a missing or invalid signature, are refusals of the source that the
+// cache must not bypass.
+func sourceUnreachable(err error) bool {
+	switch err.(type) {
+	case *RateLimitError:
+		return true
+	}
+	return err == ErrManifestNotReachable || err == ErrSourceNotReachable
+}
+
+// readCachedManifest returns the manifest of the newest cached version of the
+// source, if the installer is allowed to work offline.
+func (i *Installer) readCachedManifest() (*CacheOrigin, io.ReadCloser) {
+	if !i.offlineOk || i.cache == nil {
+		return nil, nil
+	}
+	entry := i.cache.Newest(i.src)
+	if entry == nil {
+		return nil, nil
+	}
+	b, err := i.cache.ReadFile(entry, i.manFilename)
+	if err != nil {
+		return nil, nil
+	}
+	origin := &CacheOrigin{Version: entry.Version, CachedAt: entry.CreatedAt}
+	return origin, ioutil.NopCloser(bytes.NewReader(b))
 }
 
 // Poll should be used to monitor the progress of the Installer.
 func (i *Installer) Poll() (Manifest, bool, error) {
 	select {
 	case man := <-i.manc:
-		done := man.State() == Ready
+		done := i.done(man)
 		return man, done, nil
 	case err := <-i.errc:
 		return nil, false, err
 	}
 }
 
-func updateManifest(db couchdb.Database, man Manifest) error {
-	err := permissions.DestroyApp(db, man.Slug())
-	if err != nil && !couchdb.IsNotFoundError(err) {
-		return err
+// done returns true if the manifest returned by the installer is the one of
+// the end of its operation: the application is ready after an install or an
+// update, and deleted, without its pending operation, after a deletion.
+func (i *Installer) done(man Manifest) bool {
+	if i.op == Delete {
+		return man.Operation() == nil
+	}
+	return man.State() == Ready
+}
+
+// waitInstaller polls the installer until the end of its operation, and
+// returns the final manifest.
+func waitInstaller(inst *Installer) (Manifest, error) {
+	for {
+		man, done, err := inst.Poll()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return man, nil
+		}
+	}
+}
+
+// Changes returns the changes between the installed manifest and the new one,
+// for an update. They are known when the update is done.
+func (i *Installer) Changes() []*ManifestChange {
+	return i.changes
+}
+
+// Sync returns the number of files written, skipped and deleted, or nil if
+// the files have not been fetched. It is known when the installer is done.
+func (i *Installer) Sync() *SyncReport {
+	return i.syncReport
+}
+
+// WarmUp returns the result of the warm-up of the application, or nil if it
+// has not been warmed up. It is known when the installer is done.
+func (i *Installer) WarmUp() *WarmUpReport {
+	return i.warmUpReport
+}
+
+// OperationID identifies the install or update run by the installer: it is
+// the id of its pending operation on the document of the application, and it
+// doesn't change while the installer is polled.
+func (i *Installer) OperationID() string {
+	return i.opID
+}
+
+// Progress returns the progress of the current phase of the installer.
+func (i *Installer) Progress() Progress {
+	return i.progress.current()
+}
+
+// PollProgress is like Poll, but it also returns when the installer makes
+// some progress, like a new phase or more bytes downloaded, with the last
+// manifest returned and the current progress. The manifest is nil if the
+// progress happens before the manifest has been read, like when a tarball
+// is downloaded. Poll and PollProgress must not be mixed on an installer.
+func (i *Installer) PollProgress() (Manifest, Progress, bool, error) {
+	select {
+	case man := <-i.manc:
+		i.polled = man
+		done := i.done(man)
+		return man, i.progress.next(), done, nil
+	case err := <-i.errc:
+		return nil, i.Progress(), false, err
+	case <-i.progress.c:
+		return i.polled, i.progress.next(), false, nil
 	}
-	err = couchdb.UpdateDoc(db, man)
+}
+
+// PollThrottled is like PollProgress, but the progress inside a phase is
+// returned at most once per interval, for the streams sent to the clients
+// that can't keep up with all the notifications. The new phases, the
+// manifests, the errors and the end of the operation are returned
+// immediately, and a skipped progress is returned at the end of the interval.
+// Poll and PollThrottled must not be mixed on an installer.
+func (i *Installer) PollThrottled(interval time.Duration) (Manifest, Progress, bool, error) {
+	var deadline <-chan time.Time
+	for {
+		select {
+		case man := <-i.manc:
+			i.polled = man
+			done := i.done(man)
+			return man, i.sentProgress(), done, nil
+		case err := <-i.errc:
+			return nil, i.Progress(), false, err
+		case <-i.progress.c:
+			elapsed := time.Since(i.sentAt)
+			if i.progress.pendingPhase() || elapsed >= interval {
+				return i.polled, i.sentProgress(), false, nil
+			}
+			if deadline == nil {
+				deadline = time.After(interval - elapsed)
+			}
+		case <-deadline:
+			return i.polled, i.sentProgress(), false, nil
+		}
+	}
+}
+
+// sentProgress returns the next progress to send, and records when it has
+// been returned by PollThrottled.
+func (i *Installer) sentProgress() Progress {
+	p := i.progress.next()
+	i.sentAt = time.Now()
+	return p
+}
+
+// updateManifest saves the document of an application, and its permissions,
+// during the operation with the given id (see saveManifestDoc for the
+// conflicts). The permissions are replaced only once the document is saved,
+// so that an application whose document can't be saved keeps them.
+func updateManifest(db couchdb.Database, man Manifest, opID string) error {
+	err := saveManifestDoc(db, man, opID)
 	if err != nil {
 		return err
 	}
+	err = permissions.DestroyApp(db, man.Slug())
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
 	_, err = permissions.CreateAppSet(db, man.Slug(), man.Permissions())
 	return err
 }
 
+// startOperation records the pending operation on the document of the
+// application. The revision of the document ensures that two concurrent
+// operations can't both start. If the operation expects a revision (see
+// InstallerOptions.IfMatch), a conflict is a RevisionMismatchError.
+func startOperation(db couchdb.Database, man Manifest, name, id, ifMatch string) error {
+	man.SetOperation(newOperation(name, id))
+	err := couchdb.UpdateDoc(db, man)
+	if couchdb.IsConflictError(err) {
+		if current, errg := GetBySlug(db, man.Slug(), typeOf(man)); errg == nil {
+			if op := current.Operation(); op.Fresh() {
+				return &OperationInProgressError{op}
+			}
+			if ifMatch != "" {
+				return &RevisionMismatchError{Expected: ifMatch, Current: current.Rev()}
+			}
+		}
+	}
+	return err
+}
+
+// VersionOf returns the version given in the manifest of an application.
+func VersionOf(man Manifest) string {
+	switch m := man.(type) {
+	case *WebappManifest:
+		return m.Version
+	case *konnManifest:
+		return m.Version
+	}
+	return ""
+}
+
+// cloneManifest returns a copy of the document of an application
+func cloneManifest(man Manifest) (Manifest, error) {
+	b, err := json.Marshal(man)
+	if err != nil {
+		return nil, err
+	}
+	var clone Manifest = &WebappManifest{}
+	if typeOf(man) == Konnector {
+		clone = &konnManifest{}
+	}
+	if err = json.Unmarshal(b, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+func typeOf(man Manifest) AppType {
+	if _, ok := man.(*konnManifest); ok {
+		return Konnector
+	}
+	return Webapp
+}
+
 func createManifest(db couchdb.Database, man Manifest) error {
 	if err := couchdb.CreateNamedDocWithDB(db, man); err != nil {
 		return err
@@ -1,6 +1,8 @@
 package apps
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -29,6 +32,17 @@ var ts *httptest.Server
 
 var installerType AppType
 var manifestName string
+var manifestGenerator func() string
+
+// filesDirOf returns the directory of the files of the installed version of
+// an application, that is a staging directory after an update.
+func filesDirOf(slug string, appType AppType) string {
+	man, err := GetBySlug(db, slug, appType)
+	if err != nil {
+		return "/" + slug
+	}
+	return FilesDir(man)
+}
 
 type transport struct{}
 
@@ -78,6 +92,9 @@ func serveGitRep(manName string, manGen func() string) {
 	localGitDir = dir
 	args := `
 echo '` + manGen() + `' > ` + manName + ` && \
+mkdir -p apps/sub && \
+echo '` + manGen() + `' > apps/sub/` + manName + ` && \
+echo 'sub' > apps/sub/sub && \
 git init . && \
 git add . && \
 git commit -m 'Initial commit' && \
@@ -138,6 +155,68 @@ func TestInstallBadSlug(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Equal(t, ErrInvalidSlugName, err)
 	}
+
+	_, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "Coucou",
+		SourceURL: "git://foo.bar",
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrInvalidSlugName, err)
+	}
+
+	for _, slug := range []string{"-coucou", "icon", "a"} {
+		_, err = NewInstaller(db, fs, &InstallerOptions{
+			Operation: Install,
+			Type:      installerType,
+			Slug:      slug,
+			SourceURL: "git://foo.bar",
+		})
+		assert.Equal(t, ErrInvalidSlugName, err, slug)
+	}
+}
+
+func TestLegacySlug(t *testing.T) {
+	// A slug valid before the rules of ValidSlug, but too short now
+	var doc Manifest = &WebappManifest{DocSlug: "x", DocState: Ready,
+		DocSource: "git://localhost/", DocSchema: SchemaVersion}
+	if installerType == Konnector {
+		doc = &konnManifest{DocSlug: "x", DocState: Ready,
+			DocSource: "git://localhost/", DocSchema: SchemaVersion}
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, doc)) {
+		return
+	}
+	defer func() {
+		if man, err := GetBySlug(db, "x", installerType); err == nil {
+			couchdb.DeleteDoc(db, man)
+		}
+	}()
+	assert.False(t, ValidSlug("x"))
+	assert.True(t, ValidInstalledSlug("x"))
+	assert.False(t, ValidInstalledSlug("../x"))
+
+	// It can't be installed again, but the installed app can be deleted
+	_, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "x",
+		SourceURL: "git://localhost/",
+	})
+	assert.Equal(t, ErrInvalidSlugName, err)
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      installerType,
+		Slug:      "x",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	assert.NoError(t, err)
+	_, err = GetBySlug(db, "x", installerType)
+	assert.True(t, couchdb.IsNotFoundError(err) || err == ErrNotFound, "%v", err)
 }
 
 func TestInstallBadAppsSource(t *testing.T) {
@@ -172,6 +251,36 @@ func TestInstallBadAppsSource(t *testing.T) {
 	}
 }
 
+func TestUpdateBadAppsSource(t *testing.T) {
+	var doc Manifest = &WebappManifest{DocSlug: "bad-source", DocState: Ready,
+		DocSource: "foo://bar.baz", DocSchema: SchemaVersion}
+	if installerType == Konnector {
+		doc = &konnManifest{DocSlug: "bad-source", DocState: Ready,
+			DocSource: "foo://bar.baz", DocSchema: SchemaVersion}
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, doc)) {
+		return
+	}
+	defer func() {
+		if man, err := GetBySlug(db, "bad-source", installerType); err == nil {
+			couchdb.DeleteDoc(db, man)
+		}
+	}()
+
+	_, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      installerType,
+		Slug:      "bad-source",
+	})
+	assert.Equal(t, ErrNotSupportedSource, err)
+	// The failure to build the installer doesn't lock the application
+	man, err := GetBySlug(db, "bad-source", installerType)
+	if assert.NoError(t, err) {
+		assert.Nil(t, man.Operation())
+		assert.Equal(t, State(Ready), man.State())
+	}
+}
+
 func TestInstallSuccessful(t *testing.T) {
 	inst, err := NewInstaller(db, fs, &InstallerOptions{
 		Operation: Install,
@@ -217,6 +326,21 @@ func TestInstallSuccessful(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, ok, "The manifest has the right version")
 
+	// The commit checked out is recorded on the document
+	out, err := exec.Command("git", "-C", localGitDir, "rev-parse", "HEAD").Output()
+	if assert.NoError(t, err) {
+		doc, err := GetBySlug(db, "local-cozy-mini", installerType)
+		if assert.NoError(t, err) {
+			assert.Equal(t, strings.TrimSpace(string(out)), doc.SourceCommit())
+			// And so are the figures of the install
+			if metrics := doc.LastOperation(); assert.NotNil(t, metrics) {
+				assert.Equal(t, "install", metrics.Name)
+				assert.True(t, metrics.Succeeded)
+				assert.True(t, metrics.DownloadedBytes > 0)
+			}
+		}
+	}
+
 	inst2, err := NewInstaller(db, fs, &InstallerOptions{
 		Operation: Install,
 		Type:      installerType,
@@ -314,10 +438,11 @@ func TestInstallWithUpgrade(t *testing.T) {
 		state = man.State()
 	}
 
-	ok, err = afero.Exists(fs, "/cozy-app-b/"+manifestName)
+	dir := filesDirOf("cozy-app-b", installerType)
+	ok, err = afero.Exists(fs, path.Join(dir, manifestName))
 	assert.NoError(t, err)
 	assert.True(t, ok, "The manifest is present")
-	ok, err = afero.FileContainsBytes(fs, "/cozy-app-b/"+manifestName, []byte("2.0.0"))
+	ok, err = afero.FileContainsBytes(fs, path.Join(dir, manifestName), []byte("2.0.0"))
 	assert.NoError(t, err)
 	assert.True(t, ok, "The manifest has the right version")
 }
@@ -410,13 +535,14 @@ func TestInstallAndUpgradeWithBranch(t *testing.T) {
 		state = man.State()
 	}
 
-	ok, err = afero.Exists(fs, "/local-cozy-mini-branch/"+manifestName)
+	dir := filesDirOf("local-cozy-mini-branch", installerType)
+	ok, err = afero.Exists(fs, path.Join(dir, manifestName))
 	assert.NoError(t, err)
 	assert.True(t, ok, "The manifest is present")
-	ok, err = afero.FileContainsBytes(fs, "/local-cozy-mini-branch/"+manifestName, []byte("4.0.0"))
+	ok, err = afero.FileContainsBytes(fs, path.Join(dir, manifestName), []byte("4.0.0"))
 	assert.NoError(t, err)
 	assert.True(t, ok, "The manifest has the right version")
-	ok, err = afero.Exists(fs, "/local-cozy-mini-branch/branch")
+	ok, err = afero.Exists(fs, path.Join(dir, "branch"))
 	assert.NoError(t, err)
 	assert.True(t, ok, "The good branch was checked out")
 }
@@ -499,6 +625,138 @@ func TestInstallFromGitlab(t *testing.T) {
 	}
 }
 
+func TestInstallFromSubDirectory(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	_, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation:    Install,
+		Type:         Webapp,
+		Slug:         "subdir-evil",
+		SourceURL:    "git://localhost/",
+		SubDirectory: "apps/../..",
+	})
+	assert.Equal(t, ErrInvalidSubDirectory, err)
+
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation:    Install,
+		Type:         Webapp,
+		Slug:         "subdir-mini",
+		SourceURL:    "git://localhost/",
+		SubDirectory: "/apps/sub",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	man, err := waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "git://localhost/#:/apps/sub", man.Source())
+	ok, _ := afero.Exists(fs, "/subdir-mini/sub")
+	assert.True(t, ok, "The files of the subdirectory should be at the root")
+	ok, _ = afero.Exists(fs, "/subdir-mini/apps")
+	assert.False(t, ok, "The other files of the repository should not be copied")
+
+	// The subdirectory is kept in the source for the updates
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "subdir-mini",
+	})
+	if assert.NoError(t, err) {
+		go inst.Update()
+		_, err = waitInstaller(inst)
+		assert.NoError(t, err)
+		ok, _ = afero.Exists(fs, path.Join(filesDirOf("subdir-mini", Webapp), "sub"))
+		assert.True(t, ok)
+	}
+
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      Webapp,
+		Slug:      "subdir-missing",
+		SourceURL: "git://localhost/#:/apps/missing",
+	})
+	if assert.NoError(t, err) {
+		go inst.Install()
+		_, err = waitInstaller(inst)
+		assert.Equal(t, &SubDirectoryError{Dir: "apps/missing"}, err)
+	}
+
+	for _, slug := range []string{"subdir-mini", "subdir-missing"} {
+		if doc, err := GetWebappBySlug(db, slug); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		fs.RemoveAll("/" + slug)
+	}
+}
+
+func TestOperationID(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      Webapp,
+		Slug:      "opid-mini",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "opid-mini"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		fs.RemoveAll("/opid-mini")
+	}()
+	id := inst.OperationID()
+	assert.NotEmpty(t, id)
+
+	go inst.Install()
+	for {
+		man, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, id, inst.OperationID())
+		if done {
+			assert.Nil(t, man.Operation())
+			break
+		}
+		if assert.NotNil(t, man.Operation()) {
+			assert.Equal(t, id, man.Operation().ID)
+		}
+	}
+
+	state, err := GetOperationState(db, "opid-mini", Webapp)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Ready, state.State)
+		assert.False(t, state.Pending(""))
+		assert.Nil(t, state.Progress)
+	}
+
+	// A new attempt has a new id
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "opid-mini",
+	})
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, id, inst.OperationID())
+		state, err = GetOperationState(db, "opid-mini", Webapp)
+		if assert.NoError(t, err) {
+			assert.True(t, state.Pending(inst.OperationID()))
+			assert.False(t, state.Pending(id))
+		}
+		go inst.Update()
+		_, err = waitInstaller(inst)
+		assert.NoError(t, err)
+	}
+}
+
 func TestUninstall(t *testing.T) {
 	inst1, err := NewInstaller(db, fs, &InstallerOptions{
 		Operation: Install,
@@ -541,6 +799,1091 @@ func TestUninstall(t *testing.T) {
 	assert.Equal(t, ErrNotFound, err)
 }
 
+func TestDeleteCanBeResumed(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	memfs := afero.NewMemMapFs()
+	man := &WebappManifest{
+		DocSlug:   "mini-uninstall",
+		DocSource: "git://localhost/",
+		DocState:  Ready,
+		DocSchema: SchemaVersion,
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "mini-uninstall"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+	}()
+	afero.WriteFile(memfs, "/mini-uninstall/index.html", []byte("<html></html>"), 0644)
+	opts := &InstallerOptions{Operation: Delete, Type: Webapp, Slug: "mini-uninstall"}
+
+	// The files can't be removed: the application is left errored-deleting,
+	// with its files, and it is not served
+	inst, err := NewInstaller(db, afero.NewReadOnlyFs(memfs), opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	assert.Error(t, err)
+	doc, err := GetWebappBySlug(db, "mini-uninstall")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(ErroredDeleting), doc.State())
+		assert.Nil(t, doc.Operation())
+		if assert.NotNil(t, doc.LastTransition()) {
+			assert.Equal(t, State(Deleting), doc.LastTransition().From)
+		}
+	}
+	ok, _ := afero.Exists(memfs, "/mini-uninstall/index.html")
+	assert.True(t, ok)
+
+	// It can't be updated
+	upd, err := NewInstaller(db, memfs, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "mini-uninstall",
+	})
+	if assert.NoError(t, err) {
+		go upd.Update()
+		_, err = waitInstaller(upd)
+		assert.Equal(t, ErrBadState, err)
+	}
+
+	// The deletion can be tried again, and followed with Poll
+	inst, err = NewInstaller(db, memfs, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Uninstall()
+	first, done, err := inst.Poll()
+	if assert.NoError(t, err) {
+		assert.False(t, done)
+		assert.Equal(t, State(Deleting), first.State())
+		assert.NotNil(t, first.Operation())
+	}
+	_, done, err = inst.Poll()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	_, err = GetWebappBySlug(db, "mini-uninstall")
+	assert.True(t, couchdb.IsNotFoundError(err))
+	ok, _ = afero.DirExists(memfs, "/mini-uninstall")
+	assert.False(t, ok)
+}
+
+func TestCanonicalizeLegacySlug(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the migration is the same for the konnectors")
+	}
+	legacy := &WebappManifest{DocSlug: "Legacy-App", DocState: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, legacy)) {
+		return
+	}
+	taken := &WebappManifest{DocSlug: "Taken-App", DocState: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, taken)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, taken)
+	canonical := &WebappManifest{DocSlug: "taken-app", DocState: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, canonical)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, canonical)
+
+	// The legacy document is not found by a read before the migration
+	_, err := GetWebappBySlug(db, "legacy-app")
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	renamed, err := CanonicalizeSlugs(db, Webapp)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacy-app"}, renamed)
+	man, err := GetWebappBySlug(db, "legacy-app")
+	if assert.NoError(t, err) {
+		defer couchdb.DeleteDoc(db, man)
+		assert.Equal(t, "legacy-app", man.Slug())
+		assert.Equal(t, "/Legacy-App", FilesDir(man))
+	}
+	_, err = GetWebappBySlug(db, "Legacy-App")
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// The migration is done once
+	renamed, err = CanonicalizeSlugs(db, Webapp)
+	assert.NoError(t, err)
+	assert.Empty(t, renamed)
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	man := &WebappManifest{
+		DocSlug:      "busy-app",
+		DocSource:    "git://localhost/",
+		DocState:     Ready,
+		DocOperation: newOperation("updating", ""),
+		DocSchema:    SchemaVersion,
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, man)
+
+	for _, op := range []Operation{Update, Delete} {
+		_, err := NewInstaller(db, fs, &InstallerOptions{
+			Operation: op,
+			Type:      Webapp,
+			Slug:      "busy-app",
+		})
+		if assert.IsType(t, &OperationInProgressError{}, err) {
+			assert.Equal(t, "updating", err.(*OperationInProgressError).Operation.Name)
+		}
+	}
+
+	// A stale operation doesn't lock the app
+	man.DocOperation.StartedAt = time.Now().Add(-2 * OperationTimeout)
+	if !assert.NoError(t, couchdb.UpdateDoc(db, man)) {
+		return
+	}
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "busy-app",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, inst.man.Operation().Fresh())
+
+	// The new operation is recorded on the document
+	doc, err := GetWebappBySlug(db, "busy-app")
+	if assert.NoError(t, err) {
+		assert.True(t, doc.Operation().Fresh())
+		man.SetRev(doc.Rev())
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	var events []string
+	refuse := true
+	unregister := RegisterHook(func(ctx context.Context, e *HookEvent) error {
+		if e.Slug != "hooked-app" {
+			return nil
+		}
+		events = append(events, fmt.Sprintf("%s-%s", e.Phase, e.Operation))
+		if refuse && e.Phase == BeforeHook {
+			return errors.New("not today")
+		}
+		return nil
+	})
+
+	man := &WebappManifest{DocSlug: "hooked-app", DocSource: "git://localhost/", DocState: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	opts := &InstallerOptions{Operation: Delete, Type: Webapp, Slug: "hooked-app"}
+	inst, err := NewInstaller(db, fs, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	if assert.IsType(t, &HookError{}, err) {
+		assert.Contains(t, err.Error(), "not today")
+	}
+	_, err = GetWebappBySlug(db, "hooked-app")
+	assert.NoError(t, err)
+
+	refuse = false
+	inst, err = NewInstaller(db, fs, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"before-delete", "before-delete", "after-delete"}, events)
+
+	// An unregistered hook is no longer called
+	unregister()
+	unregister()
+	refuse = true
+	man = &WebappManifest{DocSlug: "hooked-app", DocSource: "git://localhost/", DocState: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	inst, err = NewInstaller(db, fs, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestHookTimeout(t *testing.T) {
+	was := HookTimeout
+	defer func() { HookTimeout = was }()
+	HookTimeout = 10 * time.Millisecond
+	err := callHook(func(ctx context.Context, e *HookEvent) error {
+		time.Sleep(time.Second)
+		return nil
+	}, &HookEvent{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestWarmUp(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	var warmed []string
+	RegisterWarmUp(func(ctx context.Context, db couchdb.Database, man Manifest) error {
+		if !strings.HasPrefix(man.Slug(), "warm-") {
+			return nil
+		}
+		warmed = append(warmed, man.Slug())
+		return errors.New("cold")
+	})
+
+	for _, skip := range []bool{false, true} {
+		slug := "warm-mini"
+		if skip {
+			slug = "warm-skipped"
+		}
+		inst, err := NewInstaller(db, fs, &InstallerOptions{
+			Operation:  Install,
+			Type:       Webapp,
+			Slug:       slug,
+			SourceURL:  "git://localhost/",
+			SkipWarmUp: skip,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		go inst.Install()
+		man, err := waitInstaller(inst)
+		// A failed warm-up doesn't fail the install
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, Ready, man.State())
+		}
+		if skip {
+			assert.Nil(t, inst.WarmUp())
+		} else if assert.NotNil(t, inst.WarmUp()) {
+			assert.Equal(t, "cold", inst.WarmUp().Error)
+			assert.True(t, inst.WarmUp().DurationMs >= 0)
+		}
+		if doc, err := GetWebappBySlug(db, slug); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		fs.RemoveAll("/" + slug)
+	}
+	assert.Equal(t, []string{"warm-mini"}, warmed)
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	was := WarmUpTimeout
+	defer func() { WarmUpTimeout = was }()
+	WarmUpTimeout = 10 * time.Millisecond
+	err := callWarmUp(func(ctx context.Context, db couchdb.Database, man Manifest) error {
+		time.Sleep(time.Second)
+		return nil
+	}, db, &WebappManifest{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestRecordSubject(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	store := &Subject{Type: "app", ID: "io.cozy.apps/store"}
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      Webapp,
+		Slug:      "subject-mini",
+		SourceURL: "git://localhost/",
+		Subject:   store,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "subject-mini"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		fs.RemoveAll("/subject-mini")
+	}()
+	go inst.Install()
+	man, err := waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store, man.InstalledBy())
+	assert.Equal(t, store, man.UpdatedBy())
+
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "subject-mini",
+		Subject:   SystemSubject,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Update()
+	_, err = waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	man, err = GetWebappBySlug(db, "subject-mini")
+	if assert.NoError(t, err) {
+		assert.Equal(t, store, man.InstalledBy())
+		assert.Equal(t, SystemSubject, man.UpdatedBy())
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-hooks")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho \"$COZY_APP_SLUG is $COZY_APP_TYPE\"\nexit 1\n"
+	err = ioutil.WriteFile(path.Join(dir, "before-install"), []byte(script), 0755)
+	if !assert.NoError(t, err) {
+		return
+	}
+	hook := execHook(dir)
+	event := &HookEvent{Slug: "foo", Type: Webapp, Operation: Install, Phase: BeforeHook}
+	err = hook(context.Background(), event)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "foo is webapp")
+	}
+	event.Phase = AfterHook
+	assert.NoError(t, hook(context.Background(), event))
+}
+
+func TestWaitInstallers(t *testing.T) {
+	release := make(chan struct{})
+	RunInBackground(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, WaitInstallers(ctx))
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, WaitInstallers(ctx))
+}
+
+func TestGarbageCollect(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	gcfs := afero.NewMemMapFs()
+	assert.NoError(t, gcfs.MkdirAll("/gc-ok", 0755))
+	assert.NoError(t, gcfs.MkdirAll("/gc-orphan/sub", 0755))
+	ok := &WebappManifest{DocSlug: "gc-ok", DocState: Ready}
+	lost := &WebappManifest{DocSlug: "gc-lost", DocState: Ready}
+	busy := &WebappManifest{DocSlug: "gc-busy", DocState: Installing, DocOperation: newOperation("installing", "")}
+	for _, man := range []*WebappManifest{ok, lost, busy} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+		defer couchdb.DeleteDoc(db, man)
+	}
+
+	report, err := GarbageCollect(db, gcfs, Webapp, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"gc-orphan"}, report.OrphanDirs)
+	// The other tests have left apps with no directory in gcfs
+	assert.Contains(t, report.MissingDirs, "gc-lost")
+	assert.NotContains(t, report.MissingDirs, "gc-ok")
+	assert.NotContains(t, report.MissingDirs, "gc-busy")
+	assert.False(t, report.Fixed)
+	exists, _ := afero.DirExists(gcfs, "/gc-orphan")
+	assert.True(t, exists)
+
+	report, err = GarbageCollect(db, gcfs, Webapp, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, report.Fixed)
+	exists, _ = afero.DirExists(gcfs, "/gc-orphan")
+	assert.False(t, exists)
+	exists, _ = afero.DirExists(gcfs, "/gc-ok")
+	assert.True(t, exists)
+	doc, err := GetWebappBySlug(db, "gc-lost")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Errored), doc.State())
+		assert.Equal(t, ErrMissingFiles.Error(), doc.DocError)
+		lost.SetRev(doc.Rev())
+	}
+}
+
+func TestGarbageCollectManyApps(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the garbage collection is tested on the webapps")
+	}
+	// More applications than a page of the listing
+	n := appsPageSize + 20
+	defer createAppDocs(t, "gc-many", n)()
+	gcfs := afero.NewMemMapFs()
+	for i := 0; i < n; i++ {
+		assert.NoError(t, gcfs.MkdirAll(fmt.Sprintf("/gc-many%03d", i), 0755))
+	}
+
+	report, err := GarbageCollect(db, gcfs, Webapp, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, report.OrphanDirs)
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("/gc-many%03d", i)
+		exists, _ := afero.DirExists(gcfs, dir)
+		assert.True(t, exists, dir)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	hfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(hfs, "/health-ok/"+WebappManifestName, []byte("{}"), 0644))
+	assert.NoError(t, afero.WriteFile(hfs, "/health-empty/"+WebappManifestName, nil, 0644))
+	ok := &WebappManifest{DocSlug: "health-ok", DocState: Ready}
+	empty := &WebappManifest{DocSlug: "health-empty", DocState: Ready}
+	lost := &WebappManifest{DocSlug: "health-lost", DocState: Ready}
+	busy := &WebappManifest{DocSlug: "health-busy", DocState: Installing, DocOperation: newOperation("installing", "")}
+	for _, man := range []*WebappManifest{ok, empty, lost, busy} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+		defer couchdb.DeleteDoc(db, man)
+	}
+
+	report, err := CheckHealth(db, hfs, Webapp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, report.Healthy)
+	health := make(map[string]*AppHealth)
+	for _, h := range report.Apps {
+		health[h.Slug] = h
+	}
+	if assert.Contains(t, health, "health-ok") {
+		assert.True(t, health["health-ok"].Healthy)
+		assert.Empty(t, health["health-ok"].Error)
+	}
+	if assert.Contains(t, health, "health-empty") {
+		assert.False(t, health["health-empty"].Healthy)
+		assert.Equal(t, ErrBadManifest.Error(), health["health-empty"].Error)
+	}
+	if assert.Contains(t, health, "health-lost") {
+		assert.False(t, health["health-lost"].Healthy)
+		assert.NotEmpty(t, health["health-lost"].Error)
+	}
+	assert.NotContains(t, health, "health-busy")
+}
+
+func TestKonnectorResults(t *testing.T) {
+	if installerType != Konnector {
+		return
+	}
+	assert.NoError(t, SaveKonnectorResult(db, "result-ok", nil))
+	assert.NoError(t, SaveKonnectorResult(db, "result-ko", nil))
+	assert.NoError(t, SaveKonnectorResult(db, "result-ko", errors.New("LOGIN_FAILED")))
+
+	results, err := GetKonnectorResults(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Contains(t, results, "result-ok") {
+		assert.Equal(t, KonnectorDone, results["result-ok"].State)
+		assert.Empty(t, results["result-ok"].Error)
+	}
+	if assert.Contains(t, results, "result-ko") {
+		assert.Equal(t, KonnectorErrored, results["result-ko"].State)
+		assert.Equal(t, "LOGIN_FAILED", results["result-ko"].Error)
+	}
+	assert.NotContains(t, results, "result-never")
+	for _, r := range results {
+		couchdb.DeleteDoc(db, r)
+	}
+}
+
+func TestKonnectorLogs(t *testing.T) {
+	if installerType != Konnector {
+		return
+	}
+	man := &konnManifest{
+		DocSlug:  "logs-konn",
+		DocState: Ready,
+		Fields: map[string]KonnectorField{
+			"login":    {Type: "text"},
+			"password": {Type: "password"},
+		},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetKonnectorBySlug(db, "logs-konn"); err == nil {
+			deleteManifest(db, doc)
+		}
+		deleteKonnectorLogs(db, "logs-konn")
+	}()
+
+	_, err := GetKonnectorLog(db, "logs-konn", "")
+	assert.Equal(t, ErrKonnectorLogNotFound, err)
+
+	fields := []byte(`{"login":"bob","password":"s3\"cret"}`)
+	output := func(text string) *KonnectorOutput {
+		out, err := NewKonnectorOutput(db, "logs-konn", fields)
+		if assert.NoError(t, err) {
+			out.Write([]byte(text))
+		}
+		return out
+	}
+	job1 := output("login as bob\npassword is s3\"cret\n{\"password\":\"s3\\\"cret\"}\n")
+	assert.NoError(t, SaveKonnectorLog(db, "logs-konn", "job-1", job1, nil))
+	job2 := output("oops")
+	assert.NoError(t, SaveKonnectorLog(db, "logs-konn", "job-2", job2, errors.New("LOGIN_FAILED with s3\"cret")))
+
+	run, err := GetKonnectorLog(db, "logs-konn", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "job-2", run.JobID)
+		assert.Equal(t, KonnectorErrored, run.State)
+		assert.Equal(t, "LOGIN_FAILED with [REDACTED]", run.Error)
+		assert.Equal(t, []string{"oops"}, run.Lines)
+	}
+	run, err = GetKonnectorLog(db, "logs-konn", "job-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, KonnectorDone, run.State)
+		assert.Equal(t, []string{
+			"login as bob",
+			"password is [REDACTED]",
+			`{"password":"[REDACTED]"}`,
+		}, run.Lines)
+	}
+	_, err = GetKonnectorLog(db, "logs-konn", "job-3")
+	assert.Equal(t, ErrKonnectorLogNotFound, err)
+
+	// Only the last runs are kept, and a new attempt replaces the previous one
+	was := KonnectorLogsRuns
+	KonnectorLogsRuns = 2
+	defer func() { KonnectorLogsRuns = was }()
+	assert.NoError(t, SaveKonnectorLog(db, "logs-konn", "job-2", output("ok"), nil))
+	assert.NoError(t, SaveKonnectorLog(db, "logs-konn", "job-3", output("ok"), nil))
+	logs := &KonnectorLogs{}
+	if assert.NoError(t, couchdb.GetDoc(db, consts.KonnectorLogs, "logs-konn", logs)) {
+		if assert.Len(t, logs.Runs, 2) {
+			assert.Equal(t, "job-3", logs.Runs[0].JobID)
+			assert.Equal(t, "job-2", logs.Runs[1].JobID)
+			assert.Equal(t, KonnectorDone, logs.Runs[1].State)
+		}
+	}
+}
+
+func TestKonnectorOutput(t *testing.T) {
+	if installerType != Konnector {
+		t.Skip("the output is only collected for the konnectors")
+	}
+	maxLines, maxSize, maxLineSize := KonnectorLogMaxLines, KonnectorLogMaxSize, KonnectorLogMaxLineSize
+	defer func() {
+		KonnectorLogMaxLines, KonnectorLogMaxSize, KonnectorLogMaxLineSize = maxLines, maxSize, maxLineSize
+	}()
+	KonnectorLogMaxLines, KonnectorLogMaxSize, KonnectorLogMaxLineSize = 3, 100, 10
+
+	// The last lines are kept, and a secret written in several parts is
+	// redacted
+	out := newKonnectorOutput([]string{"hunter2"})
+	out.Write([]byte("l1\nl2\nl3\nhun"))
+	out.Write([]byte("ter2\r\nlast"))
+	assert.Equal(t, []string{"l3", "[REDACTED]", "last"}, out.Lines())
+	assert.True(t, out.Truncated())
+
+	// A long line is cut after its secrets have been redacted, and its end
+	// is ignored
+	out = newKonnectorOutput([]string{"hunter2"})
+	out.Write([]byte("01234567hunter2 and the rest of the line"))
+	out.Write([]byte(" that is very long\nnext\n"))
+	assert.Equal(t, []string{"01234567[R", "next"}, out.Lines())
+	assert.True(t, out.Truncated())
+
+	// The end of a cut line can't be the beginning of a secret
+	assert.Equal(t, "01234567", cutLine("01234567huxxxxxx", 10, []string{"hunter2"}))
+
+	// The size of the lines is limited too
+	KonnectorLogMaxSize = 5
+	out = newKonnectorOutput(nil)
+	out.Write([]byte("aaa\nbbb\n"))
+	assert.Equal(t, []string{"bbb"}, out.Lines())
+	assert.True(t, out.Truncated())
+
+	out = newKonnectorOutput(nil)
+	assert.Equal(t, []string{}, out.Lines())
+	assert.False(t, out.Truncated())
+}
+
+func TestBulkDelete(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	for _, slug := range []string{"bulk-a", "bulk-b", "home"} {
+		man := &WebappManifest{DocSlug: slug, DocSource: "git://localhost/", DocState: Ready}
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+		defer func(slug string) {
+			if doc, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, doc)
+			}
+		}(slug)
+	}
+
+	// The protected apps are only deleted by all if they are included, and
+	// all the pages of documents are listed
+	pageSize := appsPageSize
+	appsPageSize = 2
+	defer func() { appsPageSize = pageSize }()
+	slugs, err := bulkSlugs(db, Webapp, &BulkDeleteOptions{All: true})
+	if assert.NoError(t, err) {
+		assert.Contains(t, slugs, "bulk-a")
+		assert.NotContains(t, slugs, "home")
+	}
+	slugs, err = bulkSlugs(db, Webapp, &BulkDeleteOptions{All: true, Protected: []string{"home"}})
+	if assert.NoError(t, err) {
+		assert.Contains(t, slugs, "home")
+	}
+
+	// Nothing is deleted while one of the apps is busy, unless it is forced
+	busy, err := GetWebappBySlug(db, "bulk-b")
+	if !assert.NoError(t, err) {
+		return
+	}
+	busy.DocOperation = newOperation("updating", "")
+	if !assert.NoError(t, couchdb.UpdateDoc(db, busy)) {
+		return
+	}
+	opts := &BulkDeleteOptions{Slugs: []string{"bulk-a", "Bulk-B", "bulk-none", "bulk-a"}}
+	_, err = BulkDelete(db, fs, Webapp, opts)
+	if assert.IsType(t, &BulkInProgressError{}, err) {
+		assert.Equal(t, []string{"bulk-b"}, err.(*BulkInProgressError).Slugs)
+	}
+	_, err = GetWebappBySlug(db, "bulk-a")
+	assert.NoError(t, err)
+
+	// Nothing is deleted if a slug is invalid, even when it is forced
+	_, err = BulkDelete(db, fs, Webapp, &BulkDeleteOptions{
+		Slugs: []string{"bulk-a", "../bulk", "bulk_c"},
+		Force: true,
+	})
+	if assert.IsType(t, &BulkInvalidSlugsError{}, err) {
+		assert.Equal(t, []string{"../bulk", "bulk_c"}, err.(*BulkInvalidSlugsError).Slugs)
+	}
+	_, err = GetWebappBySlug(db, "bulk-a")
+	assert.NoError(t, err)
+
+	opts.Force = true
+	results, err := BulkDelete(db, fs, Webapp, opts)
+	if assert.NoError(t, err) && assert.Len(t, results, 3) {
+		assert.Equal(t, "bulk-a", results[0].Slug)
+		assert.Equal(t, BulkDeleted, results[0].Outcome)
+		assert.Equal(t, "bulk-b", results[1].Slug)
+		assert.Equal(t, BulkFailed, results[1].Outcome)
+		assert.NotEmpty(t, results[1].Error)
+		assert.Equal(t, "bulk-none", results[2].Slug)
+		assert.Equal(t, BulkNotFound, results[2].Outcome)
+	}
+	_, err = GetWebappBySlug(db, "bulk-a")
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// A listed protected app is not deleted without the confirmation
+	results, err = BulkDelete(db, fs, Webapp, &BulkDeleteOptions{Slugs: []string{"home"}})
+	if assert.NoError(t, err) && assert.Len(t, results, 1) {
+		assert.Equal(t, BulkFailed, results[0].Outcome)
+		assert.Equal(t, ErrProtected.Error(), results[0].Error)
+	}
+	_, err = GetWebappBySlug(db, "home")
+	assert.NoError(t, err)
+}
+
+func TestDeleteProtected(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	cfg := config.GetConfig()
+	was := cfg.Apps.ProtectedSlugs
+	cfg.Apps.ProtectedSlugs = []string{"protected-conf"}
+	defer func() { cfg.Apps.ProtectedSlugs = was }()
+
+	for _, slug := range []string{"protected-conf", "protected-flag"} {
+		man := &WebappManifest{
+			DocSlug:      slug,
+			DocSource:    "git://localhost/",
+			DocState:     Ready,
+			DocProtected: slug == "protected-flag",
+		}
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+		defer func(slug string) {
+			if doc, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, doc)
+			}
+		}(slug)
+		assert.True(t, IsProtected(man))
+
+		for _, iamSure := range []string{"", "other-app", slug} {
+			inst, err := NewInstaller(db, fs, &InstallerOptions{
+				Operation: Delete,
+				Type:      Webapp,
+				Slug:      slug,
+				IamSure:   iamSure,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = inst.Delete()
+			if iamSure == slug {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, ErrProtected, err)
+			}
+		}
+		_, err := GetWebappBySlug(db, slug)
+		assert.True(t, couchdb.IsNotFoundError(err))
+	}
+	assert.False(t, IsProtected(&WebappManifest{DocSlug: "not-protected"}))
+}
+
+func TestSetProtected(t *testing.T) {
+	var man Manifest = &WebappManifest{DocSlug: "protect-me", DocSource: "git://localhost/", DocState: Ready}
+	if installerType == Konnector {
+		man = &konnManifest{DocSlug: "protect-me", DocSource: "git://localhost/", DocState: Ready}
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetBySlug(db, "protect-me", installerType); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+	}()
+
+	for _, protected := range []bool{true, true, false} {
+		_, err := SetProtected(db, "protect-me", installerType, protected)
+		if !assert.NoError(t, err) {
+			return
+		}
+		doc, err := GetBySlug(db, "protect-me", installerType)
+		if assert.NoError(t, err) {
+			assert.Equal(t, protected, IsProtected(doc))
+		}
+	}
+
+	_, err := SetProtected(db, "not-installed", installerType, true)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMigrateToSuccessor(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	old := &WebappManifest{
+		DocSlug:       "mini-old",
+		DocState:      Ready,
+		DocSource:     "git://localhost/",
+		DocReplacedBy: &Successor{Slug: "mini-successor", Source: "git://localhost/"},
+		DocDeprecated: true,
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, old)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, old)
+	settings := couchdb.JSONDoc{Type: consts.Settings, M: map[string]interface{}{
+		"_id":   appSettingsID("mini-old"),
+		"theme": "dark",
+	}}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(db, settings)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, settings)
+
+	_, err := MigrateToSuccessor(db, fs, Webapp, "mini-successor", &MigrationOptions{})
+	assert.Equal(t, ErrNotFound, err)
+
+	report, err := MigrateToSuccessor(db, fs, Webapp, "mini-old", &MigrationOptions{CopySettings: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "mini-successor"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		var copied couchdb.JSONDoc
+		if err := couchdb.GetDoc(db, consts.Settings, appSettingsID("mini-successor"), &copied); err == nil {
+			copied.Type = consts.Settings
+			couchdb.DeleteDoc(db, copied)
+		}
+	}()
+	assert.True(t, report.Done)
+	if assert.Len(t, report.Steps, 3) {
+		for _, step := range report.Steps {
+			assert.Equal(t, MigrationDone, step.Status, step.Name)
+		}
+	}
+
+	successor, err := GetWebappBySlug(db, "mini-successor")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Ready), successor.State())
+	}
+	var copied couchdb.JSONDoc
+	if assert.NoError(t, couchdb.GetDoc(db, consts.Settings, appSettingsID("mini-successor"), &copied)) {
+		assert.Equal(t, "dark", copied.M["theme"])
+	}
+	replaced, err := GetWebappBySlug(db, "mini-old")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Replaced), replaced.State())
+		assert.True(t, replaced.DocDeprecated)
+	}
+
+	// The migration can be started again, without doing anything
+	report, err = MigrateToSuccessor(db, fs, Webapp, "mini-old", &MigrationOptions{CopySettings: true})
+	if assert.NoError(t, err) {
+		assert.True(t, report.Done)
+		for _, step := range report.Steps {
+			assert.Equal(t, MigrationSkipped, step.Status, step.Name)
+		}
+	}
+	_, err = MigrateToSuccessor(db, fs, Webapp, "mini-successor", &MigrationOptions{})
+	assert.Equal(t, ErrNoSuccessor, err)
+}
+
+func TestDeleteKonnectorWithDependents(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	konn := &konnManifest{DocSlug: "konn-dep", DocState: Ready, DocSource: "git://localhost/"}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, konn)) {
+		return
+	}
+	webapp := &WebappManifest{
+		DocSlug:    "mini-dep",
+		DocState:   Ready,
+		DocSource:  "git://localhost/",
+		Konnectors: []string{"konn-dep"},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, webapp)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "mini-dep"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+	}()
+	assert.NoError(t, registerDependencies(db, "mini-dep", nil, webapp.Konnectors))
+	deps, err := GetDependents(db, "konn-dep")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mini-dep"}, deps)
+
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      Konnector,
+		Slug:      "konn-dep",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	if e, ok := err.(*DependentsError); assert.True(t, ok) {
+		assert.Equal(t, []string{"mini-dep"}, e.Slugs)
+	}
+
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      Konnector,
+		Slug:      "konn-dep",
+		Force:     true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	assert.NoError(t, err)
+	flagged, err := GetWebappBySlug(db, "mini-dep")
+	if assert.NoError(t, err) {
+		assert.True(t, flagged.DocMissingDependency)
+	}
+
+	// The flag is removed when the konnector is installed again
+	konn = &konnManifest{DocSlug: "konn-dep", DocState: Ready, DocSource: "git://localhost/", DocSchema: SchemaVersion}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, konn)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, konn)
+	assert.NoError(t, refreshMissingDependency(db, "konn-dep"))
+	webapp, err = GetWebappBySlug(db, "mini-dep")
+	if assert.NoError(t, err) {
+		assert.False(t, webapp.DocMissingDependency)
+	}
+
+	// The webapp is removed from the index when it no longer uses the konnector
+	assert.NoError(t, registerDependencies(db, "mini-dep", webapp.Konnectors, nil))
+	deps, err = GetDependents(db, "konn-dep")
+	assert.NoError(t, err)
+	assert.Empty(t, deps)
+}
+
+func TestDependentsOfLegacyWebapp(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the index of the dependents is only tested once")
+	}
+	// The webapp has been installed before the index of the dependents
+	marker := &KonnectorDependents{}
+	if err := couchdb.GetDoc(db, consts.KonnectorDependents, dependentsBackfillID, marker); err == nil {
+		assert.NoError(t, couchdb.DeleteDoc(db, marker))
+	}
+	konn := &konnManifest{DocSlug: "konn-legacy", DocState: Ready, DocSource: "git://localhost/"}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, konn)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetKonnectorBySlug(db, "konn-legacy"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+	}()
+	webapp := &WebappManifest{
+		DocSlug:    "mini-legacy-dep",
+		DocState:   Ready,
+		DocSource:  "git://localhost/",
+		Konnectors: []string{"konn-legacy"},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, webapp)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "mini-legacy-dep"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		registerDependencies(db, "mini-legacy-dep", []string{"konn-legacy"}, nil)
+	}()
+	deps, err := GetDependents(db, "konn-legacy")
+	assert.NoError(t, err)
+	assert.Empty(t, deps)
+
+	// The index is built from the webapps on the first check
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      Konnector,
+		Slug:      "konn-legacy",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	if e, ok := err.(*DependentsError); assert.True(t, ok) {
+		assert.Equal(t, []string{"mini-legacy-dep"}, e.Slugs)
+	}
+	deps, err = GetDependents(db, "konn-legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mini-legacy-dep"}, deps)
+	assert.NoError(t, couchdb.GetDoc(db, consts.KonnectorDependents, dependentsBackfillID, marker))
+}
+
+// writesCounter is a filesystem that counts the files opened for writing
+// outside of the .git directories.
+type writesCounter struct {
+	afero.Fs
+	writes map[string]int
+}
+
+func (w *writesCounter) Create(name string) (afero.File, error) {
+	return w.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (w *writesCounter) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && !strings.Contains(name, "/.git/") {
+		w.writes[name]++
+	}
+	return w.Fs.OpenFile(name, flag, perm)
+}
+
+func TestUpdateOnlyWritesChangedFiles(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the sync of the files doesn't depend on the type of application")
+	}
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      Webapp,
+		Slug:      "sync-mini",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		if doc, err := GetWebappBySlug(db, "sync-mini"); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		deleteChecksums(db, Webapp, "sync-mini")
+		fs.RemoveAll("/sync-mini")
+	}()
+	go inst.Install()
+	_, err = waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &SyncReport{Written: 3}, inst.Sync())
+	sums, err := getChecksums(db, Webapp, "sync-mini")
+	if assert.NoError(t, err) && assert.NotNil(t, sums) {
+		assert.Len(t, sums.Files, 3)
+		assert.Contains(t, sums.Files, manifestName)
+	}
+
+	// Only the manifest has changed in the new version: it is the only file
+	// written by the fetcher, and the other ones are copied once in the
+	// staging directory, while the repository is moved
+	doUpgrade(5)
+	prev, err := GetWebappBySlug(db, "sync-mini")
+	if !assert.NoError(t, err) {
+		return
+	}
+	counter := &writesCounter{Fs: fs, writes: make(map[string]int)}
+	inst, err = NewInstaller(db, counter, &InstallerOptions{
+		Operation: Update,
+		Type:      Webapp,
+		Slug:      "sync-mini",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Update()
+	man, err := waitInstaller(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "5.0.0", VersionOf(man))
+	assert.Equal(t, &SyncReport{Written: 1, Skipped: 2, Copied: 2}, inst.Sync())
+	staged := 0
+	for name, n := range counter.writes {
+		if strings.HasPrefix(name, "/sync-mini@") {
+			staged += n
+		}
+	}
+	assert.Equal(t, 3, staged)
+	ok, _ := afero.Exists(fs, path.Join(FilesDir(prev), ".git"))
+	assert.False(t, ok)
+	ok, _ = afero.Exists(fs, path.Join(FilesDir(man), "apps/sub/sub"))
+	assert.True(t, ok)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -553,6 +1896,8 @@ func TestMain(m *testing.M) {
 	manifestClient = &http.Client{
 		Transport: &transport{},
 	}
+	// The archives of the tests are served on the loopback interface
+	config.GetConfig().Apps.AllowPrivateSources = true
 
 	res1 := RunTest(
 		m,
@@ -578,6 +1923,7 @@ func TestMain(m *testing.M) {
 func RunTest(m *testing.M, appType AppType, dbName, instDir, manName string, manGen func() string) int {
 	localVersion = "1.0.0"
 	manifestName = manName
+	manifestGenerator = manGen
 	installerType = appType
 
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -598,6 +1944,12 @@ func RunTest(m *testing.M, appType AppType, dbName, instDir, manName string, man
 		os.Exit(1)
 	}
 
+	err = couchdb.ResetDB(db, consts.AppsNamespaces)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	fs = afero.NewMemMapFs()
 
 	go serveGitRep(manName, manGen)
@@ -626,6 +1978,7 @@ func RunTest(m *testing.M, appType AppType, dbName, instDir, manName string, man
 
 	couchdb.DeleteDB(db, dbName)
 	couchdb.DeleteDB(db, consts.Files)
+	couchdb.DeleteDB(db, consts.AppsNamespaces)
 	couchdb.DeleteDB(db, consts.Permissions)
 	ts.Close()
 
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net/url"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -11,27 +13,85 @@ import (
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
 
+// Terms are the terms of service of the remote service of a konnector. The
+// user must accept them before the konnector can collect data.
+type Terms struct {
+	URL     string `json:"url"`
+	Version string `json:"version"`
+}
+
+// KonnectorField is a field of the account of a konnector, like the login or
+// the password asked to the user. The values of the fields with the password
+// type are secrets.
+type KonnectorField struct {
+	Type string `json:"type"`
+}
+
+// TermsAcceptance records the version of the terms of a konnector that the
+// user has accepted, and when.
+type TermsAcceptance struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
 type konnManifest struct {
 	DocRev string `json:"_rev,omitempty"` // konnManifest revision
 
-	Name        string     `json:"name"`
-	Type        string     `json:"type,omitempty"`
-	DocSource   string     `json:"source"`
-	DocSlug     string     `json:"slug"`
-	DocState    State      `json:"state"`
-	DocError    string     `json:"error,omitempty"`
-	Icon        string     `json:"icon"`
-	Description string     `json:"description"`
-	Developer   *Developer `json:"developer"`
+	Name          string            `json:"name"`
+	Type          string            `json:"type,omitempty"`
+	DocSource     string            `json:"source"`
+	DocSlug       string            `json:"slug"`
+	DocState      State             `json:"state"`
+	DocTransition *StateTransition  `json:"last_transition,omitempty"`
+	DocInstaller  *Subject          `json:"installed_by,omitempty"`
+	DocUpdater    *Subject          `json:"updated_by,omitempty"`
+	DocAvailable  bool              `json:"update_available"`
+	DocAvailVers  string            `json:"available_version,omitempty"`
+	DocCheckedAt  *time.Time        `json:"checked_at,omitempty"`
+	DocError      string            `json:"error,omitempty"`
+	DocErrorCode  string            `json:"error_code,omitempty"`
+	DocOperation  *PendingOperation `json:"operation,omitempty"`
+	DocSize       int64             `json:"size"`
+	DocFilesCount int               `json:"files_count"`
+	DocFromCache  *CacheOrigin      `json:"installed_from_cache,omitempty"`
+	DocResolved   string            `json:"resolved_source,omitempty"`
+	DocChannel    string            `json:"channel,omitempty"`
+	DocCommit     string            `json:"source_commit,omitempty"`
+	DocUpdatedAt  *time.Time        `json:"updated_at,omitempty"`
+	DocLastOp     *OperationMetrics `json:"last_operation,omitempty"`
+	DocSchema     int               `json:"schema_version,omitempty"`
+	DocFilesDir   string            `json:"files_dir,omitempty"`
+	DocAutoUpdate *bool             `json:"auto_update,omitempty"`
+	DocProtected  bool              `json:"protected"`
+	DocTermsOK    *TermsAcceptance  `json:"terms_accepted,omitempty"`
+	DocNeedsTerms bool              `json:"needs_terms_acceptance"`
+	Icon          string            `json:"icon"`
+	Description   string            `json:"description"`
+	Developer     *Developer        `json:"developer"`
+
+	LongDescription string            `json:"long_description,omitempty"`
+	DefaultLocale   string            `json:"default_locale"`
+	Locales         map[string]Locale `json:"locales"`
+
+	Version        string                    `json:"version"`
+	License        string                    `json:"license"`
+	DocPermissions permissions.Set           `json:"permissions"`
+	Terms          *Terms                    `json:"terms,omitempty"`
+	Fields         map[string]KonnectorField `json:"fields,omitempty"`
+	DocCategories  []string                  `json:"categories"`
+	DocTags        []string                  `json:"tags"`
+	DocReplacedBy  *Successor                `json:"replaced_by,omitempty"`
+	DocDeprecated  bool                      `json:"deprecated,omitempty"`
+	ContextSchema  ContextSchema             `json:"context_schema,omitempty"`
+	DocContext     map[string]interface{}    `json:"install_context,omitempty"`
+
+	DocExtras map[string]json.RawMessage `json:"extras,omitempty"`
 
-	DefaultLocale string `json:"default_locale"`
-	Locales       map[string]struct {
-		Description string `json:"description"`
-	} `json:"locales"`
+	// DocNamespaceLost is set when the namespace of the konnector has been
+	// taken over by another application (see claimNamespace)
+	DocNamespaceLost bool `json:"namespace_lost,omitempty"`
 
-	Version        string          `json:"version"`
-	License        string          `json:"license"`
-	DocPermissions permissions.Set `json:"permissions"`
+	warnings []string
 }
 
 func (m *konnManifest) ID() string        { return m.DocType() + "/" + m.DocSlug }
@@ -50,8 +110,111 @@ func (m *konnManifest) Error() error {
 	return errors.New(m.DocError)
 }
 
-func (m *konnManifest) SetState(state State) { m.DocState = state }
-func (m *konnManifest) SetError(err error)   { m.DocError = err.Error() }
+func (m *konnManifest) LastTransition() *StateTransition { return m.DocTransition }
+func (m *konnManifest) setState(state State, transition *StateTransition) {
+	m.DocState, m.DocTransition = state, transition
+}
+func (m *konnManifest) SetError(err error) {
+	m.DocError, m.DocErrorCode = err.Error(), ErrorCode(err)
+}
+
+// ErrorCode is part of the Manifest interface
+func (m *konnManifest) ErrorCode() string { return m.DocErrorCode }
+
+func (m *konnManifest) InstalledBy() *Subject { return m.DocInstaller }
+func (m *konnManifest) UpdatedBy() *Subject   { return m.DocUpdater }
+func (m *konnManifest) setSubjects(installedBy, updatedBy *Subject) {
+	m.DocInstaller, m.DocUpdater = installedBy, updatedBy
+}
+
+func (m *konnManifest) AvailableVersion() string { return m.DocAvailVers }
+func (m *konnManifest) CheckedAt() *time.Time    { return m.DocCheckedAt }
+func (m *konnManifest) setAvailableVersion(version string, checkedAt *time.Time) {
+	m.DocAvailable, m.DocAvailVers = version != "", version
+	if checkedAt != nil {
+		m.DocCheckedAt = checkedAt
+	}
+}
+
+func (m *konnManifest) Warnings() []string { return m.warnings }
+func (m *konnManifest) addWarning(warning string) {
+	m.warnings = append(m.warnings, warning)
+}
+
+func (m *konnManifest) Operation() *PendingOperation      { return m.DocOperation }
+func (m *konnManifest) SetOperation(op *PendingOperation) { m.DocOperation = op }
+
+func (m *konnManifest) Size() (int64, int) { return m.DocSize, m.DocFilesCount }
+func (m *konnManifest) SetSize(size int64, filesCount int) {
+	m.DocSize, m.DocFilesCount = size, filesCount
+}
+
+func (m *konnManifest) FromCache() *CacheOrigin          { return m.DocFromCache }
+func (m *konnManifest) SetFromCache(origin *CacheOrigin) { m.DocFromCache = origin }
+
+func (m *konnManifest) ResolvedSource() string     { return m.DocResolved }
+func (m *konnManifest) SetResolvedSource(u string) { m.DocResolved = u }
+
+func (m *konnManifest) Channel() string           { return m.DocChannel }
+func (m *konnManifest) SetChannel(channel string) { m.DocChannel = channel }
+
+func (m *konnManifest) Extras() map[string]json.RawMessage          { return m.DocExtras }
+func (m *konnManifest) SetExtras(extras map[string]json.RawMessage) { m.DocExtras = extras }
+
+func (m *konnManifest) SourceCommit() string          { return m.DocCommit }
+func (m *konnManifest) SetSourceCommit(commit string) { m.DocCommit = commit }
+
+func (m *konnManifest) UpdatedAt() time.Time {
+	if m.DocUpdatedAt == nil {
+		return time.Time{}
+	}
+	return *m.DocUpdatedAt
+}
+func (m *konnManifest) SetUpdatedAt(t time.Time) { m.DocUpdatedAt = &t }
+
+func (m *konnManifest) LastOperation() *OperationMetrics           { return m.DocLastOp }
+func (m *konnManifest) SetLastOperation(metrics *OperationMetrics) { m.DocLastOp = metrics }
+
+func (m *konnManifest) schemaVersion() int     { return m.DocSchema }
+func (m *konnManifest) setSchemaVersion(v int) { m.DocSchema = v }
+
+func (m *konnManifest) filesDir() string       { return m.DocFilesDir }
+func (m *konnManifest) setFilesDir(dir string) { m.DocFilesDir = dir }
+
+func (m *konnManifest) namespaceLost() bool        { return m.DocNamespaceLost }
+func (m *konnManifest) setNamespaceLost(lost bool) { m.DocNamespaceLost = lost }
+
+func (m *konnManifest) AutoUpdate() bool           { return m.DocAutoUpdate == nil || *m.DocAutoUpdate }
+func (m *konnManifest) SetAutoUpdate(enabled bool) { m.DocAutoUpdate = &enabled }
+
+func (m *konnManifest) Protected() bool             { return m.DocProtected }
+func (m *konnManifest) SetProtected(protected bool) { m.DocProtected = protected }
+
+func (m *konnManifest) Categories() []string { return normalizeCategories(m.DocCategories) }
+func (m *konnManifest) Tags() []string       { return normalizeTags(m.DocTags) }
+
+func (m *konnManifest) InstallContext() map[string]interface{}       { return m.DocContext }
+func (m *konnManifest) SetInstallContext(ctx map[string]interface{}) { m.DocContext = ctx }
+
+func (m *konnManifest) ReplacedBy() *Successor { return m.DocReplacedBy }
+func (m *konnManifest) SetReplacedBy(successor *Successor) {
+	m.DocReplacedBy, m.DocDeprecated = successor, successor != nil
+}
+
+// AcceptTerms records that the user has accepted the given version of the
+// terms of the konnector. It must be the version of the manifest.
+func (m *konnManifest) AcceptTerms(version string, at time.Time) error {
+	if m.Terms == nil {
+		return nil
+	}
+	if version != m.Terms.Version {
+		return &TermsError{URL: m.Terms.URL, Version: m.Terms.Version}
+	}
+	m.DocTermsOK = &TermsAcceptance{Version: version, AcceptedAt: at}
+	m.DocNeedsTerms = false
+	return nil
+}
+
 func (m *konnManifest) Permissions() permissions.Set {
 	return m.DocPermissions
 }
@@ -76,19 +239,64 @@ func (m *konnManifest) Valid(field, value string) bool {
 		return m.DocSlug == value
 	case "state":
 		return m.DocState == State(value)
+	case "category":
+		return hasCategory(m.DocCategories, value)
 	}
 	return false
 }
 
 func (m *konnManifest) ReadManifest(r io.Reader, slug, sourceURL string) error {
+	autoUpdate, accepted, ctx := m.DocAutoUpdate, m.DocTermsOK, m.DocContext
+	state, transition := m.DocState, m.DocTransition
+	installedBy, updatedBy := m.DocInstaller, m.DocUpdater
+	available, availVers, checkedAt := m.DocAvailable, m.DocAvailVers, m.DocCheckedAt
+	protected, filesDir, lost := m.DocProtected, m.DocFilesDir, m.DocNamespaceLost
+	m.Terms, m.DocCategories, m.DocTags, m.DocReplacedBy = nil, nil, nil, nil
+	m.ContextSchema, m.Fields = nil, nil
 	if err := json.NewDecoder(r).Decode(&m); err != nil {
 		return ErrBadManifest
 	}
-	if m.Type != "node" {
-		return ErrBadManifest
-	}
+	m.DocAutoUpdate, m.DocTermsOK, m.DocContext = autoUpdate, accepted, ctx
+	m.DocState, m.DocTransition = state, transition
+	m.DocInstaller, m.DocUpdater = installedBy, updatedBy
+	m.DocAvailable, m.DocAvailVers, m.DocCheckedAt = available, availVers, checkedAt
+	m.DocProtected, m.DocFilesDir, m.DocNamespaceLost = protected, filesDir, lost
+	m.DocDeprecated = m.DocReplacedBy != nil
+	m.DocNeedsTerms = m.Terms != nil && (accepted == nil || accepted.Version != m.Terms.Version)
 	m.DocSlug = slug
 	m.DocSource = sourceURL
+	m.Name = normalizeText(m.Name, false)
+	m.Description = normalizeText(m.Description, true)
+	m.LongDescription = normalizeText(m.LongDescription, true)
+	normalizeLocales(m.Locales)
+	m.DocCategories = normalizeCategories(m.DocCategories)
+	m.DocTags = normalizeTags(m.DocTags)
+	m.DocSchema = SchemaVersion
+	return m.validate()
+}
+
+func (m *konnManifest) validate() error {
+	var errs ManifestErrors
+	if m.Name == "" {
+		errs = errs.add("/name", ManifestMissingField, "the name is mandatory")
+	}
+	errs, m.warnings = validateDoctypes(m.DocPermissions, errs)
+	errs = validateSuccessor(m.DocReplacedBy, errs)
+	errs = validateSchema(m.ContextSchema, errs)
+	if m.Type != "node" {
+		errs = errs.add("/type", ManifestInvalidValue, "the type of a konnector must be node")
+	}
+	if m.Terms != nil {
+		if u, err := url.Parse(m.Terms.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = errs.add("/terms/url", ManifestInvalidValue, "the terms must have an http or https URL")
+		}
+		if m.Terms.Version == "" {
+			errs = errs.add("/terms/version", ManifestMissingField, "the terms must have a version")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
@@ -97,19 +305,33 @@ func (m *konnManifest) ReadManifest(r io.Reader, slug, sourceURL string) error {
 func GetKonnectorBySlug(db couchdb.Database, slug string) (Manifest, error) {
 	man := &konnManifest{}
 	err := couchdb.GetDoc(db, consts.Konnectors, consts.Konnectors+"/"+slug, man)
+	if err == nil {
+		upgradeDoc(db, man)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return man, nil
 }
 
-// ListKonnectors returns the list of installed konnectors applications.
-//
-// TODO: pagination
+// ListKonnectors returns the list of installed konnectors applications. The
+// documents written before the current schema version are upgraded.
 func ListKonnectors(db couchdb.Database) ([]Manifest, error) {
+	mans, err := listKonnectorDocs(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, man := range mans {
+		upgradeDoc(db, man)
+	}
+	return mans, nil
+}
+
+// listKonnectorDocs returns the documents of the konnectors, as they are in
+// CouchDB.
+func listKonnectorDocs(db couchdb.Database) ([]Manifest, error) {
 	var docs []*konnManifest
-	req := &couchdb.AllDocsRequest{Limit: 100}
-	err := couchdb.GetAllDocs(db, consts.Konnectors, req, &docs)
+	err := getAllAppDocs(db, consts.Konnectors, &docs)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,300 @@
+package apps
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// KonnectorLogsRuns is the number of executions of a konnector whose logs are
+// kept
+var KonnectorLogsRuns = 10
+
+// KonnectorLogMaxLines is the maximal number of lines kept for the log of an
+// execution. The last lines are kept, as they are the ones that tell why the
+// execution has failed.
+var KonnectorLogMaxLines = 1000
+
+// KonnectorLogMaxSize is the maximal size in bytes of the lines kept for the
+// log of an execution, and KonnectorLogMaxLineSize the one of a line: a
+// longer line is cut.
+var (
+	KonnectorLogMaxSize     = 1 << 20
+	KonnectorLogMaxLineSize = 64 << 10
+)
+
+// redactedSecret replaces the secrets in the logs of the konnectors
+const redactedSecret = "[REDACTED]"
+
+// KonnectorRun is the log of an execution of a konnector
+type KonnectorRun struct {
+	JobID     string    `json:"job_id"`
+	Date      time.Time `json:"date"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Lines     []string  `json:"lines"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// KonnectorLogs are the logs of the last executions of a konnector, from the
+// most recent one. There is one document per konnector, with its slug as
+// identifier, like for the results.
+type KonnectorLogs struct {
+	DocID  string          `json:"_id,omitempty"`
+	DocRev string          `json:"_rev,omitempty"`
+	Runs   []*KonnectorRun `json:"runs"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (l *KonnectorLogs) ID() string { return l.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (l *KonnectorLogs) Rev() string { return l.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (l *KonnectorLogs) DocType() string { return consts.KonnectorLogs }
+
+// SetID is used to implement the couchdb.Doc interface
+func (l *KonnectorLogs) SetID(id string) { l.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (l *KonnectorLogs) SetRev(rev string) { l.DocRev = rev }
+
+// KonnectorOutput collects the output of an execution of a konnector, for
+// its log. The output is split in lines, and the values of the password
+// fields declared by the manifest of the konnector are redacted from each
+// line before any limit is applied. Only the last lines are kept, up to
+// KonnectorLogMaxLines and KonnectorLogMaxSize, as they are the ones that
+// tell why the execution has failed.
+//
+// It can be used for both the stdout and the stderr of a command, as they
+// are not written concurrently.
+type KonnectorOutput struct {
+	secrets   []string
+	maxSecret int
+	lines     []string
+	size      int
+	partial   []byte
+	skipping  bool // the end of a line that has been cut is ignored
+	truncated bool
+}
+
+// NewKonnectorOutput returns the output of an execution of a konnector, that
+// redacts the secrets of the given fields of the account.
+func NewKonnectorOutput(db couchdb.Database, slug string, fields json.RawMessage) (*KonnectorOutput, error) {
+	var secrets []string
+	if man, err := GetKonnectorBySlug(db, slug); err == nil {
+		secrets = secretValues(man, fields)
+	} else if !couchdb.IsNotFoundError(err) {
+		return nil, err
+	}
+	return newKonnectorOutput(secrets), nil
+}
+
+func newKonnectorOutput(secrets []string) *KonnectorOutput {
+	o := &KonnectorOutput{secrets: secrets}
+	for _, secret := range secrets {
+		if len(secret) > o.maxSecret {
+			o.maxSecret = len(secret)
+		}
+	}
+	return o
+}
+
+// Write is used to implement the io.Writer interface. It never fails, so that
+// a verbose konnector is not stopped.
+func (o *KonnectorOutput) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if !o.skipping {
+			o.partial = append(o.partial, chunk...)
+			// A long line is cut once it has the kept part and enough bytes
+			// after it to redact a secret that would start in it
+			if len(o.partial) >= KonnectorLogMaxLineSize+o.maxSecret {
+				o.addLine()
+				o.skipping = true
+			}
+		}
+		if i < 0 {
+			break
+		}
+		if !o.skipping {
+			o.addLine()
+		}
+		o.skipping = false
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Lines returns the lines kept from the output, with the last line even if
+// it has no line feed.
+func (o *KonnectorOutput) Lines() []string {
+	if len(o.partial) > 0 {
+		o.addLine()
+	}
+	if o.lines == nil {
+		return []string{}
+	}
+	return o.lines
+}
+
+// Truncated returns true if some lines, or the end of a line, have not been
+// kept.
+func (o *KonnectorOutput) Truncated() bool {
+	return o.truncated
+}
+
+// addLine redacts the pending line, and adds it to the kept lines. The
+// oldest lines are removed to respect the limits.
+func (o *KonnectorOutput) addLine() {
+	line := redactSecrets(strings.TrimSuffix(string(o.partial), "\r"), o.secrets)
+	o.partial = o.partial[:0]
+	if len(line) > KonnectorLogMaxLineSize {
+		line = cutLine(line, KonnectorLogMaxLineSize, o.secrets)
+		o.truncated = true
+	}
+	o.lines = append(o.lines, line)
+	o.size += len(line)
+	for len(o.lines) > KonnectorLogMaxLines || o.size > KonnectorLogMaxSize {
+		o.size -= len(o.lines[0])
+		o.lines = o.lines[1:]
+		o.truncated = true
+	}
+}
+
+// cutLine returns the first max bytes of a redacted line, without the end
+// that could be the beginning of a secret cut by the limit.
+func cutLine(line string, max int, secrets []string) string {
+	line = line[:max]
+	for cut := true; cut; {
+		cut = false
+		for _, secret := range secrets {
+			for n := len(secret) - 1; n > 0; n-- {
+				if strings.HasSuffix(line, secret[:n]) {
+					line = line[:len(line)-n]
+					cut = true
+					break
+				}
+			}
+		}
+	}
+	return line
+}
+
+// SaveKonnectorLog records the output of an execution of a konnector, with
+// the error of the execution, whose secrets are redacted too. A new attempt
+// of the same job replaces the log of the previous one.
+func SaveKonnectorLog(db couchdb.Database, slug, jobID string, output *KonnectorOutput, execErr error) error {
+	run := &KonnectorRun{
+		JobID:     jobID,
+		Date:      time.Now().UTC(),
+		State:     KonnectorDone,
+		Lines:     output.Lines(),
+		Truncated: output.Truncated(),
+	}
+	if execErr != nil {
+		run.State = KonnectorErrored
+		run.Error = redactSecrets(execErr.Error(), output.secrets)
+	}
+
+	logs := &KonnectorLogs{}
+	err := couchdb.GetDoc(db, consts.KonnectorLogs, slug, logs)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	exists := err == nil
+	runs := []*KonnectorRun{run}
+	for _, r := range logs.Runs {
+		if len(runs) >= KonnectorLogsRuns {
+			break
+		}
+		if jobID == "" || r.JobID != jobID {
+			runs = append(runs, r)
+		}
+	}
+	logs.DocID = slug
+	logs.Runs = runs
+	if exists {
+		return couchdb.UpdateDoc(db, logs)
+	}
+	return couchdb.CreateNamedDocWithDB(db, logs)
+}
+
+// GetKonnectorLog returns the log of an execution of a konnector: the one of
+// the given job, or the last one if jobID is empty.
+func GetKonnectorLog(db couchdb.Database, slug, jobID string) (*KonnectorRun, error) {
+	logs := &KonnectorLogs{}
+	err := couchdb.GetDoc(db, consts.KonnectorLogs, slug, logs)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrKonnectorLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range logs.Runs {
+		if jobID == "" || run.JobID == jobID {
+			return run, nil
+		}
+	}
+	return nil, ErrKonnectorLogNotFound
+}
+
+// deleteKonnectorLogs removes the logs of a konnector that is deleted
+func deleteKonnectorLogs(db couchdb.Database, slug string) error {
+	logs := &KonnectorLogs{}
+	err := couchdb.GetDoc(db, consts.KonnectorLogs, slug, logs)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, logs)
+}
+
+// secretValues returns the values of the fields of an account that are
+// declared with the password type by the manifest of the konnector.
+func secretValues(man Manifest, fields json.RawMessage) []string {
+	m, ok := man.(*konnManifest)
+	if !ok || len(m.Fields) == 0 || len(fields) == 0 {
+		return nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(fields, &values); err != nil {
+		return nil
+	}
+	var secrets []string
+	for name, field := range m.Fields {
+		if field.Type != "password" {
+			continue
+		}
+		if value, ok := values[name].(string); ok && value != "" {
+			secrets = append(secrets, value)
+			// The secret can also be written in a JSON string, with escaped
+			// characters
+			if b, err := json.Marshal(value); err == nil {
+				if escaped := string(b[1 : len(b)-1]); escaped != value {
+					secrets = append(secrets, escaped)
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redactedSecret, -1)
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package apps
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The states of the executions of the konnectors
+const (
+	KonnectorDone    = "done"
+	KonnectorErrored = "errored"
+)
+
+// konnectorResultsLimit is the maximal number of results read by
+// GetKonnectorResults, like for the list of the konnectors
+const konnectorResultsLimit = 100
+
+// KonnectorResult is the state of the last execution of a konnector. There
+// is one document per konnector, with its slug as identifier.
+type KonnectorResult struct {
+	DocID  string    `json:"_id,omitempty"`
+	DocRev string    `json:"_rev,omitempty"`
+	Date   time.Time `json:"date"`
+	State  string    `json:"state"`
+	Error  string    `json:"error"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (r *KonnectorResult) ID() string { return r.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (r *KonnectorResult) Rev() string { return r.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (r *KonnectorResult) DocType() string { return consts.KonnectorResults }
+
+// SetID is used to implement the couchdb.Doc interface
+func (r *KonnectorResult) SetID(id string) { r.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (r *KonnectorResult) SetRev(rev string) { r.DocRev = rev }
+
+// SaveKonnectorResult records the end of an execution of a konnector, with
+// the error of the execution if it has failed.
+func SaveKonnectorResult(db couchdb.Database, slug string, execErr error) error {
+	result := &KonnectorResult{}
+	err := couchdb.GetDoc(db, consts.KonnectorResults, slug, result)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	exists := err == nil
+	result.DocID = slug
+	result.Date = time.Now().UTC()
+	result.State = KonnectorDone
+	result.Error = ""
+	if execErr != nil {
+		result.State = KonnectorErrored
+		result.Error = execErr.Error()
+	}
+	if exists {
+		return couchdb.UpdateDoc(db, result)
+	}
+	return couchdb.CreateNamedDocWithDB(db, result)
+}
+
+// GetKonnectorResults returns the results of the last executions of the
+// konnectors, indexed by their slugs. They are fetched with a single request.
+func GetKonnectorResults(db couchdb.Database) (map[string]*KonnectorResult, error) {
+	var docs []*KonnectorResult
+	req := &couchdb.AllDocsRequest{Limit: konnectorResultsLimit}
+	err := couchdb.GetAllDocs(db, consts.KonnectorResults, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	results := make(map[string]*KonnectorResult, len(docs))
+	for _, r := range docs {
+		results[r.DocID] = r
+	}
+	return results, nil
+}
@@ -0,0 +1,267 @@
+package apps
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// compressedSuffixes are the extensions of the precompressed siblings of the
+// files of the applications, like app.js.gz for app.js
+var compressedSuffixes = []string{".gz", ".br"}
+
+// CompactReport is the list of the files removed from the directories of the
+// applications of an instance by CompactFiles.
+type CompactReport struct {
+	// Removed are the paths of the compressed files whose original is gone
+	Removed []string `json:"removed"`
+	// Skipped are the slugs of the applications with an operation in
+	// progress, that are left as they are
+	Skipped        []string `json:"skipped"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// CompactFiles removes the compressed siblings (.gz, .br) of the files of the
+// applications whose original file is gone, like after an update that has
+// deleted it. A compressed file that is itself a file of the application, as
+// recorded in its checksums, is kept, and so are the applications whose
+// checksums are not known.
+//
+// Nothing is removed in the directory of an application while an operation is
+// in progress on it: the operation is recorded on its document during the
+// removal, like for an update.
+func CompactFiles(db couchdb.Database, fs afero.Fs, appType AppType) (*CompactReport, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	report := &CompactReport{Removed: []string{}, Skipped: []string{}}
+	for _, man := range mans {
+		slug := man.Slug()
+		if man.Operation().Fresh() || operationRunning(db, appType, slug) {
+			report.Skipped = append(report.Skipped, slug)
+			continue
+		}
+		sums, err := getChecksums(db, appType, slug)
+		if err != nil {
+			return nil, err
+		}
+		if sums == nil {
+			continue
+		}
+		dir := FilesDir(man)
+		orphans, err := orphanCompressed(fs, dir, sums.Files)
+		if err != nil {
+			return nil, err
+		}
+		if len(orphans) == 0 {
+			continue
+		}
+		done, err := compactApp(db, fs, man, sums.Files, report)
+		if err != nil {
+			return nil, err
+		}
+		if !done {
+			report.Skipped = append(report.Skipped, slug)
+		}
+	}
+	return report, nil
+}
+
+// compactApp removes the orphan compressed files of an application, after it
+// has recorded the operation on its document. It returns false if another
+// operation has started in the meantime.
+func compactApp(db couchdb.Database, fs afero.Fs, man Manifest, files map[string]string, report *CompactReport) (bool, error) {
+	appType, slug := typeOf(man), man.Slug()
+	defer holdOperation(db, appType, slug)()
+	err := startOperation(db, man, "compacting", utils.RandomString(16), "")
+	if _, ok := err.(*OperationInProgressError); ok || couchdb.IsConflictError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The files are listed again, now that no update can change them
+	dir := FilesDir(man)
+	var removed int
+	var reclaimed int64
+	orphans, err := orphanCompressed(fs, dir, files)
+	for _, name := range orphans {
+		p := path.Join(dir, name)
+		var info os.FileInfo
+		if info, err = fs.Stat(p); os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if err == nil {
+			err = fs.Remove(p)
+		}
+		if err != nil {
+			break
+		}
+		report.Removed = append(report.Removed, p)
+		removed++
+		reclaimed += info.Size()
+	}
+	report.ReclaimedBytes += reclaimed
+
+	man.SetOperation(nil)
+	if erru := couchdb.UpdateDoc(db, man); err == nil {
+		err = erru
+	}
+	if err != nil {
+		return false, err
+	}
+	domain := strings.TrimSuffix(db.Prefix(), "/")
+	log.Infof("[audit] [apps] %d orphan compressed files of the %s %s on %s removed: %s reclaimed",
+		removed, appType, slug, domain, utils.FormatSize(reclaimed))
+	return true, nil
+}
+
+// orphanCompressed returns the compressed files in the directory of an
+// application, relative to it, whose original file is gone and that are not
+// files of the application. The .git directory is not looked at.
+func orphanCompressed(fs afero.Fs, dir string, files map[string]string) ([]string, error) {
+	var orphans []string
+	err := afero.Walk(fs, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(p, dir+"/")
+		if info.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, known := files[rel]; known {
+			return nil
+		}
+		for _, suffix := range compressedSuffixes {
+			if !strings.HasSuffix(rel, suffix) {
+				continue
+			}
+			if _, err := fs.Stat(strings.TrimSuffix(p, suffix)); os.IsNotExist(err) {
+				orphans = append(orphans, rel)
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return orphans, err
+}
+
+// MaintenanceReport is the result of a run of the maintenance, for all the
+// instances it has been run on.
+type MaintenanceReport struct {
+	// RemovedFiles is the number of orphan compressed files removed from the
+	// directories of the applications, and ReclaimedBytes their size
+	RemovedFiles   int   `json:"removed_files"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	// SkippedApps is the number of applications left as they are, because
+	// an operation was in progress on them
+	SkippedApps int `json:"skipped_apps"`
+	// CacheEvicted is the number of entries evicted from the source cache,
+	// and CacheReclaimedBytes the size of the files removed from it
+	CacheEvicted        int   `json:"cache_evicted"`
+	CacheReclaimedBytes int64 `json:"cache_reclaimed_bytes"`
+}
+
+// Maintenance periodically removes the files that accumulate after many
+// updates: the orphan compressed files in the directories of the
+// applications, and the entries of the source cache beyond its maximal size.
+type Maintenance struct {
+	forEach  func(fn func(AutoUpdateTarget) error) error
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewMaintenance returns a maintenance configured with the apps.maintenance
+// section of the configuration. The forEach function iterates over the
+// instances.
+func NewMaintenance(forEach func(fn func(AutoUpdateTarget) error) error) *Maintenance {
+	return &Maintenance{
+		forEach:  forEach,
+		interval: config.GetConfig().Apps.MaintenanceInterval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the maintenance after each interval until the context is done.
+// Unlike the reaper, it doesn't run at the start of the stack, as it walks
+// the files of all the applications.
+func (m *Maintenance) Start(ctx context.Context) {
+	if m.interval <= 0 {
+		close(m.done)
+		return
+	}
+	go func() {
+		defer close(m.done)
+		utils.Every(ctx, m.interval, func(ctx context.Context) error {
+			m.Run(ctx)
+			return nil
+		})
+	}()
+}
+
+// Wait waits for the end of the run of the maintenance in progress, after the
+// context given to Start is done.
+func (m *Maintenance) Wait(ctx context.Context) error {
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run compacts the directories of the applications of all the instances, and
+// trims the source cache, once. The errors are logged, and the instances
+// that can't be compacted are not counted in the report.
+func (m *Maintenance) Run(ctx context.Context) *MaintenanceReport {
+	report := &MaintenanceReport{}
+	err := m.forEach(func(target AutoUpdateTarget) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, appType := range []AppType{Webapp, Konnector} {
+			r, err := CompactFiles(target, target.AppsFS(appType), appType)
+			if err != nil {
+				log.Errorf("[apps] could not compact the files of the %ss of %s: %s",
+					appType, strings.TrimSuffix(target.Prefix(), "/"), err)
+				continue
+			}
+			report.RemovedFiles += len(r.Removed)
+			report.ReclaimedBytes += r.ReclaimedBytes
+			report.SkippedApps += len(r.Skipped)
+		}
+		return nil
+	})
+	if err != nil && err != ctx.Err() {
+		log.Errorf("[apps] could not list the instances for the maintenance: %s", err)
+	}
+
+	if cache := sharedSourceCache(); cache != nil {
+		evicted, reclaimed, err := cache.Trim()
+		if err != nil {
+			log.Errorf("[apps] could not trim the source cache: %s", err)
+		} else if evicted > 0 || reclaimed > 0 {
+			log.Infof("[audit] [apps] %d entries evicted from the source cache: %s reclaimed",
+				evicted, utils.FormatSize(reclaimed))
+		}
+		report.CacheEvicted, report.CacheReclaimedBytes = evicted, reclaimed
+	}
+	return report
+}
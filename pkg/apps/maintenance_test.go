@@ -0,0 +1,76 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactFiles(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	ready := &WebappManifest{DocSlug: "mini-compact", DocState: Ready}
+	busy := &WebappManifest{
+		DocSlug:      "mini-compact-busy",
+		DocState:     Upgrading,
+		DocOperation: newOperation("updating", ""),
+	}
+	slugs := []string{"mini-compact", "mini-compact-busy"}
+	defer func() {
+		for _, slug := range slugs {
+			if man, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, man)
+			}
+			deleteChecksums(db, Webapp, slug)
+		}
+	}()
+	for _, man := range []*WebappManifest{ready, busy} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+	}
+
+	memfs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/index.html":    "<html></html>",
+		"/index.html.gz": "index",
+		"/old.js.gz":     "old",
+		"/old.css.br":    "old",
+		"/data.json.gz":  "data",
+		"/.git/HEAD.gz":  "git",
+	}
+	for name, content := range files {
+		for _, slug := range slugs {
+			assert.NoError(t, afero.WriteFile(memfs, "/"+slug+name, []byte(content), 0644))
+		}
+	}
+	// data.json.gz is a file of the application, not a compressed sibling
+	sums := map[string]string{"index.html": "a", "index.html.gz": "b", "data.json.gz": "c"}
+	for _, slug := range slugs {
+		assert.NoError(t, saveChecksums(db, Webapp, slug, sums))
+	}
+
+	report, err := CompactFiles(db, memfs, Webapp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"/mini-compact/old.css.br", "/mini-compact/old.js.gz"}, report.Removed)
+	assert.Equal(t, []string{"mini-compact-busy"}, report.Skipped)
+	assert.Equal(t, int64(6), report.ReclaimedBytes)
+
+	for _, name := range []string{"/index.html.gz", "/data.json.gz", "/.git/HEAD.gz"} {
+		exists, _ := afero.Exists(memfs, "/mini-compact"+name)
+		assert.True(t, exists, name)
+	}
+	exists, _ := afero.Exists(memfs, "/mini-compact-busy/old.js.gz")
+	assert.True(t, exists)
+
+	man, err := GetWebappBySlug(db, "mini-compact")
+	if assert.NoError(t, err) {
+		assert.Nil(t, man.Operation())
+		assert.Equal(t, Ready, man.State())
+	}
+}
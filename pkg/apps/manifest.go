@@ -0,0 +1,134 @@
+package apps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// ManifestMaxDepth is the maximal nesting depth of the objects and arrays in
+// a manifest
+const ManifestMaxDepth = 32
+
+// ErrManifestTooLarge is used when the manifest is larger than the maximal
+// size allowed by the configuration
+var ErrManifestTooLarge = errors.New("Application manifest is too large")
+
+// ErrManifestTooDeep is used when the manifest has too many nested objects or
+// arrays
+var ErrManifestTooDeep = fmt.Errorf("Application manifest has more than %d nested levels", ManifestMaxDepth)
+
+// ManifestSizeLimit returns the maximal size in bytes of a manifest, from the
+// configuration or ManifestMaxSize by default
+func ManifestSizeLimit() int64 {
+	if size := config.GetConfig().Apps.ManifestMaxSize; size > 0 {
+		return size
+	}
+	return ManifestMaxSize
+}
+
+// readManifestBody reads a manifest from the source, without reading more
+// than the maximal size, and checks that it is not too deeply nested before
+// it is decoded.
+func readManifestBody(r io.Reader) ([]byte, error) {
+	b, err := utils.ReadAllCapped(r, ManifestSizeLimit())
+	if err == utils.ErrTooLarge {
+		return nil, ErrManifestTooLarge
+	}
+	if err != nil {
+		return nil, ErrManifestNotReachable
+	}
+	if err = checkDepth(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkDepth walks the JSON tokens to check the nesting depth
+func checkDepth(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && depth == 0 {
+			return nil
+		}
+		if err != nil {
+			return ErrBadManifest
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > ManifestMaxDepth {
+				return ErrManifestTooDeep
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// sanitizeText removes the control characters from a string of the manifest
+// that will be displayed to the user. The line feeds are kept if multiline is
+// true.
+func sanitizeText(s string, multiline bool) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' && multiline {
+			return r
+		}
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// OthersCategory is the category of the applications whose manifest has no
+// category
+const OthersCategory = "others"
+
+// normalizeCategories returns the categories of a manifest in lowercase and
+// without duplicates, or OthersCategory if there is none.
+func normalizeCategories(categories []string) []string {
+	normalized := make([]string, 0, len(categories))
+	for _, c := range categories {
+		c = strings.ToLower(strings.TrimSpace(sanitizeText(c, false)))
+		if c != "" {
+			normalized = append(normalized, c)
+		}
+	}
+	if len(normalized) == 0 {
+		return []string{OthersCategory}
+	}
+	return utils.UniqueStrings(normalized)
+}
+
+// normalizeTags returns the non-empty tags of a manifest, without duplicates
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.TrimSpace(sanitizeText(t, false))
+		if t != "" {
+			normalized = append(normalized, t)
+		}
+	}
+	return utils.UniqueStrings(normalized)
+}
+
+// hasCategory returns true if the category is one of the given categories.
+// The comparison is case-insensitive.
+func hasCategory(categories []string, category string) bool {
+	for _, c := range normalizeCategories(categories) {
+		if c == strings.ToLower(category) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package apps
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// AppNamespace is the owner of a namespace of the routes of an instance. The
+// namespace of an application is the label of its sub-domain, given by its
+// slug, and it can be claimed by only one application, webapp or konnector.
+// There is one document per namespace, with the namespace as identifier. It
+// is updated when the applications are installed, updated or deleted.
+type AppNamespace struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Slug   string `json:"slug"`
+	Type   string `json:"type"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (n *AppNamespace) ID() string { return n.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (n *AppNamespace) Rev() string { return n.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (n *AppNamespace) DocType() string { return consts.AppsNamespaces }
+
+// SetID is used to implement the couchdb.Doc interface
+func (n *AppNamespace) SetID(id string) { n.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (n *AppNamespace) SetRev(rev string) { n.DocRev = rev }
+
+// owns returns true if the namespace is claimed by the given application
+func (n *AppNamespace) owns(slug string, appType AppType) bool {
+	return n.Slug == slug && n.Type == appType.String()
+}
+
+// ownerType returns the type of the application that owns the namespace
+func (n *AppNamespace) ownerType() AppType {
+	if n.Type == Konnector.String() {
+		return Konnector
+	}
+	return Webapp
+}
+
+// namespaceOf returns the namespace claimed by an application. The domain
+// names are case-insensitive, and so are the namespaces.
+func namespaceOf(slug string) string {
+	return strings.ToLower(slug)
+}
+
+// otherType returns the other type of applications, that can claim the same
+// namespaces
+func otherType(appType AppType) AppType {
+	if appType == Konnector {
+		return Webapp
+	}
+	return Konnector
+}
+
+// GetNamespaceOwner returns the owner of the namespace of the given slug, or
+// nil if it has not been claimed.
+func GetNamespaceOwner(db couchdb.Database, slug string) (*AppNamespace, error) {
+	ns := &AppNamespace{}
+	err := couchdb.GetDoc(db, consts.AppsNamespaces, namespaceOf(slug), ns)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// namespaceClaim is a namespace claimed by an installation, with what it has
+// changed, so that the claim can be undone if the installation fails.
+type namespaceClaim struct {
+	slug     string
+	appType  AppType
+	previous *AppNamespace // the previous owner in the index, if still installed
+	lost     Manifest      // the application flagged with namespace_lost, if any
+}
+
+// claimNamespace records the application as the owner of its namespace. A
+// NamespaceConflictError is returned if the namespace is owned by another
+// installed application, unless takeOver is true: the namespace is then
+// reassigned, and the other application is flagged with namespace_lost.
+//
+// The applications installed before the index of the namespaces are not in
+// it, so the application of the other type with the same slug is looked for
+// when the namespace has no owner. An application that has lost its
+// namespace doesn't prevent another one to claim it.
+//
+// The returned claim is nil if the application already owned its namespace.
+func claimNamespace(db couchdb.Database, slug string, appType AppType, takeOver bool) (*namespaceClaim, error) {
+	ns, err := GetNamespaceOwner(db, slug)
+	if err != nil {
+		return nil, err
+	}
+	if ns != nil && ns.owns(slug, appType) {
+		return nil, nil
+	}
+	var owner Manifest
+	if ns != nil {
+		owner, err = GetBySlug(db, ns.Slug, ns.ownerType())
+	} else {
+		owner, err = GetBySlug(db, slug, otherType(appType))
+	}
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return nil, err
+	}
+	claim := &namespaceClaim{slug: slug, appType: appType}
+	if ns != nil && owner != nil {
+		claim.previous = &AppNamespace{Slug: ns.Slug, Type: ns.Type}
+	}
+	if owner != nil && !owner.namespaceLost() {
+		if !takeOver {
+			return nil, &NamespaceConflictError{Namespace: namespaceOf(slug), Slug: owner.Slug()}
+		}
+		owner.setNamespaceLost(true)
+		if err = couchdb.UpdateDoc(db, owner); err != nil {
+			return nil, err
+		}
+		claim.lost = owner
+		log.Infof("[apps] The namespace %s of %s has been taken over by %s",
+			namespaceOf(slug), owner.Slug(), slug)
+	}
+	if ns == nil {
+		ns = &AppNamespace{DocID: namespaceOf(slug)}
+		ns.Slug, ns.Type = slug, appType.String()
+		return claim, couchdb.CreateNamedDocWithDB(db, ns)
+	}
+	ns.Slug, ns.Type = slug, appType.String()
+	return claim, couchdb.UpdateDoc(db, ns)
+}
+
+// undo gives the namespace back to its previous owner, and removes the
+// namespace_lost flag of the application that has lost it, if any. Nothing
+// is changed if the namespace has been claimed by another application since.
+func (c *namespaceClaim) undo(db couchdb.Database) error {
+	ns, err := GetNamespaceOwner(db, c.slug)
+	if err != nil || ns == nil || !ns.owns(c.slug, c.appType) {
+		return err
+	}
+	if c.previous == nil {
+		err = couchdb.DeleteDoc(db, ns)
+	} else {
+		ns.Slug, ns.Type = c.previous.Slug, c.previous.Type
+		err = couchdb.UpdateDoc(db, ns)
+	}
+	if err != nil || c.lost == nil {
+		return err
+	}
+	owner, err := GetBySlug(db, c.lost.Slug(), typeOf(c.lost))
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner.setNamespaceLost(false)
+	if err = couchdb.UpdateDoc(db, owner); err != nil {
+		return err
+	}
+	log.Infof("[apps] The namespace %s has been given back to %s",
+		namespaceOf(c.slug), owner.Slug())
+	return nil
+}
+
+// refreshNamespace claims the namespace of an updated application, if it is
+// free, and removes its namespace_lost flag once it owns it again. It doesn't
+// take over the namespace of another application.
+func refreshNamespace(db couchdb.Database, man Manifest) error {
+	_, err := claimNamespace(db, man.Slug(), typeOf(man), false)
+	if _, ok := err.(*NamespaceConflictError); ok {
+		return nil
+	}
+	if err != nil || !man.namespaceLost() {
+		return err
+	}
+	man.setNamespaceLost(false)
+	return nil
+}
+
+// releaseNamespace removes the application as the owner of its namespace,
+// when it is deleted.
+func releaseNamespace(db couchdb.Database, slug string, appType AppType) error {
+	ns, err := GetNamespaceOwner(db, slug)
+	if err != nil || ns == nil || !ns.owns(slug, appType) {
+		return err
+	}
+	return couchdb.DeleteDoc(db, ns)
+}
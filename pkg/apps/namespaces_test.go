@@ -0,0 +1,165 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceConflict(t *testing.T) {
+	// An application of the other type, installed before the index of the
+	// namespaces, has the same slug
+	var other Manifest = &konnManifest{DocSlug: "ns-mini", DocState: Ready, DocSource: "git://localhost/"}
+	if installerType == Konnector {
+		other = &WebappManifest{DocSlug: "ns-mini", DocState: Ready, DocSource: "git://localhost/"}
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(db, other)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetBySlug(db, "ns-mini", typeOf(other)); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		releaseNamespace(db, "ns-mini", typeOf(other))
+	}()
+
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "ns-mini",
+		SourceURL: "git://localhost/",
+	})
+	assert.Nil(t, inst)
+	if e, ok := err.(*NamespaceConflictError); assert.True(t, ok) {
+		assert.Equal(t, "ns-mini", e.Namespace)
+		assert.Equal(t, "ns-mini", e.Slug)
+	}
+	_, err = GetBySlug(db, "ns-mini", installerType)
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// The namespace can be taken over, and the other application is flagged
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "ns-mini",
+		SourceURL: "git://localhost/",
+		TakeOver:  true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	if _, err = waitInstaller(inst); !assert.NoError(t, err) {
+		return
+	}
+	owner, err := GetNamespaceOwner(db, "ns-mini")
+	if assert.NoError(t, err) && assert.NotNil(t, owner) {
+		assert.True(t, owner.owns("ns-mini", installerType))
+	}
+	flagged, err := GetBySlug(db, "ns-mini", typeOf(other))
+	if assert.NoError(t, err) {
+		assert.True(t, flagged.namespaceLost())
+	}
+
+	// A flagged application doesn't take the namespace back by itself
+	assert.NoError(t, refreshNamespace(db, flagged))
+	assert.True(t, flagged.namespaceLost())
+
+	// The namespace is released when the application is deleted, and the
+	// flagged application can then claim it again
+	inst, err = NewInstaller(db, fs, &InstallerOptions{
+		Operation: Delete,
+		Type:      installerType,
+		Slug:      "ns-mini",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = inst.Delete()
+	if !assert.NoError(t, err) {
+		return
+	}
+	owner, err = GetNamespaceOwner(db, "ns-mini")
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+
+	assert.NoError(t, refreshNamespace(db, flagged))
+	assert.False(t, flagged.namespaceLost())
+	owner, err = GetNamespaceOwner(db, "ns-mini")
+	if assert.NoError(t, err) && assert.NotNil(t, owner) {
+		assert.True(t, owner.owns("ns-mini", typeOf(other)))
+	}
+}
+
+func TestNamespaceOfDeletedOwner(t *testing.T) {
+	// The owner of the namespace is no longer installed
+	ns := &AppNamespace{DocID: "ns-gone", Slug: "ns-gone", Type: otherType(installerType).String()}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(db, ns)) {
+		return
+	}
+	defer releaseNamespace(db, "ns-gone", installerType)
+
+	_, err := claimNamespace(db, "ns-gone", installerType, false)
+	assert.NoError(t, err)
+	owner, err := GetNamespaceOwner(db, "NS-Gone")
+	if assert.NoError(t, err) && assert.NotNil(t, owner) {
+		assert.True(t, owner.owns("ns-gone", installerType))
+	}
+}
+
+func TestFailedTakeOver(t *testing.T) {
+	var other Manifest = &konnManifest{DocSlug: "ns-failed", DocState: Ready, DocSource: "git://localhost/"}
+	if installerType == Konnector {
+		other = &WebappManifest{DocSlug: "ns-failed", DocState: Ready, DocSource: "git://localhost/"}
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(db, other)) {
+		return
+	}
+	ns := &AppNamespace{DocID: "ns-failed", Slug: "ns-failed", Type: typeOf(other).String()}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(db, ns)) {
+		return
+	}
+	defer func() {
+		if doc, err := GetBySlug(db, "ns-failed", typeOf(other)); err == nil {
+			couchdb.DeleteDoc(db, doc)
+		}
+		releaseNamespace(db, "ns-failed", typeOf(other))
+	}()
+
+	// The install is refused by a hook, after the namespace has been claimed
+	unregister := RegisterHook(func(ctx context.Context, e *HookEvent) error {
+		if e.Slug == "ns-failed" && e.Phase == BeforeHook {
+			return errors.New("not today")
+		}
+		return nil
+	})
+	defer unregister()
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "ns-failed",
+		SourceURL: "git://localhost/",
+		TakeOver:  true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	_, err = waitInstaller(inst)
+	assert.Error(t, err)
+
+	// The namespace and the flag of the other application are restored
+	owner, err := GetNamespaceOwner(db, "ns-failed")
+	if assert.NoError(t, err) && assert.NotNil(t, owner) {
+		assert.True(t, owner.owns("ns-failed", typeOf(other)))
+	}
+	restored, err := GetBySlug(db, "ns-failed", typeOf(other))
+	if assert.NoError(t, err) {
+		assert.False(t, restored.namespaceLost())
+	}
+	_, err = GetBySlug(db, "ns-failed", installerType)
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
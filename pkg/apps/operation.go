@@ -0,0 +1,101 @@
+package apps
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// runningProgress are the reporters of the installers of this process, by
+// id of their operation, to give the progress of an operation to the clients
+// that follow it
+var (
+	progressMu      sync.Mutex
+	runningProgress = make(map[string]*progressReporter)
+)
+
+// trackOperation makes the progress of the operation available by its id,
+// until the returned function is called.
+func trackOperation(id string, r *progressReporter) func() {
+	progressMu.Lock()
+	runningProgress[id] = r
+	progressMu.Unlock()
+	return func() {
+		progressMu.Lock()
+		delete(runningProgress, id)
+		progressMu.Unlock()
+	}
+}
+
+// operationProgress returns the progress of an operation run by an installer
+// of this process.
+func operationProgress(id string) (Progress, bool) {
+	progressMu.Lock()
+	r, ok := runningProgress[id]
+	progressMu.Unlock()
+	if !ok {
+		return Progress{}, false
+	}
+	return r.current(), true
+}
+
+// OperationMetrics are the figures of the last install or update of an
+// application, recorded on its document at the end of the operation, even if
+// it has failed. DownloadedBytes is 0 when the files have been restored from
+// the source cache.
+type OperationMetrics struct {
+	Name            string    `json:"name"`
+	Succeeded       bool      `json:"succeeded"`
+	EndedAt         time.Time `json:"ended_at"`
+	DurationMs      int64     `json:"duration_ms"`
+	DownloadedBytes int64     `json:"downloaded_bytes"`
+}
+
+// OperationState is a snapshot of the state of an application, with its
+// pending operation, to follow an install or an update
+type OperationState struct {
+	Slug      string            `json:"slug"`
+	State     State             `json:"state"`
+	Operation *PendingOperation `json:"operation,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	ErrorCode string            `json:"error_code,omitempty"`
+	// Progress is only known by the process of the stack that runs the
+	// operation
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Pending returns true if the operation with the given id is still pending
+// on the application, or any operation if id is empty.
+func (s *OperationState) Pending(id string) bool {
+	return s.Operation != nil && (id == "" || s.Operation.ID == id)
+}
+
+// GetOperationState returns the state of an application and of its pending
+// operation.
+func GetOperationState(db couchdb.Database, slug string, appType AppType) (*OperationState, error) {
+	man, err := GetBySlug(db, slug, appType)
+	if err != nil {
+		return nil, err
+	}
+	return NewOperationState(man), nil
+}
+
+// NewOperationState returns the state of the application of the manifest
+func NewOperationState(man Manifest) *OperationState {
+	s := &OperationState{
+		Slug:      man.Slug(),
+		State:     man.State(),
+		Operation: man.Operation(),
+		ErrorCode: man.ErrorCode(),
+	}
+	if err := man.Error(); err != nil {
+		s.Error = err.Error()
+	}
+	if s.Operation != nil && s.Operation.ID != "" {
+		if p, ok := operationProgress(s.Operation.ID); ok {
+			s.Progress = &p
+		}
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+package apps
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Phase is a step of an installation or an update of an application
+type Phase string
+
+const (
+	// PhaseResolving is when the manifest is fetched from the source
+	PhaseResolving Phase = "resolving"
+	// PhaseDownloading is when the application is downloaded from the source
+	PhaseDownloading Phase = "downloading"
+	// PhaseExtracting is when the files of the application are written in its
+	// directory
+	PhaseExtracting Phase = "extracting"
+	// PhaseValidating is when the manifest is read and checked
+	PhaseValidating Phase = "validating"
+	// PhaseFinalizing is when the size of the application is computed and its
+	// document saved
+	PhaseFinalizing Phase = "finalizing"
+	// PhaseWarmingUp is when the caches used to serve the application are
+	// primed
+	PhaseWarmingUp Phase = "warming_up"
+)
+
+// progressStep is the number of bytes between two notifications of the
+// progress inside a phase
+const progressStep = 256 << 10
+
+// Progress is the state of the current phase of an installer. Bytes is the
+// number of bytes downloaded or written since the start of the phase, and
+// Total is the expected number of bytes, or 0 if it is not known (like for a
+// git clone).
+type Progress struct {
+	Phase Phase
+	Bytes int64
+	Total int64
+}
+
+// Percentage returns the completion of the phase, between 0 and 100, or -1
+// if the total is not known.
+func (p Progress) Percentage() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	if p.Bytes >= p.Total {
+		return 100
+	}
+	return int(p.Bytes * 100 / p.Total)
+}
+
+// MarshalJSON is used to add the percentage, when it is known
+func (p Progress) MarshalJSON() ([]byte, error) {
+	var percentage *int
+	if pc := p.Percentage(); pc >= 0 {
+		percentage = &pc
+	}
+	return json.Marshal(struct {
+		Phase      Phase `json:"phase"`
+		Bytes      int64 `json:"bytes"`
+		Total      int64 `json:"total,omitempty"`
+		Percentage *int  `json:"percentage,omitempty"`
+	}{p.Phase, p.Bytes, p.Total, percentage})
+}
+
+// progressReporter is used by the installer and its fetcher to track the
+// progress. The poller is notified on each new phase, and every progressStep
+// bytes, but the notifications are never blocking: a slow poller just sees
+// the latest progress inside a phase. The new phases are queued until the
+// poller has seen them, so that a quick phase is not missed. A nil reporter
+// ignores everything.
+type progressReporter struct {
+	mu         sync.Mutex
+	progress   Progress
+	phases     []Progress // the phases started and not yet seen by the poller
+	notified   int64
+	downloaded int64 // the bytes of all the downloading phases
+	c          chan struct{}
+}
+
+func newProgressReporter() *progressReporter {
+	return &progressReporter{c: make(chan struct{}, 1)}
+}
+
+// start begins a new phase, with the expected number of bytes if it is known
+func (r *progressReporter) start(phase Phase, total int64) {
+	if r == nil {
+		return
+	}
+	if total < 0 {
+		total = 0
+	}
+	r.mu.Lock()
+	r.progress = Progress{Phase: phase, Total: total}
+	r.phases = append(r.phases, r.progress)
+	r.notified = 0
+	r.mu.Unlock()
+	r.notify()
+}
+
+// Write adds the length of p to the bytes of the current phase, so that the
+// reporter can be used with io.TeeReader or io.MultiWriter.
+func (r *progressReporter) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mu.Lock()
+	r.progress.Bytes += int64(len(p))
+	if r.progress.Phase == PhaseDownloading {
+		r.downloaded += int64(len(p))
+	}
+	bytes, total := r.progress.Bytes, r.progress.Total
+	step := bytes-r.notified >= progressStep || (total > 0 && bytes >= total && r.notified < total)
+	if step {
+		r.notified = bytes
+	}
+	r.mu.Unlock()
+	if step {
+		r.notify()
+	}
+	return len(p), nil
+}
+
+// addDownloaded adds some bytes to the downloaded ones, for a fetcher that
+// can't report them while it downloads
+func (r *progressReporter) addDownloaded(n int64) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.downloaded += n
+	r.mu.Unlock()
+}
+
+// downloadedBytes returns the number of bytes downloaded since the creation
+// of the reporter
+func (r *progressReporter) downloadedBytes() int64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.downloaded
+}
+
+func (r *progressReporter) current() Progress {
+	if r == nil {
+		return Progress{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// next returns the oldest phase not yet seen by the poller, or the current
+// progress if it has seen all of them. The poller is notified again while
+// some phases are queued.
+func (r *progressReporter) next() Progress {
+	if r == nil {
+		return Progress{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.phases) == 0 {
+		return r.progress
+	}
+	p := r.phases[0]
+	r.phases = r.phases[1:]
+	if len(r.phases) > 0 {
+		r.notify()
+		return p
+	}
+	// The current phase is returned with its bytes
+	return r.progress
+}
+
+// pendingPhase returns true if a phase has not been seen by the poller
+func (r *progressReporter) pendingPhase() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.phases) > 0
+}
+
+func (r *progressReporter) notify() {
+	select {
+	case r.c <- struct{}{}:
+	default:
+	}
+}
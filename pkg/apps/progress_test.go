@@ -0,0 +1,167 @@
+package apps
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressPercentage(t *testing.T) {
+	assert.Equal(t, -1, Progress{Phase: PhaseDownloading, Bytes: 42}.Percentage())
+	assert.Equal(t, 0, Progress{Phase: PhaseDownloading, Total: 200}.Percentage())
+	assert.Equal(t, 25, Progress{Phase: PhaseDownloading, Bytes: 50, Total: 200}.Percentage())
+	assert.Equal(t, 100, Progress{Phase: PhaseDownloading, Bytes: 300, Total: 200}.Percentage())
+
+	b, err := json.Marshal(Progress{Phase: PhaseDownloading, Bytes: 50, Total: 200})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"phase":"downloading","bytes":50,"total":200,"percentage":25}`, string(b))
+	b, err = json.Marshal(Progress{Phase: PhaseExtracting, Bytes: 42})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"phase":"extracting","bytes":42}`, string(b))
+}
+
+func TestProgressReporter(t *testing.T) {
+	notified := func(r *progressReporter) bool {
+		select {
+		case <-r.c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	r := newProgressReporter()
+	r.start(PhaseDownloading, 2*progressStep+1)
+	assert.True(t, notified(r))
+	assert.Equal(t, Progress{Phase: PhaseDownloading, Total: 2*progressStep + 1}, r.current())
+
+	// The small writes are only notified every progressStep bytes
+	r.Write(make([]byte, progressStep-1))
+	assert.False(t, notified(r))
+	r.Write([]byte{0})
+	assert.True(t, notified(r))
+	r.Write(make([]byte, progressStep))
+	// The notifications are not blocking, and don't pile up
+	r.Write([]byte{0})
+	assert.True(t, notified(r))
+	assert.False(t, notified(r))
+	assert.Equal(t, 100, r.current().Percentage())
+
+	// A new phase resets the bytes, but not the downloaded ones
+	r.start(PhaseExtracting, -1)
+	assert.True(t, notified(r))
+	assert.Equal(t, Progress{Phase: PhaseExtracting}, r.current())
+	r.Write([]byte("foo"))
+	r.addDownloaded(10)
+	assert.Equal(t, int64(2*progressStep+1+10), r.downloadedBytes())
+
+	// The quick phases are all seen by the poller, in order, and the current
+	// one with its bytes
+	r = newProgressReporter()
+	r.start(PhaseResolving, 0)
+	r.start(PhaseValidating, 0)
+	r.start(PhaseDownloading, 10)
+	r.Write([]byte("foo"))
+	var seen []Progress
+	for notified(r) {
+		seen = append(seen, r.next())
+	}
+	assert.Equal(t, []Progress{
+		{Phase: PhaseResolving},
+		{Phase: PhaseValidating},
+		{Phase: PhaseDownloading, Bytes: 3, Total: 10},
+	}, seen)
+	assert.False(t, r.pendingPhase())
+	assert.Equal(t, Progress{Phase: PhaseDownloading, Bytes: 3, Total: 10}, r.next())
+
+	// A nil reporter ignores everything
+	var nilReporter *progressReporter
+	nilReporter.start(PhaseResolving, 0)
+	n, err := nilReporter.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, Progress{}, nilReporter.current())
+	nilReporter.addDownloaded(10)
+	assert.Equal(t, int64(0), nilReporter.downloadedBytes())
+}
+
+// fastInstaller is an installer that only reports a lot of progress, in two
+// phases, as fast as it can, and then its final manifest.
+func fastInstaller(writes int) *Installer {
+	inst := &Installer{
+		errc:     make(chan error, 1),
+		manc:     make(chan Manifest, 2),
+		progress: newProgressReporter(),
+	}
+	go func() {
+		for _, phase := range []Phase{PhaseDownloading, PhaseExtracting} {
+			inst.progress.start(phase, int64(writes*progressStep))
+			for j := 0; j < writes; j++ {
+				inst.progress.Write(make([]byte, progressStep))
+				time.Sleep(time.Millisecond)
+			}
+		}
+		inst.manc <- &WebappManifest{DocSlug: "fast", DocState: Ready}
+	}()
+	return inst
+}
+
+func pollAll(t *testing.T, inst *Installer, interval time.Duration) []Progress {
+	var events []Progress
+	for {
+		man, progress, done, err := inst.PollThrottled(interval)
+		if !assert.NoError(t, err) {
+			return events
+		}
+		events = append(events, progress)
+		if done {
+			assert.Equal(t, "fast", man.Slug())
+			return events
+		}
+	}
+}
+
+func TestPollThrottled(t *testing.T) {
+	// Only the phases and the final state are sent with a long interval
+	events := pollAll(t, fastInstaller(100), time.Hour)
+	if assert.True(t, len(events) >= 2 && len(events) <= 3) {
+		assert.Equal(t, PhaseDownloading, events[0].Phase)
+		assert.Equal(t, PhaseExtracting, events[len(events)-1].Phase)
+	}
+
+	// With a short interval, the progress inside a phase is sent, but much
+	// less often than it is reported
+	events = pollAll(t, fastInstaller(100), 50*time.Millisecond)
+	assert.True(t, len(events) > 3)
+	assert.True(t, len(events) < 20)
+	for j := 1; j < len(events); j++ {
+		if events[j].Phase == events[j-1].Phase {
+			assert.True(t, events[j].Bytes >= events[j-1].Bytes)
+		}
+	}
+
+	// A phase that ends before the poller is called is not missed
+	inst := &Installer{
+		errc:     make(chan error, 1),
+		manc:     make(chan Manifest, 2),
+		progress: newProgressReporter(),
+	}
+	for _, phase := range []Phase{PhaseResolving, PhaseValidating, PhaseDownloading} {
+		inst.progress.start(phase, 0)
+	}
+	for _, phase := range []Phase{PhaseResolving, PhaseValidating, PhaseDownloading} {
+		_, progress, done, err := inst.PollThrottled(time.Hour)
+		assert.NoError(t, err)
+		assert.False(t, done)
+		assert.Equal(t, phase, progress.Phase)
+	}
+
+	// The errors are returned immediately
+	inst = &Installer{errc: make(chan error, 1), progress: newProgressReporter()}
+	inst.errc <- errors.New("boom")
+	_, _, _, err := inst.PollThrottled(time.Hour)
+	assert.EqualError(t, err, "boom")
+}
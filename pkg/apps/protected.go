@@ -0,0 +1,38 @@
+package apps
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// IsProtected returns true if the application can't be deleted without a
+// confirmation: its slug is in the apps.protected list of the configuration,
+// or the administrator has set the protected flag on its document. Such an
+// application can still be updated.
+func IsProtected(man Manifest) bool {
+	if man.Protected() {
+		return true
+	}
+	return containsString(config.GetConfig().Apps.ProtectedSlugs, man.Slug())
+}
+
+// SetProtected sets or removes the protected flag of an installed webapp or
+// konnector. It is only done by the administrator, as the clients that can
+// delete an application must not be able to remove its protection first.
+func SetProtected(db couchdb.Database, slug string, appType AppType, protected bool) (Manifest, error) {
+	man, err := GetBySlug(db, slug, appType)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if man.Protected() == protected {
+		return man, nil
+	}
+	man.SetProtected(protected)
+	if err = couchdb.UpdateDoc(db, man); err != nil {
+		return nil, err
+	}
+	return man, nil
+}
@@ -0,0 +1,258 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// ErrOperationInterrupted is used for the applications whose pending
+// operation has been interrupted, like by a crash of the stack
+var ErrOperationInterrupted = errors.New("The previous operation on the application was interrupted")
+
+// runningOps are the operations run by the installers of this process, by
+// instance, type and slug of the application. They are the locks that the
+// reaper checks before removing a pending operation from a document.
+var (
+	runningMu  sync.Mutex
+	runningOps = make(map[string]int)
+)
+
+func operationKey(db couchdb.Database, appType AppType, slug string) string {
+	return db.Prefix() + string(appType) + "/" + slug
+}
+
+// holdOperation records that an installer of this process is running an
+// operation on the application, until the returned function is called.
+func holdOperation(db couchdb.Database, appType AppType, slug string) func() {
+	key := operationKey(db, appType, slug)
+	runningMu.Lock()
+	runningOps[key]++
+	runningMu.Unlock()
+	return func() {
+		runningMu.Lock()
+		if runningOps[key]--; runningOps[key] <= 0 {
+			delete(runningOps, key)
+		}
+		runningMu.Unlock()
+	}
+}
+
+// operationRunning returns true if an installer of this process is running
+// an operation on the application.
+func operationRunning(db couchdb.Database, appType AppType, slug string) bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	return runningOps[operationKey(db, appType, slug)] > 0
+}
+
+// ReapedOperation is a pending operation removed by the reaper
+type ReapedOperation struct {
+	Slug        string    `json:"slug"`
+	Operation   string    `json:"operation"`
+	OperationID string    `json:"operation_id,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	// State is the state of the application when its operation was reaped
+	State State `json:"state"`
+	// RemovedDir is true if the partial files of an interrupted install, or
+	// the staged files of an interrupted update, have been removed
+	RemovedDir bool `json:"removed_dir,omitempty"`
+}
+
+// ReapOperations removes the pending operations that have started more than
+// threshold ago, and that are not run by an installer of this process. The
+// applications with an interrupted install or deletion are put in the
+// errored state, and the files of an install are removed, as they are
+// partial. They can then be updated or deleted like any errored application.
+// An interrupted update or compaction leaves the installed version intact,
+// so the application goes back to its previous state (see
+// restoreInterrupted), and only the staged files of an update are removed.
+//
+// The document of an application that changes in the meantime is left as it
+// is. Each reaped operation is written in the audit log.
+func ReapOperations(db couchdb.Database, fs afero.Fs, appType AppType, threshold time.Duration) ([]*ReapedOperation, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	reaped := []*ReapedOperation{}
+	for _, man := range mans {
+		op := man.Operation()
+		if op == nil || time.Since(op.StartedAt) < threshold {
+			continue
+		}
+		slug := man.Slug()
+		if operationRunning(db, appType, slug) {
+			continue
+		}
+		r := &ReapedOperation{
+			Slug:        slug,
+			Operation:   op.Name,
+			OperationID: op.ID,
+			StartedAt:   op.StartedAt,
+			State:       man.State(),
+		}
+		man.SetOperation(nil)
+		if !restoreInterrupted(man, op) {
+			// A trashed or replaced application keeps its state
+			if Transition(man, erroredState(man.State())) == nil {
+				man.SetError(ErrOperationInterrupted)
+			}
+		}
+		if err = couchdb.UpdateDoc(db, man); couchdb.IsConflictError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.State == Installing {
+			if err = fs.RemoveAll(path.Join("/", slug)); err != nil {
+				return nil, err
+			}
+			r.RemovedDir = true
+		} else if op.Name == "updating" && op.ID != "" {
+			// The installed version has been kept, only the staged files
+			// of the new one are partial
+			if err = fs.RemoveAll(stagingDir(slug, op.ID)); err != nil {
+				return nil, err
+			}
+			r.RemovedDir = true
+		}
+		auditReaped(db, appType, r, man.State())
+		reaped = append(reaped, r)
+	}
+	return reaped, nil
+}
+
+// restoreInterrupted puts back the application in the state it had before
+// an interrupted update or compaction, and returns false for the other
+// operations. The installed version of the application is intact after
+// them: an update only writes in its staging directory until the end, and a
+// compaction only removes the compressed files that are not used. Without a
+// known previous state, the application is errored.
+func restoreInterrupted(man Manifest, op *PendingOperation) bool {
+	if op.Name != "updating" && op.Name != "compacting" {
+		return false
+	}
+	if man.State() != Upgrading {
+		return true
+	}
+	last := man.LastTransition()
+	if last == nil || last.From == Upgrading || !CanTransition(Upgrading, last.From) {
+		return false
+	}
+	return Transition(man, last.From) == nil
+}
+
+func auditReaped(db couchdb.Database, appType AppType, r *ReapedOperation, state State) {
+	domain := strings.TrimSuffix(db.Prefix(), "/")
+	log.Warnf("[audit] [apps] the operation %s (id %q) of the %s %s on %s, started at %s in the %s state, was interrupted: the %s is now %s (partial files removed: %t)",
+		r.Operation, r.OperationID, appType, r.Slug, domain, r.StartedAt.UTC().Format(time.RFC3339),
+		r.State, appType, state, r.RemovedDir)
+}
+
+// Reaper runs ReapOperations on all the instances, at the start of the stack
+// and then periodically, so that a crash during an operation doesn't leave
+// the application blocked in the middle of it.
+type Reaper struct {
+	forEach   func(fn func(AutoUpdateTarget) error) error
+	interval  time.Duration
+	threshold time.Duration
+	done      chan struct{}
+}
+
+// NewReaper returns a reaper configured with the apps.reaper section of the
+// configuration. The forEach function iterates over the instances.
+func NewReaper(forEach func(fn func(AutoUpdateTarget) error) error) *Reaper {
+	cfg := config.GetConfig().Apps
+	return &Reaper{
+		forEach:   forEach,
+		interval:  cfg.ReaperInterval,
+		threshold: cfg.ReaperThreshold,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs the reaper once, and then after each interval (if any) until the
+// context is done. The first run also canonicalizes the slugs of the legacy
+// applications (see CanonicalizeSlugs).
+func (r *Reaper) Start(ctx context.Context) {
+	go func() {
+		defer close(r.done)
+		r.canonicalize(ctx)
+		r.Run(ctx)
+		if r.interval <= 0 {
+			return
+		}
+		utils.Every(ctx, r.interval, func(ctx context.Context) error {
+			r.Run(ctx)
+			return nil
+		})
+	}()
+}
+
+// Wait waits for the end of the run of the reaper in progress, after the
+// context given to Start is done.
+func (r *Reaper) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// canonicalize runs CanonicalizeSlugs on all the instances, before their
+// operations are reaped.
+func (r *Reaper) canonicalize(ctx context.Context) {
+	err := r.forEach(func(target AutoUpdateTarget) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, appType := range []AppType{Webapp, Konnector} {
+			if _, err := CanonicalizeSlugs(target, appType); err != nil {
+				log.Errorf("[apps] could not canonicalize the slugs of the %ss of %s: %s",
+					appType, strings.TrimSuffix(target.Prefix(), "/"), err)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != ctx.Err() {
+		log.Errorf("[apps] could not list the instances to canonicalize the slugs: %s", err)
+	}
+}
+
+// Run reaps the interrupted operations of all the instances once
+func (r *Reaper) Run(ctx context.Context) {
+	// The operations run by the other processes of the stack are not in the
+	// lock table, so a fresh operation is never reaped
+	threshold := r.threshold
+	if threshold < OperationTimeout {
+		threshold = OperationTimeout
+	}
+	err := r.forEach(func(target AutoUpdateTarget) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, appType := range []AppType{Webapp, Konnector} {
+			_, err := ReapOperations(target, target.AppsFS(appType), appType, threshold)
+			if err != nil {
+				log.Errorf("[apps] could not reap the operations of the %ss of %s: %s",
+					appType, strings.TrimSuffix(target.Prefix(), "/"), err)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != ctx.Err() {
+		log.Errorf("[apps] could not list the instances for the reaper: %s", err)
+	}
+}
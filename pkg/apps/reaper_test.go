@@ -0,0 +1,125 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapOperations(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	old := time.Now().Add(-time.Hour)
+	installing := &WebappManifest{
+		DocSlug:      "mini-reap-install",
+		DocState:     Installing,
+		DocOperation: &PendingOperation{Name: "installing", StartedAt: old},
+	}
+	updating := &WebappManifest{
+		DocSlug:       "mini-reap-update",
+		DocState:      Upgrading,
+		DocTransition: &StateTransition{From: Ready, At: old},
+		DocOperation:  &PendingOperation{Name: "updating", ID: "op-1", StartedAt: old},
+	}
+	held := &WebappManifest{
+		DocSlug:      "mini-reap-held",
+		DocState:     Upgrading,
+		DocOperation: &PendingOperation{Name: "updating", StartedAt: old},
+	}
+	compacting := &WebappManifest{
+		DocSlug:      "mini-reap-compact",
+		DocState:     Ready,
+		DocOperation: &PendingOperation{Name: "compacting", StartedAt: old},
+	}
+	recent := &WebappManifest{
+		DocSlug:      "mini-reap-recent",
+		DocState:     Ready,
+		DocOperation: newOperation("updating", ""),
+	}
+	slugs := []string{"mini-reap-install", "mini-reap-update", "mini-reap-held", "mini-reap-recent", "mini-reap-compact"}
+	defer func() {
+		for _, slug := range slugs {
+			if man, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, man)
+			}
+		}
+	}()
+	for _, man := range []*WebappManifest{installing, updating, held, recent, compacting} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+	}
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/mini-reap-install/index.html", []byte("partial"), 0644))
+	assert.NoError(t, afero.WriteFile(memfs, "/mini-reap-update/index.html", []byte("index"), 0644))
+	assert.NoError(t, afero.WriteFile(memfs, "/mini-reap-update@op-1/index.html", []byte("staged"), 0644))
+
+	release := holdOperation(db, Webapp, "mini-reap-held")
+	reaped, err := ReapOperations(db, memfs, Webapp, 30*time.Minute)
+	release()
+	if assert.NoError(t, err) && assert.Len(t, reaped, 3) {
+		bySlug := make(map[string]*ReapedOperation)
+		for _, r := range reaped {
+			bySlug[r.Slug] = r
+		}
+		if r := bySlug["mini-reap-install"]; assert.NotNil(t, r) {
+			assert.Equal(t, "installing", r.Operation)
+			assert.Equal(t, State(Installing), r.State)
+			assert.True(t, r.RemovedDir)
+		}
+		if r := bySlug["mini-reap-update"]; assert.NotNil(t, r) {
+			assert.Equal(t, State(Upgrading), r.State)
+			assert.True(t, r.RemovedDir)
+		}
+		if r := bySlug["mini-reap-compact"]; assert.NotNil(t, r) {
+			assert.Equal(t, "compacting", r.Operation)
+			assert.False(t, r.RemovedDir)
+		}
+	}
+
+	man, err := GetWebappBySlug(db, "mini-reap-install")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Errored), man.State())
+		assert.Nil(t, man.Operation())
+		assert.Equal(t, ErrOperationInterrupted.Error(), man.DocError)
+	}
+	// The installed version is intact after an interrupted update or
+	// compaction, so the application is still served
+	for _, slug := range []string{"mini-reap-update", "mini-reap-compact"} {
+		man, err := GetWebappBySlug(db, slug)
+		if assert.NoError(t, err) {
+			assert.Equal(t, State(Ready), man.State(), slug)
+			assert.Nil(t, man.Operation())
+			assert.Empty(t, man.DocError)
+		}
+	}
+	exists, _ := afero.DirExists(memfs, "/mini-reap-install")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(memfs, "/mini-reap-update/index.html")
+	assert.True(t, exists)
+	exists, _ = afero.DirExists(memfs, "/mini-reap-update@op-1")
+	assert.False(t, exists)
+
+	for _, slug := range []string{"mini-reap-held", "mini-reap-recent"} {
+		man, err := GetWebappBySlug(db, slug)
+		if assert.NoError(t, err) {
+			assert.NotNil(t, man.Operation())
+		}
+	}
+
+	// The operation is no longer held once the installer is done
+	reaped, err = ReapOperations(db, memfs, Webapp, 30*time.Minute)
+	if assert.NoError(t, err) && assert.Len(t, reaped, 1) {
+		assert.Equal(t, "mini-reap-held", reaped[0].Slug)
+		assert.Equal(t, State(Upgrading), reaped[0].State)
+	}
+	// Without a known previous state, the application is errored
+	man, err = GetWebappBySlug(db, "mini-reap-held")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Errored), man.State())
+	}
+}
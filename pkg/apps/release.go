@@ -0,0 +1,420 @@
+package apps
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// The URLs of GitHub and GitLab, used to resolve the release sources. They
+// are variables for the tests.
+var (
+	githubAPIURL = "https://api.github.com"
+	githubURL    = "https://github.com"
+	gitlabURL    = "https://gitlab.com"
+)
+
+// releaseMaxSize is the maximal size in bytes of the responses of the APIs
+// and of the checksum files of the releases
+const releaseMaxSize = 1 << 20
+
+// checksumAssets are the names of the files of checksums published with the
+// releases, in the format of sha256sum. A file named like the archive with a
+// .sha256 extension is also accepted.
+var checksumAssets = []string{"SHA256SUMS", "sha256sums.txt", "checksums.txt"}
+
+// releaseAsset is a file published with a release
+type releaseAsset struct {
+	Name string
+	URL  string
+}
+
+// releaseFetcher installs an application from a release on GitHub or GitLab,
+// with a source like github://org/repo@v1.2.3, or with a channel instead of
+// the tag (github://org/repo@beta). Without tag, the default channel of the
+// instance is used. The source is resolved to the archive published with the
+// release, or to the archive of the tag if there is none, and then it is
+// fetched like a tarball, with the checksum of the release if there is one,
+// and the signature given in the fragment of the source if there is one
+// (github://org/repo@v1.2.3#sig=...).
+type releaseFetcher struct {
+	*tarballFetcher
+	resolved *url.URL
+	// channel is the channel used when the source has no tag, and effective
+	// is the one used by the resolution (empty for an explicit tag)
+	channel   string
+	effective string
+}
+
+func newReleaseFetcher(fs afero.Fs, cache *SourceCache, manFilename string, progress *progressReporter) *releaseFetcher {
+	return &releaseFetcher{tarballFetcher: newTarballFetcher(fs, cache, manFilename, progress)}
+}
+
+func (f *releaseFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
+	u, err := f.resolve(src)
+	if err != nil {
+		return nil, err
+	}
+	return f.tarballFetcher.FetchManifest(u)
+}
+
+func (f *releaseFetcher) Fetch(src *url.URL, baseDir string) error {
+	u, err := f.resolve(src)
+	if err != nil {
+		return err
+	}
+	return f.tarballFetcher.Fetch(u, baseDir)
+}
+
+// ResolvedSource returns the URL of the archive the source has been resolved
+// to, or an empty string if it has not been resolved yet.
+func (f *releaseFetcher) ResolvedSource() string {
+	if f.resolved == nil {
+		return ""
+	}
+	return f.resolved.String()
+}
+
+// Channel returns the channel used to resolve the source, or an empty string
+// if the source gives the tag of the release (or if it has not been resolved
+// yet).
+func (f *releaseFetcher) Channel() string {
+	if f.resolved == nil {
+		return ""
+	}
+	return f.effective
+}
+
+func (f *releaseFetcher) resolve(src *url.URL) (*url.URL, error) {
+	if f.resolved != nil {
+		return f.resolved, nil
+	}
+	repo, tag, err := parseReleaseSource(src)
+	if err != nil {
+		return nil, err
+	}
+	channel := ""
+	if ValidChannel(tag) {
+		channel, tag = tag, ""
+	} else if tag == "" {
+		channel = f.channel
+		if !ValidChannel(channel) {
+			channel = ChannelStable
+		}
+	}
+	var archive string
+	var assets []releaseAsset
+	switch src.Scheme {
+	case "github":
+		archive, assets, err = resolveGithubRelease(repo, tag, channel)
+	case "gitlab":
+		archive, assets, err = resolveGitlabRelease(repo, tag, channel)
+	default:
+		err = ErrNotSupportedSource
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(archive)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	// The signature given in the fragment of the source is kept with the
+	// checksum of the release
+	var params []string
+	if sum := releaseChecksum(path.Base(u.Path), assets); sum != "" {
+		params = append(params, checksumPrefix+sum)
+	}
+	if sig, ok := fragmentParam(src, sigPrefix); ok {
+		params = append(params, sigPrefix+sig)
+	}
+	u.Fragment = strings.Join(params, fragmentSep)
+	log.Debugf("[release] %s resolved to %s", src, u)
+	f.resolved, f.effective = u, channel
+	return u, nil
+}
+
+// parseReleaseSource returns the repository and the tag of a release source.
+// The tag is empty for the latest release.
+func parseReleaseSource(src *url.URL) (repo, tag string, err error) {
+	repo = strings.Trim(src.Host+src.Path, "/")
+	if i := strings.LastIndex(repo, "@"); i >= 0 {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	parts := strings.Split(repo, "/")
+	valid := len(parts) >= 2 && (src.Scheme != "github" || len(parts) == 2)
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			valid = false
+		}
+	}
+	if !valid || strings.ContainsAny(tag, "/?#") {
+		return "", "", &url.Error{
+			Op:  "parsepath",
+			URL: src.String(),
+			Err: fmt.Errorf("Could not parse the release source, expected %s://owner/repo@tag", src.Scheme),
+		}
+	}
+	return repo, tag, nil
+}
+
+// resolveGithubRelease returns the archive to download for the release of a
+// GitHub repository, with the assets of the release. Without tag, the release
+// is the latest one of the channel: GitHub excludes the pre-releases from its
+// latest release, but not from the list of the releases.
+func resolveGithubRelease(repo, tag, channel string) (string, []releaseAsset, error) {
+	if tag == "" && channel == ChannelDev {
+		return githubURL + "/" + repo + "/archive/HEAD.tar.gz", nil, nil
+	}
+	type githubRelease struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	var release githubRelease
+	var found bool
+	var err error
+	switch {
+	case tag != "":
+		api := githubAPIURL + "/repos/" + repo + "/releases/tags/" + escapeSegment(tag)
+		found, err = getReleaseJSON("GitHub", api, &release)
+	case channel == ChannelBeta:
+		// The releases are sorted from the newest one
+		var releases []githubRelease
+		api := githubAPIURL + "/repos/" + repo + "/releases?per_page=1"
+		found, err = getReleaseJSON("GitHub", api, &releases)
+		if len(releases) > 0 {
+			release = releases[0]
+		} else {
+			found = false
+		}
+	default:
+		api := githubAPIURL + "/repos/" + repo + "/releases/latest"
+		found, err = getReleaseJSON("GitHub", api, &release)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		// A tag without release can still be installed from its archive
+		if tag == "" {
+			return "", nil, ErrSourceNotReachable
+		}
+		release.TagName = tag
+	}
+	assets := make([]releaseAsset, len(release.Assets))
+	for i, a := range release.Assets {
+		assets[i] = releaseAsset{Name: a.Name, URL: a.URL}
+	}
+	if archive := releaseArchive(assets); archive != "" {
+		return archive, assets, nil
+	}
+	archive := githubURL + "/" + repo + "/archive/" + escapeSegment(release.TagName) + ".tar.gz"
+	return archive, assets, nil
+}
+
+// resolveGitlabRelease returns the archive to download for the release of a
+// GitLab project, with the assets of the release. GitLab has no pre-releases,
+// so the latest release of the stable channel is the newest one whose tag is
+// not the version of a pre-release, like v1.2.0-beta.1.
+func resolveGitlabRelease(repo, tag, channel string) (string, []releaseAsset, error) {
+	api := gitlabURL + "/api/v4/projects/" + url.QueryEscape(repo)
+	if tag == "" && channel == ChannelDev {
+		return api + "/repository/archive.tar.gz", nil, nil
+	}
+	api += "/releases"
+	if tag != "" {
+		api += "/" + escapeSegment(tag)
+	}
+	type gitlabRelease struct {
+		TagName string `json:"tag_name"`
+		Assets  struct {
+			Links []struct {
+				Name string `json:"name"`
+				URL  string `json:"url"`
+			} `json:"links"`
+		} `json:"assets"`
+	}
+	var release gitlabRelease
+	var found bool
+	var err error
+	if tag != "" {
+		found, err = getReleaseJSON("GitLab", api, &release)
+	} else {
+		// The releases are sorted from the newest one
+		var releases []gitlabRelease
+		_, err = getReleaseJSON("GitLab", api+"?per_page="+strconv.Itoa(gitlabReleasesPage), &releases)
+		for _, r := range releases {
+			if channel == ChannelBeta || !prereleaseTag(r.TagName) {
+				release, found = r, true
+				break
+			}
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		if tag == "" {
+			return "", nil, ErrSourceNotReachable
+		}
+		release.TagName = tag
+	}
+	assets := make([]releaseAsset, len(release.Assets.Links))
+	for i, l := range release.Assets.Links {
+		assets[i] = releaseAsset{Name: l.Name, URL: l.URL}
+	}
+	if archive := releaseArchive(assets); archive != "" {
+		return archive, assets, nil
+	}
+	project := path.Base(repo)
+	archive := fmt.Sprintf("%s/%s/-/archive/%s/%s-%s.tar.gz", gitlabURL, repo,
+		escapeSegment(release.TagName), project, escapeSegment(release.TagName))
+	return archive, assets, nil
+}
+
+// gitlabReleasesPage is the number of releases of a GitLab project looked
+// at for the latest stable one
+const gitlabReleasesPage = 20
+
+// prereleaseTag returns true if the tag is the version of a pre-release
+func prereleaseTag(tag string) bool {
+	v, err := utils.ParseVersion(tag)
+	return err == nil && len(v.Prerelease) > 0
+}
+
+// escapeSegment escapes a tag to be used as a segment of the path of a URL
+func escapeSegment(s string) string {
+	return (&url.URL{Path: s}).EscapedPath()
+}
+
+// getReleaseJSON fetches a resource of the API of GitHub or GitLab. It
+// returns false if the resource doesn't exist, and a RateLimitError if the
+// API refuses the request because of its rate limit.
+func getReleaseJSON(service, u string, v interface{}) (bool, error) {
+	client, err := httpClient(manifestTimeout)
+	if err != nil {
+		return false, err
+	}
+	res, err := client.Get(u)
+	if isSourceNotAllowed(err) {
+		return false, ErrSourceNotAllowed
+	}
+	if err != nil {
+		return false, ErrSourceNotReachable
+	}
+	defer res.Body.Close()
+	if err = rateLimitError(service, res); err != nil {
+		return false, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, ErrSourceNotReachable
+	}
+	b, err := utils.ReadAllCapped(res.Body, releaseMaxSize)
+	if err != nil {
+		return false, ErrSourceNotReachable
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return false, ErrSourceNotReachable
+	}
+	return true, nil
+}
+
+// rateLimitError returns a RateLimitError if the response is a refusal
+// because of the rate limit. GitHub answers with a 403 and no remaining
+// requests, and GitLab with a 429. The reset time is an epoch in seconds, or
+// a delay in seconds for Retry-After.
+func rateLimitError(service string, res *http.Response) error {
+	limited := res.StatusCode == http.StatusTooManyRequests ||
+		(res.StatusCode == http.StatusForbidden && res.Header.Get("X-RateLimit-Remaining") == "0")
+	if !limited {
+		return nil
+	}
+	e := &RateLimitError{Service: service}
+	for _, h := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		if epoch, err := strconv.ParseInt(res.Header.Get(h), 10, 64); err == nil {
+			e.Reset = time.Unix(epoch, 0).UTC()
+			return e
+		}
+	}
+	if delay, err := strconv.ParseInt(res.Header.Get("Retry-After"), 10, 64); err == nil {
+		e.Reset = time.Now().Add(time.Duration(delay) * time.Second).UTC().Truncate(time.Second)
+	}
+	return e
+}
+
+// releaseArchive returns the URL of the first gzipped tarball of the assets,
+// or an empty string if there is none.
+func releaseArchive(assets []releaseAsset) string {
+	for _, a := range assets {
+		if strings.HasSuffix(a.Name, ".tar.gz") || strings.HasSuffix(a.Name, ".tgz") {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// releaseChecksum returns the SHA-256 checksum of the archive with the given
+// name published with the release, in hexadecimal, or an empty string if the
+// release has no checksum for it. The checksums can't be trusted more than
+// the archive, but they protect against the corruptions and the truncations.
+func releaseChecksum(name string, assets []releaseAsset) string {
+	for _, a := range assets {
+		if a.Name == name+".sha256" || utils.ContainsFold(checksumAssets, a.Name) {
+			if sum := fetchChecksum(a.URL, name); sum != "" {
+				return sum
+			}
+		}
+	}
+	return ""
+}
+
+// fetchChecksum downloads a file of checksums and returns the one for the
+// given name. A file with a single checksum and no name is accepted too.
+func fetchChecksum(u, name string) string {
+	client, err := httpClient(manifestTimeout)
+	if err != nil {
+		return ""
+	}
+	res, err := client.Get(u)
+	if err != nil {
+		return ""
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ""
+	}
+	scanner := bufio.NewScanner(io.LimitReader(res.Body, releaseMaxSize))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sum := strings.ToLower(fields[0])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+			continue
+		}
+		// sha256sum prefixes the names of the binary files with a *
+		if len(fields) == 1 || strings.TrimPrefix(fields[1], "*") == name {
+			return sum
+		}
+	}
+	return ""
+}
@@ -0,0 +1,292 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeForge serves the API of GitHub and GitLab for the releases, and the
+// files of the releases.
+func fakeForge(archive []byte, sums string) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	release := func(tag string) string {
+		return fmt.Sprintf(`{"tag_name": %q, "assets": [
+			{"name": "notes.txt", "browser_download_url": "%s/files/notes.txt"},
+			{"name": "app.tar.gz", "browser_download_url": "%s/files/app.tar.gz"},
+			{"name": "SHA256SUMS", "browser_download_url": "%s/files/SHA256SUMS"}
+		]}`, tag, srv.URL, srv.URL, srv.URL)
+	}
+	mux.HandleFunc("/repos/cozy/released/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, release("v1.2.4"))
+	})
+	mux.HandleFunc("/repos/cozy/released/releases/tags/v1.2.3", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, release("v1.2.3"))
+	})
+	mux.HandleFunc("/repos/cozy/limited/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "1500000000")
+		w.WriteHeader(http.StatusForbidden)
+	})
+	mux.HandleFunc("/api/v4/projects/group/sub/project/releases", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"tag_name": "v2.0.0", "assets": {"links": []}}]`)
+	})
+	mux.HandleFunc("/repos/cozy/channels/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name": "v1.0.0", "assets": []}`)
+	})
+	mux.HandleFunc("/repos/cozy/channels/releases", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"tag_name": "v1.1.0-beta.1", "assets": []}]`)
+	})
+	mux.HandleFunc("/api/v4/projects/group/channels/releases", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"tag_name": "v3.1.0-rc.1", "assets": {"links": []}},
+			{"tag_name": "v3.0.0", "assets": {"links": []}}
+		]`)
+	})
+	mux.HandleFunc("/files/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sums)
+	})
+	serveArchive := func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }
+	mux.HandleFunc("/files/app.tar.gz", serveArchive)
+	mux.HandleFunc("/cozy/tagged/archive/v0.1.0.tar.gz", serveArchive)
+	mux.HandleFunc("/group/sub/project/-/archive/v2.0.0/project-v2.0.0.tar.gz", serveArchive)
+	for _, p := range []string{
+		"/cozy/channels/archive/v1.0.0.tar.gz",
+		"/cozy/channels/archive/v1.1.0-beta.1.tar.gz",
+		"/cozy/channels/archive/v0.9.0.tar.gz",
+		"/cozy/channels/archive/HEAD.tar.gz",
+		"/group/channels/-/archive/v3.0.0/channels-v3.0.0.tar.gz",
+		"/group/channels/-/archive/v3.1.0-rc.1/channels-v3.1.0-rc.1.tar.gz",
+		"/api/v4/projects/group/channels/repository/archive.tar.gz",
+	} {
+		mux.HandleFunc(p, serveArchive)
+	}
+	return srv
+}
+
+func withFakeForge(srv *httptest.Server) func() {
+	apiURL, ghURL, glURL := githubAPIURL, githubURL, gitlabURL
+	githubAPIURL, githubURL, gitlabURL = srv.URL, srv.URL, srv.URL
+	return func() {
+		githubAPIURL, githubURL, gitlabURL = apiURL, ghURL, glURL
+	}
+}
+
+func TestParseReleaseSource(t *testing.T) {
+	tests := []struct {
+		source string
+		repo   string
+		tag    string
+	}{
+		{"github://cozy/cozy-drive@v1.2.3", "cozy/cozy-drive", "v1.2.3"},
+		{"github://cozy/cozy-drive", "cozy/cozy-drive", ""},
+		{"gitlab://group/sub/project@v2.0.0", "group/sub/project", "v2.0.0"},
+	}
+	for _, test := range tests {
+		src, _ := url.Parse(test.source)
+		repo, tag, err := parseReleaseSource(src)
+		assert.NoError(t, err, test.source)
+		assert.Equal(t, test.repo, repo, test.source)
+		assert.Equal(t, test.tag, tag, test.source)
+	}
+
+	for _, source := range []string{"github://cozy", "github://cozy/a/b@v1", "gitlab://group/../project", "github://cozy/drive@v1/evil"} {
+		src, _ := url.Parse(source)
+		_, _, err := parseReleaseSource(src)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestReleaseFetcher(t *testing.T) {
+	archive := makeTarball(t, map[string]string{
+		manifestName: `{"name": "released"}`,
+		"index.html": "<html></html>",
+	})
+	sum := sha256.Sum256(archive)
+	sums := hex.EncodeToString(sum[:]) + "  app.tar.gz\n" +
+		"0000000000000000000000000000000000000000000000000000000000000000  other.tar.gz\n"
+	srv := fakeForge(archive, sums)
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	// A release with an archive and its checksum
+	src, _ := url.Parse("github://cozy/released@v1.2.3")
+	afs := afero.NewMemMapFs()
+	fetcher := newReleaseFetcher(afs, nil, manifestName, nil)
+	r, err := fetcher.FetchManifest(src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Close()
+	assert.Equal(t, srv.URL+"/files/app.tar.gz#sha256="+hex.EncodeToString(sum[:]), fetcher.ResolvedSource())
+	assert.NoError(t, fetcher.Fetch(src, "/released"))
+	ok, _ := afero.Exists(afs, "/released/index.html")
+	assert.True(t, ok)
+
+	// The latest release
+	src, _ = url.Parse("github://cozy/released")
+	fetcher = newReleaseFetcher(afs, nil, manifestName, nil)
+	r, err = fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+
+	// A tag without release is installed from the archive of the tag
+	src, _ = url.Parse("github://cozy/tagged@v0.1.0")
+	fetcher = newReleaseFetcher(afs, nil, manifestName, nil)
+	r, err = fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+	assert.Equal(t, srv.URL+"/cozy/tagged/archive/v0.1.0.tar.gz", fetcher.ResolvedSource())
+
+	// The latest release of a GitLab project without assets
+	src, _ = url.Parse("gitlab://group/sub/project")
+	fetcher = newReleaseFetcher(afs, nil, manifestName, nil)
+	r, err = fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+	assert.Equal(t, srv.URL+"/group/sub/project/-/archive/v2.0.0/project-v2.0.0.tar.gz", fetcher.ResolvedSource())
+
+	// No release and no tag
+	src, _ = url.Parse("github://cozy/unknown")
+	_, err = newReleaseFetcher(afs, nil, manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrSourceNotReachable, err)
+}
+
+func TestReleaseFetcherBadChecksum(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "released"}`})
+	sums := "0000000000000000000000000000000000000000000000000000000000000000 *app.tar.gz\n"
+	srv := fakeForge(archive, sums)
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	src, _ := url.Parse("github://cozy/released@v1.2.3")
+	_, err := newReleaseFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrInvalidChecksum, err)
+}
+
+func TestReleaseFetcherSignature(t *testing.T) {
+	defer trustKey(trustedSeed)()
+	config.GetConfig().Apps.RequireSignatures = true
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "released"}`})
+	sum := sha256.Sum256(archive)
+	srv := fakeForge(archive, hex.EncodeToString(sum[:])+"  app.tar.gz\n")
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	// The signature of the source is kept with the checksum of the release
+	sig := signTarball(trustedSeed, archive)
+	src, _ := url.Parse("github://cozy/released@v1.2.3#sig=" + sig)
+	fetcher := newReleaseFetcher(afero.NewMemMapFs(), nil, manifestName, nil)
+	r, err := fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+	assert.Equal(t, srv.URL+"/files/app.tar.gz#sha256="+hex.EncodeToString(sum[:])+"&sig="+sig, fetcher.ResolvedSource())
+
+	src, _ = url.Parse("github://cozy/released@v1.2.3")
+	_, err = newReleaseFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrMissingSignature, err)
+}
+
+func TestReleaseSourceVersion(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "released", "version": "1.2.4"}`})
+	srv := fakeForge(archive, "")
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	// The release is resolved to the archive of the installed version, that
+	// is not downloaded
+	man := &WebappManifest{
+		DocSlug:     "released",
+		DocSource:   "github://cozy/released",
+		DocResolved: srv.URL + "/files/app.tar.gz",
+		Version:     "1.2.3",
+	}
+	afs := afero.NewMemMapFs()
+	version, err := sourceVersion(db, afs, Webapp, man)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3", version)
+
+	// A new release is resolved to another archive
+	man.DocResolved = srv.URL + "/files/old.tar.gz"
+	version, err = sourceVersion(db, afs, Webapp, man)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.4", version)
+}
+
+func TestReleaseFetcherRateLimit(t *testing.T) {
+	srv := fakeForge(nil, "")
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	src, _ := url.Parse("github://cozy/limited")
+	_, err := newReleaseFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+	if assert.IsType(t, &RateLimitError{}, err) {
+		e := err.(*RateLimitError)
+		assert.Equal(t, "GitHub", e.Service)
+		assert.Equal(t, time.Unix(1500000000, 0).UTC(), e.Reset)
+		assert.Contains(t, e.Error(), "2017-07-14T02:40:00Z")
+	}
+}
+
+func TestReleaseFetcherChannels(t *testing.T) {
+	archive := makeTarball(t, map[string]string{manifestName: `{"name": "channels"}`})
+	srv := fakeForge(archive, "")
+	defer srv.Close()
+	defer withFakeForge(srv)()
+
+	tests := []struct {
+		source   string
+		channel  string
+		resolved string
+		used     string
+	}{
+		{"github://cozy/channels", "", "/cozy/channels/archive/v1.0.0.tar.gz", ChannelStable},
+		{"github://cozy/channels", ChannelBeta, "/cozy/channels/archive/v1.1.0-beta.1.tar.gz", ChannelBeta},
+		{"github://cozy/channels", ChannelDev, "/cozy/channels/archive/HEAD.tar.gz", ChannelDev},
+		{"github://cozy/channels@stable", ChannelBeta, "/cozy/channels/archive/v1.0.0.tar.gz", ChannelStable},
+		{"github://cozy/channels@v0.9.0", ChannelBeta, "/cozy/channels/archive/v0.9.0.tar.gz", ""},
+		{"gitlab://group/channels", ChannelStable, "/group/channels/-/archive/v3.0.0/channels-v3.0.0.tar.gz", ChannelStable},
+		{"gitlab://group/channels", ChannelBeta, "/group/channels/-/archive/v3.1.0-rc.1/channels-v3.1.0-rc.1.tar.gz", ChannelBeta},
+		{"gitlab://group/channels@dev", ChannelStable, "/api/v4/projects/group%2Fchannels/repository/archive.tar.gz", ChannelDev},
+	}
+	for _, test := range tests {
+		src, _ := url.Parse(test.source)
+		fetcher := newReleaseFetcher(afero.NewMemMapFs(), nil, manifestName, nil)
+		fetcher.channel = test.channel
+		r, err := fetcher.FetchManifest(src)
+		if !assert.NoError(t, err, test.source) {
+			continue
+		}
+		r.Close()
+		assert.Equal(t, srv.URL+test.resolved, fetcher.ResolvedSource(), test.source)
+		assert.Equal(t, test.used, fetcher.Channel(), test.source)
+	}
+}
+
+func TestDefaultChannel(t *testing.T) {
+	assert.Equal(t, ChannelStable, defaultChannel(db))
+	assert.Equal(t, ChannelBeta, defaultChannel(&channelDB{db, ChannelBeta}))
+	assert.Equal(t, ChannelStable, defaultChannel(&channelDB{db, "nightly"}))
+}
+
+type channelDB struct {
+	couchdb.Database
+	channel string
+}
+
+func (c *channelDB) DefaultAppsChannel() string { return c.channel }
@@ -0,0 +1,170 @@
+package apps
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ManifestMissingRouteFile is the code for a route of the manifest whose
+// folder or index file is not in the files of the application
+const ManifestMissingRouteFile = "missing_route_file"
+
+// RouteEntry is a route of the normalized route table of a webapp. The table
+// is built at install from the routes of the manifest, and is sorted from the
+// most specific path to the least specific one, so that the first entry that
+// matches a request is the one to serve.
+type RouteEntry struct {
+	Path   string `json:"path"`
+	Folder string `json:"folder"`
+	Index  string `json:"index"`
+	Public bool   `json:"public"`
+}
+
+// route returns the route of the entry
+func (e *RouteEntry) route() Route {
+	return Route{Folder: e.Folder, Index: e.Index, Public: e.Public}
+}
+
+// parts returns the parts of the path of the entry, as compared to the parts
+// of the path of a request by FindRoute
+func (e *RouteEntry) parts() []string {
+	if e.Path == "/" {
+		return []string{""}
+	}
+	return strings.Split(e.Path, "/")
+}
+
+type routeTable []RouteEntry
+
+func (t routeTable) Len() int      { return len(t) }
+func (t routeTable) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t routeTable) Less(i, j int) bool {
+	ci, cj := len(t[i].parts()), len(t[j].parts())
+	if ci != cj {
+		return ci > cj
+	}
+	return t[i].Path < t[j].Path
+}
+
+// normalizeRoutePath returns the path of a route key, without the duplicated
+// and trailing slashes.
+func normalizeRoutePath(key string) string {
+	return path.Clean(key)
+}
+
+// sortedRouteKeys returns the keys of the routes, sorted
+func sortedRouteKeys(routes Routes) []string {
+	keys := make([]string, 0, len(routes))
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateRoutes checks the routes of a manifest: the keys and the folders must
+// be absolute paths, and two keys can't be the same path once normalized, like
+// /foo and /foo/.
+func validateRoutes(routes Routes, errs ManifestErrors) ManifestErrors {
+	seen := make(map[string]string)
+	for _, key := range sortedRouteKeys(routes) {
+		route := routes[key]
+		pointer := "/routes/" + escapePointer(key)
+		if !strings.HasPrefix(route.Folder, "/") {
+			errs = errs.add(pointer+"/folder", ManifestInvalidValue, "the folder must be an absolute path")
+		}
+		if !strings.HasPrefix(key, "/") {
+			errs = errs.add(pointer, ManifestInvalidValue, "the route must start with a /")
+			continue
+		}
+		normalized := normalizeRoutePath(key)
+		if other, ok := seen[normalized]; ok {
+			errs = errs.add(pointer, ManifestInvalidValue, "the route overlaps the route "+other)
+			continue
+		}
+		seen[normalized] = key
+	}
+	return errs
+}
+
+// buildRouteTable returns the normalized route table of the routes of a
+// manifest. The routes that are not valid are left out.
+func buildRouteTable(routes Routes) []RouteEntry {
+	table := make(routeTable, 0, len(routes))
+	seen := make(map[string]bool)
+	for _, key := range sortedRouteKeys(routes) {
+		route := routes[key]
+		if !strings.HasPrefix(key, "/") || !strings.HasPrefix(route.Folder, "/") {
+			continue
+		}
+		normalized := normalizeRoutePath(key)
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		table = append(table, RouteEntry{
+			Path:   normalized,
+			Folder: path.Clean(route.Folder),
+			Index:  route.Index,
+			Public: route.Public,
+		})
+	}
+	sort.Sort(table)
+	return table
+}
+
+// checkRoutes verifies that the folders and the index files of the routes
+// declared by the manifest (not the default route of a manifest without
+// routes) are in the files of the application.
+func checkRoutes(fs afero.Fs, dir string, man Manifest) error {
+	m, ok := man.(*WebappManifest)
+	if !ok || m.defaultRoutes {
+		return nil
+	}
+	var errs ManifestErrors
+	for _, key := range sortedRouteKeys(m.Routes) {
+		route := m.Routes[key]
+		pointer := "/routes/" + escapePointer(key)
+		folder := path.Join(dir, route.Folder)
+		if folder != dir && !strings.HasPrefix(folder, dir+"/") {
+			errs = errs.add(pointer+"/folder", ManifestInvalidValue,
+				"the folder is outside of the directory of the application")
+			continue
+		}
+		infos, err := fs.Stat(folder)
+		if os.IsNotExist(err) || (err == nil && !infos.IsDir()) {
+			errs = errs.add(pointer+"/folder", ManifestMissingRouteFile,
+				route.Folder+": the folder is missing")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if route.Index == "" {
+			continue
+		}
+		index := path.Join(folder, route.Index)
+		if !strings.HasPrefix(index, folder+"/") {
+			errs = errs.add(pointer+"/index", ManifestInvalidValue,
+				"the index file is outside of the folder of the route")
+			continue
+		}
+		infos, err = fs.Stat(index)
+		if os.IsNotExist(err) || (err == nil && infos.IsDir()) {
+			errs = errs.add(pointer+"/index", ManifestMissingRouteFile,
+				route.Index+": the index file is missing")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	routes := Routes{
+		"/":      Route{Folder: "/", Index: "index.html"},
+		"/foo":   Route{Folder: "/foo", Index: "index.html"},
+		"/foo/":  Route{Folder: "/foo", Index: "index.html"},
+		"//bar":  Route{Folder: "/bar", Index: "index.html"},
+		"/bar":   Route{Folder: "/bar", Index: "index.html"},
+		"/qux":   Route{Folder: "qux", Index: "index.html"},
+		"nope":   Route{Folder: "/nope", Index: "index.html"},
+		"/admin": Route{Folder: "/admin", Index: "admin.html"},
+	}
+	errs := validateRoutes(routes, nil)
+	if assert.Len(t, errs, 4) {
+		assert.Equal(t, "/routes/~1bar", errs[0].Field)
+		assert.Equal(t, ManifestInvalidValue, errs[0].Code)
+		assert.Equal(t, "the route overlaps the route //bar", errs[0].Reason)
+		assert.Equal(t, "/routes/~1foo~1", errs[1].Field)
+		assert.Equal(t, "/routes/~1qux/folder", errs[2].Field)
+		assert.Equal(t, "/routes/nope", errs[3].Field)
+	}
+
+	assert.Len(t, validateRoutes(Routes{
+		"/":      Route{Folder: "/", Index: "index.html"},
+		"/admin": Route{Folder: "/admin", Index: "admin.html"},
+	}, nil), 0)
+}
+
+func TestBuildRouteTable(t *testing.T) {
+	table := buildRouteTable(Routes{
+		"/":               Route{Folder: "/", Index: "index.html"},
+		"/public/":        Route{Folder: "/public/", Index: "public.html", Public: true},
+		"/admin":          Route{Folder: "/admin", Index: "admin.html"},
+		"/admin/special":  Route{Folder: "/special", Index: "admin.html"},
+		"nope":            Route{Folder: "/nope", Index: "index.html"},
+		"/admin/special/": Route{Folder: "/dup", Index: "admin.html"},
+	})
+	if assert.Len(t, table, 4) {
+		assert.Equal(t, "/admin/special", table[0].Path)
+		assert.Equal(t, "/special", table[0].Folder)
+		assert.Equal(t, "/admin", table[1].Path)
+		assert.Equal(t, "/public", table[2].Path)
+		assert.Equal(t, "/public", table[2].Folder)
+		assert.True(t, table[2].Public)
+		assert.Equal(t, "/", table[3].Path)
+	}
+}
+
+func TestFindRouteWithTable(t *testing.T) {
+	manifest := &WebappManifest{}
+	manifest.Routes = make(Routes)
+	manifest.Routes["/"] = Route{Folder: "/", Index: "index.html"}
+	manifest.Routes["/public/"] = Route{Folder: "/public", Index: "public.html", Public: true}
+	manifest.Routes["/admin"] = Route{Folder: "/admin", Index: "admin.html"}
+	manifest.Routes["/admin/special"] = Route{Folder: "/special", Index: "admin.html"}
+	manifest.DocRouteTable = buildRouteTable(manifest.Routes)
+
+	ctx, rest := manifest.FindRoute("/admin/special/foo")
+	assert.Equal(t, "/special", ctx.Folder)
+	assert.Equal(t, "foo", rest)
+
+	ctx, rest = manifest.FindRoute("/public/app.js")
+	assert.Equal(t, "/public", ctx.Folder)
+	assert.True(t, ctx.Public)
+	assert.Equal(t, "app.js", rest)
+
+	ctx, rest = manifest.FindRoute("/admin")
+	assert.Equal(t, "/admin", ctx.Folder)
+	assert.Equal(t, "", rest)
+
+	ctx, rest = manifest.FindRoute("/foo/bar")
+	assert.Equal(t, "/", ctx.Folder)
+	assert.Equal(t, "foo/bar", rest)
+
+	manifest.DocRouteTable = buildRouteTable(Routes{
+		"/admin": Route{Folder: "/admin", Index: "admin.html"},
+	})
+	ctx, _ = manifest.FindRoute("/foo")
+	assert.True(t, ctx.NotFound())
+}
+
+func TestCheckRoutes(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, fs.MkdirAll("/routes-app/public", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/routes-app/index.html", []byte("index"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/routes-app/admin", []byte("admin"), 0644))
+
+	man := &WebappManifest{Routes: Routes{
+		"/":       Route{Folder: "/", Index: "index.html"},
+		"/public": Route{Folder: "/public", Index: "public.html", Public: true},
+		"/admin":  Route{Folder: "/admin", Index: "admin.html"},
+		"/up":     Route{Folder: "/../other", Index: "index.html"},
+	}}
+	err := checkRoutes(fs, "/routes-app", man)
+	if assert.Error(t, err) {
+		errs, ok := err.(ManifestErrors)
+		if assert.True(t, ok) && assert.Len(t, errs, 3) {
+			assert.Equal(t, "/routes/~1admin/folder", errs[0].Field)
+			assert.Equal(t, ManifestMissingRouteFile, errs[0].Code)
+			assert.Equal(t, "/routes/~1public/index", errs[1].Field)
+			assert.Equal(t, ManifestMissingRouteFile, errs[1].Code)
+			assert.Equal(t, "/routes/~1up/folder", errs[2].Field)
+			assert.Equal(t, ManifestInvalidValue, errs[2].Code)
+		}
+	}
+
+	assert.NoError(t, afero.WriteFile(fs, "/routes-app/public/public.html", []byte("public"), 0644))
+	delete(man.Routes, "/admin")
+	delete(man.Routes, "/up")
+	assert.NoError(t, checkRoutes(fs, "/routes-app", man))
+
+	// The default route of a manifest without routes is not checked
+	man = &WebappManifest{Routes: Routes{"/": Route{Folder: "/", Index: "missing.html"}}}
+	man.defaultRoutes = true
+	assert.NoError(t, checkRoutes(fs, "/routes-app", man))
+}
@@ -0,0 +1,148 @@
+package apps
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// StateTransition is the last change of the state of an application
+type StateTransition struct {
+	From State     `json:"from"`
+	At   time.Time `json:"at"`
+}
+
+// TransitionError is used when an application is moved to a state that can't
+// be reached from its current state.
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	from := e.From
+	if from == "" {
+		from = "new"
+	}
+	return fmt.Sprintf("The application can't go from the %s state to the %s state", from, e.To)
+}
+
+// transitions are the states that can be reached from each state. The empty
+// state is the one of an application that has not been installed yet. An
+// application goes to the errored state if its update fails, and to the
+// errored-deleting state if its deletion fails.
+var transitions = map[State][]State{
+	"":              {Installing},
+	Installing:      {Ready, Errored, Upgrading},
+	Upgrading:       {Ready, Errored},
+	Ready:           {Upgrading, Errored, Inactive, Trashed, Replaced, Deleting},
+	Errored:         {Upgrading, Trashed, Replaced, Deleting},
+	Inactive:        {Ready, Errored, Trashed, Deleting},
+	Trashed:         {Deleting},
+	Replaced:        {Deleting},
+	Deleting:        {ErroredDeleting},
+	ErroredDeleting: {Deleting},
+}
+
+// erroredState returns the state of an application whose operation has
+// failed, or has been interrupted, in the given state.
+func erroredState(state State) State {
+	if state == Deleting {
+		return ErroredDeleting
+	}
+	return Errored
+}
+
+// KnownState returns true if the state is one of the state machine of the
+// applications.
+func KnownState(state State) bool {
+	_, ok := transitions[state]
+	return ok && state != ""
+}
+
+// CanTransition returns true if an application can go from a state to
+// another. Staying in the same state is always possible.
+func CanTransition(from, to State) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the application to the given state, and records the
+// previous state with the date of the change. It is the only way to change
+// the state of an application: an invalid move is logged and returned as a
+// TransitionError, and the application is left unchanged.
+func Transition(man Manifest, to State) error {
+	from := man.State()
+	if from == to {
+		return nil
+	}
+	if !CanTransition(from, to) {
+		err := &TransitionError{From: from, To: to}
+		log.Warnf("[apps] Invalid transition for %s: %s", man.Slug(), err)
+		return err
+	}
+	man.setState(to, &StateTransition{From: from, At: time.Now().UTC()})
+	return nil
+}
+
+// StatesReport is the list of the applications whose state has been
+// normalized.
+type StatesReport struct {
+	// Normalized are the slugs of the applications with an unknown state, or
+	// stuck in an operation that has been interrupted.
+	Normalized []string `json:"normalized"`
+	// Fixed is true if these applications have been put in the errored state
+	Fixed bool `json:"fixed"`
+}
+
+// NormalizeStates finds the documents of the applications with a state that
+// is not in the state machine (like the legacy available and uninstalling
+// states), or that are installing, upgrading or deleting without a fresh pending
+// operation. Nothing is changed, unless fix is true: these applications are
+// then put in the errored state, from which they can be updated or deleted,
+// or in the errored-deleting state for a deletion.
+func NormalizeStates(db couchdb.Database, appType AppType, fix bool) (*StatesReport, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	report := &StatesReport{Normalized: []string{}, Fixed: fix}
+	for _, man := range mans {
+		state := man.State()
+		stuck := (state == Installing || state == Upgrading || state == Deleting) &&
+			!man.Operation().Fresh()
+		if KnownState(state) && !stuck {
+			continue
+		}
+		report.Normalized = append(report.Normalized, man.Slug())
+		if !fix {
+			continue
+		}
+		// The unknown states have no transition, so they are forced
+		var reason error
+		if !KnownState(state) {
+			log.Infof("[apps] Normalizing the unknown state %q of %s", state, man.Slug())
+			man.setState(Errored, &StateTransition{From: state, At: time.Now().UTC()})
+			reason = fmt.Errorf("The state %s of the application is unknown", state)
+		} else if err = Transition(man, erroredState(state)); err != nil {
+			return nil, err
+		} else {
+			reason = fmt.Errorf("The application was stuck in the %s state", state)
+		}
+		man.SetOperation(nil)
+		man.SetError(reason)
+		if err = couchdb.UpdateDoc(db, man); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,106 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransition(t *testing.T) {
+	man := &WebappManifest{DocSlug: "mini"}
+	assert.NoError(t, Transition(man, Installing))
+	assert.NoError(t, Transition(man, Ready))
+	assert.Equal(t, State(Ready), man.State())
+	if assert.NotNil(t, man.LastTransition()) {
+		assert.Equal(t, State(Installing), man.LastTransition().From)
+		assert.WithinDuration(t, time.Now(), man.LastTransition().At, time.Minute)
+	}
+
+	// Staying in the same state doesn't record a transition
+	last := man.LastTransition()
+	assert.NoError(t, Transition(man, Ready))
+	assert.Equal(t, last, man.LastTransition())
+
+	err := Transition(man, Installing)
+	if e, ok := err.(*TransitionError); assert.True(t, ok) {
+		assert.Equal(t, State(Ready), e.From)
+		assert.Equal(t, State(Installing), e.To)
+	}
+	assert.Equal(t, State(Ready), man.State())
+
+	assert.NoError(t, Transition(man, Inactive))
+	assert.NoError(t, Transition(man, Ready))
+	assert.NoError(t, Transition(man, Upgrading))
+	assert.NoError(t, Transition(man, Errored))
+	assert.NoError(t, Transition(man, Trashed))
+	assert.Error(t, Transition(man, Ready))
+
+	// A deletion that fails leaves the application errored-deleting, from
+	// which it can only be deleted again
+	assert.NoError(t, Transition(man, Deleting))
+	assert.Error(t, Transition(man, Ready))
+	assert.Error(t, Transition(man, Errored))
+	assert.NoError(t, Transition(man, ErroredDeleting))
+	assert.Error(t, Transition(man, Upgrading))
+	assert.NoError(t, Transition(man, Deleting))
+
+	konn := &konnManifest{DocSlug: "konn", DocState: Available}
+	assert.False(t, KnownState(konn.State()))
+	assert.Error(t, Transition(konn, Ready))
+}
+
+func TestNormalizeStates(t *testing.T) {
+	if installerType != Webapp {
+		return
+	}
+	legacy := &WebappManifest{DocSlug: "mini-legacy", DocState: Available}
+	stuck := &WebappManifest{
+		DocSlug:      "mini-stuck",
+		DocState:     Installing,
+		DocOperation: &PendingOperation{Name: "installing", StartedAt: time.Now().Add(-time.Hour)},
+	}
+	running := &WebappManifest{
+		DocSlug:      "mini-running",
+		DocState:     Upgrading,
+		DocOperation: newOperation("updating", ""),
+	}
+	defer func() {
+		for _, slug := range []string{"mini-legacy", "mini-stuck", "mini-running"} {
+			if man, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, man)
+			}
+		}
+	}()
+	for _, man := range []*WebappManifest{legacy, stuck, running} {
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, man)) {
+			return
+		}
+	}
+
+	report, err := NormalizeStates(db, Webapp, false)
+	if assert.NoError(t, err) {
+		assert.False(t, report.Fixed)
+		assert.Contains(t, report.Normalized, "mini-legacy")
+		assert.Contains(t, report.Normalized, "mini-stuck")
+		assert.NotContains(t, report.Normalized, "mini-running")
+	}
+
+	report, err = NormalizeStates(db, Webapp, true)
+	if assert.NoError(t, err) {
+		assert.True(t, report.Fixed)
+	}
+	for _, slug := range []string{"mini-legacy", "mini-stuck"} {
+		man, err := GetWebappBySlug(db, slug)
+		if assert.NoError(t, err) {
+			assert.Equal(t, State(Errored), man.State())
+			assert.Nil(t, man.Operation())
+			assert.NotNil(t, man.LastTransition())
+		}
+	}
+	running, err = GetWebappBySlug(db, "mini-running")
+	if assert.NoError(t, err) {
+		assert.Equal(t, State(Upgrading), running.State())
+	}
+}
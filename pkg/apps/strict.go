@@ -0,0 +1,167 @@
+package apps
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+// ManifestUnknownField is the code for a field of the manifest that is not
+// known by the stack, like a typo in its name
+const ManifestUnknownField = "unknown_field"
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonShapes are the JSON shapes of the types of the manifests that have
+// their own decoder
+var jsonShapes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(permissions.Set{}): reflect.TypeOf(map[string]permissions.Rule{}),
+}
+
+// unknownFields returns the JSON pointers of the fields of the manifest that
+// are ignored when it is decoded in man, at the top-level (except the extra
+// fields) and in the nested objects. The names of the fields are matched like
+// encoding/json does, so without taking care of the case.
+func unknownFields(b []byte, man Manifest) []string {
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil
+	}
+	return walkUnknownFields(doc, reflect.TypeOf(man), "", nil)
+}
+
+func walkUnknownFields(doc interface{}, t reflect.Type, pointer string, unknown []string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if shape, ok := jsonShapes[t]; ok {
+		t = shape
+	} else if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return unknown
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return unknown
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p := pointer + "/" + escapePointer(key)
+			ft, ok := lookupField(fields, key)
+			if !ok {
+				// The extra fields are kept, they are not unknown
+				if pointer != "" || !isExtraField(key) {
+					unknown = append(unknown, p)
+				}
+				continue
+			}
+			unknown = walkUnknownFields(obj[key], ft, p, unknown)
+		}
+	case reflect.Map:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return unknown
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p := pointer + "/" + escapePointer(key)
+			unknown = walkUnknownFields(obj[key], t.Elem(), p, unknown)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := doc.([]interface{})
+		if !ok {
+			return unknown
+		}
+		for i, item := range list {
+			p := pointer + "/" + strconv.Itoa(i)
+			unknown = walkUnknownFields(item, t.Elem(), p, unknown)
+		}
+	}
+	return unknown
+}
+
+// jsonFields returns the types of the fields of a struct by their JSON names,
+// with the fields of the embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for n, typ := range jsonFields(ft) {
+					if _, ok := fields[n]; !ok {
+						fields[n] = typ
+					}
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func lookupField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// checkUnknownFields reports the unknown fields of a manifest: they are
+// errors in strict mode, and warnings else. The errors are added to the ones
+// of the validation of the manifest, if any.
+func checkUnknownFields(b []byte, man Manifest, strict bool, err error) error {
+	unknown := unknownFields(b, man)
+	if len(unknown) == 0 {
+		return err
+	}
+	if !strict {
+		if w, ok := man.(warner); ok {
+			for _, pointer := range unknown {
+				w.addWarning(pointer + ": the field is unknown")
+			}
+		}
+		return err
+	}
+	var errs ManifestErrors
+	for _, pointer := range unknown {
+		errs = errs.add(pointer, ManifestUnknownField, "the field is unknown")
+	}
+	return withManifestErrors(err, errs)
+}
@@ -0,0 +1,57 @@
+package apps
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownFields(t *testing.T) {
+	b := []byte(`{
+  "name": "Mini",
+  "Version": "1.0.0",
+  "permisions": {},
+  "permissions": {
+    "files": {"type": "io.cozy.files", "verbs": ["GET"], "descripton": "typo"}
+  },
+  "routes": {"/admin": {"fodler": "/admin", "index": "admin.html"}},
+  "intents": [{"action": "PICK", "href": "/pick", "extra": true}],
+  "locales": {"fr": {"description": "Mini", "name": "Mini"}},
+  "editor": "Cozy"
+}`)
+	unknown := unknownFields(b, &WebappManifest{})
+	assert.Equal(t, []string{
+		"/editor",
+		"/intents/0/extra",
+		"/locales/fr/name",
+		"/permisions",
+		"/permissions/files/descripton",
+		"/routes/~1admin/fodler",
+	}, unknown)
+
+	assert.Empty(t, unknownFields([]byte(`{"name": "Mini", "type": "node"}`), &konnManifest{}))
+}
+
+func TestCheckUnknownFields(t *testing.T) {
+	b := []byte(`{"name": "Mini", "permisions": {}}`)
+
+	man := &WebappManifest{}
+	assert.NoError(t, checkUnknownFields(b, man, false, nil))
+	assert.Equal(t, []string{"/permisions: the field is unknown"}, man.Warnings())
+
+	err := checkUnknownFields(b, &WebappManifest{}, true, nil)
+	if errs, ok := err.(ManifestErrors); assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "/permisions", errs[0].Field)
+		assert.Equal(t, ManifestUnknownField, errs[0].Code)
+	}
+
+	validation := ManifestErrors{}.add("/name", ManifestMissingField, "the name is mandatory")
+	err = checkUnknownFields(b, &WebappManifest{}, true, validation)
+	if errs, ok := err.(ManifestErrors); assert.True(t, ok) {
+		assert.Len(t, errs, 2)
+	}
+
+	other := errors.New("other")
+	assert.Equal(t, other, checkUnknownFields(b, &WebappManifest{}, true, other))
+}
@@ -0,0 +1,24 @@
+package apps
+
+import "github.com/cozy/cozy-stack/pkg/permissions"
+
+// SubjectSystem is the type of the subject of the operations triggered by the
+// stack itself, like the automatic updates.
+const SubjectSystem = "system"
+
+// Subject is the author of an operation on an application: the type of the
+// permission used for it (cli for the owner, app, oauth, ...), and its source,
+// like the application or the OAuth client.
+type Subject struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// SystemSubject is the subject of the operations triggered by the stack
+var SystemSubject = &Subject{Type: SubjectSystem}
+
+// SubjectOf returns the subject of an operation done with the given
+// permission.
+func SubjectOf(pdoc *permissions.Permission) *Subject {
+	return &Subject{Type: pdoc.Type, ID: pdoc.SourceID}
+}
@@ -0,0 +1,230 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/spf13/afero"
+)
+
+// Successor is the application that replaces a deprecated one, as declared
+// by the replaced_by field of the manifest of the deprecated application.
+type Successor struct {
+	Slug   string `json:"slug"`
+	Source string `json:"source"`
+}
+
+// The status of the steps of a migration to a successor
+const (
+	MigrationDone    = "done"
+	MigrationSkipped = "skipped"
+	MigrationFailed  = "failed"
+	MigrationPending = "pending"
+)
+
+// MigrationStep is the result of a step of a migration to a successor
+type MigrationStep struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// MigrationReport is the result of the migration of an application to its
+// successor. The steps after a failed one are left pending, and the
+// migration can be started again: the steps already done are then skipped.
+type MigrationReport struct {
+	From  string           `json:"from"`
+	To    *Successor       `json:"to"`
+	Done  bool             `json:"done"`
+	Steps []*MigrationStep `json:"steps"`
+}
+
+// MigrationOptions are the options for the migration to a successor
+type MigrationOptions struct {
+	// CopySettings copies the settings document of the application for its
+	// successor, if the successor has none
+	CopySettings bool
+	// TermsAccepted is the version of the terms of the successor accepted by
+	// the user, for the konnectors
+	TermsAccepted string
+	// Subject is the author of the migration, recorded on the successor. The
+	// system subject is used if it is nil.
+	Subject *Subject
+}
+
+// MigrateToSuccessor installs the successor of a deprecated application,
+// copies its settings if asked, and then puts the deprecated application in
+// the replaced state, without removing its document and its files.
+func MigrateToSuccessor(db couchdb.Database, fs afero.Fs, appType AppType, slug string, opts *MigrationOptions) (*MigrationReport, error) {
+	man, err := GetBySlug(db, slug, appType)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	successor := man.ReplacedBy()
+	if successor == nil {
+		return nil, ErrNoSuccessor
+	}
+	if op := man.Operation(); op.Fresh() {
+		return nil, &OperationInProgressError{op}
+	}
+
+	steps := []struct {
+		name string
+		run  func() (bool, error)
+	}{
+		{"install_successor", func() (bool, error) {
+			return installSuccessor(db, fs, appType, successor, opts)
+		}},
+		{"copy_settings", func() (bool, error) {
+			if !opts.CopySettings {
+				return false, nil
+			}
+			return copySettings(db, man.Slug(), successor.Slug)
+		}},
+		{"soft_delete", func() (bool, error) {
+			return retire(db, man)
+		}},
+	}
+
+	report := &MigrationReport{From: man.Slug(), To: successor, Done: true}
+	for _, s := range steps {
+		step := &MigrationStep{Name: s.name, Status: MigrationPending}
+		report.Steps = append(report.Steps, step)
+		if !report.Done {
+			continue
+		}
+		done, err := s.run()
+		switch {
+		case err != nil:
+			step.Status, step.Error = MigrationFailed, err.Error()
+			report.Done = false
+		case done:
+			step.Status = MigrationDone
+		default:
+			step.Status = MigrationSkipped
+		}
+	}
+	return report, nil
+}
+
+// installSuccessor installs the successor, and waits for the end of its
+// installation. Nothing is done if it is already installed.
+func installSuccessor(db couchdb.Database, fs afero.Fs, appType AppType, successor *Successor, opts *MigrationOptions) (bool, error) {
+	subject := opts.Subject
+	if subject == nil {
+		subject = SystemSubject
+	}
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation:     Install,
+		Type:          appType,
+		Slug:          successor.Slug,
+		SourceURL:     successor.Source,
+		TermsAccepted: opts.TermsAccepted,
+		Subject:       subject,
+	})
+	if err == ErrAlreadyExists {
+		installed, errg := GetBySlug(db, successor.Slug, appType)
+		if errg != nil {
+			return false, errg
+		}
+		if installed.State() == Errored {
+			return false, installed.Error()
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	RunInBackground(inst.Install)
+	_, err = waitInstaller(inst)
+	return err == nil, err
+}
+
+// appSettingsID returns the identifier of the io.cozy.settings document of
+// an application
+func appSettingsID(slug string) string {
+	return consts.Settings + ".apps." + slug
+}
+
+// copySettings copies the settings document of an application for another
+// one. The settings of the other application are kept if it already has them.
+func copySettings(db couchdb.Database, from, to string) (bool, error) {
+	var doc couchdb.JSONDoc
+	err := couchdb.GetDoc(db, consts.Settings, appSettingsID(from), &doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var existing couchdb.JSONDoc
+	err = couchdb.GetDoc(db, consts.Settings, appSettingsID(to), &existing)
+	if err == nil {
+		return false, nil
+	}
+	if !couchdb.IsNotFoundError(err) {
+		return false, err
+	}
+	copied := couchdb.JSONDoc{Type: consts.Settings, M: make(map[string]interface{})}
+	for k, v := range doc.M {
+		if k != "_id" && k != "_rev" {
+			copied.M[k] = v
+		}
+	}
+	copied.M["_id"] = appSettingsID(to)
+	return true, couchdb.CreateNamedDoc(db, copied)
+}
+
+// retire puts a deprecated application in the replaced state, and removes
+// its permissions. Its document and its files are kept, and it can still be
+// uninstalled.
+func retire(db couchdb.Database, man Manifest) (bool, error) {
+	if man.State() == Replaced {
+		return false, nil
+	}
+	if err := Transition(man, Replaced); err != nil {
+		return false, err
+	}
+	if err := permissions.DestroyApp(db, man.Slug()); err != nil {
+		return false, err
+	}
+	return true, couchdb.UpdateDoc(db, man)
+}
+
+// peekSuccessor returns the successor declared by a manifest, if any. The
+// other fields of the manifest are not read, as the manifest of a replaced
+// application can be just a stub.
+func peekSuccessor(b []byte) (*Successor, error) {
+	var doc struct {
+		ReplacedBy *Successor `json:"replaced_by"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, ErrBadManifest
+	}
+	if doc.ReplacedBy == nil {
+		return nil, nil
+	}
+	if errs := validateSuccessor(doc.ReplacedBy, nil); len(errs) > 0 {
+		return nil, errs
+	}
+	return doc.ReplacedBy, nil
+}
+
+func validateSuccessor(successor *Successor, errs ManifestErrors) ManifestErrors {
+	if successor == nil {
+		return errs
+	}
+	if !ValidSlug(successor.Slug) {
+		errs = errs.add("/replaced_by/slug", ManifestInvalidValue, "the slug of the successor is invalid")
+	}
+	if u, err := url.Parse(successor.Source); err != nil || u.Scheme == "" {
+		errs = errs.add("/replaced_by/source", ManifestInvalidValue, "the source of the successor must be an URL")
+	}
+	return errs
+}
@@ -0,0 +1,76 @@
+package apps
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Summary gives the figures of the installed applications of an instance,
+// for the settings. They are computed from the documents of the
+// applications, without reading their files.
+type Summary struct {
+	Webapps          int   `json:"webapps"`
+	Konnectors       int   `json:"konnectors"`
+	Size             int64 `json:"size"`
+	UpdatesAvailable int   `json:"updates_available"`
+	Errored          int   `json:"errored"`
+	ErroredDeleting  int   `json:"errored_deleting"`
+
+	// The updates available are known from the last check of the sources,
+	// by the auto-updater or POST /apps/updates/check. UpdatesCheckedAt is
+	// the date of the oldest check, and LastCheckedAt the one of the most
+	// recent check, so that the figure can be shown as stale. The
+	// applications never checked are counted in UpdatesUnchecked.
+	UpdatesCheckedAt *time.Time `json:"updates_checked_at,omitempty"`
+	LastCheckedAt    *time.Time `json:"last_checked_at,omitempty"`
+	UpdatesUnchecked int        `json:"updates_unchecked"`
+}
+
+// Count counts all the applications of a type of an instance in the
+// summary. The documents are read by pages, and the legacy ones are only
+// upgraded in memory: this read doesn't write them.
+func (s *Summary) Count(db couchdb.Database, appType AppType) error {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return err
+	}
+	for _, man := range mans {
+		upgradeManifest(man)
+	}
+	s.Add(appType, mans)
+	return nil
+}
+
+// Add counts the given applications of a type in the summary
+func (s *Summary) Add(appType AppType, mans []Manifest) {
+	for _, man := range mans {
+		if appType == Konnector {
+			s.Konnectors++
+		} else {
+			s.Webapps++
+		}
+		size, _ := man.Size()
+		s.Size += size
+		if man.AvailableVersion() != "" {
+			s.UpdatesAvailable++
+		}
+		switch man.State() {
+		case Errored:
+			s.Errored++
+		case ErroredDeleting:
+			s.ErroredDeleting++
+		}
+		checkedAt := man.CheckedAt()
+		if checkedAt == nil {
+			s.UpdatesUnchecked++
+			continue
+		}
+		if s.UpdatesCheckedAt == nil || checkedAt.Before(*s.UpdatesCheckedAt) {
+			s.UpdatesCheckedAt = checkedAt
+		}
+		if s.LastCheckedAt == nil || checkedAt.After(*s.LastCheckedAt) {
+			s.LastCheckedAt = checkedAt
+		}
+	}
+}
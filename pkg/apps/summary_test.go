@@ -0,0 +1,71 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary(t *testing.T) {
+	old := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	recent := old.Add(48 * time.Hour)
+	s := &Summary{}
+	s.Add(Webapp, []Manifest{
+		&WebappManifest{DocSlug: "a", DocState: Ready, DocSize: 100, DocCheckedAt: &recent},
+		&WebappManifest{DocSlug: "b", DocState: Errored, DocSize: 50,
+			DocAvailable: true, DocAvailVers: "2.0.0", DocCheckedAt: &old},
+	})
+	s.Add(Konnector, []Manifest{
+		&konnManifest{DocSlug: "k", DocState: Ready, DocSize: 10},
+		&konnManifest{DocSlug: "l", DocState: ErroredDeleting},
+	})
+	assert.Equal(t, 2, s.Webapps)
+	assert.Equal(t, 2, s.Konnectors)
+	assert.EqualValues(t, 160, s.Size)
+	assert.Equal(t, 1, s.UpdatesAvailable)
+	assert.Equal(t, 1, s.Errored)
+	assert.Equal(t, 1, s.ErroredDeleting)
+	assert.Equal(t, &old, s.UpdatesCheckedAt)
+	assert.Equal(t, &recent, s.LastCheckedAt)
+	assert.Equal(t, 2, s.UpdatesUnchecked)
+}
+
+func TestSummaryCount(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the summary reads the documents like the listings")
+	}
+	before := &Summary{}
+	if !assert.NoError(t, before.Count(db, Webapp)) {
+		return
+	}
+
+	// More applications than a page, and a legacy document that is not
+	// upgraded in CouchDB by the count
+	pageSize := appsPageSize
+	appsPageSize = 2
+	defer func() { appsPageSize = pageSize }()
+	defer createAppDocs(t, "sum-many", 5)()
+	legacy := couchdb.JSONDoc{Type: consts.Apps, M: map[string]interface{}{
+		"_id":   consts.Apps + "/sum-legacy",
+		"slug":  "sum-legacy",
+		"state": "available",
+	}}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(db, legacy)) {
+		return
+	}
+	defer couchdb.DeleteDoc(db, legacy)
+
+	after := &Summary{}
+	if !assert.NoError(t, after.Count(db, Webapp)) {
+		return
+	}
+	assert.Equal(t, before.Webapps+6, after.Webapps)
+	assert.Equal(t, before.Errored+1, after.Errored)
+	var stored couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(db, consts.Apps, consts.Apps+"/sum-legacy", &stored))
+	assert.Equal(t, legacy.Rev(), stored.Rev())
+	assert.Equal(t, "available", stored.M["state"])
+}
@@ -0,0 +1,296 @@
+package apps
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// SyncReport is the number of files written by an install or an update, and
+// for an update, the number of files skipped as they have not changed, the
+// number of files copied from the installed version in the staging directory
+// as they have not changed, and the number of files deleted as they are no
+// longer in the new version.
+type SyncReport struct {
+	Written int `json:"written"`
+	Skipped int `json:"skipped"`
+	Copied  int `json:"copied"`
+	Deleted int `json:"deleted"`
+}
+
+// AppChecksums are the SHA-256 checksums of the files of an installed
+// application, by path in its directory. They are recorded at the end of
+// each install and update, so that the next update only writes the files
+// that have changed.
+type AppChecksums struct {
+	DocID  string            `json:"_id,omitempty"`
+	DocRev string            `json:"_rev,omitempty"`
+	Files  map[string]string `json:"files"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (c *AppChecksums) ID() string { return c.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (c *AppChecksums) Rev() string { return c.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (c *AppChecksums) DocType() string { return consts.AppsChecksums }
+
+// SetID is used to implement the couchdb.Doc interface
+func (c *AppChecksums) SetID(id string) { c.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (c *AppChecksums) SetRev(rev string) { c.DocRev = rev }
+
+func checksumsID(appType AppType, slug string) string {
+	return string(appType) + "/" + slug
+}
+
+// getChecksums returns the checksums of the files of an application, or nil
+// if they are not known, like for the applications installed before they were
+// recorded.
+func getChecksums(db couchdb.Database, appType AppType, slug string) (*AppChecksums, error) {
+	sums := &AppChecksums{}
+	err := couchdb.GetDoc(db, consts.AppsChecksums, checksumsID(appType, slug), sums)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// saveChecksums records the checksums of the files of an application.
+func saveChecksums(db couchdb.Database, appType AppType, slug string, files map[string]string) error {
+	sums, err := getChecksums(db, appType, slug)
+	if err != nil {
+		return err
+	}
+	if sums != nil {
+		sums.Files = files
+		return couchdb.UpdateDoc(db, sums)
+	}
+	sums = &AppChecksums{DocID: checksumsID(appType, slug), Files: files}
+	return couchdb.CreateNamedDocWithDB(db, sums)
+}
+
+// deleteChecksums removes the checksums of the files of an application.
+func deleteChecksums(db couchdb.Database, appType AppType, slug string) error {
+	sums, err := getChecksums(db, appType, slug)
+	if err != nil || sums == nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, sums)
+}
+
+// syncFs is the filesystem given to the fetchers. It computes the checksums
+// of the files written in the directory of the application, and when the
+// checksums of the installed version are known, it only writes the files
+// that have changed, and it deletes the files that are no longer in the new
+// version at the end, instead of removing them all before. The .git
+// directory is not tracked.
+//
+// For an update in a staging directory, the files of the installed version
+// that have not changed are copied from its directory at the end, so that
+// the files that have changed or that have been deleted are not copied.
+type syncFs struct {
+	afero.Fs
+	dir    string
+	from   string            // the directory of the installed version, for an update
+	before map[string]string // nil for a full copy
+	after  map[string]string
+	report SyncReport
+}
+
+func newSyncFs(fs afero.Fs, dir string) *syncFs {
+	return &syncFs{Fs: fs, dir: dir}
+}
+
+// begin starts to track the files written in the directory, with the
+// checksums of the installed version, or nil for a full copy.
+func (s *syncFs) begin(before map[string]string) {
+	s.before, s.after, s.report = before, make(map[string]string), SyncReport{}
+}
+
+// finish deletes the files of the installed version that are not in the new
+// one, stops the tracking, and returns the checksums of the new version. If
+// no file has been written, like for a git repository that is already
+// up-to-date, the files have not changed.
+func (s *syncFs) finish() (map[string]string, error) {
+	before, after := s.before, s.after
+	s.before, s.after = nil, nil
+	if len(after) == 0 {
+		return before, s.copyInstalled(func(string) bool { return true })
+	}
+	for name := range before {
+		if _, ok := after[name]; ok {
+			continue
+		}
+		err := s.Fs.Remove(path.Join(s.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s.report.Deleted++
+		s.removeEmptyDirs(path.Dir(name))
+	}
+	err := s.copyInstalled(func(rel string) bool {
+		sum, ok := before[rel]
+		return ok && after[rel] == sum
+	})
+	return after, err
+}
+
+// copyInstalled copies the files of the installed version that have not
+// changed in the staging directory of an update. The .git directory has been
+// moved by the stage of the update, and it is not copied.
+func (s *syncFs) copyInstalled(unchanged func(rel string) bool) error {
+	if s.from == "" {
+		return nil
+	}
+	exists, err := afero.DirExists(s.Fs, s.from)
+	if err != nil || !exists {
+		return err
+	}
+	return afero.Walk(s.Fs, s.from, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.from, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".git" {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !unchanged(rel) {
+			return nil
+		}
+		if err = copyFile(s.Fs, name, path.Join(s.dir, rel), info.Mode()); err != nil {
+			return err
+		}
+		s.report.Copied++
+		return nil
+	})
+}
+
+// removeEmptyDirs removes a directory of the application, and its parents,
+// if they are empty.
+func (s *syncFs) removeEmptyDirs(dir string) {
+	for dir != "." && dir != "/" {
+		full := path.Join(s.dir, dir)
+		infos, err := afero.ReadDir(s.Fs, full)
+		if err != nil || len(infos) > 0 || s.Fs.Remove(full) != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// tracked returns the path of a file in the directory of the application, or
+// false if it is not tracked.
+func (s *syncFs) tracked(name string) (string, bool) {
+	prefix := s.dir + "/"
+	name = path.Clean(name)
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	rel := strings.TrimPrefix(name, prefix)
+	if rel == ".git" || strings.HasPrefix(rel, ".git/") {
+		return "", false
+	}
+	return rel, true
+}
+
+// Create is part of the afero.Fs interface
+func (s *syncFs) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile is part of the afero.Fs interface. The tracked files opened for
+// writing are kept in memory until they are closed.
+func (s *syncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	rel, ok := s.tracked(name)
+	if !ok || s.after == nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 || flag&os.O_APPEND != 0 {
+		return s.Fs.OpenFile(name, flag, perm)
+	}
+	return &syncFile{fs: s, name: name, rel: rel, flag: flag, perm: perm}, nil
+}
+
+// Remove is part of the afero.Fs interface. When the checksums of the
+// installed version are known, the tracked files are not removed: finish
+// deletes the ones that are not in the new version.
+func (s *syncFs) Remove(name string) error {
+	if s.keep(name) {
+		return nil
+	}
+	return s.Fs.Remove(name)
+}
+
+// RemoveAll is part of the afero.Fs interface, see Remove.
+func (s *syncFs) RemoveAll(name string) error {
+	if s.keep(name) {
+		return nil
+	}
+	return s.Fs.RemoveAll(name)
+}
+
+func (s *syncFs) keep(name string) bool {
+	if s.before == nil {
+		return false
+	}
+	if path.Clean(name) == s.dir {
+		return true
+	}
+	_, ok := s.tracked(name)
+	return ok
+}
+
+// commit writes a tracked file, unless it has not changed since the
+// installed version.
+func (s *syncFs) commit(f *syncFile) error {
+	data := f.buf.Bytes()
+	sum := checksum(data)
+	s.after[f.rel] = sum
+	if s.before != nil && s.before[f.rel] == sum {
+		s.report.Skipped++
+		return nil
+	}
+	file, err := s.Fs.OpenFile(f.name, f.flag, f.perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		s.report.Written++
+	}
+	return err
+}
+
+// syncFile is a tracked file opened for writing. Only its Write, WriteString,
+// Name and Close methods can be used.
+type syncFile struct {
+	afero.File
+	fs   *syncFs
+	name string
+	rel  string
+	flag int
+	perm os.FileMode
+	buf  bytes.Buffer
+}
+
+func (f *syncFile) Name() string                      { return f.name }
+func (f *syncFile) Write(p []byte) (int, error)       { return f.buf.Write(p) }
+func (f *syncFile) WriteString(s string) (int, error) { return f.buf.WriteString(s) }
+func (f *syncFile) Close() error                      { return f.fs.commit(f) }
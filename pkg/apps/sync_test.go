@@ -0,0 +1,115 @@
+package apps
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSyncFile(t *testing.T, fs afero.Fs, name, content string) {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+}
+
+func TestSyncFs(t *testing.T) {
+	base := afero.NewMemMapFs()
+	sync := newSyncFs(base, "/sync-app")
+	assert.NoError(t, base.MkdirAll("/sync-app/lib", 0755))
+	assert.NoError(t, base.MkdirAll("/sync-app/.git", 0755))
+
+	// A full copy writes all the files
+	sync.begin(nil)
+	writeSyncFile(t, sync, "/sync-app/index.html", "index")
+	writeSyncFile(t, sync, "/sync-app/lib/app.js", "app")
+	writeSyncFile(t, sync, "/sync-app/.git/HEAD", "ref")
+	sums, err := sync.finish()
+	assert.NoError(t, err)
+	assert.Len(t, sums, 2)
+	assert.Equal(t, SyncReport{Written: 2}, sync.report)
+
+	// With the checksums, only the changed files are written, and the files
+	// removed by the fetcher are kept until the end
+	sync.begin(sums)
+	assert.NoError(t, sync.RemoveAll("/sync-app"))
+	assert.NoError(t, sync.Remove("/sync-app/lib/app.js"))
+	writeSyncFile(t, sync, "/sync-app/index.html", "index")
+	writeSyncFile(t, sync, "/sync-app/lib/app.js", "app v2")
+	writeSyncFile(t, sync, "/sync-app/lib/vendor.js", "vendor")
+	sums, err = sync.finish()
+	assert.NoError(t, err)
+	assert.Len(t, sums, 3)
+	assert.Equal(t, SyncReport{Written: 2, Skipped: 1}, sync.report)
+	content, err := afero.ReadFile(base, "/sync-app/lib/app.js")
+	assert.NoError(t, err)
+	assert.Equal(t, "app v2", string(content))
+
+	// The files that are no longer in the new version are deleted, with the
+	// directories left empty
+	sync.begin(sums)
+	writeSyncFile(t, sync, "/sync-app/index.html", "index v3")
+	sums, err = sync.finish()
+	assert.NoError(t, err)
+	assert.Len(t, sums, 1)
+	assert.Equal(t, SyncReport{Written: 1, Deleted: 2}, sync.report)
+	exists, _ := afero.Exists(base, "/sync-app/lib")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(base, "/sync-app/.git/HEAD")
+	assert.True(t, exists)
+
+	// Nothing has changed if no file is written
+	sync.begin(sums)
+	after, err := sync.finish()
+	assert.NoError(t, err)
+	assert.Equal(t, sums, after)
+	assert.Equal(t, SyncReport{}, sync.report)
+}
+
+func TestSyncFsFromInstalled(t *testing.T) {
+	base := afero.NewMemMapFs()
+	writeSyncFile(t, base, "/sync-app/index.html", "index")
+	writeSyncFile(t, base, "/sync-app/lib/app.js", "app")
+	writeSyncFile(t, base, "/sync-app/lib/old.js", "old")
+	writeSyncFile(t, base, "/sync-app/.git/HEAD", "ref")
+	sums := map[string]string{
+		"index.html": checksum([]byte("index")),
+		"lib/app.js": checksum([]byte("app")),
+		"lib/old.js": checksum([]byte("old")),
+	}
+
+	// Only the unchanged files are copied from the installed version, after
+	// the changed ones have been written in the staging directory
+	sync := newSyncFs(base, "/sync-app@op")
+	sync.from = "/sync-app"
+	sync.begin(sums)
+	writeSyncFile(t, sync, "/sync-app@op/index.html", "index")
+	writeSyncFile(t, sync, "/sync-app@op/lib/app.js", "app v2")
+	after, err := sync.finish()
+	assert.NoError(t, err)
+	assert.Len(t, after, 2)
+	assert.Equal(t, SyncReport{Written: 1, Skipped: 1, Copied: 1, Deleted: 1}, sync.report)
+	content, err := afero.ReadFile(base, "/sync-app@op/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "index", string(content))
+	content, err = afero.ReadFile(base, "/sync-app@op/lib/app.js")
+	assert.NoError(t, err)
+	assert.Equal(t, "app v2", string(content))
+	exists, _ := afero.Exists(base, "/sync-app@op/lib/old.js")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(base, "/sync-app@op/.git/HEAD")
+	assert.False(t, exists)
+
+	// All the files are copied if nothing has changed
+	sync = newSyncFs(base, "/sync-app@op2")
+	sync.from = "/sync-app"
+	sync.begin(sums)
+	after, err = sync.finish()
+	assert.NoError(t, err)
+	assert.Equal(t, sums, after)
+	assert.Equal(t, SyncReport{Copied: 3}, sync.report)
+}
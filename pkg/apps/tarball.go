@@ -0,0 +1,430 @@
+package apps
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/utils/archive"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TarballMaxSize is the maximal size in bytes of the archive of an
+// application
+const TarballMaxSize = 100 << 20
+
+// tarballMaxExtractedSize and tarballMaxFiles are the limits for the files
+// extracted from the archive of an application, as a small archive can
+// expand to a lot of data.
+const (
+	tarballMaxExtractedSize = 10 * TarballMaxSize
+	tarballMaxFiles         = 50000
+)
+
+// ErrTarballTooLarge is used when the archive of an application is larger
+// than TarballMaxSize
+var ErrTarballTooLarge = fmt.Errorf("Application archive is larger than %s", utils.FormatSize(TarballMaxSize))
+
+// sigPrefix is the prefix of the URL fragment used to give the detached
+// signature of an archive, like https://example.org/app.tar.gz#sig=...
+const sigPrefix = "sig="
+
+// checksumPrefix is the prefix of the URL fragment used to give the SHA-256
+// checksum of an archive, in hexadecimal, like the ones published with the
+// releases: https://example.org/app.tar.gz#sha256=...
+const checksumPrefix = "sha256="
+
+// fragmentSep separates the parameters of the URL fragment, so that an
+// archive can have both a checksum and a signature, like
+// https://example.org/app.tar.gz#sha256=...&sig=...
+const fragmentSep = "&"
+
+// fragmentParam returns the value of a parameter of the URL fragment, like
+// sig= or sha256=, and false if the fragment doesn't have it.
+func fragmentParam(src *url.URL, prefix string) (string, bool) {
+	for _, part := range strings.Split(src.Fragment, fragmentSep) {
+		if strings.HasPrefix(part, prefix) {
+			return strings.TrimPrefix(part, prefix), true
+		}
+	}
+	return "", false
+}
+
+// tarballFetcher installs an application from a gzipped tarball served over
+// http(s). The archive is downloaded once, in a temporary file removed by
+// Close, and its signature is checked before anything is read from it.
+type tarballFetcher struct {
+	fs          afero.Fs
+	cache       *SourceCache
+	manFilename string
+	archive     *os.File
+	archiveSize int64
+	prefix      string
+	progress    *progressReporter
+	// ifNoneMatch is the ETag of an archive already seen, to download it only
+	// if it has changed, and etag is the ETag of the downloaded archive
+	ifNoneMatch string
+	etag        string
+}
+
+// errNotModified is used when the archive has not changed since the one
+// with the ETag given to the fetcher
+var errNotModified = errors.New("The archive has not been modified")
+
+// pinnedArchive returns true if the archive of the source is signed or
+// checksummed: its content can't change for the same URL.
+func pinnedArchive(src *url.URL) bool {
+	_, signed := fragmentParam(src, sigPrefix)
+	_, checksummed := fragmentParam(src, checksumPrefix)
+	return signed || checksummed
+}
+
+func newTarballFetcher(fs afero.Fs, cache *SourceCache, manFilename string, progress *progressReporter) *tarballFetcher {
+	return &tarballFetcher{fs: fs, cache: cache, manFilename: manFilename, progress: progress}
+}
+
+func (t *tarballFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
+	if err := t.download(src); err != nil {
+		return nil, err
+	}
+	var manifest []byte
+	found := false
+	err := t.walk(func(hdr *tar.Header, r io.Reader) error {
+		if found || hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil
+		}
+		// The files can be at the root of the archive or in a single top-level
+		// directory, like the package/ directory of the npm tarballs.
+		name := strings.TrimPrefix(hdr.Name, "./")
+		dir, file := path.Split(name)
+		if file != t.manFilename || strings.Count(dir, "/") > 1 {
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		manifest, t.prefix, found = b, dir, true
+		return nil
+	})
+	if err != nil || !found {
+		return nil, ErrManifestNotReachable
+	}
+	return ioutil.NopCloser(bytes.NewReader(manifest)), nil
+}
+
+func (t *tarballFetcher) Fetch(src *url.URL, baseDir string) error {
+	log.Debugf("[tarball] Fetch %s", src.String())
+	if err := t.download(src); err != nil {
+		return err
+	}
+	fs := t.fs
+	if err := fs.RemoveAll(baseDir); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+	// The progress of the extraction is the part of the archive already read
+	t.progress.start(PhaseExtracting, t.archiveSize)
+	r := io.TeeReader(t.archiveReader(), t.progress)
+	return archive.ExtractTarGz(r, fs, baseDir, archive.Options{
+		MaxSize:  tarballMaxExtractedSize,
+		MaxFiles: tarballMaxFiles,
+		Prefix:   t.prefix,
+	})
+}
+
+// Close removes the downloaded archive
+func (t *tarballFetcher) Close() error {
+	if t.archive == nil {
+		return nil
+	}
+	t.archive.Close()
+	err := os.Remove(t.archive.Name())
+	t.archive = nil
+	return err
+}
+
+// archiveReader returns a reader for the content of the downloaded archive,
+// from its beginning
+func (t *tarballFetcher) archiveReader() io.Reader {
+	return io.NewSectionReader(t.archive, 0, t.archiveSize)
+}
+
+// download fetches the archive in a temporary file, and verifies its
+// checksum and its signature
+func (t *tarballFetcher) download(src *url.URL) error {
+	if t.archive != nil {
+		return nil
+	}
+	f, err := ioutil.TempFile("", "cozy-app-")
+	if err != nil {
+		return err
+	}
+	size, err := t.fetchArchive(src, f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	t.archive, t.archiveSize = f, size
+	return nil
+}
+
+// fetchArchive writes the archive of the source in f, from the source cache
+// or from its URL, and returns its size.
+func (t *tarballFetcher) fetchArchive(src *url.URL, f *os.File) (int64, error) {
+	if err := checkSourceURL(src); err != nil {
+		return 0, err
+	}
+	// The content of a signed or checksummed archive can't change for the same
+	// URL, so it can be kept in the cache
+	pinned := pinnedArchive(src)
+	if t.cache != nil && pinned {
+		if t.cache.loadArchive(src, f) {
+			if size, err := f.Seek(0, io.SeekCurrent); err == nil && verifyArchive(f, size, src) == nil {
+				return size, nil
+			}
+		}
+		if err := resetFile(f); err != nil {
+			return 0, err
+		}
+	}
+	u := *src
+	u.Fragment = ""
+	client, err := archiveClient()
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, ErrSourceNotReachable
+	}
+	if t.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", t.ifNoneMatch)
+	}
+	res, err := client.Do(req)
+	if isSourceNotAllowed(err) {
+		return 0, ErrSourceNotAllowed
+	}
+	if err != nil {
+		return 0, ErrSourceNotReachable
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && t.ifNoneMatch != "" {
+		return 0, errNotModified
+	}
+	if res.StatusCode != 200 {
+		return 0, ErrSourceNotReachable
+	}
+	t.etag = res.Header.Get("ETag")
+	t.progress.start(PhaseDownloading, res.ContentLength)
+	r := utils.NewCappedReader(io.TeeReader(res.Body, t.progress), TarballMaxSize)
+	size, err := io.Copy(f, r)
+	if err == utils.ErrTooLarge {
+		return 0, ErrTarballTooLarge
+	}
+	if err != nil {
+		return 0, ErrSourceNotReachable
+	}
+	if err = verifyArchive(f, size, src); err != nil {
+		return 0, err
+	}
+	if t.cache != nil && pinned {
+		if err = t.cache.storeArchive(src, io.NewSectionReader(f, 0, size)); err != nil {
+			log.Warnf("[tarball] Can't add %s to the source cache: %s", src, err)
+		}
+	}
+	return size, nil
+}
+
+// resetFile removes the content of a file, to write it again
+func resetFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// checkSourceURL verifies the URL of an archive with the policy of the
+// sources: the private and the loopback addresses are refused, unless the
+// apps.allow_private_sources option of the configuration is set (for an
+// on-premise registry, for example). As the host is resolved to check its
+// addresses, a source that can't be resolved is not reachable.
+func checkSourceURL(src *url.URL) error {
+	return checkSourcePolicy(src, []string{"http", "https"})
+}
+
+// checkSourcePolicy verifies a source with the policy of the sources, for the
+// given schemes (all of them if empty).
+func checkSourcePolicy(src *url.URL, schemes []string) error {
+	allowed := config.GetConfig().Apps.AllowPrivateSources
+	_, err := utils.ValidateURL(src.String(), utils.URLPolicy{
+		Schemes:       schemes,
+		AllowPrivate:  allowed,
+		AllowLoopback: allowed,
+		AllowUserinfo: true,
+	})
+	switch err {
+	case nil:
+		return nil
+	case utils.ErrURLUnresolvable:
+		return ErrSourceNotReachable
+	case utils.ErrURLPrivateIP, utils.ErrURLLoopbackIP:
+		return ErrSourceNotAllowed
+	}
+	return ErrNotSupportedSource
+}
+
+// maxRedirects is the number of redirections followed to download an
+// archive, like the default of net/http
+const maxRedirects = 10
+
+// archiveClient returns the client used to download the archives. The URLs
+// of the redirections are checked like the source, so that a public URL
+// can't redirect to a private address.
+func archiveClient() (*http.Client, error) {
+	client, err := httpClient(tarballTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+		}
+		return checkSourceURL(req.URL)
+	}
+	return client, nil
+}
+
+// walk calls fn for each entry of the archive
+func (t *tarballFetcher) walk(fn func(hdr *tar.Header, r io.Reader) error) error {
+	gr, err := gzip.NewReader(t.archiveReader())
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// signatureOf returns the detached signature given in the fragment of the
+// source URL, or nil if there is none.
+func signatureOf(src *url.URL) ([]byte, error) {
+	sig, ok := fragmentParam(src, sigPrefix)
+	if !ok {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(sig)
+	}
+	if err != nil || len(b) != ed25519.SignatureSize {
+		return nil, ErrInvalidSignature
+	}
+	return b, nil
+}
+
+// trustedKeys returns the Ed25519 public keys from the configuration. The
+// malformed keys are ignored.
+func trustedKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, k := range config.GetConfig().Apps.TrustedKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			log.Warnf("[apps] Ignoring malformed trusted key %s", k)
+			continue
+		}
+		keys = append(keys, ed25519.PublicKey(b))
+	}
+	return keys
+}
+
+// verifyArchive checks the checksum and the signature of an archive, with
+// the given size
+func verifyArchive(r io.ReaderAt, size int64, src *url.URL) error {
+	if err := verifyChecksum(io.NewSectionReader(r, 0, size), src); err != nil {
+		return err
+	}
+	return verifySignature(io.NewSectionReader(r, 0, size), src)
+}
+
+// verifyChecksum checks the SHA-256 checksum given in the fragment of the
+// source URL, if there is one.
+func verifyChecksum(r io.Reader, src *url.URL) error {
+	param, ok := fragmentParam(src, checksumPrefix)
+	if !ok {
+		return nil
+	}
+	expected, err := hex.DecodeString(param)
+	if err != nil || len(expected) != sha256.Size {
+		return ErrInvalidChecksum
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// verifySignature checks that the archive has been signed by one of the
+// trusted keys. An archive without signature is accepted, unless the
+// configuration requires the signatures.
+//
+// An Ed25519 signature can only be verified with the whole message, so a
+// signed archive is read in memory for the verification.
+func verifySignature(r io.Reader, src *url.URL) error {
+	sig, err := signatureOf(src)
+	if err != nil {
+		return err
+	}
+	if sig == nil {
+		if config.GetConfig().Apps.RequireSignatures {
+			return ErrMissingSignature
+		}
+		return nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, key := range trustedKeys() {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
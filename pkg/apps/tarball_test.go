@@ -0,0 +1,275 @@
+package apps
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The fixture keys are derived from fixed seeds, so that the tests are
+// reproducible
+var trustedSeed = bytes.Repeat([]byte{0x2a}, ed25519.SeedSize)
+var untrustedSeed = bytes.Repeat([]byte{0x17}, ed25519.SeedSize)
+
+func makeTarball(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		assert.NoError(t, err)
+		_, err = tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func serveTarball(archive []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+}
+
+func signTarball(seed, archive []byte) string {
+	priv := ed25519.NewKeyFromSeed(seed)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, archive))
+}
+
+func trustKey(seed []byte) func() {
+	cfg := config.GetConfig()
+	keys, required := cfg.Apps.TrustedKeys, cfg.Apps.RequireSignatures
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	cfg.Apps.TrustedKeys = []string{"malformed", base64.StdEncoding.EncodeToString(pub)}
+	return func() {
+		cfg.Apps.TrustedKeys, cfg.Apps.RequireSignatures = keys, required
+	}
+}
+
+func TestTarballSignature(t *testing.T) {
+	defer trustKey(trustedSeed)()
+
+	archive := makeTarball(t, map[string]string{
+		manifestName: `{"name": "signed"}`,
+		"index.html": "<html></html>",
+	})
+	srv := serveTarball(archive)
+	defer srv.Close()
+
+	fetch := func(fragment string) error {
+		src, err := url.Parse(srv.URL + "/app.tar.gz" + fragment)
+		if !assert.NoError(t, err) {
+			return err
+		}
+		r, err := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"name": "signed"}`, string(b))
+		return nil
+	}
+
+	assert.NoError(t, fetch(""))
+	assert.NoError(t, fetch("#sig="+signTarball(trustedSeed, archive)))
+	assert.Equal(t, ErrInvalidSignature, fetch("#sig="+signTarball(untrustedSeed, archive)))
+	assert.Equal(t, ErrInvalidSignature, fetch("#sig=bm90IGEgc2lnbmF0dXJl"))
+
+	tampered := append([]byte{}, archive...)
+	tampered[len(tampered)-1] ^= 0xff
+	assert.Equal(t, ErrInvalidSignature, fetch("#sig="+signTarball(trustedSeed, tampered)))
+
+	// The fragment can have both a checksum and a signature
+	sum := sha256.Sum256(archive)
+	checksum := "#sha256=" + hex.EncodeToString(sum[:])
+	assert.NoError(t, fetch(checksum+"&sig="+signTarball(trustedSeed, archive)))
+	assert.Equal(t, ErrInvalidSignature, fetch(checksum+"&sig="+signTarball(untrustedSeed, archive)))
+	assert.Equal(t, ErrInvalidChecksum, fetch("#sha256="+strings.Repeat("0", 64)+"&sig="+signTarball(trustedSeed, archive)))
+
+	config.GetConfig().Apps.RequireSignatures = true
+	assert.Equal(t, ErrMissingSignature, fetch(""))
+	assert.Equal(t, ErrMissingSignature, fetch(checksum))
+	assert.NoError(t, fetch("#sig="+signTarball(trustedSeed, archive)))
+	assert.NoError(t, fetch(checksum+"&sig="+signTarball(trustedSeed, archive)))
+
+	src, _ := url.Parse("git://localhost/")
+	_, err := newGitFetcher(afero.NewMemMapFs(), manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrMissingSignature, err)
+}
+
+func TestTarballFetch(t *testing.T) {
+	archive := makeTarball(t, map[string]string{
+		"package/" + manifestName: `{"name": "packaged"}`,
+		"package/index.html":      "<html></html>",
+		"package/assets/app.js":   "alert(1)",
+		"README.md":               "outside of the package",
+	})
+	srv := serveTarball(archive)
+	defer srv.Close()
+
+	src, err := url.Parse(srv.URL + "/app.tar.gz")
+	if !assert.NoError(t, err) {
+		return
+	}
+	afs := afero.NewMemMapFs()
+	fetcher := newTarballFetcher(afs, nil, manifestName, nil)
+	r, err := fetcher.FetchManifest(src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Close()
+	assert.NoError(t, fetcher.Fetch(src, "/packaged"))
+
+	for _, name := range []string{manifestName, "index.html", "assets/app.js"} {
+		ok, err := afero.Exists(afs, "/packaged/"+name)
+		assert.NoError(t, err)
+		assert.True(t, ok, name)
+	}
+	ok, _ := afero.Exists(afs, "/packaged/README.md")
+	assert.False(t, ok)
+
+	// The downloaded archive is removed when the fetcher is closed
+	tmp := fetcher.archive.Name()
+	assert.NoError(t, fetcher.Close())
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+
+	// An archive with an entry outside of its directory is refused
+	evil := makeTarball(t, map[string]string{
+		"package/" + manifestName:   `{"name": "evil"}`,
+		"package/../../../evil.txt": "evil",
+	})
+	srvEvil := serveTarball(evil)
+	defer srvEvil.Close()
+	src, _ = url.Parse(srvEvil.URL + "/app.tar.gz")
+	fetcher = newTarballFetcher(afs, nil, manifestName, nil)
+	r, err = fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+	assert.Equal(t, utils.ErrUnsafePath, fetcher.Fetch(src, "/evil"))
+	ok, _ = afero.Exists(afs, "/evil.txt")
+	assert.False(t, ok)
+
+	missing := makeTarball(t, map[string]string{"index.html": "<html></html>"})
+	srv2 := serveTarball(missing)
+	defer srv2.Close()
+	src, _ = url.Parse(srv2.URL + "/app.tar.gz")
+	_, err = newTarballFetcher(afs, nil, manifestName, nil).FetchManifest(src)
+	assert.Equal(t, ErrManifestNotReachable, err)
+}
+
+func TestTarballSourcePolicy(t *testing.T) {
+	srv := serveTarball(makeTarball(t, map[string]string{manifestName: `{"name": "private"}`}))
+	defer srv.Close()
+	cfg := config.GetConfig()
+	defer func(allowed bool) { cfg.Apps.AllowPrivateSources = allowed }(cfg.Apps.AllowPrivateSources)
+	cfg.Apps.AllowPrivateSources = false
+
+	// The test server listens on a loopback address
+	for _, source := range []string{srv.URL + "/app.tar.gz", "http://10.1.2.3/app.tar.gz", "https://[fc00::1]/app.tar.gz"} {
+		src, _ := url.Parse(source)
+		_, err := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil).FetchManifest(src)
+		assert.Equal(t, ErrSourceNotAllowed, err, source)
+	}
+
+	// The redirections are checked too
+	client, err := archiveClient()
+	if assert.NoError(t, err) {
+		req, _ := http.NewRequest("GET", "http://192.168.1.1/app.tar.gz", nil)
+		assert.Equal(t, ErrSourceNotAllowed, client.CheckRedirect(req, nil))
+	}
+
+	cfg.Apps.AllowPrivateSources = true
+	src, _ := url.Parse(srv.URL + "/app.tar.gz")
+	fetcher := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, nil)
+	defer fetcher.Close()
+	r, err := fetcher.FetchManifest(src)
+	if assert.NoError(t, err) {
+		r.Close()
+	}
+}
+
+func TestTarballFetchProgress(t *testing.T) {
+	archive := makeTarball(t, map[string]string{
+		manifestName: `{"name": "progress"}`,
+		"index.html": "<html></html>",
+	})
+	srv := serveTarball(archive)
+	defer srv.Close()
+	src, _ := url.Parse(srv.URL + "/app.tar.gz")
+
+	progress := newProgressReporter()
+	fetcher := newTarballFetcher(afero.NewMemMapFs(), nil, manifestName, progress)
+	r, err := fetcher.FetchManifest(src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Close()
+	size := int64(len(archive))
+	assert.Equal(t, Progress{Phase: PhaseDownloading, Bytes: size, Total: size}, progress.current())
+
+	assert.NoError(t, fetcher.Fetch(src, "/progress"))
+	p := progress.current()
+	assert.Equal(t, PhaseExtracting, p.Phase)
+	assert.Equal(t, size, p.Total)
+	assert.True(t, p.Bytes > 0 && p.Bytes <= size, "%d bytes read", p.Bytes)
+}
+
+func TestInstallFromTarball(t *testing.T) {
+	archive := makeTarball(t, map[string]string{
+		manifestName: manifestGenerator(),
+		"index.html": "<html></html>",
+	})
+	srv := serveTarball(archive)
+	defer srv.Close()
+
+	inst, err := NewInstaller(db, fs, &InstallerOptions{
+		Operation: Install,
+		Type:      installerType,
+		Slug:      "tarball-app",
+		SourceURL: srv.URL + "/app.tar.gz",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.Install()
+	for {
+		man, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			assert.EqualValues(t, Ready, man.State())
+			break
+		}
+	}
+
+	ok, err := afero.Exists(fs, "/tarball-app/index.html")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
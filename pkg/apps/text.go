@@ -0,0 +1,207 @@
+package apps
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The maximal lengths in characters of the texts of a manifest, if they are
+// not set in the configuration
+const (
+	NameMaxLength             = 64
+	ShortDescriptionMaxLength = 256
+	LongDescriptionMaxLength  = 4 << 10
+)
+
+const (
+	// ManifestTextTooLong is the code for a text of the manifest that is
+	// longer than its limit
+	ManifestTextTooLong = "text_too_long"
+	// ManifestInvalidText is the code for a text of the manifest that is not
+	// valid UTF-8
+	ManifestInvalidText = "invalid_utf8"
+)
+
+// Locale is the translation in a language of the texts of a manifest
+type Locale struct {
+	Description     string `json:"description"`
+	LongDescription string `json:"long_description,omitempty"`
+}
+
+// normalizeText sanitizes a text of the manifest (see sanitizeText), and
+// returns it in the NFC form, without the leading and trailing spaces.
+func normalizeText(s string, multiline bool) string {
+	return strings.TrimSpace(norm.NFC.String(sanitizeText(s, multiline)))
+}
+
+// normalizeLocales normalizes the texts of the translations of a manifest
+func normalizeLocales(locales map[string]Locale) {
+	for locale, l := range locales {
+		l.Description = normalizeText(l.Description, true)
+		l.LongDescription = normalizeText(l.LongDescription, true)
+		locales[locale] = l
+	}
+}
+
+func textLimit(configured, limit int) int {
+	if configured > 0 {
+		return configured
+	}
+	return limit
+}
+
+// textField is a text of a manifest, with its path in the JSON document and
+// its maximal length
+type textField struct {
+	path  []string
+	limit int
+	get   func() string
+	set   func(string)
+}
+
+func (f *textField) pointer() string {
+	tokens := make([]string, len(f.path))
+	for i, token := range f.path {
+		tokens[i] = escapePointer(token)
+	}
+	return "/" + strings.Join(tokens, "/")
+}
+
+// manifestTexts returns the texts of a manifest that are displayed to the
+// users: the name, and the short and long descriptions with their
+// translations.
+func manifestTexts(man Manifest) []*textField {
+	var name, description, long *string
+	var locales map[string]Locale
+	switch m := man.(type) {
+	case *WebappManifest:
+		name, description, long, locales = &m.Name, &m.Description, &m.LongDescription, m.Locales
+	case *konnManifest:
+		name, description, long, locales = &m.Name, &m.Description, &m.LongDescription, m.Locales
+	default:
+		return nil
+	}
+	cfg := config.GetConfig().Apps
+	shortLimit := textLimit(cfg.ShortDescriptionMaxLength, ShortDescriptionMaxLength)
+	longLimit := textLimit(cfg.LongDescriptionMaxLength, LongDescriptionMaxLength)
+	fields := []*textField{
+		stringField([]string{"name"}, textLimit(cfg.NameMaxLength, NameMaxLength), name),
+		stringField([]string{"description"}, shortLimit, description),
+		stringField([]string{"long_description"}, longLimit, long),
+	}
+
+	names := make([]string, 0, len(locales))
+	for locale := range locales {
+		names = append(names, locale)
+	}
+	sort.Strings(names)
+	for _, locale := range names {
+		locale := locale
+		fields = append(fields, &textField{
+			path:  []string{"locales", locale, "description"},
+			limit: shortLimit,
+			get:   func() string { return locales[locale].Description },
+			set: func(s string) {
+				l := locales[locale]
+				l.Description = s
+				locales[locale] = l
+			},
+		}, &textField{
+			path:  []string{"locales", locale, "long_description"},
+			limit: longLimit,
+			get:   func() string { return locales[locale].LongDescription },
+			set: func(s string) {
+				l := locales[locale]
+				l.LongDescription = s
+				locales[locale] = l
+			},
+		})
+	}
+	return fields
+}
+
+func stringField(path []string, limit int, s *string) *textField {
+	return &textField{
+		path:  path,
+		limit: limit,
+		get:   func() string { return *s },
+		set:   func(v string) { *s = v },
+	}
+}
+
+// checkTexts checks the texts of a manifest, that have been normalized when
+// it was read: the source must be valid UTF-8, and the texts must not be
+// longer than their limit. In strict mode, the problems are errors, added to
+// the ones of the validation of the manifest, if any. Else, they are
+// warnings: the invalid bytes have already been removed, and the texts too
+// long are truncated.
+func checkTexts(b []byte, man Manifest, strict bool, err error) error {
+	w, _ := man.(warner)
+	var errs ManifestErrors
+	report := func(f *textField, code, reason, fix string) {
+		if strict {
+			errs = errs.add(f.pointer(), code, reason)
+		} else if w != nil {
+			w.addWarning(f.pointer() + ": " + reason + ", " + fix)
+		}
+	}
+	for _, f := range manifestTexts(man) {
+		if raw := rawValue(b, f.path); raw != nil && !utf8.Valid(raw) {
+			report(f, ManifestInvalidText, "the text is not valid UTF-8",
+				"the invalid bytes have been removed")
+		}
+		if utf8.RuneCountInString(f.get()) > f.limit {
+			reason := fmt.Sprintf("the text is longer than %d characters", f.limit)
+			report(f, ManifestTextTooLong, reason, "it has been truncated")
+			if !strict {
+				f.set(truncateText(f.get(), f.limit))
+			}
+		}
+	}
+	return withManifestErrors(err, errs)
+}
+
+// truncateText cuts a text after the given number of characters
+func truncateText(s string, limit int) string {
+	n := 0
+	for i := range s {
+		if n == limit {
+			return strings.TrimSpace(s[:i])
+		}
+		n++
+	}
+	return s
+}
+
+// rawValue returns the value of a field of a JSON document, as it is in the
+// source, or nil if it is absent. The names of the fields are matched like
+// encoding/json does, so without taking care of the case.
+func rawValue(b []byte, path []string) json.RawMessage {
+	raw := json.RawMessage(b)
+	for _, key := range path {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil
+		}
+		value, ok := obj[key]
+		if !ok {
+			for k, v := range obj {
+				if strings.EqualFold(k, key) {
+					value, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil
+		}
+		raw = value
+	}
+	return raw
+}
@@ -0,0 +1,67 @@
+package apps
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func readTexts(t *testing.T, b []byte, strict bool) (*WebappManifest, error) {
+	man := &WebappManifest{}
+	err := man.ReadManifest(bytes.NewReader(b), "mini", "git://github.com/cozy/mini.git")
+	return man, checkTexts(b, man, strict, err)
+}
+
+func TestNormalizeText(t *testing.T) {
+	assert.Equal(t, "Café", normalizeText("  Cafe\u0301\n", false))
+	assert.Equal(t, "line 1\nline 2", normalizeText("\nline 1\nline 2\n\n", true))
+	assert.Equal(t, "Ab", truncateText("Ab cd", 3))
+	assert.Equal(t, "été", truncateText("été", 3))
+}
+
+func TestCheckTexts(t *testing.T) {
+	long := strings.Repeat("a", NameMaxLength+10)
+	b := []byte(`{
+  "name": "` + long + `",
+  "description": " Café ",
+  "locales": {"fr": {"long_description": "` + strings.Repeat("é", LongDescriptionMaxLength+1) + `"}}
+}`)
+	man, err := readTexts(t, b, false)
+	assert.NoError(t, err)
+	assert.Equal(t, long[:NameMaxLength], man.Name)
+	assert.Equal(t, "Café", man.Description)
+	assert.Len(t, []rune(man.Locales["fr"].LongDescription), LongDescriptionMaxLength)
+	assert.Equal(t, []string{
+		"/name: the text is longer than 64 characters, it has been truncated",
+		"/locales/fr/long_description: the text is longer than 4096 characters, it has been truncated",
+	}, man.Warnings())
+
+	_, err = readTexts(t, b, true)
+	if errs, ok := err.(ManifestErrors); assert.True(t, ok) && assert.Len(t, errs, 2) {
+		assert.Equal(t, "/name", errs[0].Field)
+		assert.Equal(t, ManifestTextTooLong, errs[0].Code)
+		assert.Equal(t, "/locales/fr/long_description", errs[1].Field)
+	}
+
+	invalid := []byte("{\"name\": \"Mi\xffni\", \"description\": \"ok\"}")
+	man, err = readTexts(t, invalid, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "Mini", man.Name)
+	assert.Equal(t, []string{
+		"/name: the text is not valid UTF-8, the invalid bytes have been removed",
+	}, man.Warnings())
+	_, err = readTexts(t, invalid, true)
+	if errs, ok := err.(ManifestErrors); assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, ManifestInvalidText, errs[0].Code)
+	}
+
+	cfg := config.GetConfig()
+	defer func(max int) { cfg.Apps.NameMaxLength = max }(cfg.Apps.NameMaxLength)
+	cfg.Apps.NameMaxLength = 3
+	man, err = readTexts(t, []byte(`{"name": "Mini"}`), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "Min", man.Name)
+}
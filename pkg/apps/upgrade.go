@@ -0,0 +1,146 @@
+package apps
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// SchemaVersion is the version of the schema of the documents of the
+// applications. It is recorded on the documents written by ReadManifest, and
+// must be incremented when upgradeManifest has a new default to fill.
+const SchemaVersion = 1
+
+// legacyStates are the states written by the previous versions of the stack,
+// that are no longer in the state machine. Like with NormalizeStates, these
+// applications are put in the errored state, from which they can be updated
+// or deleted.
+var legacyStates = map[State]State{
+	Available:    Errored,
+	Uninstalling: Errored,
+}
+
+// upgradeManifest normalizes in memory the document of an application that
+// has been written before the current schema version: the fields added since
+// then get their default values, and the legacy states are mapped to the
+// states of the state machine. It returns false if the document was already
+// up-to-date.
+func upgradeManifest(man Manifest) bool {
+	if man.schemaVersion() >= SchemaVersion {
+		return false
+	}
+	upgradeState(man)
+	switch m := man.(type) {
+	case *WebappManifest:
+		if m.Routes == nil {
+			m.Routes = Routes{"/": Route{Folder: "/", Index: "index.html"}}
+			m.defaultRoutes = true
+		}
+		if m.DocRouteTable == nil {
+			m.DocRouteTable = buildRouteTable(m.Routes)
+		}
+		if m.DocAssets == nil {
+			m.DocAssets = buildAssetList(m)
+		}
+		if m.Locales == nil {
+			m.Locales = make(map[string]Locale)
+		}
+		m.DocCategories = normalizeCategories(m.DocCategories)
+		m.DocTags = normalizeTags(m.DocTags)
+		m.DocDeprecated = m.DocReplacedBy != nil
+	case *konnManifest:
+		if m.Locales == nil {
+			m.Locales = make(map[string]Locale)
+		}
+		m.DocCategories = normalizeCategories(m.DocCategories)
+		m.DocTags = normalizeTags(m.DocTags)
+		m.DocDeprecated = m.DocReplacedBy != nil
+		accepted := m.DocTermsOK
+		m.DocNeedsTerms = m.Terms != nil && (accepted == nil || accepted.Version != m.Terms.Version)
+	}
+	man.setSchemaVersion(SchemaVersion)
+	return true
+}
+
+// upgradeState maps a legacy state, or a known state with another case (like
+// "Ready"), to a state of the state machine. The other unknown states are
+// left for NormalizeStates.
+func upgradeState(man Manifest) {
+	state := man.State()
+	lower := State(strings.ToLower(strings.TrimSpace(string(state))))
+	if to, ok := legacyStates[lower]; ok {
+		log.Infof("[apps] Upgrading the legacy state %q of %s", state, man.Slug())
+		man.setState(to, &StateTransition{From: state, At: time.Now().UTC()})
+		man.SetError(fmt.Errorf("The application was left in the legacy %s state", lower))
+	} else if lower != state && KnownState(lower) {
+		man.setState(lower, man.LastTransition())
+	}
+}
+
+// upgradeDoc upgrades the document of an application that has just been
+// loaded, and saves it. It is best-effort: on a conflict, the document
+// changed meanwhile is left as it is, and will be upgraded on the next read.
+func upgradeDoc(db couchdb.Database, man Manifest) {
+	if !upgradeManifest(man) {
+		return
+	}
+	err := updateDoc(db, man)
+	if err != nil && !couchdb.IsConflictError(err) {
+		log.Warnf("[apps] Could not save the upgraded document of %s: %s", man.Slug(), err)
+	}
+}
+
+// CanonicalizeSlugs renames the documents of the applications installed
+// before the slugs were canonicalized to lowercase, like io.cozy.apps/Drive,
+// so that GetWebappBySlug and GetKonnectorBySlug find them with a single
+// read. The files of a renamed application stay in their directory, that is
+// recorded on its document. A document whose canonical slug is already taken
+// is left as it is. It returns the slugs of the renamed applications.
+//
+// It is a one-off migration, run by the reaper at the start of the stack.
+func CanonicalizeSlugs(db couchdb.Database, appType AppType) ([]string, error) {
+	mans, err := listManifests(db, appType)
+	if err != nil {
+		return nil, err
+	}
+	renamed := []string{}
+	for _, man := range mans {
+		legacy := man.Slug()
+		slug := strings.ToLower(legacy)
+		if slug == legacy {
+			continue
+		}
+		rev, dir := man.Rev(), FilesDir(man)
+		setSlug(man, slug)
+		man.setFilesDir(dir)
+		man.SetRev("")
+		err = couchdb.CreateNamedDocWithDB(db, man)
+		if couchdb.IsConflictError(err) {
+			log.Warnf("[apps] Can't canonicalize the slug of %s: %s is already installed", legacy, slug)
+			continue
+		}
+		if err != nil {
+			return renamed, err
+		}
+		setSlug(man, legacy)
+		man.SetRev(rev)
+		if err = couchdb.DeleteDoc(db, man); err != nil {
+			return renamed, err
+		}
+		log.Infof("[apps] The slug of %s has been canonicalized to %s", legacy, slug)
+		renamed = append(renamed, slug)
+	}
+	return renamed, nil
+}
+
+func setSlug(man Manifest, slug string) {
+	switch m := man.(type) {
+	case *WebappManifest:
+		m.DocSlug = slug
+	case *konnManifest:
+		m.DocSlug = slug
+	}
+}
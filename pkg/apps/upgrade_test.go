@@ -0,0 +1,136 @@
+package apps
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// The documents written by the first versions of the stack, without the
+// categories, the route table and the served assets
+const legacyWebappDoc = `{
+  "_id": "io.cozy.apps/mini-old",
+  "name": "Mini",
+  "slug": "mini-old",
+  "source": "git://github.com/cozy/mini.git",
+  "state": "available",
+  "icon": "icon.svg",
+  "version": "0.1.0"
+}`
+
+// The documents written before the schema version, with the routes but with
+// a state in uppercase
+const legacyRoutesDoc = `{
+  "_id": "io.cozy.apps/mini-routes",
+  "name": "Mini",
+  "slug": "mini-routes",
+  "source": "git://github.com/cozy/mini.git",
+  "state": "Ready",
+  "routes": {"/admin": {"folder": "/admin", "index": "index.html"}},
+  "categories": ["Productivity", ""],
+  "tags": null,
+  "version": "1.0.0"
+}`
+
+const legacyKonnectorDoc = `{
+  "_id": "io.cozy.konnectors/konn-old",
+  "name": "Konn",
+  "type": "node",
+  "slug": "konn-old",
+  "source": "git://github.com/cozy/konn.git",
+  "state": "uninstalling",
+  "terms": {"url": "https://konn.example/terms", "version": "2"},
+  "terms_accepted": {"version": "1", "accepted_at": "2017-07-01T00:00:00Z"}
+}`
+
+func TestUpgradeManifest(t *testing.T) {
+	old := &WebappManifest{}
+	assert.NoError(t, json.Unmarshal([]byte(legacyWebappDoc), old))
+	assert.True(t, upgradeManifest(old))
+	assert.Equal(t, SchemaVersion, old.DocSchema)
+	assert.Equal(t, State(Errored), old.State())
+	if assert.NotNil(t, old.LastTransition()) {
+		assert.Equal(t, Available, old.LastTransition().From)
+	}
+	assert.Equal(t, "The application was left in the legacy available state", old.DocError)
+	assert.Equal(t, []string{OthersCategory}, old.DocCategories)
+	assert.Equal(t, []string{}, old.DocTags)
+	assert.NotNil(t, old.Locales)
+	assert.Equal(t, "index.html", old.Routes["/"].Index)
+	assert.Len(t, old.DocRouteTable, 1)
+	assert.Equal(t, []string{"icon.svg"}, old.DocAssets)
+	// Nothing to do the second time
+	assert.False(t, upgradeManifest(old))
+
+	routes := &WebappManifest{}
+	assert.NoError(t, json.Unmarshal([]byte(legacyRoutesDoc), routes))
+	assert.True(t, upgradeManifest(routes))
+	assert.Equal(t, State(Ready), routes.State())
+	assert.Empty(t, routes.DocError)
+	assert.Nil(t, routes.LastTransition())
+	assert.Equal(t, []string{"productivity"}, routes.DocCategories)
+	assert.Len(t, routes.Routes, 1)
+	if assert.Len(t, routes.DocRouteTable, 1) {
+		assert.Equal(t, "/admin", routes.DocRouteTable[0].Path)
+	}
+
+	konn := &konnManifest{}
+	assert.NoError(t, json.Unmarshal([]byte(legacyKonnectorDoc), konn))
+	assert.True(t, upgradeManifest(konn))
+	assert.Equal(t, State(Errored), konn.State())
+	assert.True(t, konn.DocNeedsTerms)
+	assert.Equal(t, []string{OthersCategory}, konn.DocCategories)
+
+	// The manifests read from the sources are at the current version
+	man := &WebappManifest{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"state": "ready", "schema_version": 1}`), man))
+	assert.False(t, upgradeManifest(man))
+}
+
+func TestUpgradeDoc(t *testing.T) {
+	if installerType != Webapp {
+		t.Skip("the legacy documents are webapps")
+	}
+	for _, doc := range []string{legacyWebappDoc, legacyRoutesDoc} {
+		var raw couchdb.JSONDoc
+		assert.NoError(t, json.Unmarshal([]byte(doc), &raw.M))
+		raw.Type = consts.Apps
+		if !assert.NoError(t, couchdb.CreateNamedDoc(db, raw)) {
+			return
+		}
+	}
+	defer func() {
+		for _, slug := range []string{"mini-old", "mini-routes"} {
+			if man, err := GetWebappBySlug(db, slug); err == nil {
+				couchdb.DeleteDoc(db, man)
+			}
+		}
+	}()
+
+	// A conflict is not an error, the document is upgraded on the next read
+	attempts := 0
+	restore := conflictingUpdates(1, &attempts)
+	man, err := GetWebappBySlug(db, "mini-old")
+	restore()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, attempts)
+		assert.Equal(t, State(Errored), man.State())
+	}
+	var stored WebappManifest
+	assert.NoError(t, couchdb.GetDoc(db, consts.Apps, consts.Apps+"/mini-old", &stored))
+	assert.Equal(t, 0, stored.DocSchema)
+
+	// The upgraded documents are saved
+	webapps, err := ListWebapps(db)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, webapps)
+	for _, slug := range []string{"mini-old", "mini-routes"} {
+		var stored WebappManifest
+		assert.NoError(t, couchdb.GetDoc(db, consts.Apps, consts.Apps+"/"+slug, &stored))
+		assert.Equal(t, SchemaVersion, stored.DocSchema, slug)
+		assert.NotEmpty(t, stored.DocRouteTable, slug)
+	}
+}
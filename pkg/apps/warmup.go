@@ -0,0 +1,78 @@
+package apps
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// WarmUpTimeout is the maximal duration of the warm-up of an application
+var WarmUpTimeout = 10 * time.Second
+
+// WarmUp is a function called when an application has been installed or
+// updated, before the installer reports it as ready, to prime the caches used
+// to serve it. The context has a deadline of WarmUpTimeout.
+type WarmUp func(ctx context.Context, db couchdb.Database, man Manifest) error
+
+var (
+	warmUpsMu sync.RWMutex
+	warmUps   []WarmUp
+)
+
+// RegisterWarmUp adds a function that will be called after each successful
+// install and update of an application, like the serving layer of the
+// webapps.
+func RegisterWarmUp(fn WarmUp) {
+	warmUpsMu.Lock()
+	defer warmUpsMu.Unlock()
+	warmUps = append(warmUps, fn)
+}
+
+// WarmUpReport is the result of the warm-up of an application. A failed
+// warm-up doesn't fail the operation: its error is only reported.
+type WarmUpReport struct {
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// warmUp calls the registered warm-up functions for the application, unless
+// the installer has been told to skip them.
+func (i *Installer) warmUp(man Manifest) {
+	warmUpsMu.RLock()
+	list := make([]WarmUp, len(warmUps))
+	copy(list, warmUps)
+	warmUpsMu.RUnlock()
+	if i.skipWarmUp || len(list) == 0 {
+		return
+	}
+
+	i.progress.start(PhaseWarmingUp, 0)
+	start := time.Now()
+	report := &WarmUpReport{}
+	for _, fn := range list {
+		if err := callWarmUp(fn, i.db, man); err != nil {
+			log.Warnf("[apps] The warm-up of %s has failed: %s", i.slug, err)
+			report.Error = err.Error()
+		}
+	}
+	report.DurationMs = int64(time.Since(start) / time.Millisecond)
+	i.warmUpReport = report
+}
+
+// callWarmUp calls the warm-up function with a deadline, and doesn't wait for
+// it after this deadline, like callHook.
+func callWarmUp(fn WarmUp, db couchdb.Database, man Manifest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WarmUpTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx, db, man) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"io"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 )
 
@@ -40,27 +43,83 @@ type WebappManifest struct {
 
 	Type string `json:"type,omitempty"`
 
-	Name        string     `json:"name"`
-	DocSource   string     `json:"source"`
-	DocSlug     string     `json:"slug"`
-	DocState    State      `json:"state"`
-	DocError    string     `json:"error,omitempty"`
-	Icon        string     `json:"icon"`
-	Description string     `json:"description"`
-	Developer   *Developer `json:"developer"`
-
-	DefaultLocale string `json:"default_locale"`
-	Locales       map[string]struct {
-		Description string `json:"description"`
-	} `json:"locales"`
-
-	Version        string          `json:"version"`
-	License        string          `json:"license"`
-	DocPermissions permissions.Set `json:"permissions"`
-	Intents        []Intent        `json:"intents"`
-	Routes         Routes          `json:"routes"`
+	Name          string            `json:"name"`
+	DocSource     string            `json:"source"`
+	DocSlug       string            `json:"slug"`
+	DocState      State             `json:"state"`
+	DocTransition *StateTransition  `json:"last_transition,omitempty"`
+	DocInstaller  *Subject          `json:"installed_by,omitempty"`
+	DocUpdater    *Subject          `json:"updated_by,omitempty"`
+	DocAvailable  bool              `json:"update_available"`
+	DocAvailVers  string            `json:"available_version,omitempty"`
+	DocCheckedAt  *time.Time        `json:"checked_at,omitempty"`
+	DocError      string            `json:"error,omitempty"`
+	DocErrorCode  string            `json:"error_code,omitempty"`
+	DocOperation  *PendingOperation `json:"operation,omitempty"`
+	DocSize       int64             `json:"size"`
+	DocFilesCount int               `json:"files_count"`
+	DocFromCache  *CacheOrigin      `json:"installed_from_cache,omitempty"`
+	DocResolved   string            `json:"resolved_source,omitempty"`
+	DocChannel    string            `json:"channel,omitempty"`
+	DocCommit     string            `json:"source_commit,omitempty"`
+	DocUpdatedAt  *time.Time        `json:"updated_at,omitempty"`
+	DocLastOp     *OperationMetrics `json:"last_operation,omitempty"`
+	DocSchema     int               `json:"schema_version,omitempty"`
+	DocFilesDir   string            `json:"files_dir,omitempty"`
+	DocAutoUpdate *bool             `json:"auto_update,omitempty"`
+	DocProtected  bool              `json:"protected"`
+	Icon          string            `json:"icon"`
+	Description   string            `json:"description"`
+	Developer     *Developer        `json:"developer"`
+
+	LongDescription string            `json:"long_description,omitempty"`
+	DefaultLocale   string            `json:"default_locale"`
+	Locales         map[string]Locale `json:"locales"`
+
+	Version        string                 `json:"version"`
+	License        string                 `json:"license"`
+	DocPermissions permissions.Set        `json:"permissions"`
+	Intents        []Intent               `json:"intents"`
+	Routes         Routes                 `json:"routes"`
+	DocRouteTable  []RouteEntry           `json:"route_table,omitempty"`
+	Konnectors     []string               `json:"konnectors,omitempty"`
+	DocCategories  []string               `json:"categories"`
+	DocTags        []string               `json:"tags"`
+	DocReplacedBy  *Successor             `json:"replaced_by,omitempty"`
+	DocDeprecated  bool                   `json:"deprecated,omitempty"`
+	ContextSchema  ContextSchema          `json:"context_schema,omitempty"`
+	DocContext     map[string]interface{} `json:"install_context,omitempty"`
+
+	// Screenshots and Assets are the paths of the files of the application,
+	// other than its icon, that can be served by the assets route, and
+	// DocAssets is the list of these paths, built at install
+	Screenshots []string `json:"screenshots,omitempty"`
+	Assets      []string `json:"assets,omitempty"`
+	DocAssets   []string `json:"served_assets,omitempty"`
+
+	// DocExtras are the extra fields of the manifest, kept as they are
+	DocExtras map[string]json.RawMessage `json:"extras,omitempty"`
+
+	// DocMissingDependency is set when a konnector of the webapp has been
+	// deleted, until it is installed again
+	DocMissingDependency bool `json:"missing_dependency,omitempty"`
+
+	// DocNamespaceLost is set when the namespace of the webapp has been taken
+	// over by another application (see claimNamespace)
+	DocNamespaceLost bool `json:"namespace_lost,omitempty"`
+
+	// Maintenance is a message set by the administrator of the instance to
+	// warn the users that the application is in maintenance
+	Maintenance string `json:"maintenance,omitempty"`
 
 	Instance SubDomainer `json:"-"` // Used for JSON-API links
+
+	included []jsonapi.Object
+	warnings []string
+
+	// defaultRoutes is true when the manifest has no routes, and the default
+	// route has been added by ReadManifest
+	defaultRoutes bool
 }
 
 // ID is part of the Manifest interface
@@ -95,11 +154,162 @@ func (m *WebappManifest) Error() error {
 	return errors.New(m.DocError)
 }
 
-// SetState is part of the Manifest interface
-func (m *WebappManifest) SetState(state State) { m.DocState = state }
+// LastTransition is part of the Manifest interface
+func (m *WebappManifest) LastTransition() *StateTransition { return m.DocTransition }
+
+// setState is part of the Manifest interface
+func (m *WebappManifest) setState(state State, transition *StateTransition) {
+	m.DocState, m.DocTransition = state, transition
+}
 
 // SetError is part of the Manifest interface
-func (m *WebappManifest) SetError(err error) { m.DocError = err.Error() }
+func (m *WebappManifest) SetError(err error) {
+	m.DocError, m.DocErrorCode = err.Error(), ErrorCode(err)
+}
+
+// ErrorCode is part of the Manifest interface
+func (m *WebappManifest) ErrorCode() string { return m.DocErrorCode }
+
+// InstalledBy is part of the Manifest interface
+func (m *WebappManifest) InstalledBy() *Subject { return m.DocInstaller }
+
+// UpdatedBy is part of the Manifest interface
+func (m *WebappManifest) UpdatedBy() *Subject { return m.DocUpdater }
+
+// setSubjects is part of the Manifest interface
+func (m *WebappManifest) setSubjects(installedBy, updatedBy *Subject) {
+	m.DocInstaller, m.DocUpdater = installedBy, updatedBy
+}
+
+// AvailableVersion is part of the Manifest interface
+func (m *WebappManifest) AvailableVersion() string { return m.DocAvailVers }
+
+// CheckedAt is part of the Manifest interface
+func (m *WebappManifest) CheckedAt() *time.Time { return m.DocCheckedAt }
+
+// setAvailableVersion is part of the Manifest interface. A nil checkedAt
+// keeps the date of the last check.
+func (m *WebappManifest) setAvailableVersion(version string, checkedAt *time.Time) {
+	m.DocAvailable, m.DocAvailVers = version != "", version
+	if checkedAt != nil {
+		m.DocCheckedAt = checkedAt
+	}
+}
+
+// Warnings returns the problems found in the manifest that are not severe
+// enough to abort the installation. They are sent in the meta of the JSON-API
+// resource object.
+func (m *WebappManifest) Warnings() []string { return m.warnings }
+
+func (m *WebappManifest) addWarning(warning string) {
+	m.warnings = append(m.warnings, warning)
+}
+
+// Operation is part of the Manifest interface
+func (m *WebappManifest) Operation() *PendingOperation { return m.DocOperation }
+
+// SetOperation is part of the Manifest interface
+func (m *WebappManifest) SetOperation(op *PendingOperation) { m.DocOperation = op }
+
+// Size is part of the Manifest interface
+func (m *WebappManifest) Size() (int64, int) { return m.DocSize, m.DocFilesCount }
+
+// SetSize is part of the Manifest interface
+func (m *WebappManifest) SetSize(size int64, filesCount int) {
+	m.DocSize, m.DocFilesCount = size, filesCount
+}
+
+// FromCache is part of the Manifest interface
+func (m *WebappManifest) FromCache() *CacheOrigin { return m.DocFromCache }
+
+// SetFromCache is part of the Manifest interface
+func (m *WebappManifest) SetFromCache(origin *CacheOrigin) { m.DocFromCache = origin }
+
+// ResolvedSource is part of the Manifest interface
+func (m *WebappManifest) ResolvedSource() string { return m.DocResolved }
+
+// SetResolvedSource is part of the Manifest interface
+func (m *WebappManifest) SetResolvedSource(u string) { m.DocResolved = u }
+
+// Channel is part of the Manifest interface
+func (m *WebappManifest) Channel() string { return m.DocChannel }
+
+// SetChannel is part of the Manifest interface
+func (m *WebappManifest) SetChannel(channel string) { m.DocChannel = channel }
+
+// Extras is part of the Manifest interface
+func (m *WebappManifest) Extras() map[string]json.RawMessage { return m.DocExtras }
+
+// SetExtras is part of the Manifest interface
+func (m *WebappManifest) SetExtras(extras map[string]json.RawMessage) { m.DocExtras = extras }
+
+// SourceCommit is part of the Manifest interface
+func (m *WebappManifest) SourceCommit() string { return m.DocCommit }
+
+// SetSourceCommit is part of the Manifest interface
+func (m *WebappManifest) SetSourceCommit(commit string) { m.DocCommit = commit }
+
+// UpdatedAt is part of the Manifest interface
+func (m *WebappManifest) UpdatedAt() time.Time {
+	if m.DocUpdatedAt == nil {
+		return time.Time{}
+	}
+	return *m.DocUpdatedAt
+}
+
+// SetUpdatedAt is part of the Manifest interface
+func (m *WebappManifest) SetUpdatedAt(t time.Time) { m.DocUpdatedAt = &t }
+
+// LastOperation is part of the Manifest interface
+func (m *WebappManifest) LastOperation() *OperationMetrics { return m.DocLastOp }
+
+// SetLastOperation is part of the Manifest interface
+func (m *WebappManifest) SetLastOperation(metrics *OperationMetrics) { m.DocLastOp = metrics }
+
+func (m *WebappManifest) schemaVersion() int     { return m.DocSchema }
+func (m *WebappManifest) setSchemaVersion(v int) { m.DocSchema = v }
+
+func (m *WebappManifest) filesDir() string       { return m.DocFilesDir }
+func (m *WebappManifest) setFilesDir(dir string) { m.DocFilesDir = dir }
+
+func (m *WebappManifest) namespaceLost() bool        { return m.DocNamespaceLost }
+func (m *WebappManifest) setNamespaceLost(lost bool) { m.DocNamespaceLost = lost }
+
+// AutoUpdate is part of the Manifest interface
+func (m *WebappManifest) AutoUpdate() bool {
+	return m.DocAutoUpdate == nil || *m.DocAutoUpdate
+}
+
+// SetAutoUpdate is part of the Manifest interface
+func (m *WebappManifest) SetAutoUpdate(enabled bool) { m.DocAutoUpdate = &enabled }
+
+// Protected is part of the Manifest interface
+func (m *WebappManifest) Protected() bool { return m.DocProtected }
+
+// SetProtected is part of the Manifest interface
+func (m *WebappManifest) SetProtected(protected bool) { m.DocProtected = protected }
+
+// Categories is part of the Manifest interface
+func (m *WebappManifest) Categories() []string {
+	return normalizeCategories(m.DocCategories)
+}
+
+// Tags is part of the Manifest interface
+func (m *WebappManifest) Tags() []string { return normalizeTags(m.DocTags) }
+
+// InstallContext is part of the Manifest interface
+func (m *WebappManifest) InstallContext() map[string]interface{} { return m.DocContext }
+
+// SetInstallContext is part of the Manifest interface
+func (m *WebappManifest) SetInstallContext(ctx map[string]interface{}) { m.DocContext = ctx }
+
+// ReplacedBy is part of the Manifest interface
+func (m *WebappManifest) ReplacedBy() *Successor { return m.DocReplacedBy }
+
+// SetReplacedBy is part of the Manifest interface
+func (m *WebappManifest) SetReplacedBy(successor *Successor) {
+	m.DocReplacedBy, m.DocDeprecated = successor, successor != nil
+}
 
 // Permissions is part of the Manifest interface
 func (m *WebappManifest) Permissions() permissions.Set {
@@ -120,14 +330,50 @@ func (m *WebappManifest) Links() *jsonapi.LinksList {
 	return &links
 }
 
-// Relationships is part of the Manifest interface
+// Relationships is part of the Manifest interface. The konnectors are left
+// out when they are disabled on the instance.
 func (m *WebappManifest) Relationships() jsonapi.RelationshipMap {
-	return jsonapi.RelationshipMap{}
+	rels := jsonapi.RelationshipMap{}
+	if e, ok := m.Instance.(KonnectorsEnabler); ok && !e.KonnectorsEnabled() {
+		return rels
+	}
+	if len(m.Konnectors) > 0 {
+		data := make([]jsonapi.ResourceIdentifier, len(m.Konnectors))
+		for i, slug := range m.Konnectors {
+			data[i] = jsonapi.ResourceIdentifier{
+				ID:   consts.Konnectors + "/" + slug,
+				Type: consts.Konnectors,
+			}
+		}
+		rels["konnectors"] = jsonapi.Relationship{Data: data}
+	}
+	return rels
 }
 
 // Included is part of the Manifest interface
 func (m *WebappManifest) Included() []jsonapi.Object {
-	return []jsonapi.Object{}
+	if m.included == nil {
+		return []jsonapi.Object{}
+	}
+	return m.included
+}
+
+// IncludeKonnectors fetches the konnectors related to the webapp, so that
+// they are included in its JSON-API representation. The konnectors that are
+// not installed are silently ignored.
+func (m *WebappManifest) IncludeKonnectors(db couchdb.Database) error {
+	m.included = make([]jsonapi.Object, 0, len(m.Konnectors))
+	for _, slug := range m.Konnectors {
+		konn, err := GetKonnectorBySlug(db, slug)
+		if couchdb.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m.included = append(m.included, konn)
+	}
+	return nil
 }
 
 // Valid is part of the Manifest interface
@@ -137,19 +383,55 @@ func (m *WebappManifest) Valid(field, value string) bool {
 		return m.DocSlug == value
 	case "state":
 		return m.DocState == State(value)
+	case "category":
+		return hasCategory(m.DocCategories, value)
 	}
 	return false
 }
 
 // ReadManifest  is part of the Manifest interface
 func (m *WebappManifest) ReadManifest(r io.Reader, slug, sourceURL string) error {
+	// The choice of the user for the automatic updates, the install context
+	// and the missing dependencies can't be changed by the manifest, and
+	// neither can the state, the subjects of the operations, the last check
+	// of the updates, the protection against the deletion, the directory of
+	// the files and the loss of the namespace
+	autoUpdate, ctx, missing := m.DocAutoUpdate, m.DocContext, m.DocMissingDependency
+	state, transition := m.DocState, m.DocTransition
+	installedBy, updatedBy := m.DocInstaller, m.DocUpdater
+	available, availVers, checkedAt := m.DocAvailable, m.DocAvailVers, m.DocCheckedAt
+	protected, filesDir, lost := m.DocProtected, m.DocFilesDir, m.DocNamespaceLost
+	m.DocCategories, m.DocTags, m.DocReplacedBy = nil, nil, nil
+	m.ContextSchema = nil
+	m.Screenshots, m.Assets = nil, nil
 	if err := json.NewDecoder(r).Decode(&m); err != nil {
 		return ErrBadManifest
 	}
+	m.DocAutoUpdate, m.DocContext, m.DocMissingDependency = autoUpdate, ctx, missing
+	m.DocState, m.DocTransition = state, transition
+	m.DocInstaller, m.DocUpdater = installedBy, updatedBy
+	m.DocAvailable, m.DocAvailVers, m.DocCheckedAt = available, availVers, checkedAt
+	m.DocProtected, m.DocFilesDir, m.DocNamespaceLost = protected, filesDir, lost
+	m.DocDeprecated = m.DocReplacedBy != nil
 
 	m.DocSlug = slug
 	m.DocSource = sourceURL
+	m.Name = normalizeText(m.Name, false)
+	m.Description = normalizeText(m.Description, true)
+	m.LongDescription = normalizeText(m.LongDescription, true)
+	normalizeLocales(m.Locales)
+	m.DocCategories = normalizeCategories(m.DocCategories)
+	m.DocTags = normalizeTags(m.DocTags)
+
+	konnectors := m.Konnectors[:0]
+	for _, k := range m.Konnectors {
+		if ValidInstalledSlug(k) {
+			konnectors = append(konnectors, k)
+		}
+	}
+	m.Konnectors = utils.UniqueStrings(konnectors)
 
+	m.defaultRoutes = m.Routes == nil
 	if m.Routes == nil {
 		m.Routes = make(Routes)
 		m.Routes["/"] = Route{
@@ -158,15 +440,57 @@ func (m *WebappManifest) ReadManifest(r io.Reader, slug, sourceURL string) error
 			Public: false,
 		}
 	}
+	m.DocRouteTable = buildRouteTable(m.Routes)
+	m.DocAssets = buildAssetList(m)
+	m.DocSchema = SchemaVersion
+	return m.validate()
+}
+
+// validate checks the fields of the manifest, and returns the list of all the
+// problems found, if any, as ManifestErrors.
+func (m *WebappManifest) validate() error {
+	var errs ManifestErrors
+	if m.Name == "" {
+		errs = errs.add("/name", ManifestMissingField, "the name is mandatory")
+	}
+	errs, m.warnings = validateDoctypes(m.DocPermissions, errs)
+	errs = validateSuccessor(m.DocReplacedBy, errs)
+	errs = validateSchema(m.ContextSchema, errs)
+	errs = validateRoutes(m.Routes, errs)
+	errs = validateAssets(m, errs)
+	for i, intent := range m.Intents {
+		pointer := "/intents/" + strconv.Itoa(i)
+		if intent.Action == "" {
+			errs = errs.add(pointer+"/action", ManifestMissingField, "the action of an intent is mandatory")
+		}
+		if intent.Href == "" {
+			errs = errs.add(pointer+"/href", ManifestMissingField, "the href of an intent is mandatory")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
 // FindRoute takes a path, returns the route which matches the best,
-// and the part that remains unmatched
+// and the part that remains unmatched. The route table is used when the
+// document has one, else the routes are compared one by one.
 func (m *WebappManifest) FindRoute(vpath string) (Route, string) {
 	parts := strings.Split(vpath, "/")
 	lenParts := len(parts)
 
+	for _, entry := range m.DocRouteTable {
+		keys := entry.parts()
+		count := len(keys)
+		if count <= lenParts && routeMatches(parts, keys) {
+			return entry.route(), path.Join(parts[count:]...)
+		}
+	}
+	if len(m.DocRouteTable) > 0 {
+		return Route{}, ""
+	}
+
 	var best Route
 	rest := ""
 	specificity := 0
@@ -216,19 +540,33 @@ func (m *WebappManifest) FindIntent(action, typ string) *Intent {
 func GetWebappBySlug(db couchdb.Database, slug string) (*WebappManifest, error) {
 	man := &WebappManifest{}
 	err := couchdb.GetDoc(db, consts.Apps, consts.Apps+"/"+slug, man)
+	if err == nil {
+		upgradeDoc(db, man)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return man, nil
 }
 
-// ListWebapps returns the list of installed web applications.
-//
-// TODO: pagination
+// ListWebapps returns the list of installed web applications. The documents
+// written before the current schema version are upgraded.
 func ListWebapps(db couchdb.Database) ([]*WebappManifest, error) {
+	docs, err := listWebappDocs(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		upgradeDoc(db, doc)
+	}
+	return docs, nil
+}
+
+// listWebappDocs returns the documents of the web applications, as they are
+// in CouchDB.
+func listWebappDocs(db couchdb.Database) ([]*WebappManifest, error) {
 	var docs []*WebappManifest
-	req := &couchdb.AllDocsRequest{Limit: 100}
-	err := couchdb.GetAllDocs(db, consts.Apps, req, &docs)
+	err := getAllAppDocs(db, consts.Apps, &docs)
 	if err != nil {
 		return nil, err
 	}
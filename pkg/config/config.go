@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -66,11 +67,13 @@ type Config struct {
 	Port       int
 	Assets     string
 	Subdomains string
+	Gzip       bool
 	AdminHost  string
 	AdminPort  int
 	Fs         Fs
 	CouchDB    CouchDB
 	Konnectors Konnectors
+	Apps       Apps
 	Mail       *gomail.DialerOptions
 	Logger     Logger
 }
@@ -88,6 +91,101 @@ type CouchDB struct {
 // Konnectors contains the configuration values for the konnectors.
 type Konnectors struct {
 	Cmd string
+	// Enabled is the default of the konnectors_enabled setting of the
+	// instances (true by default). When it is false, the konnectors can't be
+	// installed, and their routes are disabled.
+	Enabled bool
+}
+
+// Apps contains the configuration values for the applications.
+type Apps struct {
+	// PublicIcons allows the icons of the apps to be fetched without a token
+	// by the pages served on the instance's own origin (login, sharings...).
+	PublicIcons bool
+	// HooksDir is a directory with the executables to run before and after
+	// the operations on the applications (like before-install).
+	HooksDir string
+	// StrictDoctypes makes the installation of an application fail if its
+	// manifest asks permissions on a malformed or unknown doctype.
+	StrictDoctypes bool
+	// StrictManifests makes the installation of an application fail if its
+	// manifest has some unknown fields. Else, they are just warnings.
+	StrictManifests bool
+	// StrictIcons makes the installation of an application fail if its icon
+	// is not a valid image (true by default). Else, it is just a warning.
+	StrictIcons bool
+	// ManifestMaxSize is the maximal size in bytes of the manifest of an
+	// application
+	ManifestMaxSize int64
+	// ExtraFields are the fields of the manifests, in addition to the ones
+	// with the x- prefix, that are kept as they are in the extras of the
+	// applications
+	ExtraFields []string
+	// ExtrasMaxSize is the maximal size in bytes of the extra fields of a
+	// manifest
+	ExtrasMaxSize int64
+	// NameMaxLength, ShortDescriptionMaxLength and LongDescriptionMaxLength
+	// are the maximal lengths in characters of the name and the descriptions
+	// of a manifest (0 for the default ones)
+	NameMaxLength             int
+	ShortDescriptionMaxLength int
+	LongDescriptionMaxLength  int
+	// TrustedKeys is the list of the Ed25519 public keys, encoded in base64,
+	// that can sign the archives of the applications
+	TrustedKeys []string
+	// RequireSignatures makes the installation of an application fail if its
+	// archive is not signed by one of the trusted keys
+	RequireSignatures bool
+	// CacheDir is a directory shared by the instances where the sources of
+	// the applications are kept, to avoid downloading them again
+	CacheDir string
+	// CacheMaxSize is the maximal size in bytes of the source cache
+	CacheMaxSize int64
+	// CacheBypass disables the source cache (useful for debugging)
+	CacheBypass bool
+	// OfflineOk makes the installations fall back to the newest cached
+	// version of the source when it is not reachable
+	OfflineOk bool
+	// HTTPProxy is the URL of the proxy used to fetch the applications. If it
+	// is empty, the HTTP_PROXY and HTTPS_PROXY environment variables are used.
+	HTTPProxy string
+	// CABundle is a file with the PEM certificates of the authorities trusted
+	// to fetch the applications, in addition to the ones of the system (for
+	// an on-premise registry for example)
+	CABundle string
+	// AllowPrivateSources allows the archives of the applications to be
+	// downloaded from the private and the loopback addresses (for an
+	// on-premise registry, or for the development)
+	AllowPrivateSources bool
+	// ProgressInterval is the minimal time between two notifications of the
+	// progress of an installer inside the same phase, for the streams sent
+	// to the clients (500ms by default)
+	ProgressInterval time.Duration
+	// AutoUpdateInterval is the time between two checks of the updates of
+	// the applications of all the instances. The automatic updates are
+	// disabled if it is 0.
+	AutoUpdateInterval time.Duration
+	// AutoUpdateJitter is the maximal random delay between the checks of two
+	// instances, to spread the updates over time
+	AutoUpdateJitter time.Duration
+	// AutoUpdateConcurrency is the maximal number of instances whose
+	// applications are updated at the same time
+	AutoUpdateConcurrency int
+	// ProtectedSlugs are the slugs of the applications that can't be deleted
+	// without a confirmation (home and settings by default)
+	ProtectedSlugs []string
+	// ReaperInterval is the time between two runs of the reaper of the
+	// interrupted operations on the applications, after the one at the start
+	// of the stack (1h by default, 0 to only run it at the start)
+	ReaperInterval time.Duration
+	// ReaperThreshold is the age after which a pending operation that no
+	// installer of this stack is running is considered as interrupted (30min
+	// by default)
+	ReaperThreshold time.Duration
+	// MaintenanceInterval is the time between two runs of the maintenance
+	// that removes the orphan compressed files of the applications and trims
+	// the source cache (24h by default, 0 to disable it)
+	MaintenanceInterval time.Duration
 }
 
 // Logger contains the configuration values of the logger system
@@ -205,10 +303,83 @@ func UseViper(v *viper.Viper) error {
 		couchURL.Path = "/"
 	}
 
+	manifestMaxSize, err := getSize(v, "apps.manifest_max_size")
+	if err != nil {
+		return err
+	}
+	extrasMaxSize, err := getSize(v, "apps.extras_max_size")
+	if err != nil {
+		return err
+	}
+	cacheMaxSize, err := getSize(v, "apps.cache_max_size")
+	if err != nil {
+		return err
+	}
+
+	autoUpdateInterval, err := getDuration(v, "apps.auto_update.interval")
+	if err != nil {
+		return err
+	}
+	autoUpdateJitter, err := getDuration(v, "apps.auto_update.jitter")
+	if err != nil {
+		return err
+	}
+	autoUpdateConcurrency := v.GetInt("apps.auto_update.concurrency")
+	if autoUpdateConcurrency <= 0 {
+		autoUpdateConcurrency = 1
+	}
+
+	strictIcons := !v.IsSet("apps.strict_icons") || v.GetBool("apps.strict_icons")
+	konnectorsEnabled := !v.IsSet("konnectors.enabled") || v.GetBool("konnectors.enabled")
+
+	progressInterval := defaultProgressInterval
+	if v.IsSet("apps.progress_interval") {
+		if progressInterval, err = getDuration(v, "apps.progress_interval"); err != nil {
+			return err
+		}
+	}
+
+	reaperInterval := defaultReaperInterval
+	if v.IsSet("apps.reaper.interval") {
+		if reaperInterval, err = getDuration(v, "apps.reaper.interval"); err != nil {
+			return err
+		}
+	}
+	reaperThreshold := defaultReaperThreshold
+	if v.IsSet("apps.reaper.threshold") {
+		if reaperThreshold, err = getDuration(v, "apps.reaper.threshold"); err != nil {
+			return err
+		}
+		if reaperThreshold <= 0 {
+			return fmt.Errorf("Invalid duration for apps.reaper.threshold (%q)",
+				v.GetString("apps.reaper.threshold"))
+		}
+	}
+
+	maintenanceInterval := defaultMaintenanceInterval
+	if v.IsSet("apps.maintenance.interval") {
+		if maintenanceInterval, err = getDuration(v, "apps.maintenance.interval"); err != nil {
+			return err
+		}
+	}
+
+	protectedSlugs := defaultProtectedSlugs
+	if v.IsSet("apps.protected") {
+		protectedSlugs = v.GetStringSlice("apps.protected")
+	}
+
+	httpProxy := v.GetString("apps.http_proxy")
+	if httpProxy != "" {
+		if u, errp := url.Parse(httpProxy); errp != nil || u.Host == "" {
+			return fmt.Errorf("Invalid URL for apps.http_proxy (%q)", httpProxy)
+		}
+	}
+
 	config = &Config{
 		Host:       v.GetString("host"),
 		Port:       v.GetInt("port"),
 		Subdomains: v.GetString("subdomains"),
+		Gzip:       v.GetBool("gzip"),
 		AdminHost:  v.GetString("admin.host"),
 		AdminPort:  v.GetInt("admin.port"),
 		Assets:     v.GetString("assets"),
@@ -219,7 +390,40 @@ func UseViper(v *viper.Viper) error {
 			URL: couchURL.String(),
 		},
 		Konnectors: Konnectors{
-			Cmd: v.GetString("konnectors.cmd"),
+			Cmd:     v.GetString("konnectors.cmd"),
+			Enabled: konnectorsEnabled,
+		},
+		Apps: Apps{
+			PublicIcons:         v.GetBool("apps.public_icons"),
+			HooksDir:            v.GetString("apps.hooks_dir"),
+			StrictDoctypes:      v.GetBool("apps.strict_doctypes"),
+			StrictManifests:     v.GetBool("apps.strict_manifests"),
+			StrictIcons:         strictIcons,
+			ManifestMaxSize:     manifestMaxSize,
+			ExtraFields:         v.GetStringSlice("apps.extra_fields"),
+			ExtrasMaxSize:       extrasMaxSize,
+			TrustedKeys:         v.GetStringSlice("apps.trusted_keys"),
+			RequireSignatures:   v.GetBool("apps.require_signatures"),
+			CacheDir:            v.GetString("apps.cache_dir"),
+			CacheMaxSize:        cacheMaxSize,
+			CacheBypass:         v.GetBool("apps.cache_bypass"),
+			OfflineOk:           v.GetBool("apps.offline_ok"),
+			HTTPProxy:           httpProxy,
+			CABundle:            v.GetString("apps.ca_bundle"),
+			AllowPrivateSources: v.GetBool("apps.allow_private_sources"),
+			ProgressInterval:    progressInterval,
+
+			AutoUpdateInterval:    autoUpdateInterval,
+			AutoUpdateJitter:      autoUpdateJitter,
+			AutoUpdateConcurrency: autoUpdateConcurrency,
+			ProtectedSlugs:        protectedSlugs,
+			ReaperInterval:        reaperInterval,
+			ReaperThreshold:       reaperThreshold,
+			MaintenanceInterval:   maintenanceInterval,
+
+			NameMaxLength:             v.GetInt("apps.max_lengths.name"),
+			ShortDescriptionMaxLength: v.GetInt("apps.max_lengths.short_description"),
+			LongDescriptionMaxLength:  v.GetInt("apps.max_lengths.long_description"),
 		},
 		Mail: &gomail.DialerOptions{
 			Host:                      v.GetString("mail.host"),
@@ -237,6 +441,50 @@ func UseViper(v *viper.Viper) error {
 	return configureLogger()
 }
 
+// getSize returns a size in bytes from the configuration, where it can be
+// written as a number or with a unit, like "20MB". It is 0 if not set.
+func getSize(v *viper.Viper, key string) (int64, error) {
+	value := v.GetString(key)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := utils.ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size for %s (%q): %s", key, value, err)
+	}
+	return size, nil
+}
+
+// defaultProgressInterval is the default value of apps.progress_interval
+const defaultProgressInterval = 500 * time.Millisecond
+
+// defaultReaperInterval and defaultReaperThreshold are the default values of
+// apps.reaper.interval and apps.reaper.threshold
+const (
+	defaultReaperInterval  = time.Hour
+	defaultReaperThreshold = 30 * time.Minute
+)
+
+// defaultMaintenanceInterval is the default value of apps.maintenance.interval
+const defaultMaintenanceInterval = 24 * time.Hour
+
+// defaultProtectedSlugs is the default value of apps.protected
+var defaultProtectedSlugs = []string{"home", "settings"}
+
+// getDuration returns a duration from the configuration, like "24h". It is 0
+// if not set.
+func getDuration(v *viper.Viper, key string) (time.Duration, error) {
+	value := v.GetString(key)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid duration for %s (%q)", key, value)
+	}
+	return d, nil
+}
+
 const defaultTestConfig = `
 host: localhost
 port: 8080
@@ -298,7 +546,13 @@ func UseTestYAML(yaml string) {
 // searching.
 func FindConfigFile(name string) (string, error) {
 	for _, cp := range Paths {
-		filename := filepath.Join(utils.AbsPath(cp), name)
+		// A path with an undefined variable (like $HOME under some init
+		// systems) is skipped
+		dir, err := utils.AbsPath(cp)
+		if err != nil {
+			continue
+		}
+		filename := filepath.Join(dir, name)
 		ok, err := utils.FileExists(filename)
 		if err != nil {
 			return "", err
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -17,6 +18,92 @@ func TestUseViper(t *testing.T) {
 	assert.Equal(t, "http://db:1234/", CouchURL())
 }
 
+func TestUseViperSizes(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("apps.manifest_max_size", 1048576)
+	cfg.Set("apps.cache_max_size", "1.5GiB")
+	cfg.Set("apps.extras_max_size", "32KiB")
+	assert.NoError(t, UseViper(cfg))
+	assert.EqualValues(t, 1<<20, GetConfig().Apps.ManifestMaxSize)
+	assert.EqualValues(t, 32<<10, GetConfig().Apps.ExtrasMaxSize)
+	assert.EqualValues(t, 3<<29, GetConfig().Apps.CacheMaxSize)
+
+	cfg.Set("apps.cache_max_size", "-1GB")
+	err := UseViper(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "apps.cache_max_size")
+	}
+}
+
+func TestUseViperHTTPProxy(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("apps.http_proxy", "http://proxy.example.org:3128")
+	cfg.Set("apps.ca_bundle", "/etc/cozy/registry-ca.pem")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, "http://proxy.example.org:3128", GetConfig().Apps.HTTPProxy)
+	assert.Equal(t, "/etc/cozy/registry-ca.pem", GetConfig().Apps.CABundle)
+
+	cfg.Set("apps.http_proxy", "proxy.example.org")
+	err := UseViper(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "apps.http_proxy")
+	}
+}
+
+func TestUseViperAutoUpdate(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, time.Duration(0), GetConfig().Apps.AutoUpdateInterval)
+	assert.Equal(t, 1, GetConfig().Apps.AutoUpdateConcurrency)
+
+	cfg.Set("apps.auto_update.interval", "24h")
+	cfg.Set("apps.auto_update.jitter", "30s")
+	cfg.Set("apps.auto_update.concurrency", 4)
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, 24*time.Hour, GetConfig().Apps.AutoUpdateInterval)
+	assert.Equal(t, 30*time.Second, GetConfig().Apps.AutoUpdateJitter)
+	assert.Equal(t, 4, GetConfig().Apps.AutoUpdateConcurrency)
+
+	cfg.Set("apps.auto_update.interval", "daily")
+	err := UseViper(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "apps.auto_update.interval")
+	}
+}
+
+func TestUseViperReaper(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, time.Hour, GetConfig().Apps.ReaperInterval)
+	assert.Equal(t, 30*time.Minute, GetConfig().Apps.ReaperThreshold)
+
+	cfg.Set("apps.reaper.interval", "0")
+	cfg.Set("apps.reaper.threshold", "2h")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, time.Duration(0), GetConfig().Apps.ReaperInterval)
+	assert.Equal(t, 2*time.Hour, GetConfig().Apps.ReaperThreshold)
+
+	cfg.Set("apps.reaper.threshold", "0")
+	err := UseViper(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "apps.reaper.threshold")
+	}
+}
+
+func TestUseViperMaintenance(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, 24*time.Hour, GetConfig().Apps.MaintenanceInterval)
+
+	cfg.Set("apps.maintenance.interval", "6h")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, 6*time.Hour, GetConfig().Apps.MaintenanceInterval)
+
+	cfg.Set("apps.maintenance.interval", "0")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, time.Duration(0), GetConfig().Apps.MaintenanceInterval)
+}
+
 func TestSetup(t *testing.T) {
 	tmpdir := os.TempDir()
 	tmpfile, err := os.OpenFile(filepath.Join(tmpdir, "cozy.yaml"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
@@ -82,3 +169,54 @@ log:
 
 	assert.Equal(t, logrus.GetLevel(), logrus.WarnLevel)
 }
+
+func TestUseViperStrictIcons(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.True(t, GetConfig().Apps.StrictIcons)
+
+	cfg.Set("apps.strict_icons", false)
+	assert.NoError(t, UseViper(cfg))
+	assert.False(t, GetConfig().Apps.StrictIcons)
+}
+
+func TestUseViperKonnectorsEnabled(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.True(t, GetConfig().Konnectors.Enabled)
+
+	cfg.Set("konnectors.enabled", false)
+	assert.NoError(t, UseViper(cfg))
+	assert.False(t, GetConfig().Konnectors.Enabled)
+}
+
+func TestUseViperProgressInterval(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, 500*time.Millisecond, GetConfig().Apps.ProgressInterval)
+
+	cfg.Set("apps.progress_interval", "0")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, time.Duration(0), GetConfig().Apps.ProgressInterval)
+
+	cfg.Set("apps.progress_interval", "2s")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, 2*time.Second, GetConfig().Apps.ProgressInterval)
+
+	cfg.Set("apps.progress_interval", "fast")
+	assert.Error(t, UseViper(cfg))
+}
+
+func TestUseViperProtectedSlugs(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, []string{"home", "settings"}, GetConfig().Apps.ProtectedSlugs)
+
+	cfg.Set("apps.protected", []string{"drive"})
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, []string{"drive"}, GetConfig().Apps.ProtectedSlugs)
+
+	cfg.Set("apps.protected", []string{})
+	assert.NoError(t, UseViper(cfg))
+	assert.Empty(t, GetConfig().Apps.ProtectedSlugs)
+}
@@ -8,6 +8,21 @@ const (
 	Apps = "io.cozy.apps"
 	// Konnectors doc type for konnector application manifests
 	Konnectors = "io.cozy.konnectors"
+	// KonnectorResults doc type for the results of the last executions of
+	// the konnectors
+	KonnectorResults = "io.cozy.konnectors.result"
+	// KonnectorLogs doc type for the logs of the last executions of the
+	// konnectors
+	KonnectorLogs = "io.cozy.konnectors.logs"
+	// KonnectorDependents doc type for the lists of the webapps that use a
+	// konnector
+	KonnectorDependents = "io.cozy.konnectors.dependents"
+	// AppsNamespaces doc type for the owners of the namespaces of the routes
+	// of the applications
+	AppsNamespaces = "io.cozy.apps.namespaces"
+	// AppsChecksums doc type for the checksums of the files of the installed
+	// applications
+	AppsChecksums = "io.cozy.apps.checksums"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
 	// Doctypes doc type for doctype list
@@ -60,6 +60,9 @@ var (
 	ErrMissingPassphrase = errors.New("Missing new passphrase")
 	// ErrInvalidPassphrase is returned when the passphrase is invalid
 	ErrInvalidPassphrase = errors.New("Invalid passphrase")
+	// ErrInvalidAppsChannel is used when the channel of the applications is
+	// not stable, beta or dev
+	ErrInvalidAppsChannel = errors.New("Invalid channel for the applications")
 )
 
 // An Instance has the informations relatives to the logical cozy instance,
@@ -72,6 +75,13 @@ type Instance struct {
 	Locale string `json:"locale"`         // The locale used on the server
 	Dev    bool   `json:"dev"`            // Whether or not the instance is for development
 
+	// AppsChannel is the channel of the releases of the applications, for the
+	// sources that don't give a version or a channel (see DefaultAppsChannel)
+	AppsChannel string `json:"apps_channel,omitempty"`
+	// KonnectorsSetting is the konnectors_enabled setting, or nil for the
+	// default of the configuration (see KonnectorsEnabled)
+	KonnectorsSetting *bool `json:"konnectors_enabled,omitempty"`
+
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
 	PassphraseHash       []byte    `json:"passphrase_hash,omitempty"`
@@ -96,13 +106,14 @@ type Instance struct {
 
 // Options holds the parameters to create a new instance.
 type Options struct {
-	Domain     string
-	Locale     string
-	Timezone   string
-	Email      string
-	PublicName string
-	Apps       []string
-	Dev        bool
+	Domain      string
+	Locale      string
+	Timezone    string
+	Email       string
+	PublicName  string
+	Apps        []string
+	Dev         bool
+	AppsChannel string
 }
 
 // DocType implements couchdb.Doc
@@ -295,7 +306,7 @@ func (i *Instance) installApp(slug string) error {
 	if err != nil {
 		return err
 	}
-	go inst.Install()
+	apps.RunInBackground(inst.Install)
 	for {
 		_, done, err := inst.Poll()
 		if err != nil {
@@ -336,6 +347,11 @@ func Create(opts *Options) (*Instance, error) {
 
 	i.Dev = opts.Dev
 
+	if opts.AppsChannel != "" && !apps.ValidChannel(opts.AppsChannel) {
+		return nil, ErrInvalidAppsChannel
+	}
+	i.AppsChannel = opts.AppsChannel
+
 	i.PassphraseHash = nil
 	i.PassphraseResetToken = nil
 	i.PassphraseResetTime = time.Time{}
@@ -449,6 +465,45 @@ func Get(domain string) (*Instance, error) {
 	return i, nil
 }
 
+// DefaultAppsChannel returns the channel of the releases of the applications
+// installed on this instance, when their source doesn't give one. It is
+// stable, unless the instance has another apps_channel.
+func (i *Instance) DefaultAppsChannel() string {
+	if i.AppsChannel == "" {
+		return apps.ChannelStable
+	}
+	return i.AppsChannel
+}
+
+// SetAppsChannel changes the default channel of the applications of the
+// instance. The installed applications keep the channel they come from until
+// their next update.
+func (i *Instance) SetAppsChannel(channel string) error {
+	if !apps.ValidChannel(channel) {
+		return ErrInvalidAppsChannel
+	}
+	i.AppsChannel = channel
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
+// KonnectorsEnabled returns true if the konnectors can be installed on this
+// instance. It is the default of the configuration, unless the instance has
+// its own konnectors_enabled setting.
+func (i *Instance) KonnectorsEnabled() bool {
+	if i.KonnectorsSetting == nil {
+		return config.GetConfig().Konnectors.Enabled
+	}
+	return *i.KonnectorsSetting
+}
+
+// SetKonnectorsEnabled changes the konnectors_enabled setting of the
+// instance, or removes it with nil to use the default of the configuration.
+// The installed konnectors are kept.
+func (i *Instance) SetKonnectorsEnabled(enabled *bool) error {
+	i.KonnectorsSetting = enabled
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
 var translations = make(map[string]*gotext.Po)
 
 // LoadLocale creates the translation object for a locale from the content of a .po file
@@ -483,6 +538,34 @@ func List() ([]*Instance, error) {
 	return docs, nil
 }
 
+// instancesPageSize is the number of instances fetched at once by
+// ForeachInstances
+var instancesPageSize = 100
+
+// ForeachInstances calls fn for each declared instance. The instances are
+// fetched by pages, so that it can be used for a large number of instances.
+// It stops at the first error returned by fn.
+func ForeachInstances(fn func(*Instance) error) error {
+	for skip := 0; ; skip += instancesPageSize {
+		var docs []*Instance
+		req := &couchdb.AllDocsRequest{Limit: instancesPageSize, Skip: skip}
+		err := couchdb.GetAllDocs(couchdb.GlobalDB, consts.Instances, req, &docs)
+		if err != nil {
+			return err
+		}
+		// The design docs are not returned, so a page can have less
+		// instances than its size without being the last one
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			if err = fn(doc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // Destroy is used to remove the instance. All the data linked to this
 // instance will be permanently deleted.
 func Destroy(domain string) (*Instance, error) {
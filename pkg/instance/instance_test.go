@@ -2,6 +2,7 @@ package instance
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -341,6 +342,42 @@ func TestInstanceNoDuplicate(t *testing.T) {
 	}
 }
 
+func TestForeachInstances(t *testing.T) {
+	pageSize := instancesPageSize
+	instancesPageSize = 2
+	defer func() { instancesPageSize = pageSize }()
+
+	for _, domain := range []string{"test.cozycloud.cc.foreach1", "test.cozycloud.cc.foreach2", "test.cozycloud.cc.foreach3"} {
+		_, err := Create(&Options{Domain: domain, Locale: "en"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer Destroy(domain)
+	}
+
+	list, err := List()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var domains []string
+	err = ForeachInstances(func(i *Instance) error {
+		domains = append(domains, i.Domain)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, domains, len(list))
+	assert.Contains(t, domains, "test.cozycloud.cc.foreach3")
+
+	errStop := errors.New("stop")
+	count := 0
+	err = ForeachInstances(func(i *Instance) error {
+		count++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, count)
+}
+
 func TestInstanceDestroy(t *testing.T) {
 	Destroy("test.cozycloud.cc")
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,8 +17,18 @@ type contextKey int
 const (
 	// ContextDomainKey is the used to store the domain string name
 	ContextDomainKey contextKey = iota
+	// ContextJobIDKey is the used to store the identifier of the job
+	ContextJobIDKey
 )
 
+// jitter is the source of the random delays added to the retries, seeded
+// once so that the processes don't retry at the same times, and protected
+// by a mutex as it is used by all the workers.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
 var (
 	defaultConcurrency  = 1
 	defaultMaxExecCount = 3
@@ -185,6 +196,7 @@ func (t *task) exec(ctx context.Context) (err error) {
 			}
 		}
 	}()
+	ctx = context.WithValue(ctx, ContextJobIDKey, t.infos.ID)
 	return t.conf.WorkerFunc(ctx, t.infos.Message)
 }
 
@@ -212,7 +224,9 @@ func (t *task) nextDelay() (bool, time.Duration, time.Duration) {
 
 		// fuzzDelay number between delay * (1 +/- 0.1)
 		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay = nextDelay + time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+		jitter.Lock()
+		nextDelay = nextDelay + time.Duration((jitter.Intn(2*fuzzDelay) - fuzzDelay))
+		jitter.Unlock()
 	}
 
 	if execTime+nextDelay > c.MaxExecTime {
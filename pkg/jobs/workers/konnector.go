@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"net/url"
 	"os/exec"
+	"path"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
 func init() {
@@ -41,19 +46,54 @@ func KonnectorWorker(ctx context.Context, m *jobs.Message) error {
 		Host:   domain,
 	}
 
+	db := couchdb.SimpleDatabasePrefix(domain)
+	output, err := apps.NewKonnectorOutput(db, opts.Slug, opts.Fields)
+	if err != nil {
+		return err
+	}
+	dir := konnectorDir(db, domain, opts.Slug)
 	konnCmd := config.GetConfig().Konnectors.Cmd
-	cmd := exec.CommandContext(ctx, konnCmd, opts.Slug) // #nosec
+	cmd := exec.CommandContext(ctx, konnCmd, opts.Slug, dir) // #nosec
 	cmd.Env = []string{
 		"COZY_CREDENTIALS=" + credentials,
 		"COZY_FIELDS=" + fields,
 		"COZY_DOMAIN=" + domain,
 		"COZY_URL=" + cozyURL.String(),
+		"COZY_KONNECTOR_DIR=" + dir,
 	}
-	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return context.DeadlineExceeded
-		}
-		return err
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = context.DeadlineExceeded
+	}
+	// The result is kept for the list of the konnectors, but a failure to
+	// save it is not a failure of the konnector
+	if errs := apps.SaveKonnectorResult(db, opts.Slug, err); errs != nil {
+		log.Warnf("[konnector] Could not save the result of %s for %s: %s", opts.Slug, domain, errs)
+	}
+	jobID, _ := ctx.Value(jobs.ContextJobIDKey).(string)
+	if errs := apps.SaveKonnectorLog(db, opts.Slug, jobID, output, err); errs != nil {
+		log.Warnf("[konnector] Could not save the log of %s for %s: %s", opts.Slug, domain, errs)
+	}
+	return err
+}
+
+// konnectorDir returns the directory of the files of the installed version
+// of a konnector. An update writes the new version in another directory (see
+// apps.FilesDir), so it can't be guessed from the slug. The directory of the
+// previous version is kept for a grace period longer than the timeout of the
+// worker, so a konnector started just before an update can still run. For
+// the file systems on disk, the path is absolute.
+func konnectorDir(db couchdb.Database, domain, slug string) string {
+	dir := path.Join("/", slug)
+	if man, err := apps.GetKonnectorBySlug(db, slug); err == nil {
+		dir = apps.FilesDir(man)
+	}
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case "file", "mem":
+		return path.Join(fsURL.Path, domain, vfs.KonnectorsDirName, dir)
 	}
-	return nil
+	return dir
 }
@@ -2,9 +2,11 @@ package workers
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/stretchr/testify/assert"
 )
@@ -29,3 +31,11 @@ func TestKonnectorWorker(t *testing.T) {
 	err = KonnectorWorker(ctx, msg)
 	assert.NoError(t, err)
 }
+
+func TestKonnectorDir(t *testing.T) {
+	// Without document, the konnector is looked for in the directory of its
+	// slug
+	db := couchdb.SimpleDatabasePrefix("cozy.local")
+	dir := konnectorDir(db, "cozy.local", "no-such-konnector")
+	assert.True(t, strings.HasSuffix(dir, "/cozy.local/.cozy_konnectors/no-such-konnector"), dir)
+}
@@ -0,0 +1,253 @@
+// Package archive creates and extracts the tar archives of the applications,
+// with the safety checks that an untrusted archive needs: the entries can't
+// be written outside of the destination directory, the total size and the
+// number of files are capped, the modes are sanitized, and the symbolic links
+// are refused by default.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+var (
+	// ErrTooLarge is used when the files of an archive are larger than the
+	// maximal size of the options
+	ErrTooLarge = errors.New("The files of the archive are too large")
+	// ErrTooManyFiles is used when an archive has more files than the maximal
+	// number of the options
+	ErrTooManyFiles = errors.New("The archive has too many files")
+	// ErrUnsafeSymlink is used when a symbolic link of an archive is absolute
+	// or goes up in the tree
+	ErrUnsafeSymlink = errors.New("The archive has a symbolic link that may escape its directory")
+)
+
+// Options are the options for the creation and the extraction of an archive
+type Options struct {
+	// MaxSize is the maximal total size in bytes of the files. For an
+	// extraction, the size declared in the header of an entry is checked
+	// before anything is written. Zero means no limit.
+	MaxSize int64
+	// MaxFiles is the maximal number of files (the directories are not
+	// counted). Zero means no limit.
+	MaxFiles int
+	// Filter is called for each entry with its cleaned relative name (without
+	// the prefix for an extraction). Only the entries for which it returns
+	// true are kept. Nil keeps all the entries.
+	Filter func(name string, info os.FileInfo) bool
+	// Prefix limits an extraction to the entries whose names start with it,
+	// like the package/ directory of the npm tarballs. They are extracted
+	// without the prefix.
+	Prefix string
+	// AllowSymlinks extracts the symbolic links, instead of skipping them.
+	// Their targets must be relative and can't go up in the tree (no ..), so
+	// that they can't be used to write outside of the destination. They are
+	// only created if the filesystem supports them, and they are never added
+	// to a new archive.
+	AllowSymlinks bool
+}
+
+func (opts *Options) keep(name string, info os.FileInfo) bool {
+	return opts.Filter == nil || opts.Filter(name, info)
+}
+
+// linker is implemented by the afero filesystems that can create symbolic
+// links
+type linker interface {
+	SymlinkIfPossible(oldname, newname string) error
+}
+
+// ExtractTarGz extracts a gzipped tar archive in the dst directory of the
+// filesystem (created if needed). See ExtractTar.
+func ExtractTarGz(r io.Reader, fs afero.Fs, dst string, opts Options) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	return ExtractTar(gr, fs, dst, opts)
+}
+
+// ExtractTar extracts a tar archive in the dst directory of the filesystem
+// (created if needed). An entry whose name is absolute or goes above the
+// directory makes the extraction fail with utils.ErrUnsafePath. The files are
+// written with the 0644 mode (0755 if they are executable), and the hard
+// links and the special files are skipped. The files extracted before an
+// error are kept.
+func ExtractTar(r io.Reader, fs afero.Fs, dst string, opts Options) error {
+	if err := fs.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	var total int64
+	var count int
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !strings.HasPrefix(name, opts.Prefix) {
+			continue
+		}
+		cleaned, err := utils.SafeJoinSlash("/", strings.TrimPrefix(name, opts.Prefix))
+		if err != nil {
+			return err
+		}
+		name = strings.TrimPrefix(cleaned, "/")
+		if name == "" || !opts.keep(name, hdr.FileInfo()) {
+			continue
+		}
+		fullpath := path.Join(dst, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fs.MkdirAll(fullpath, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			count++
+			if opts.MaxFiles > 0 && count > opts.MaxFiles {
+				return ErrTooManyFiles
+			}
+			total += hdr.Size
+			if hdr.Size < 0 || (opts.MaxSize > 0 && total > opts.MaxSize) {
+				return ErrTooLarge
+			}
+			err = extractFile(fs, fullpath, hdr, tr)
+		case tar.TypeSymlink:
+			if !opts.AllowSymlinks {
+				continue
+			}
+			count++
+			if opts.MaxFiles > 0 && count > opts.MaxFiles {
+				return ErrTooManyFiles
+			}
+			err = extractSymlink(fs, fullpath, hdr.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(fs afero.Fs, fullpath string, hdr *tar.Header, r io.Reader) error {
+	if err := fs.MkdirAll(path.Dir(fullpath), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if hdr.Mode&0111 != 0 {
+		mode = 0755
+	}
+	f, err := fs.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// extractSymlink creates a symbolic link, if its target can't escape the
+// destination. A target that only goes down in the tree can't: even if it is
+// itself a link, it is another link checked with the same rule.
+func extractSymlink(fs afero.Fs, fullpath, target string) error {
+	cleaned, err := utils.SafeJoinSlash("/", target)
+	if err != nil || cleaned == "/" {
+		return ErrUnsafeSymlink
+	}
+	l, ok := fs.(linker)
+	if !ok {
+		return nil
+	}
+	if err = fs.MkdirAll(path.Dir(fullpath), 0755); err != nil {
+		return err
+	}
+	return l.SymlinkIfPossible(strings.TrimPrefix(cleaned, "/"), fullpath)
+}
+
+// CreateTarGz writes a gzipped tar archive with the files of the src
+// directory of the filesystem. See CreateTar.
+func CreateTarGz(fs afero.Fs, src string, w io.Writer, opts Options) error {
+	gw := gzip.NewWriter(w)
+	if err := CreateTar(fs, src, gw, opts); err != nil {
+		gw.Close()
+		return err
+	}
+	return gw.Close()
+}
+
+// CreateTar writes a tar archive with the files and directories of the src
+// directory of the filesystem, with names relative to it. The symbolic links
+// and the special files are skipped. ErrTooLarge or ErrTooManyFiles are
+// returned if the files exceed the limits of the options.
+func CreateTar(fs afero.Fs, src string, w io.Writer, opts Options) error {
+	var total int64
+	var count int
+	tw := tar.NewWriter(w)
+	err := afero.Walk(fs, src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = path.Clean(filepath.ToSlash(rel))
+		if !opts.keep(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		hdr := &tar.Header{
+			Name:    rel,
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		if info.IsDir() {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			return tw.WriteHeader(hdr)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		count++
+		if opts.MaxFiles > 0 && count > opts.MaxFiles {
+			return ErrTooManyFiles
+		}
+		total += info.Size()
+		if opts.MaxSize > 0 && total > opts.MaxSize {
+			return ErrTooLarge
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
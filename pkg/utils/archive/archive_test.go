@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// entry is an entry of a test archive. The size is the one declared in the
+// header, and can be larger than the content for the malicious archives.
+type entry struct {
+	name     string
+	typeflag byte
+	content  string
+	size     int64
+	linkname string
+	mode     int64
+}
+
+func makeTarGz(t *testing.T, entries ...entry) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	complete := true
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     e.mode,
+			Typeflag: e.typeflag,
+			Size:     e.size,
+			Linkname: e.linkname,
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if e.typeflag == tar.TypeReg && e.size == 0 {
+			hdr.Size = int64(len(e.content))
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > int64(len(e.content)) {
+			// The content of an entry with a huge declared size is missing
+			complete = false
+			break
+		}
+		_, err := tw.Write([]byte(e.content))
+		assert.NoError(t, err)
+	}
+	if complete {
+		assert.NoError(t, tw.Close())
+	} else {
+		tw.Flush()
+	}
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func file(name, content string) entry {
+	return entry{name: name, typeflag: tar.TypeReg, content: content}
+}
+
+func symlink(name, target string) entry {
+	return entry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+
+func assertFile(t *testing.T, fs afero.Fs, name, content string) {
+	b, err := afero.ReadFile(fs, name)
+	if assert.NoError(t, err, name) {
+		assert.Equal(t, content, string(b), name)
+	}
+}
+
+func assertMissing(t *testing.T, fs afero.Fs, name string) {
+	ok, err := afero.Exists(fs, name)
+	assert.NoError(t, err)
+	assert.False(t, ok, name)
+}
+
+func TestExtractTarGz(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	archive := makeTarGz(t,
+		entry{name: "package/", typeflag: tar.TypeDir},
+		file("package/manifest.webapp", `{"name": "mini"}`),
+		file("./package/assets/app.js", "alert(1)"),
+		entry{name: "package/bin/run", typeflag: tar.TypeReg, content: "#!/bin/sh", mode: 04755},
+		file("package/.git/HEAD", "ref: refs/heads/master"),
+		entry{name: "package/hardlink", typeflag: tar.TypeLink, linkname: "package/manifest.webapp"},
+		symlink("package/link", "assets/app.js"),
+		file("README.md", "outside of the package"),
+	)
+	err := ExtractTarGz(bytes.NewReader(archive), fs, "/app", Options{
+		Prefix: "package/",
+		Filter: func(name string, info os.FileInfo) bool {
+			return name != ".git" && info.Name() != "HEAD"
+		},
+	})
+	assert.NoError(t, err)
+	assertFile(t, fs, "/app/manifest.webapp", `{"name": "mini"}`)
+	assertFile(t, fs, "/app/assets/app.js", "alert(1)")
+	assertFile(t, fs, "/app/bin/run", "#!/bin/sh")
+	assertMissing(t, fs, "/app/.git/HEAD")
+	assertMissing(t, fs, "/app/hardlink")
+	assertMissing(t, fs, "/app/link")
+	assertMissing(t, fs, "/app/README.md")
+	assertMissing(t, fs, "/README.md")
+
+	// The modes are sanitized
+	info, err := fs.Stat("/app/bin/run")
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		assert.Equal(t, os.FileMode(0), info.Mode()&os.ModeSetuid)
+	}
+	info, err = fs.Stat("/app/manifest.webapp")
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+}
+
+func TestExtractMaliciousArchives(t *testing.T) {
+	tests := []struct {
+		name     string
+		archive  []byte
+		opts     Options
+		expected error
+	}{
+		{"dot-dot", makeTarGz(t, file("../../evil.txt", "evil")), Options{}, utils.ErrUnsafePath},
+		{"dot-dot in the middle", makeTarGz(t, file("app/../../evil.txt", "evil")), Options{}, utils.ErrUnsafePath},
+		{"dot-dot after the prefix", makeTarGz(t, file("package/../evil.txt", "evil")), Options{Prefix: "package/"}, utils.ErrUnsafePath},
+		{"backslashes", makeTarGz(t, file("..\\..\\evil.txt", "evil")), Options{}, utils.ErrUnsafePath},
+		{"absolute", makeTarGz(t, file("/etc/evil.txt", "evil")), Options{}, utils.ErrUnsafePath},
+		{"huge declared size", makeTarGz(t, file("index.html", "ok"), entry{name: "huge.bin", typeflag: tar.TypeReg, size: 1 << 40}), Options{MaxSize: 1 << 20}, ErrTooLarge},
+		{"total size", makeTarGz(t, file("a", "12345"), file("b", "67890")), Options{MaxSize: 8}, ErrTooLarge},
+		{"too many files", makeTarGz(t, file("a", "a"), file("b", "b"), file("c", "c")), Options{MaxFiles: 2}, ErrTooManyFiles},
+		{"symlink to a parent", makeTarGz(t, symlink("link", "../../etc"), file("link/evil.txt", "evil")), Options{AllowSymlinks: true}, ErrUnsafeSymlink},
+		{"symlink to itself", makeTarGz(t, symlink("link", "."), file("link/evil.txt", "evil")), Options{AllowSymlinks: true}, ErrUnsafeSymlink},
+		{"absolute symlink", makeTarGz(t, symlink("link", "/etc/passwd")), Options{AllowSymlinks: true}, ErrUnsafeSymlink},
+		{"not gzipped", []byte("this is not an archive"), Options{}, gzip.ErrHeader},
+	}
+	for _, test := range tests {
+		fs := afero.NewMemMapFs()
+		err := ExtractTarGz(bytes.NewReader(test.archive), fs, "/app/dst", test.opts)
+		assert.Equal(t, test.expected, err, test.name)
+		assertMissing(t, fs, "/evil.txt")
+		assertMissing(t, fs, "/app/evil.txt")
+		assertMissing(t, fs, "/etc/evil.txt")
+		assertMissing(t, fs, "/app/dst/huge.bin")
+	}
+
+	// Without AllowSymlinks, the links are skipped
+	fs := afero.NewMemMapFs()
+	archive := makeTarGz(t, symlink("link", "../../etc"), file("link/file.txt", "ok"))
+	assert.NoError(t, ExtractTarGz(bytes.NewReader(archive), fs, "/app/dst", Options{}))
+	assertFile(t, fs, "/app/dst/link/file.txt", "ok")
+
+	// A safe link is accepted
+	archive = makeTarGz(t, file("v1/index.html", "ok"), symlink("current", "v1"))
+	assert.NoError(t, ExtractTarGz(bytes.NewReader(archive), fs, "/app/dst", Options{AllowSymlinks: true}))
+}
+
+func TestCreateTarGz(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/app/manifest.webapp", []byte(`{"name": "mini"}`), 0644)
+	afero.WriteFile(fs, "/app/assets/app.js", []byte("alert(1)"), 0644)
+	afero.WriteFile(fs, "/app/.git/HEAD", []byte("ref: refs/heads/master"), 0644)
+
+	buf := new(bytes.Buffer)
+	err := CreateTarGz(fs, "/app", buf, Options{
+		Filter: func(name string, info os.FileInfo) bool { return name != ".git" },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, ExtractTarGz(bytes.NewReader(buf.Bytes()), fs, "/copy", Options{}))
+	assertFile(t, fs, "/copy/manifest.webapp", `{"name": "mini"}`)
+	assertFile(t, fs, "/copy/assets/app.js", "alert(1)")
+	assertMissing(t, fs, "/copy/.git")
+
+	buf.Reset()
+	assert.Equal(t, ErrTooLarge, CreateTarGz(fs, "/app", buf, Options{MaxSize: 20}))
+	assert.Equal(t, ErrTooManyFiles, CreateTarGz(fs, "/app", buf, Options{MaxFiles: 2}))
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// These functions are variables so that the tests can inject failures in the
+// middle of an atomic write.
+var (
+	atomicSync   = func(f *os.File) error { return f.Sync() }
+	atomicRename = os.Rename
+)
+
+// WriteFileAtomic writes the content of r in the file at the given path, in a
+// way that the file has either its old content or the new one, even after a
+// crash: the content is written to a temporary file in the same directory,
+// synced on disk, and then renamed over the file. The temporary file is
+// removed if an error occurs.
+//
+// If perm is zero, the permissions of the existing file are kept (or 0644 is
+// used for a new file).
+func WriteFileAtomic(name string, r io.Reader, perm os.FileMode) (err error) {
+	if perm == 0 {
+		perm = 0644
+		if infos, errs := os.Stat(name); errs == nil {
+			perm = infos.Mode().Perm()
+		}
+	}
+
+	dir := filepath.Dir(name)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = atomicSync(f); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = atomicRename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// WriteFileAtomicBytes is like WriteFileAtomic, with the content as a slice
+// of bytes.
+func WriteFileAtomicBytes(name string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomic(name, bytes.NewReader(data), perm)
+}
+
+// syncDir syncs a directory, so that a rename in it is persisted on disk. The
+// directories can't be synced on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if errc := d.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tmpFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		if strings.Contains(info.Name(), ".tmp") {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-atomic")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "manifest.webapp")
+
+	err = WriteFileAtomic(name, strings.NewReader("foo"), 0640)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+
+	// The permissions of the existing file are kept when perm is zero
+	err = WriteFileAtomicBytes(name, []byte("bar"), 0)
+	assert.NoError(t, err)
+	content, _ = ioutil.ReadFile(name)
+	assert.Equal(t, "bar", string(content))
+	if runtime.GOOS != "windows" {
+		infos, err := os.Stat(name)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), infos.Mode().Perm())
+	}
+	assert.Empty(t, tmpFiles(t, dir))
+
+	err = WriteFileAtomicBytes(filepath.Join(dir, "no/such/dir"), []byte("baz"), 0)
+	assert.Error(t, err)
+}
+
+func TestWriteFileAtomicFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-atomic")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "icon.svg")
+	assert.NoError(t, WriteFileAtomicBytes(name, []byte("old"), 0644))
+
+	errCrash := errors.New("crash")
+	defer func() {
+		atomicSync = func(f *os.File) error { return f.Sync() }
+		atomicRename = os.Rename
+	}()
+
+	// A failure after the write and before the rename
+	atomicSync = func(f *os.File) error { return errCrash }
+	err = WriteFileAtomicBytes(name, []byte("new"), 0644)
+	assert.Equal(t, errCrash, err)
+	content, _ := ioutil.ReadFile(name)
+	assert.Equal(t, "old", string(content))
+	assert.Empty(t, tmpFiles(t, dir))
+	atomicSync = func(f *os.File) error { return f.Sync() }
+
+	// A failure of the rename
+	atomicRename = func(oldpath, newpath string) error {
+		// The temporary file is complete at this point
+		tmp, err := ioutil.ReadFile(oldpath)
+		assert.NoError(t, err)
+		assert.Equal(t, "new", string(tmp))
+		return errCrash
+	}
+	err = WriteFileAtomicBytes(name, []byte("new"), 0644)
+	assert.Equal(t, errCrash, err)
+	content, _ = ioutil.ReadFile(name)
+	assert.Equal(t, "old", string(content))
+	assert.Empty(t, tmpFiles(t, dir))
+	atomicRename = os.Rename
+
+	// A failure of the reader
+	err = WriteFileAtomic(name, &failingReader{err: errCrash}, 0644)
+	assert.Equal(t, errCrash, err)
+	content, _ = ioutil.ReadFile(name)
+	assert.Equal(t, "old", string(content))
+	assert.Empty(t, tmpFiles(t, dir))
+}
+
+type failingReader struct {
+	read bool
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, r.err
+	}
+	r.read = true
+	return copy(p, "partial"), nil
+}
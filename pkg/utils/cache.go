@@ -0,0 +1,403 @@
+package utils
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache is a map safe for concurrent use, where each entry can expire after
+// a delay. When the maximal number of entries is reached, the least recently
+// used entry is evicted to make room for a new one.
+//
+// The expired entries are removed lazily when they are read. A janitor can
+// also be started to remove them periodically, so that they don't use memory
+// until they are evicted.
+//
+// The cache counts its hits, misses, evictions and the bytes of its entries,
+// in total and by bucket (see SetBucketFunc), to help sizing it.
+type Cache struct {
+	mu         sync.RWMutex
+	maxEntries int
+	clock      Clock
+	lru        *list.List
+	items      map[string]*list.Element
+	bucketOf   func(key string) string
+	total      CacheStats
+	buckets    map[string]*CacheStats
+	shards     []CacheStats
+
+	janitor  sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type cacheItem struct {
+	key     string
+	bucket  string
+	value   interface{}
+	size    int64
+	added   time.Time
+	expires time.Time
+}
+
+// CacheStats are the counters of a cache, or of a bucket of a cache. The
+// hits, misses, evictions and expirations are counted since the start, and
+// the entries and bytes are the current ones.
+type CacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+	Expirations int64 `json:"expirations"`
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// CacheEntry is the metadata of an entry of a cache, without its value
+type CacheEntry struct {
+	Key       string
+	Bucket    string
+	Size      int64
+	AddedAt   time.Time
+	ExpiresAt time.Time // zero if the entry never expires
+}
+
+// Sizer can be implemented by the values of a cache to give their size in
+// bytes. The size of the other values is counted as zero.
+type Sizer interface {
+	Size() int64
+}
+
+// NewCache returns a cache that can keep up to maxEntries (no limit if zero).
+// The clock is used for the expiry of the entries, and can be nil for the
+// real clock.
+func NewCache(maxEntries int, clock Clock) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		clock:      OrRealClock(clock),
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+		buckets:    make(map[string]*CacheStats),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// CacheShards is the number of shards of the buckets of a cache. The
+// buckets, like the domains of the instances, are unbounded, so they are
+// hashed in a fixed number of shards for the metrics.
+const CacheShards = 16
+
+// SetBucketFunc sets the function that gives the bucket of a key, like the
+// domain of the instance for the keys prefixed by it. The counters are then
+// also kept by bucket, once the bucket has had some entries, and by shard of
+// the buckets (see CacheShards). It must be called before the cache is used.
+func (c *Cache) SetBucketFunc(fn func(key string) string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bucketOf = fn
+	c.shards = make([]CacheStats, CacheShards)
+}
+
+// Get returns the value for the given key, if it is in the cache and has not
+// expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.count(c.bucketFor(key), func(s *CacheStats) { s.Misses++ })
+		return nil, false
+	}
+	item := elem.Value.(*cacheItem)
+	if item.expired(c.clock.Now()) {
+		c.removeElement(elem)
+		c.count(item.bucket, func(s *CacheStats) { s.Expirations++; s.Misses++ })
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.count(item.bucket, func(s *CacheStats) { s.Hits++ })
+	return item.value, true
+}
+
+// Set adds or replaces the value for the given key. The entry expires after
+// the ttl, or never if the ttl is zero.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	now := c.clock.Now()
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	var size int64
+	if sizer, ok := value.(Sizer); ok {
+		size = sizer.Size()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*cacheItem)
+		delta := size - item.size
+		c.count(item.bucket, func(s *CacheStats) { s.Bytes += delta })
+		item.value = value
+		item.size = size
+		item.added = now
+		item.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+	item := &cacheItem{
+		key:     key,
+		bucket:  c.bucketFor(key),
+		value:   value,
+		size:    size,
+		added:   now,
+		expires: expires,
+	}
+	c.items[key] = c.lru.PushFront(item)
+	c.count(item.bucket, func(s *CacheStats) { s.Entries++; s.Bytes += size })
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		back := c.lru.Back()
+		c.removeElement(back)
+		c.count(back.Value.(*cacheItem).bucket, func(s *CacheStats) { s.Evictions++ })
+	}
+}
+
+// Delete removes the entry for the given key, if any
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// Len returns the number of entries in the cache. It can include expired
+// entries that have not been removed yet.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lru.Len()
+}
+
+// MaxEntries returns the maximal number of entries of the cache, or zero if
+// there is no limit.
+func (c *Cache) MaxEntries() int {
+	return c.maxEntries
+}
+
+// Stats returns the counters of the whole cache
+func (c *Cache) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.total
+}
+
+// BucketStats returns the counters of each bucket of the cache that has had
+// some entries. It is empty if no bucket function has been set.
+func (c *Cache) BucketStats() map[string]CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := make(map[string]CacheStats, len(c.buckets))
+	for bucket, s := range c.buckets {
+		stats[bucket] = *s
+	}
+	return stats
+}
+
+// ShardStats returns the counters of each shard of the buckets of the cache,
+// indexed by shard (see ShardOfBucket). It is empty if no bucket function
+// has been set.
+func (c *Cache) ShardStats() []CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]CacheStats(nil), c.shards...)
+}
+
+// ShardOfBucket returns the shard of the counters of a bucket
+func ShardOfBucket(bucket string) int {
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	return int(h.Sum32() % CacheShards)
+}
+
+// StatsOfBucket returns the counters of a bucket of the cache. A bucket that
+// has never had an entry has zero counters.
+func (c *Cache) StatsOfBucket(bucket string) CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, ok := c.buckets[bucket]; ok {
+		return *s
+	}
+	return CacheStats{}
+}
+
+// ResetBucketStats removes the counters of a bucket, like when its instance
+// is destroyed. The entries and the bytes of the bucket are still counted if
+// it has some entries.
+func (c *Cache) ResetBucketStats(bucket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.buckets[bucket]
+	if !ok {
+		return
+	}
+	if s.Entries > 0 {
+		c.buckets[bucket] = &CacheStats{Entries: s.Entries, Bytes: s.Bytes}
+	} else {
+		delete(c.buckets, bucket)
+	}
+}
+
+// Entries returns the metadata of the entries of a bucket, or of all the
+// entries if the bucket is empty, from the most recently used. Only the
+// metadata are copied under the read lock, so the users of the cache are
+// not blocked for long.
+func (c *Cache) Entries(bucket string) []CacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make([]CacheEntry, 0)
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		item := elem.Value.(*cacheItem)
+		if bucket != "" && item.bucket != bucket {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Key:       item.key,
+			Bucket:    item.bucket,
+			Size:      item.size,
+			AddedAt:   item.added,
+			ExpiresAt: item.expires,
+		})
+	}
+	return entries
+}
+
+// RemoveExpired removes all the expired entries from the cache
+func (c *Cache) RemoveExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	for _, elem := range c.items {
+		if item := elem.Value.(*cacheItem); item.expired(now) {
+			c.removeElement(elem)
+			c.count(item.bucket, func(s *CacheStats) { s.Expirations++ })
+		}
+	}
+}
+
+// StartJanitor starts a goroutine that removes the expired entries at the
+// given interval, until StopJanitor is called. It can be started only once.
+func (c *Cache) StartJanitor(interval time.Duration) {
+	c.janitor.Do(func() {
+		go c.runJanitor(interval)
+	})
+}
+
+// StopJanitor stops the janitor goroutine and waits for it to exit. If the
+// janitor has not been started, it won't be startable after that.
+func (c *Cache) StopJanitor() {
+	started := true
+	c.janitor.Do(func() { started = false })
+	if !started {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+func (c *Cache) runJanitor(interval time.Duration) {
+	defer close(c.done)
+	timer := c.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.Chan():
+			c.RemoveExpired()
+			timer.Reset(interval)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// removeElement removes an entry. The mutex must be held.
+func (c *Cache) removeElement(elem *list.Element) {
+	item := elem.Value.(*cacheItem)
+	c.lru.Remove(elem)
+	delete(c.items, item.key)
+	c.count(item.bucket, func(s *CacheStats) { s.Entries--; s.Bytes -= item.size })
+}
+
+// bucketFor returns the bucket of a key. The mutex must be held.
+func (c *Cache) bucketFor(key string) string {
+	if c.bucketOf == nil {
+		return ""
+	}
+	return c.bucketOf(key)
+}
+
+// count updates the counters of the whole cache, of a bucket and of its
+// shard. The counters of a bucket are created when it has its first entry,
+// so that the buckets don't grow with all the keys ever seen, like the
+// misses, and they are then kept until ResetBucketStats. The mutex must be
+// held.
+func (c *Cache) count(bucket string, fn func(s *CacheStats)) {
+	fn(&c.total)
+	if c.bucketOf == nil {
+		return
+	}
+	fn(&c.shards[ShardOfBucket(bucket)])
+	s, ok := c.buckets[bucket]
+	if !ok {
+		s = &CacheStats{}
+	}
+	fn(s)
+	if ok || s.Entries > 0 {
+		c.buckets[bucket] = s
+	}
+}
+
+func (i *cacheItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+var caches = struct {
+	sync.Mutex
+	byName map[string]*Cache
+}{byName: make(map[string]*Cache)}
+
+// RegisterCache registers a cache with a name, for its metrics, and returns
+// it. A cache registered with the same name is replaced.
+func RegisterCache(name string, c *Cache) *Cache {
+	caches.Lock()
+	defer caches.Unlock()
+	caches.byName[name] = c
+	return c
+}
+
+// RegisteredCache is a cache with the name it has been registered with
+type RegisteredCache struct {
+	Name  string
+	Cache *Cache
+}
+
+// RegisteredCaches returns the registered caches, sorted by name
+func RegisteredCaches() []RegisteredCache {
+	caches.Lock()
+	defer caches.Unlock()
+	list := make([]RegisteredCache, 0, len(caches.byName))
+	for name, c := range caches.byName {
+		list = append(list, RegisteredCache{Name: name, Cache: c})
+	}
+	sort.Sort(byCacheName(list))
+	return list
+}
+
+type byCacheName []RegisteredCache
+
+func (a byCacheName) Len() int           { return len(a) }
+func (a byCacheName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCacheName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheGetSetDelete(t *testing.T) {
+	c := NewCache(0, nil)
+	_, ok := c.Get("foo")
+	assert.False(t, ok)
+
+	c.Set("foo", "bar", 0)
+	c.Set("baz", 42, 0)
+	v, ok := c.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "bar", v)
+	assert.Equal(t, 2, c.Len())
+
+	c.Set("foo", "qux", 0)
+	v, _ = c.Get("foo")
+	assert.Equal(t, "qux", v)
+	assert.Equal(t, 2, c.Len())
+
+	c.Delete("foo")
+	c.Delete("no-such-key")
+	_, ok = c.Get("foo")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c := NewCache(0, clock)
+	c.Set("short", 1, time.Second)
+	c.Set("long", 2, time.Minute)
+	c.Set("forever", 3, 0)
+
+	clock.Advance(999 * time.Millisecond)
+	_, ok := c.Get("short")
+	assert.True(t, ok)
+
+	clock.Advance(time.Millisecond)
+	_, ok = c.Get("short")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 2, c.Len())
+	c.RemoveExpired()
+	assert.Equal(t, 1, c.Len())
+	v, ok := c.Get("forever")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(3, nil)
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Set("c", 3, 0)
+	c.Get("a")
+	c.Set("d", 4, 0)
+	assert.Equal(t, 3, c.Len())
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = c.Get(key)
+		assert.True(t, ok, key)
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c := NewCache(0, clock)
+	c.Set("foo", "bar", time.Second)
+	c.StartJanitor(time.Minute)
+	c.StartJanitor(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	// Wait for the janitor to be sleeping again, after its pass
+	clock.BlockUntil(1)
+	assert.Equal(t, 0, c.Len())
+	c.StopJanitor()
+	c.StopJanitor()
+
+	// Stopping a cache without janitor doesn't block
+	NewCache(0, nil).StopJanitor()
+}
+
+func TestCacheConcurrency(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c := NewCache(50, clock)
+	c.StartJanitor(time.Second)
+	defer c.StopJanitor()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := strconv.Itoa((i * j) % 100)
+				c.Set(key, j, time.Duration(j%3)*time.Second)
+				if j%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Get(strconv.Itoa(j % 100))
+				if j%100 == 0 {
+					clock.Advance(time.Second)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, c.Len() <= 50)
+}
+
+type sizedValue string
+
+func (v sizedValue) Size() int64 { return int64(len(v)) }
+
+func TestCacheStats(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c := NewCache(2, clock)
+	c.SetBucketFunc(func(key string) string { return key[:1] })
+	c.Set("a1", sizedValue("xxx"), time.Second)
+	c.Set("a2", sizedValue("xx"), 0)
+	c.Get("a1")
+	c.Get("a3")
+	c.Set("a2", sizedValue("xxxxx"), 0)
+	c.Set("b1", 42, 0)
+
+	// a1 is the least recently used, and is evicted for b1
+	s := c.Stats()
+	assert.EqualValues(t, 1, s.Hits)
+	assert.EqualValues(t, 1, s.Misses)
+	assert.EqualValues(t, 1, s.Evictions)
+	assert.Equal(t, 2, s.Entries)
+	assert.EqualValues(t, 5, s.Bytes)
+
+	buckets := c.BucketStats()
+	assert.Len(t, buckets, 2)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Evictions: 1, Entries: 1, Bytes: 5}, buckets["a"])
+	assert.Equal(t, CacheStats{Entries: 1}, buckets["b"])
+	assert.Equal(t, buckets["a"], c.StatsOfBucket("a"))
+	assert.Equal(t, CacheStats{}, c.StatsOfBucket("c"))
+
+	c.Set("b2", sizedValue("x"), time.Second)
+	clock.Advance(time.Second)
+	_, ok := c.Get("b2")
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{Misses: 1, Expirations: 1, Entries: 1}, c.BucketStats()["b"])
+
+	// The buckets keep their counters when they have no more entries (a2 has
+	// been evicted for b2), but a miss doesn't create a bucket
+	c.Get("c1")
+	c.Delete("b1")
+	assert.Len(t, c.BucketStats(), 2)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Evictions: 2}, c.StatsOfBucket("a"))
+	assert.Equal(t, CacheStats{Misses: 1, Expirations: 1}, c.StatsOfBucket("b"))
+	assert.Equal(t, CacheStats{}, c.StatsOfBucket("c"))
+
+	// Until they are reset, but not their shards
+	c.ResetBucketStats("a")
+	assert.Len(t, c.BucketStats(), 1)
+	assert.Equal(t, CacheStats{}, c.StatsOfBucket("a"))
+	shards := c.ShardStats()
+	assert.Len(t, shards, CacheShards)
+	assert.EqualValues(t, 1, shards[ShardOfBucket("c")].Misses)
+	var sum CacheStats
+	for _, shard := range shards {
+		sum.Hits += shard.Hits
+		sum.Misses += shard.Misses
+		sum.Entries += shard.Entries
+	}
+	s = c.Stats()
+	assert.Equal(t, CacheStats{Hits: s.Hits, Misses: s.Misses, Entries: s.Entries}, sum)
+
+	// Without a bucket function, only the totals are counted
+	plain := NewCache(0, nil)
+	plain.Get("foo")
+	assert.EqualValues(t, 1, plain.Stats().Misses)
+	assert.Empty(t, plain.BucketStats())
+	assert.Empty(t, plain.ShardStats())
+}
+
+func TestCacheEntries(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c := NewCache(0, clock)
+	c.SetBucketFunc(func(key string) string { return key[:1] })
+	c.Set("a1", sizedValue("xxx"), time.Minute)
+	clock.Advance(time.Second)
+	c.Set("b1", sizedValue("x"), 0)
+	c.Set("a2", "y", 0)
+
+	entries := c.Entries("a")
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, CacheEntry{Key: "a2", Bucket: "a", AddedAt: epoch.Add(time.Second)}, entries[0])
+		assert.Equal(t, CacheEntry{Key: "a1", Bucket: "a", Size: 3, AddedAt: epoch,
+			ExpiresAt: epoch.Add(time.Minute)}, entries[1])
+	}
+	assert.Len(t, c.Entries(""), 3)
+	assert.Empty(t, c.Entries("c"))
+}
+
+func TestRegisteredCaches(t *testing.T) {
+	c := RegisterCache("test-b", NewCache(0, nil))
+	RegisterCache("test-a", NewCache(0, nil))
+	var names []string
+	for _, rc := range RegisteredCaches() {
+		names = append(names, rc.Name)
+		if rc.Name == "test-b" {
+			assert.Equal(t, c, rc.Cache)
+		}
+	}
+	assert.Equal(t, []string{"test-a", "test-b"}, names)
+}
+
+// mapCache is the plain mutex and map used as a reference by the benchmarks
+type mapCache struct {
+	mu    sync.Mutex
+	items map[string]interface{}
+}
+
+func (m *mapCache) Get(key string) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.items[key]
+	return v, ok
+}
+
+func (m *mapCache) Set(key string, value interface{}, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = value
+}
+
+type benchCache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttl time.Duration)
+}
+
+func benchmarkCache(b *testing.B, c benchCache) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], i, time.Hour)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				c.Set(key, i, time.Hour)
+			} else {
+				c.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCache(b *testing.B) {
+	benchmarkCache(b, NewCache(10000, nil))
+}
+
+func BenchmarkMutexMap(b *testing.B) {
+	benchmarkCache(b, &mapCache{items: make(map[string]interface{})})
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ErrTooLarge is returned by a capped reader when there are more bytes than
+// its maximum
+var ErrTooLarge = errors.New("The content is too large")
+
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+// NewCappedReader returns a reader that reads at most max bytes from r. Unlike
+// io.LimitReader, it doesn't truncate the content silently: it returns
+// ErrTooLarge if r has more than max bytes.
+func NewCappedReader(r io.Reader, max int64) io.Reader {
+	return &cappedReader{r: r, remaining: max}
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	// One more byte than the remaining is read, to know if the cap is
+	// exceeded even when the content stops exactly at the cap.
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		c.err = ErrTooLarge
+		return n, c.err
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// ReadAllCapped reads all the content of r, or returns ErrTooLarge if it has
+// more than max bytes.
+func ReadAllCapped(r io.Reader, max int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(NewCappedReader(r, max))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
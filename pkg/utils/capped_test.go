@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAllCappedBoundary(t *testing.T) {
+	content := strings.Repeat("x", 100)
+
+	b, err := ReadAllCapped(strings.NewReader(content), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(b))
+
+	b, err = ReadAllCapped(strings.NewReader(content), 101)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(b))
+
+	b, err = ReadAllCapped(strings.NewReader(content), 99)
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Nil(t, b)
+
+	b, err = ReadAllCapped(strings.NewReader(""), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+
+	_, err = ReadAllCapped(strings.NewReader("x"), 0)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestCappedReaderSmallReads(t *testing.T) {
+	content := strings.Repeat("abc", 10)
+
+	// One byte at a time, the cap is still exact
+	r := NewCappedReader(iotest.OneByteReader(strings.NewReader(content)), 30)
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf.String())
+
+	r = NewCappedReader(iotest.OneByteReader(strings.NewReader(content)), 29)
+	buf.Reset()
+	_, err = io.Copy(&buf, r)
+	assert.Equal(t, ErrTooLarge, err)
+	// The bytes before the cap are given, but not the ones after
+	assert.Equal(t, content[:29], buf.String())
+
+	// The error is sticky
+	n, err := r.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestCappedReaderErrors(t *testing.T) {
+	errFoo := errors.New("foo")
+	_, err := ReadAllCapped(&failingReader{err: errFoo}, 10)
+	assert.Equal(t, errFoo, err)
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSHA256 returns the SHA-256 of the content of a file, in hexadecimal. The
+// file is streamed, not loaded in memory.
+func FileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TreeChecksums returns the SHA-256 of the regular files inside the root
+// directory, with at most workers files hashed at the same time. The keys of
+// the map are the paths relative to root, with forward slashes on all the
+// platforms. The symlinks and the special files are skipped.
+func TreeChecksums(root string, workers int) (map[string]string, error) {
+	var rels []string
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sums := make(map[string]string, len(rels))
+	var mu sync.Mutex
+	tasks := make([]func(context.Context) error, len(rels))
+	for i, rel := range rels {
+		rel := rel
+		tasks[i] = func(ctx context.Context) error {
+			sum, err := FileSHA256(filepath.Join(root, rel))
+			if err != nil {
+				// No need to hash the other files
+				cancel()
+				return err
+			}
+			mu.Lock()
+			sums[filepath.ToSlash(rel)] = sum
+			mu.Unlock()
+			return nil
+		}
+	}
+	// The tasks not run after a failure have the error of the context, but it
+	// is the error of the failing task that is interesting.
+	for _, err := range RunConcurrently(ctx, workers, tasks) {
+		if err != nil && err != context.Canceled {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSHA256(t *testing.T) {
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+	sum, err := FileSHA256(filepath.Join(dir, "index.html"))
+	assert.NoError(t, err)
+	expected := sha256.Sum256([]byte("<html></html>"))
+	assert.Equal(t, hex.EncodeToString(expected[:]), sum)
+
+	_, err = FileSHA256(filepath.Join(dir, "no-such-file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// sequentialChecksums is the simplest implementation of TreeChecksums, to
+// check that the concurrent one gives the same result
+func sequentialChecksums(t *testing.T, root string) map[string]string {
+	sums := make(map[string]string)
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, name)
+		sums[filepath.ToSlash(rel)], err = FileSHA256(name)
+		return err
+	})
+	assert.NoError(t, err)
+	return sums
+}
+
+func TestTreeChecksums(t *testing.T) {
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+	if runtime.GOOS != "windows" {
+		assert.NoError(t, os.Symlink(filepath.Join(dir, "index.html"), filepath.Join(dir, "js/link.html")))
+	}
+
+	expected := sequentialChecksums(t, dir)
+	assert.Len(t, expected, 7)
+	assert.Contains(t, expected, "js/vendor/lib.js")
+	assert.NotContains(t, expected, "js/link.html")
+	for _, workers := range []int{0, 1, 3, 100} {
+		sums, err := TreeChecksums(dir, workers)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sums)
+	}
+}
+
+func TestTreeChecksumsErrors(t *testing.T) {
+	_, err := TreeChecksums(filepath.Join(os.TempDir(), "no-such-dir-for-cozy"), 2)
+	assert.Error(t, err)
+
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("the permissions are not enforced")
+	}
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "js/app.js"), 0))
+	_, err = TreeChecksums(dir, 2)
+	assert.True(t, os.IsPermission(err))
+}
+
+func BenchmarkTreeChecksums(b *testing.B) {
+	dir, err := ioutil.TempDir("", "cozy-checksums")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := []byte(strings.Repeat("cozy", 16<<10))
+	for i := 0; i < 200; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("dir%d", i%10), fmt.Sprintf("file%d", i))
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, content, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := TreeChecksums(dir, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestRealClock(t *testing.T) {
+	c := OrRealClock(nil)
+	assert.Equal(t, RealClock, c)
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+	<-c.After(time.Millisecond)
+	timer := c.NewTimer(time.Hour)
+	assert.True(t, timer.Stop())
+	timer.Reset(time.Millisecond)
+	<-timer.Chan()
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	c := NewFakeClock(epoch)
+	assert.Equal(t, c, OrRealClock(c))
+	assert.Equal(t, epoch, c.Now())
+
+	after := c.After(2 * time.Second)
+	timer := c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	c.Advance(500 * time.Millisecond)
+	assertNotFired(t, after)
+	assertNotFired(t, timer.Chan())
+
+	c.Advance(500 * time.Millisecond)
+	assert.Equal(t, epoch.Add(time.Second), <-timer.Chan())
+	assertNotFired(t, after)
+	assertNotFired(t, stopped.Chan())
+
+	assert.False(t, timer.Reset(time.Second))
+	c.Advance(time.Second)
+	assert.Equal(t, epoch.Add(2*time.Second), <-after)
+	assert.Equal(t, epoch.Add(2*time.Second), <-timer.Chan())
+	assert.Equal(t, epoch.Add(2*time.Second), c.Now())
+
+	// A timer with no delay fires immediately
+	assert.Equal(t, c.Now(), <-c.After(0))
+}
+
+func assertNotFired(t *testing.T, ch <-chan time.Time) {
+	select {
+	case <-ch:
+		t.Error("the timer should not have fired")
+	default:
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(epoch)
+	var wg sync.WaitGroup
+	woken := make(chan time.Time, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			woken <- <-c.After(time.Duration(i+1) * time.Minute)
+		}(i)
+	}
+	c.BlockUntil(10)
+	c.Advance(10 * time.Minute)
+	wg.Wait()
+	close(woken)
+	count := 0
+	for range woken {
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
+
+func TestFakeClockConcurrency(t *testing.T) {
+	c := NewFakeClock(epoch)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			timer := c.NewTimer(time.Second)
+			timer.Reset(2 * time.Second)
+			timer.Stop()
+			c.Now()
+		}()
+		go func() {
+			defer wg.Done()
+			c.Advance(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, epoch.Add(50*time.Millisecond), c.Now())
+}
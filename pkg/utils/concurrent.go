@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// RunConcurrently runs the tasks with at most limit of them in flight at the
+// same time (no limit if it is zero or negative), and waits for them to
+// finish. It returns the errors of the tasks, in the same order as the tasks.
+//
+// The context is given to the tasks. When it is canceled, the tasks that have
+// not started are not run, and their error is the error of the context. A
+// task that panics has an error for it, and the other tasks are not affected.
+func RunConcurrently(ctx context.Context, limit int, tasks []func(context.Context) error) []error {
+	errs := make([]error, len(tasks))
+	if limit <= 0 || limit > len(tasks) {
+		limit = len(tasks)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+		// When the context is done and a slot is free at the same time, the
+		// select can pick either of them.
+		if err := ctx.Err(); err != nil {
+			<-sem
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, task func(context.Context) error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = runTask(ctx, task)
+		}(i, task)
+	}
+	wg.Wait()
+	return errs
+}
+
+func runTask(ctx context.Context, task func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return task(ctx)
+}
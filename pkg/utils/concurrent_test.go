@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunConcurrentlyErrors(t *testing.T) {
+	errFoo := errors.New("foo")
+	tasks := []func(context.Context) error{
+		func(ctx context.Context) error {
+			time.Sleep(20 * time.Millisecond)
+			return errFoo
+		},
+		func(ctx context.Context) error { return nil },
+		func(ctx context.Context) error { panic("bar") },
+		func(ctx context.Context) error { return errors.New("baz") },
+	}
+	errs := RunConcurrently(context.Background(), 2, tasks)
+	if assert.Len(t, errs, 4) {
+		assert.Equal(t, errFoo, errs[0])
+		assert.NoError(t, errs[1])
+		if assert.Error(t, errs[2]) {
+			assert.Equal(t, "panic: bar", errs[2].Error())
+		}
+		if assert.Error(t, errs[3]) {
+			assert.Equal(t, "baz", errs[3].Error())
+		}
+	}
+
+	assert.Len(t, RunConcurrently(context.Background(), 3, nil), 0)
+}
+
+func TestRunConcurrentlyLimit(t *testing.T) {
+	var running, max int32
+	tasks := make([]func(context.Context) error, 20)
+	for i := range tasks {
+		tasks[i] = func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}
+	}
+	errs := RunConcurrently(context.Background(), 3, tasks)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, max)
+
+	max = 0
+	RunConcurrently(context.Background(), 0, tasks)
+	assert.True(t, max > 3)
+}
+
+func TestRunConcurrentlyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started int32
+	tasks := make([]func(context.Context) error, 10)
+	for i := range tasks {
+		tasks[i] = func(ctx context.Context) error {
+			if atomic.AddInt32(&started, 1) == 2 {
+				cancel()
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+	errs := RunConcurrently(ctx, 2, tasks)
+	assert.EqualValues(t, 2, started)
+	if assert.Len(t, errs, 10) {
+		for _, err := range errs {
+			assert.Equal(t, context.Canceled, err)
+		}
+	}
+}
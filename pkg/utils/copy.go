@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrCopyTooLarge is used when a copy is aborted because the files are larger
+// than the maximal size of the copy options.
+var ErrCopyTooLarge = errors.New("The files to copy are too large")
+
+// CopyOptions are the options for CopyDir
+type CopyOptions struct {
+	// Exclude is called for each file and directory, with its path relative
+	// to the source directory. The files and directories for which it returns
+	// true are not copied.
+	Exclude func(rel string, info os.FileInfo) bool
+	// ExcludeGlobs is a list of patterns (see filepath.Match) for the files
+	// and directories to exclude. They are matched against the relative path
+	// and against the base name.
+	ExcludeGlobs []string
+	// MaxSize is the maximal total size in bytes of the copied files. The
+	// copy is aborted with ErrCopyTooLarge if it is exceeded (the files
+	// already copied are kept). Zero means no limit.
+	MaxSize int64
+	// FollowSymlinks copies the files targeted by the symbolic links. By
+	// default, the symbolic links are skipped. The links to directories are
+	// always skipped.
+	FollowSymlinks bool
+}
+
+func (opts *CopyOptions) excluded(rel string, info os.FileInfo) bool {
+	for _, glob := range opts.ExcludeGlobs {
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, info.Name()); ok {
+			return true
+		}
+	}
+	return opts.Exclude != nil && opts.Exclude(rel, info)
+}
+
+// CopyDir copies the tree of the src directory to the dst directory (which is
+// created if needed), keeping the modes of the files and directories.
+func CopyDir(src, dst string, opts CopyOptions) error {
+	var total int64
+	return filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if rel == "." {
+			return mkdirWithMode(target, info.Mode())
+		}
+		if opts.excluded(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !opts.FollowSymlinks {
+				return nil
+			}
+			if info, err = os.Stat(name); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			return mkdirWithMode(target, info.Mode())
+		case info.Mode().IsRegular():
+			total += info.Size()
+			if opts.MaxSize > 0 && total > opts.MaxSize {
+				return ErrCopyTooLarge
+			}
+			return CopyFile(name, target)
+		}
+		// The special files (devices, sockets...) are not copied
+		return nil
+	})
+}
+
+func mkdirWithMode(name string, mode os.FileMode) error {
+	if err := os.MkdirAll(name, mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(name, mode.Perm())
+}
+
+// CopyFile copies the content and the mode of the src file to dst. The dst
+// file is replaced if it already exists.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	infos, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, infos.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Chmod(infos.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cozy-copy")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	files := map[string]string{
+		"index.html":          "<html></html>",
+		"js/app.js":           "alert(1)",
+		"js/vendor/lib.js":    "var lib",
+		"img/icon.svg":        "<svg></svg>",
+		".git/HEAD":           "ref: refs/heads/master",
+		"node_modules/foo.js": "module.exports = 1",
+		"README.md":           "# Readme",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		assert.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestCopyDir(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+	dst, _ := ioutil.TempDir("", "cozy-copy-dst")
+	defer os.RemoveAll(dst)
+	dst = filepath.Join(dst, "copy")
+
+	if runtime.GOOS != "windows" {
+		assert.NoError(t, os.Chmod(filepath.Join(src, "js/app.js"), 0755))
+		assert.NoError(t, os.Chmod(filepath.Join(src, "img"), 0700))
+	}
+
+	err := CopyDir(src, dst, CopyOptions{
+		ExcludeGlobs: []string{".git", "*.md"},
+		Exclude: func(rel string, info os.FileInfo) bool {
+			return strings.HasPrefix(rel, "node_modules")
+		},
+	})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"index.html", "js/app.js", "js/vendor/lib.js", "img/icon.svg"} {
+		content, err := ioutil.ReadFile(filepath.Join(dst, name))
+		assert.NoError(t, err, name)
+		expected, _ := ioutil.ReadFile(filepath.Join(src, name))
+		assert.Equal(t, string(expected), string(content), name)
+	}
+	for _, name := range []string{".git", "node_modules", "README.md"} {
+		_, err := os.Stat(filepath.Join(dst, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	if runtime.GOOS != "windows" {
+		infos, err := os.Stat(filepath.Join(dst, "js/app.js"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), infos.Mode().Perm())
+		infos, err = os.Stat(filepath.Join(dst, "img"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), infos.Mode().Perm())
+		infos, err = os.Stat(filepath.Join(dst, "index.html"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), infos.Mode().Perm())
+	}
+}
+
+func TestCopyDirMaxSize(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+	dst, _ := ioutil.TempDir("", "cozy-copy-dst")
+	defer os.RemoveAll(dst)
+
+	err := CopyDir(src, dst, CopyOptions{MaxSize: 20})
+	assert.Equal(t, ErrCopyTooLarge, err)
+
+	err = CopyDir(src, dst, CopyOptions{MaxSize: 1 << 20})
+	assert.NoError(t, err)
+}
+
+func TestCopyDirSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+	outside := makeTree(t)
+	defer os.RemoveAll(outside)
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "index.html"), filepath.Join(src, "link.html")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "js"), filepath.Join(src, "linkdir")))
+
+	dst, _ := ioutil.TempDir("", "cozy-copy-dst")
+	defer os.RemoveAll(dst)
+	assert.NoError(t, CopyDir(src, dst, CopyOptions{}))
+	_, err := os.Lstat(filepath.Join(dst, "link.html"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(dst, "linkdir"))
+	assert.True(t, os.IsNotExist(err))
+
+	dst2, _ := ioutil.TempDir("", "cozy-copy-dst")
+	defer os.RemoveAll(dst2)
+	assert.NoError(t, CopyDir(src, dst2, CopyOptions{FollowSymlinks: true}))
+	infos, err := os.Lstat(filepath.Join(dst2, "link.html"))
+	if assert.NoError(t, err) {
+		assert.True(t, infos.Mode().IsRegular())
+	}
+	_, err = os.Lstat(filepath.Join(dst2, "linkdir"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyFile(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+
+	dst := filepath.Join(src, "copy.html")
+	assert.NoError(t, ioutil.WriteFile(dst, []byte("a longer content to be replaced"), 0600))
+	assert.NoError(t, CopyFile(filepath.Join(src, "index.html"), dst))
+	content, err := ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(content))
+	if runtime.GOOS != "windows" {
+		infos, _ := os.Stat(dst)
+		assert.Equal(t, os.FileMode(0644), infos.Mode().Perm())
+	}
+
+	assert.Error(t, CopyFile(filepath.Join(src, "no-such-file"), dst))
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SkippedPathsError is returned by DirSize when some files or directories
+// could not be read, for example because of their permissions. The results
+// are computed without them.
+type SkippedPathsError struct {
+	Paths []string
+}
+
+func (e *SkippedPathsError) Error() string {
+	return fmt.Sprintf("Could not read %d paths: %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
+
+// DirSize returns the total size in bytes and the number of the files in the
+// given directory and its sub-directories. The symbolic links are not
+// followed (nor counted). The paths that can't be read because of their
+// permissions are skipped, and reported with a *SkippedPathsError.
+func DirSize(path string) (int64, int64, error) {
+	var size, count int64
+	var skipped []string
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsPermission(err) && name != path {
+				skipped = append(skipped, name)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(skipped) > 0 {
+		return size, count, &SkippedPathsError{Paths: skipped}
+	}
+	return size, count, nil
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirSize(t *testing.T) {
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+	afterSize, afterCount, err := DirSize(dir)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, afterCount)
+
+	var expected int64
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			expected += info.Size()
+		}
+		return nil
+	})
+	assert.Equal(t, expected, afterSize)
+
+	_, _, err = DirSize(filepath.Join(dir, "no-such-dir"))
+	assert.Error(t, err)
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// The symlinks are not followed
+	outside := makeTree(t)
+	defer os.RemoveAll(outside)
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "index.html"), filepath.Join(dir, "link.html")))
+	size, count, err := DirSize(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, afterSize, size)
+	assert.Equal(t, afterCount, count)
+}
+
+func TestDirSizePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("the permissions can't be tested on Windows or as root")
+	}
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "private")
+	assert.NoError(t, os.Mkdir(private, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(private, "secret"), []byte("secret"), 0644))
+	assert.NoError(t, os.Chmod(private, 0))
+	defer os.Chmod(private, 0755)
+
+	_, count, err := DirSize(dir)
+	assert.EqualValues(t, 7, count)
+	if assert.Error(t, err) {
+		skipped, ok := err.(*SkippedPathsError)
+		if assert.True(t, ok) {
+			assert.Equal(t, []string{private}, skipped.Paths)
+		}
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-disk")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	free, err := DiskFree(dir)
+	assert.NoError(t, err)
+	assert.True(t, free > 0)
+
+	_, err = DiskFree(filepath.Join(dir, "no-such-dir"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package utils
+
+import "errors"
+
+// DiskFree is not supported on this platform
+func DiskFree(path string) (uint64, error) {
+	return 0, errors.New("DiskFree is not supported on this platform")
+}
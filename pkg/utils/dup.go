@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DupSuppressor coalesces the concurrent calls for the same key: while a
+// function is running for a key, the other callers with this key wait for
+// its result instead of running their own function.
+//
+// The zero value is ready to use.
+type DupSuppressor struct {
+	mu    sync.Mutex
+	calls map[string]*dupCall
+}
+
+type dupCall struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int
+}
+
+// Do runs fn for the given key and returns its result, or waits for the
+// result of the call already in flight for this key. A panic in fn is
+// returned as an error to all the callers.
+func (d *DupSuppressor) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	d.mu.Lock()
+	if d.calls == nil {
+		d.calls = make(map[string]*dupCall)
+	}
+	if c, ok := d.calls[key]; ok {
+		c.dups++
+		d.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &dupCall{}
+	c.wg.Add(1)
+	d.calls[key] = c
+	d.mu.Unlock()
+
+	d.run(key, c, fn)
+	return c.val, c.err
+}
+
+func (d *DupSuppressor) run(key string, c *dupCall, fn func() (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("panic: %v", r)
+		}
+		d.mu.Lock()
+		// The key can have been forgotten, and used by a new call
+		if d.calls[key] == c {
+			delete(d.calls, key)
+		}
+		d.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+}
+
+// Forget removes the key, so that the next call to Do for it runs its
+// function, even if a call is still in flight. The callers already waiting
+// get the result of the call in flight.
+func (d *DupSuppressor) Forget(key string) {
+	d.mu.Lock()
+	delete(d.calls, key)
+	d.mu.Unlock()
+}
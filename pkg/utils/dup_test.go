@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitDups waits until n callers are waiting for the call in flight for key
+func waitDups(d *DupSuppressor, key string, n int) {
+	for {
+		d.mu.Lock()
+		c, ok := d.calls[key]
+		done := ok && c.dups == n
+		d.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDupSuppressorDo(t *testing.T) {
+	var d DupSuppressor
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	results := make([]interface{}, n)
+	wg.Add(n)
+	go func() {
+		defer wg.Done()
+		results[0], _ = d.Do("foo", fn)
+	}()
+	// The first call must be in flight before the others
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = d.Do("foo", fn)
+		}(i)
+	}
+	waitDups(&d, "foo", n-1)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, calls)
+	for _, res := range results {
+		assert.Equal(t, "bar", res)
+	}
+	assert.Len(t, d.calls, 0)
+
+	// The next call starts a new execution
+	_, err := d.Do("foo", func() (interface{}, error) {
+		return nil, errors.New("baz")
+	})
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, calls)
+}
+
+func TestDupSuppressorPanic(t *testing.T) {
+	var d DupSuppressor
+	_, err := d.Do("foo", func() (interface{}, error) { panic("qux") })
+	if assert.Error(t, err) {
+		assert.Equal(t, "panic: qux", err.Error())
+	}
+	assert.Len(t, d.calls, 0)
+}
+
+func TestDupSuppressorForget(t *testing.T) {
+	var d DupSuppressor
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.Do("foo", func() (interface{}, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+		close(done)
+	}()
+	<-started
+
+	d.Forget("foo")
+	val, err := d.Do("foo", func() (interface{}, error) { return 2, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, val)
+
+	close(release)
+	<-done
+	assert.Len(t, d.calls, 0)
+}
+
+func TestDupSuppressorConcurrency(t *testing.T) {
+	var d DupSuppressor
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i % 10)
+			val, err := d.Do(key, func() (interface{}, error) { return key, nil })
+			assert.NoError(t, err)
+			assert.Equal(t, key, val)
+			if i%7 == 0 {
+				d.Forget(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, d.calls, 0)
+}
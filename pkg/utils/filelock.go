@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrFileLockUnsupported is returned when the file locks are not supported on
+// this platform
+var ErrFileLockUnsupported = errors.New("The file locks are not supported on this platform")
+
+// fileLockPollInterval is how often Lock tries to take a lock held by
+// another process
+var fileLockPollInterval = 10 * time.Millisecond
+
+// FileLock is an exclusive lock on a file, to coordinate several processes
+// working on the same directory, like the stacks sharing a source cache or a
+// stack and an admin command. It uses flock on Unix and LockFileEx on Windows.
+//
+// The lock is held by the open file, so two FileLock on the same path exclude
+// each other, even in the same process. A FileLock must not be used by
+// several goroutines at the same time.
+//
+// These locks are released by the operating system when the process dies, so
+// there is no stale lock to detect or to clean: a lock held by a crashed
+// process is available again. For the same reason, the lock file must not be
+// removed: a process could then lock a new file with the same name while
+// another one still has the lock on the old one.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// NewFileLock returns a lock on the given path. The file is created if it
+// doesn't exist when the lock is taken, and it is left on disk after.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// TryLock takes the lock if it is available, and returns false without
+// waiting if it is held by someone else.
+func (l *FileLock) TryLock() (bool, error) {
+	if l.file != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	ok, err := tryLockFile(f)
+	if err != nil || !ok {
+		f.Close()
+		return false, err
+	}
+	l.file = f
+	return true, nil
+}
+
+// Lock takes the lock, waiting for it to be released if it is held by
+// someone else. It gives up when the context is done, with its error.
+func (l *FileLock) Lock(ctx context.Context) error {
+	for {
+		ok, err := l.TryLock()
+		if err != nil || ok {
+			return err
+		}
+		if err = SleepCtx(ctx, fileLockPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// Close releases the lock, if it is held. The lock can be taken again after.
+func (l *FileLock) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	f := l.file
+	l.file = nil
+	err := unlockFile(f)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
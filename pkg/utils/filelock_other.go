@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package utils
+
+import "os"
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, ErrFileLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return ErrFileLockUnsupported
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-filelock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "lock")
+
+	a := NewFileLock(name)
+	b := NewFileLock(name)
+	ok, err := a.TryLock()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = a.TryLock()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = b.TryLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Lock(ctx))
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, a.Close())
+	ok, err = b.TryLock()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, b.Close())
+}
+
+func TestFileLockGoroutines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-filelock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "lock")
+
+	// At most one goroutine holds the lock at any time
+	var holders, max int32
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := NewFileLock(name)
+			for j := 0; j < 50; j++ {
+				if !assert.NoError(t, l.Lock(context.Background())) {
+					return
+				}
+				if n := atomic.AddInt32(&holders, 1); n > atomic.LoadInt32(&max) {
+					atomic.StoreInt32(&max, n)
+				}
+				time.Sleep(100 * time.Microsecond)
+				atomic.AddInt32(&holders, -1)
+				assert.NoError(t, l.Close())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, max)
+}
@@ -0,0 +1,75 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package utils
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFileLockHelperProcess is not a real test: it is run in a child process
+// by TestFileLockCrossProcess to hold the lock.
+func TestFileLockHelperProcess(t *testing.T) {
+	name := os.Getenv("COZY_FILELOCK_HELPER")
+	if name == "" {
+		return
+	}
+	l := NewFileLock(name)
+	if err := l.Lock(context.Background()); err != nil {
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("locked\n")
+	// Wait to be killed
+	select {}
+}
+
+func TestFileLockCrossProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-filelock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "lock")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "COZY_FILELOCK_HELPER="+name)
+	stdout, err := cmd.StdoutPipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, cmd.Start()) {
+		return
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if !assert.NoError(t, err) || !assert.Equal(t, "locked\n", line) {
+		cmd.Process.Kill()
+		return
+	}
+
+	l := NewFileLock(name)
+	ok, err := l.TryLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The lock of a dead process is released
+	done := make(chan error)
+	go func() { done <- l.Lock(context.Background()) }()
+	assert.NoError(t, cmd.Process.Kill())
+	cmd.Wait()
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock has not been released")
+	}
+	assert.NoError(t, l.Close())
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is the number of bytes used by http.DetectContentType
+const sniffLen = 512
+
+// DetectMimeType returns the content-type of a file. The content is sniffed
+// first, so that a file with a wrong extension is not mislabeled, and the
+// extension of the name is only used when the content is not recognized, like
+// for CSS or javascript. The reader is rewound to its initial position.
+func DetectMimeType(name string, r io.ReadSeeker) (string, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	buf = buf[:n]
+	if _, err = r.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	// http.DetectContentType knows neither SVG nor JSON
+	if isSVG(buf) {
+		return "image/svg+xml", nil
+	}
+	sniffed := http.DetectContentType(buf)
+	if !strings.HasPrefix(sniffed, "text/plain") && sniffed != "application/octet-stream" {
+		return sniffed, nil
+	}
+	if isJSON(buf, n < sniffLen) {
+		return "application/json", nil
+	}
+	if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+		return byExt, nil
+	}
+	return sniffed, nil
+}
+
+// isSVG returns true if the content starts like an SVG document, optionally
+// with an XML declaration, a doctype and comments before the svg element.
+func isSVG(buf []byte) bool {
+	buf = bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))
+	for {
+		buf = bytes.TrimLeft(buf, " \t\r\n")
+		if !bytes.HasPrefix(buf, []byte("<?")) && !bytes.HasPrefix(buf, []byte("<!")) {
+			break
+		}
+		end := []byte(">")
+		if bytes.HasPrefix(buf, []byte("<!--")) {
+			end = []byte("-->")
+		}
+		i := bytes.Index(buf, end)
+		if i < 0 {
+			return false
+		}
+		buf = buf[i+len(end):]
+	}
+	return bytes.HasPrefix(buf, []byte("<svg")) && len(buf) > 4 &&
+		bytes.IndexByte([]byte(" \t\r\n>/"), buf[4]) >= 0
+}
+
+// isJSON returns true if the content looks like a JSON object or array. If
+// the whole content has been read, it must also be valid JSON.
+func isJSON(buf []byte, complete bool) bool {
+	buf = bytes.TrimLeft(buf, " \t\r\n")
+	if len(buf) == 0 || (buf[0] != '{' && buf[0] != '[') {
+		return false
+	}
+	if !complete {
+		return true
+	}
+	var raw json.RawMessage
+	return json.Unmarshal(buf, &raw) == nil
+}
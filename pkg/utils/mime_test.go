@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectMimeType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		// The content wins over a spoofed extension
+		{"icon.jpg", png, "image/png"},
+		{"icon.svg", png, "image/png"},
+		{"icon", "<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>", "image/svg+xml"},
+		{"icon.png", "<svg>...</svg>", "image/svg+xml"},
+		{"icon", "\xef\xbb\xbf<?xml version=\"1.0\"?>\n<!-- Created with Inkscape -->\n<!DOCTYPE svg>\n<svg/>", "image/svg+xml"},
+		{"icon", "<svgfoo></svgfoo>", "text/plain; charset=utf-8"},
+		{"index.svg", "<html><script>alert(1)</script></html>", "text/html; charset=utf-8"},
+		{"manifest", ` {"name": "Mini", "slug": "mini"}`, "application/json"},
+		{"manifest.txt", `[1, 2, 3]`, "application/json"},
+		{"notes", `{not json`, "text/plain; charset=utf-8"},
+		{"manifest", `{"name": "` + strings.Repeat("x", sniffLen) + `"}`, "application/json"},
+		// The extension is used when the content is not recognized
+		{"app.css", "body { color: red; }", "text/css; charset=utf-8"},
+		{"app.bin", "\x00\x01\x02", "application/octet-stream"},
+		{"app", "hello", "text/plain; charset=utf-8"},
+		{"empty", "", "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		r := strings.NewReader(test.content)
+		mime, err := DetectMimeType(test.name, r)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, mime, test.name)
+		// The reader has been rewound
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, test.content, string(rest))
+	}
+
+	r := bytes.NewReader([]byte("ignored<svg></svg>"))
+	r.Seek(7, io.SeekStart)
+	mime, err := DetectMimeType("icon", r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/svg+xml", mime)
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "<svg></svg>", string(rest))
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// urlSafeLetters has 64 characters, so that a random byte can be mapped to
+// one of them without bias
+const urlSafeLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+
+// rng is the source of the non-cryptographic random strings. It is seeded
+// once, so that we do not generate the same IDs upon restart, and protected
+// by a mutex as a rand.Source is not safe for concurrent use.
+var rng = mrand.New(mrand.NewSource(time.Now().UTC().UnixNano()))
+var rngMu sync.Mutex
+
+// The alphabets of the non-cryptographic random strings
+const (
+	letters          = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	lowercaseDigits  = "abcdefghijklmnopqrstuvwxyz0123456789"
+	hexadecimalChars = "0123456789abcdef"
+)
+
+// RandomString returns a string of random alpha characters of the specified
+// length.
+//
+// It must not be used for anything security-sensitive (tokens, signed URLs,
+// etc.): use SecureRandomString instead.
+func RandomString(n int) string {
+	return RandomStringWithAlphabet(n, letters)
+}
+
+// RandomStringWithAlphabet returns a random string of the specified length,
+// with the characters picked from the given alphabet. The alphabet must be
+// made of ASCII characters, and not be empty.
+func RandomStringWithAlphabet(n int, alphabet string) string {
+	b := make([]byte, n)
+	lenAlphabet := len(alphabet)
+	rngMu.Lock()
+	for i := 0; i < n; i++ {
+		b[i] = alphabet[rng.Intn(lenAlphabet)]
+	}
+	rngMu.Unlock()
+	return string(b)
+}
+
+// RandomHex returns a random string of n hexadecimal characters (lowercase),
+// like for cache keys.
+func RandomHex(n int) string {
+	return RandomStringWithAlphabet(n, hexadecimalChars)
+}
+
+// RandomLowercaseString returns a random string of n lowercase letters and
+// digits, like for the generated slugs.
+func RandomLowercaseString(n int) string {
+	return RandomStringWithAlphabet(n, lowercaseDigits)
+}
+
+// RandomDuration returns a random duration between 0 (included) and max
+// (excluded), like for a jitter. It is 0 if max is not positive.
+func RandomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	rngMu.Lock()
+	d := time.Duration(rng.Int63n(int64(max)))
+	rngMu.Unlock()
+	return d
+}
+
+// SecureRandomBytes returns n bytes from the cryptographically secure random
+// generator of the system. It panics if the generator fails.
+func SecureRandomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// SecureRandomString returns a cryptographically secure random string of the
+// specified length, with only URL-safe characters (letters, digits, - and _).
+func SecureRandomString(n int) string {
+	b := SecureRandomBytes(n)
+	for i := range b {
+		b[i] = urlSafeLetters[b[i]&63]
+	}
+	return string(b)
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomStringNoReseed(t *testing.T) {
+	// Two calls in the same nanosecond used to return the same string when
+	// the generator was seeded with the clock
+	for i := 0; i < 1000; i++ {
+		assert.NotEqual(t, RandomString(16), RandomString(16))
+	}
+}
+
+func TestSecureRandomBytes(t *testing.T) {
+	b1 := SecureRandomBytes(32)
+	b2 := SecureRandomBytes(32)
+	assert.Len(t, b1, 32)
+	assert.Len(t, b2, 32)
+	assert.NotEqual(t, b1, b2)
+	assert.Len(t, SecureRandomBytes(0), 0)
+}
+
+func TestSecureRandomString(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		s := SecureRandomString(24)
+		assert.Len(t, s, 24)
+		for _, c := range s {
+			assert.Contains(t, urlSafeLetters, string(c))
+		}
+		assert.False(t, seen[s])
+		seen[s] = true
+	}
+}
+
+func TestRandomStringWithAlphabet(t *testing.T) {
+	cases := []struct {
+		alphabet string
+		gen      func(n int) string
+	}{
+		{"ab", func(n int) string { return RandomStringWithAlphabet(n, "ab") }},
+		{"0123456789", func(n int) string { return RandomStringWithAlphabet(n, "0123456789") }},
+		{hexadecimalChars, RandomHex},
+		{lowercaseDigits, RandomLowercaseString},
+		{letters, RandomString},
+	}
+	for _, c := range cases {
+		assert.Len(t, c.gen(0), 0)
+		assert.Len(t, c.gen(7), 7)
+
+		// Each character should appear about the same number of times
+		const n = 100000
+		counts := make(map[rune]int)
+		for _, r := range c.gen(n) {
+			counts[r]++
+		}
+		assert.Len(t, counts, len(c.alphabet), c.alphabet)
+		expected := n / len(c.alphabet)
+		for _, r := range c.alphabet {
+			assert.InDelta(t, expected, counts[r], float64(expected)/5, string(r))
+		}
+	}
+}
+
+func TestRandomDuration(t *testing.T) {
+	assert.Equal(t, time.Duration(0), RandomDuration(0))
+	assert.Equal(t, time.Duration(0), RandomDuration(-time.Second))
+	for i := 0; i < 1000; i++ {
+		d := RandomDuration(time.Second)
+		assert.True(t, d >= 0 && d < time.Second, d.String())
+	}
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimitExceeded is returned by Wait when the rate limiter will never
+// give a token, because its rate is zero.
+var ErrRateLimitExceeded = errors.New("Rate limit exceeded")
+
+// tokenEpsilon is the tolerance on the number of tokens, as adding fractions of
+// tokens is not exact with floats.
+const tokenEpsilon = 1e-9
+
+// RateLimiter is a token bucket: it holds up to burst tokens, and is refilled
+// at rate tokens per second. Each event consumes a token, so that the events
+// can't happen more often than rate per second on average, with bursts of at
+// most burst events.
+type RateLimiter struct {
+	mu     sync.Mutex
+	clock  Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a rate limiter with a full bucket. The clock can be
+// nil for the real clock.
+func NewRateLimiter(rate float64, burst int, clock Clock) *RateLimiter {
+	clock = OrRealClock(clock)
+	return &RateLimiter{
+		clock:  clock,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+	}
+}
+
+// Allow consumes a token and returns true if one is available, or returns
+// false without waiting.
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if !l.hasToken() {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait consumes a token, and waits until it is available if needed. It
+// returns an error if the context is done before that.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.refill()
+	if l.hasToken() {
+		l.tokens--
+		l.mu.Unlock()
+		return nil
+	}
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ErrRateLimitExceeded
+	}
+	// The token is reserved now, which makes the bucket go negative, so that
+	// the waiters are served in order.
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := l.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.refill()
+		l.tokens++
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens for the time elapsed since the last call. The mutex
+// must be held.
+func (l *RateLimiter) refill() {
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// hasToken returns true if a token is available, with a tolerance for the
+// rounding errors of the refills. The mutex must be held.
+func (l *RateLimiter) hasToken() bool {
+	return l.tokens >= 1-tokenEpsilon
+}
+
+// full returns true if the bucket is full, i.e. if the limiter is in the same
+// state as a new one.
+func (l *RateLimiter) full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return l.tokens >= l.burst-tokenEpsilon
+}
+
+// KeyedRateLimiter has a token bucket for each key, like an instance domain.
+// The buckets that have not been used for the idle duration are forgotten, so
+// that the memory is not filled by the keys seen only once.
+type KeyedRateLimiter struct {
+	mu        sync.Mutex
+	clock     Clock
+	rate      float64
+	burst     int
+	idle      time.Duration
+	limiters  map[string]*keyedLimiter
+	lastSweep time.Time
+}
+
+type keyedLimiter struct {
+	*RateLimiter
+	lastUsed time.Time
+}
+
+// NewKeyedRateLimiter returns a keyed rate limiter, where each bucket has the
+// given rate and burst. The clock can be nil for the real clock.
+func NewKeyedRateLimiter(rate float64, burst int, idle time.Duration, clock Clock) *KeyedRateLimiter {
+	clock = OrRealClock(clock)
+	return &KeyedRateLimiter{
+		clock:     clock,
+		rate:      rate,
+		burst:     burst,
+		idle:      idle,
+		limiters:  make(map[string]*keyedLimiter),
+		lastSweep: clock.Now(),
+	}
+}
+
+// Allow is like RateLimiter.Allow for the bucket of the given key
+func (k *KeyedRateLimiter) Allow(key string) bool {
+	return k.get(key).Allow()
+}
+
+// Wait is like RateLimiter.Wait for the bucket of the given key
+func (k *KeyedRateLimiter) Wait(ctx context.Context, key string) error {
+	return k.get(key).Wait(ctx)
+}
+
+// Len returns the number of buckets currently kept
+func (k *KeyedRateLimiter) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.limiters)
+}
+
+func (k *KeyedRateLimiter) get(key string) *RateLimiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.clock.Now()
+	if now.Sub(k.lastSweep) >= k.idle {
+		k.sweep(now)
+	}
+	l, ok := k.limiters[key]
+	if !ok {
+		l = &keyedLimiter{RateLimiter: NewRateLimiter(k.rate, k.burst, k.clock)}
+		k.limiters[key] = l
+	}
+	l.lastUsed = now
+	return l.RateLimiter
+}
+
+// sweep removes the idle buckets. A bucket that is not full yet is kept, as
+// forgetting it would give more tokens to its key. The mutex must be held.
+func (k *KeyedRateLimiter) sweep(now time.Time) {
+	for key, l := range k.limiters {
+		if now.Sub(l.lastUsed) >= k.idle && l.full() {
+			delete(k.limiters, key)
+		}
+	}
+	k.lastSweep = now
+}
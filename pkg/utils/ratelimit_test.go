@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	l := NewRateLimiter(1, 5, clock)
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Allow())
+	}
+	assert.False(t, l.Allow())
+
+	// The bucket doesn't fill beyond the burst
+	clock.Advance(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Allow())
+	}
+	assert.False(t, l.Allow())
+}
+
+func TestRateLimiterSustainedRate(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	l := NewRateLimiter(10, 1, clock)
+	allowed := 0
+	// One minute, with an attempt every 10ms
+	for i := 0; i < 6000; i++ {
+		if l.Allow() {
+			allowed++
+		}
+		clock.Advance(10 * time.Millisecond)
+	}
+	assert.InDelta(t, 600, allowed, 1)
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	l := NewRateLimiter(2, 1, clock)
+	assert.NoError(t, l.Wait(context.Background()))
+
+	done := make(chan error, 2)
+	go func() { done <- l.Wait(context.Background()) }()
+	clock.BlockUntil(1)
+	go func() { done <- l.Wait(context.Background()) }()
+	clock.BlockUntil(2)
+
+	// The first waiter gets a token after 500ms, the second one after 1s
+	clock.Advance(500 * time.Millisecond)
+	assert.NoError(t, <-done)
+	select {
+	case <-done:
+		t.Error("the second waiter should still be waiting")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	assert.NoError(t, <-done)
+	assert.False(t, l.Allow())
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	l := NewRateLimiter(1, 1, clock)
+	assert.True(t, l.Allow())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Wait(ctx) }()
+	clock.BlockUntil(1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	// The reserved token has been given back
+	clock.Advance(time.Second)
+	assert.True(t, l.Allow())
+
+	assert.Equal(t, context.Canceled, l.Wait(ctx))
+	assert.Equal(t, ErrRateLimitExceeded, NewRateLimiter(0, 0, clock).Wait(context.Background()))
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	// A token every 100 seconds
+	k := NewKeyedRateLimiter(0.01, 2, time.Minute, clock)
+	assert.True(t, k.Allow("alice.cozy.tools"))
+	assert.True(t, k.Allow("alice.cozy.tools"))
+	assert.False(t, k.Allow("alice.cozy.tools"))
+	assert.NoError(t, k.Wait(context.Background(), "bob.cozy.tools"))
+	assert.Equal(t, 2, k.Len())
+
+	// The idle keys are forgotten, but not a key whose bucket is not full yet
+	clock.Advance(2 * time.Minute)
+	assert.True(t, k.Allow("carol.cozy.tools"))
+	assert.Equal(t, 2, k.Len())
+	assert.True(t, k.Allow("alice.cozy.tools"))
+	assert.False(t, k.Allow("alice.cozy.tools"))
+}
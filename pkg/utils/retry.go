@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BackoffPolicy describes how the attempts of Retry are spaced
+type BackoffPolicy struct {
+	// InitialDelay is the delay before the second attempt
+	InitialDelay time.Duration
+	// MaxDelay is the maximal delay between two attempts (no maximum if zero)
+	MaxDelay time.Duration
+	// Multiplier is the factor applied to the delay after each attempt (2 if
+	// zero)
+	Multiplier float64
+	// Jitter is the fraction of the delay that is randomized: with 0.1, a
+	// delay of 1s can be anything between 0.9s and 1.1s
+	Jitter float64
+	// MaxAttempts is the maximal number of attempts (no maximum if zero)
+	MaxAttempts int
+}
+
+// DefaultBackoffPolicy is a policy for the calls to remote services
+var DefaultBackoffPolicy = BackoffPolicy{
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     10 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	MaxAttempts:  5,
+}
+
+func (p BackoffPolicy) next(delay time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay = time.Duration(float64(delay) * multiplier)
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func (p BackoffPolicy) jittered(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return delay
+	}
+	rngMu.Lock()
+	r := rng.Float64()
+	rngMu.Unlock()
+	return time.Duration(float64(delay) * (1 + p.Jitter*(2*r-1)))
+}
+
+// retrySleep waits for the given delay, or until the context is done. It is a
+// variable so that the tests can record the delays.
+var retrySleep = SleepCtx
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// Permanent wraps an error to tell Retry that it is useless to try again
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// RetryError is the error returned by Retry when it gives up
+type RetryError struct {
+	// Attempts is the number of times the function has been called
+	Attempts int
+	// Err is the last error returned by the function (without the Permanent
+	// wrapper), or the error of the context if it is done
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s (after %d attempts)", e.Err, e.Attempts)
+}
+
+// Retry calls fn until it succeeds, with a delay between the attempts
+// following the given policy. It stops when the maximal number of attempts is
+// reached, when the context is done, or when fn returns an error wrapped
+// with Permanent. In these cases, a *RetryError is returned.
+func Retry(ctx context.Context, policy BackoffPolicy, fn func(context.Context) error) error {
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return &RetryError{Attempts: attempt - 1, Err: err}
+		}
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if perm, ok := err.(*permanentError); ok {
+			return &RetryError{Attempts: attempt, Err: perm.err}
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return &RetryError{Attempts: attempt, Err: err}
+		}
+		if errs := retrySleep(ctx, policy.jittered(delay)); errs != nil {
+			return &RetryError{Attempts: attempt, Err: errs}
+		}
+		delay = policy.next(delay)
+	}
+}
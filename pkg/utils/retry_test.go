@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSleep replaces the sleep of Retry, and records the delays
+func fakeSleep(delays *[]time.Duration) func() {
+	sleep := retrySleep
+	retrySleep = func(ctx context.Context, delay time.Duration) error {
+		*delays = append(*delays, delay)
+		return ctx.Err()
+	}
+	return func() { retrySleep = sleep }
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+
+	errFoo := errors.New("foo")
+	calls := 0
+	policy := BackoffPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+		MaxAttempts:  6,
+	}
+	err := Retry(context.Background(), policy, func(ctx context.Context) error {
+		calls++
+		return errFoo
+	})
+	assert.Equal(t, 6, calls)
+	if assert.IsType(t, &RetryError{}, err) {
+		assert.Equal(t, 6, err.(*RetryError).Attempts)
+		assert.Equal(t, errFoo, err.(*RetryError).Err)
+		assert.Equal(t, "foo (after 6 attempts)", err.Error())
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}, delays)
+}
+
+func TestRetrySuccess(t *testing.T) {
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+
+	calls := 0
+	err := Retry(context.Background(), DefaultBackoffPolicy, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Len(t, delays, 2)
+}
+
+func TestRetryJitter(t *testing.T) {
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+
+	policy := BackoffPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   1,
+		Jitter:       0.5,
+		MaxAttempts:  100,
+	}
+	Retry(context.Background(), policy, func(ctx context.Context) error {
+		return errors.New("foo")
+	})
+	assert.Len(t, delays, 99)
+	different := false
+	for _, delay := range delays {
+		assert.True(t, delay >= 500*time.Millisecond)
+		assert.True(t, delay <= 1500*time.Millisecond)
+		if delay != delays[0] {
+			different = true
+		}
+	}
+	assert.True(t, different)
+}
+
+func TestRetryPermanent(t *testing.T) {
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+
+	errFoo := errors.New("foo")
+	calls := 0
+	err := Retry(context.Background(), DefaultBackoffPolicy, func(ctx context.Context) error {
+		calls++
+		if calls == 2 {
+			return Permanent(errFoo)
+		}
+		return errors.New("temporary")
+	})
+	assert.Equal(t, 2, calls)
+	if assert.IsType(t, &RetryError{}, err) {
+		assert.Equal(t, 2, err.(*RetryError).Attempts)
+		assert.Equal(t, errFoo, err.(*RetryError).Err)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	policy := BackoffPolicy{InitialDelay: time.Second}
+	err := Retry(ctx, policy, func(ctx context.Context) error {
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+		return errors.New("foo")
+	})
+	assert.Equal(t, 3, calls)
+	if assert.IsType(t, &RetryError{}, err) {
+		assert.Equal(t, 3, err.(*RetryError).Attempts)
+		assert.Equal(t, context.Canceled, err.(*RetryError).Err)
+	}
+
+	// A context already done before the first attempt
+	calls = 0
+	err = Retry(ctx, policy, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	assert.Equal(t, 0, calls)
+	if assert.IsType(t, &RetryError{}, err) {
+		assert.Equal(t, 0, err.(*RetryError).Attempts)
+	}
+}
+
+func TestRetrySleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.Equal(t, context.Canceled, retrySleep(ctx, time.Hour))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NoError(t, retrySleep(context.Background(), time.Millisecond))
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is used when a path can't be joined to a root directory
+// without escaping it.
+var ErrUnsafePath = errors.New("The path is absolute or escapes its root")
+
+// SafeJoin joins an untrusted relative path to a root directory of the local
+// file system, and guarantees that the result is inside the root. The
+// backslashes are considered as separators, whatever the platform, and the
+// resolution of the .. segments is only lexical: the symlinks are not
+// followed.
+func SafeJoin(root, unsafe string) (string, error) {
+	rel, err := cleanRelative(unsafe)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+// SafeJoinSlash is like SafeJoin, but for the paths that always use forward
+// slashes, like those of afero or the VFS.
+func SafeJoinSlash(root, unsafe string) (string, error) {
+	rel, err := cleanRelative(unsafe)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, rel), nil
+}
+
+// cleanRelative returns the cleaned version of a relative path, with forward
+// slashes, or an error if the path is absolute or goes above its root.
+func cleanRelative(unsafe string) (string, error) {
+	if strings.ContainsRune(unsafe, 0) {
+		return "", ErrUnsafePath
+	}
+	p := strings.Replace(unsafe, "\\", "/", -1)
+	if strings.HasPrefix(p, "/") || hasVolumeName(p) {
+		return "", ErrUnsafePath
+	}
+	p = path.Clean(p)
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", ErrUnsafePath
+	}
+	return p, nil
+}
+
+// hasVolumeName returns true for the paths starting with a Windows drive
+// letter, like C: (they are rejected on all platforms, as C:foo is not
+// relative to the root on Windows).
+func hasVolumeName(p string) bool {
+	if len(p) < 2 || p[1] != ':' {
+		return false
+	}
+	c := p[0]
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		unsafe string
+		out    string
+		ok     bool
+	}{
+		{"", "/srv/app", true},
+		{".", "/srv/app", true},
+		{"icon.svg", "/srv/app/icon.svg", true},
+		{"img/icon.svg", "/srv/app/img/icon.svg", true},
+		{"img//icon.svg", "/srv/app/img/icon.svg", true},
+		{"./img/./icon.svg", "/srv/app/img/icon.svg", true},
+		{"img/../icon.svg", "/srv/app/icon.svg", true},
+		{"img/", "/srv/app/img", true},
+		{"a/b/../../c", "/srv/app/c", true},
+		{"..foo/bar", "/srv/app/..foo/bar", true},
+		{"foo..", "/srv/app/foo..", true},
+		{"...", "/srv/app/...", true},
+		// The encoded dots are not decoded, they are just file names
+		{"%2e%2e/secret", "/srv/app/%2e%2e/secret", true},
+		{"%2e%2e%2fsecret", "/srv/app/%2e%2e%2fsecret", true},
+		{"img\\icon.svg", "/srv/app/img/icon.svg", true},
+		{"..", "", false},
+		{"../", "", false},
+		{"../secret", "", false},
+		{"img/../../secret", "", false},
+		{"a/b/../../../secret", "", false},
+		{"img//..//..//secret", "", false},
+		{"..\\secret", "", false},
+		{"img\\..\\..\\secret", "", false},
+		{"/etc/passwd", "", false},
+		{"//etc/passwd", "", false},
+		{"\\etc\\passwd", "", false},
+		{"C:\\Windows", "", false},
+		{"c:secret", "", false},
+		{"icon.svg\x00.png", "", false},
+	}
+	for _, test := range tests {
+		out, err := SafeJoin("/srv/app", test.unsafe)
+		if test.ok {
+			if assert.NoError(t, err, test.unsafe) {
+				assert.Equal(t, filepath.FromSlash(test.out), out, test.unsafe)
+			}
+		} else {
+			assert.Equal(t, ErrUnsafePath, err, test.unsafe)
+		}
+
+		out, err = SafeJoinSlash("/srv/app", test.unsafe)
+		if test.ok {
+			if assert.NoError(t, err, test.unsafe) {
+				assert.Equal(t, test.out, out, test.unsafe)
+			}
+		} else {
+			assert.Equal(t, ErrUnsafePath, err, test.unsafe)
+		}
+	}
+
+	out, err := SafeJoinSlash("/", "../app")
+	assert.Equal(t, ErrUnsafePath, err)
+	out, err = SafeJoinSlash("/", "app/icon.svg")
+	assert.NoError(t, err)
+	assert.Equal(t, "/app/icon.svg", out)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAlreadyShutdown is returned by Shutdown when it has already been called
+var ErrAlreadyShutdown = errors.New("Shutdown has already been called")
+
+// ShutdownGroup coordinates the stop of the components of the stack, like the
+// servers, the background goroutines and the caches. Each component registers
+// a stop function, and they are called in order of priority when the process
+// exits.
+type ShutdownGroup struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stoppers []*stopper
+	down     bool
+}
+
+type stopper struct {
+	name     string
+	priority int
+	timeout  time.Duration
+	stop     func(context.Context) error
+}
+
+// ShutdownError is returned by Shutdown when some stop functions have failed
+type ShutdownError struct {
+	// Errors has the error of each failed stop function, prefixed by its name
+	Errors []error
+}
+
+func (e *ShutdownError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "Shutdown failed: " + strings.Join(msgs, "; ")
+}
+
+// NewShutdownGroup returns an empty shutdown group
+func NewShutdownGroup() *ShutdownGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ShutdownGroup{ctx: ctx, cancel: cancel}
+}
+
+// Context returns a context that is canceled when the shutdown starts. It can
+// be used by the background goroutines to know that they should finish.
+func (g *ShutdownGroup) Context() context.Context {
+	return g.ctx
+}
+
+// Register adds a stop function. The functions with a lower priority are
+// called first, and the functions with the same priority are called in the
+// order of registration. The context given to stop is done after the timeout
+// (no timeout if zero), or when the deadline of the shutdown is reached.
+//
+// If the shutdown has already been done, stop is called immediately.
+func (g *ShutdownGroup) Register(name string, priority int, timeout time.Duration, stop func(context.Context) error) {
+	s := &stopper{name: name, priority: priority, timeout: timeout, stop: stop}
+	g.mu.Lock()
+	down := g.down
+	if !down {
+		g.stoppers = append(g.stoppers, s)
+	}
+	g.mu.Unlock()
+	if down {
+		s.run(context.Background())
+	}
+}
+
+// Shutdown cancels the context of the group, and calls the stop functions in
+// order. It returns a *ShutdownError with the errors of the functions that
+// have failed or have not returned before their timeout. A function that
+// doesn't return in time is not waited for, and the next ones are called.
+func (g *ShutdownGroup) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	if g.down {
+		g.mu.Unlock()
+		return ErrAlreadyShutdown
+	}
+	g.down = true
+	stoppers := g.stoppers
+	g.stoppers = nil
+	g.mu.Unlock()
+
+	g.cancel()
+	sort.Stable(byPriority(stoppers))
+	var errs []error
+	for _, s := range stoppers {
+		if err := s.run(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", s.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &ShutdownError{Errors: errs}
+	}
+	return nil
+}
+
+func (s *stopper) run(ctx context.Context) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() { done <- runTask(ctx, s.stop) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type byPriority []*stopper
+
+func (a byPriority) Len() int           { return len(a) }
+func (a byPriority) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPriority) Less(i, j int) bool { return a[i].priority < a[j].priority }
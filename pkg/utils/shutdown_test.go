@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownGroupOrder(t *testing.T) {
+	g := NewShutdownGroup()
+	var mu sync.Mutex
+	var order []string
+	stop := func(name string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	g.Register("caches", 20, time.Second, stop("caches"))
+	g.Register("http", 0, time.Second, stop("http"))
+	g.Register("installers", 10, time.Second, stop("installers"))
+	g.Register("jobs", 10, time.Second, stop("jobs"))
+
+	select {
+	case <-g.Context().Done():
+		t.Error("the context should not be canceled before the shutdown")
+	default:
+	}
+	assert.NoError(t, g.Shutdown(context.Background()))
+	assert.Equal(t, []string{"http", "installers", "jobs", "caches"}, order)
+	assert.Equal(t, context.Canceled, g.Context().Err())
+	assert.Equal(t, ErrAlreadyShutdown, g.Shutdown(context.Background()))
+
+	// A late registration is stopped immediately
+	g.Register("late", 0, time.Second, stop("late"))
+	assert.Equal(t, "late", order[len(order)-1])
+}
+
+func TestShutdownGroupErrors(t *testing.T) {
+	g := NewShutdownGroup()
+	g.Register("failing", 0, 0, func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+	g.Register("stuck", 1, 10*time.Millisecond, func(ctx context.Context) error {
+		select {}
+	})
+	g.Register("panicking", 2, 0, func(ctx context.Context) error {
+		panic("oops")
+	})
+	called := false
+	g.Register("ok", 3, 0, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+
+	start := time.Now()
+	err := g.Shutdown(context.Background())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, called)
+	if assert.IsType(t, &ShutdownError{}, err) {
+		errs := err.(*ShutdownError).Errors
+		if assert.Len(t, errs, 3) {
+			assert.Equal(t, "failing: boom", errs[0].Error())
+			assert.Equal(t, "stuck: context deadline exceeded", errs[1].Error())
+			assert.Equal(t, "panicking: panic: oops", errs[2].Error())
+		}
+		assert.Contains(t, err.Error(), "failing: boom; stuck")
+	}
+}
+
+func TestShutdownGroupDeadline(t *testing.T) {
+	g := NewShutdownGroup()
+	// The stop functions that wait for the context of the group
+	for i := 0; i < 5; i++ {
+		done := make(chan struct{})
+		go func() {
+			<-g.Context().Done()
+			close(done)
+		}()
+		g.Register("worker", 0, time.Minute, func(ctx context.Context) error {
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+	g.Register("slow", 1, time.Minute, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := g.Shutdown(ctx)
+	assert.True(t, time.Since(start) < time.Second)
+	if assert.IsType(t, &ShutdownError{}, err) {
+		assert.Len(t, err.(*ShutdownError).Errors, 1)
+	}
+}
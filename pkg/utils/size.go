@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidSize is returned by ParseSize for a malformed size
+	ErrInvalidSize = errors.New("Invalid size, expected a number with an optional unit like 20MB")
+	// ErrNegativeSize is returned by ParseSize for a negative size
+	ErrNegativeSize = errors.New("The size can't be negative")
+	// ErrSizeOverflow is returned by ParseSize for a size that doesn't fit in
+	// an int64
+	ErrSizeOverflow = errors.New("The size is too large")
+)
+
+// sizeUnits are the multipliers of the units accepted by ParseSize, with SI
+// (powers of 1000) and binary (powers of 1024) prefixes.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a human-readable size, like "20MB", "1.5 GiB" or "512", in
+// bytes. The units are case-insensitive: KB, MB and GB are powers of 1000, and
+// KiB, MiB and GiB (or just K, M and G) are powers of 1024. A size without a
+// unit is in bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "-") {
+		return 0, ErrNegativeSize
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	multiplier, ok := sizeUnits[unit]
+	if !ok || number == "" {
+		return 0, ErrInvalidSize
+	}
+
+	if !strings.Contains(number, ".") {
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+				return 0, ErrSizeOverflow
+			}
+			return 0, ErrInvalidSize
+		}
+		if n > math.MaxInt64/multiplier {
+			return 0, ErrSizeOverflow
+		}
+		return n * multiplier, nil
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, ErrInvalidSize
+	}
+	f = math.Floor(f * float64(multiplier))
+	// float64(math.MaxInt64) is rounded up to 2^63, which doesn't fit
+	if f >= math.MaxInt64 {
+		return 0, ErrSizeOverflow
+	}
+	return int64(f), nil
+}
+
+// formatUnits are the units used by FormatSize, from the largest one
+var formatUnits = []struct {
+	name string
+	size uint64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+}
+
+// FormatSize returns a human-readable size, like "312 MiB", for the error
+// messages and the logs. The sizes below 10 of a unit keep one decimal, like
+// "1.5 GiB". The units are binary, so that ParseSize gives back the size
+// (rounded).
+func FormatSize(n int64) string {
+	if n < 0 {
+		// -(n+1) doesn't overflow, even for math.MinInt64
+		return "-" + formatSize(uint64(-(n+1))+1)
+	}
+	return formatSize(uint64(n))
+}
+
+func formatSize(n uint64) string {
+	for _, unit := range formatUnits {
+		if n < unit.size {
+			continue
+		}
+		v := float64(n) / float64(unit.size)
+		var s string
+		if v < 10 {
+			s = strconv.FormatFloat(v, 'f', 1, 64)
+			s = strings.TrimSuffix(s, ".0")
+		} else {
+			s = strconv.FormatFloat(v, 'f', 0, 64)
+		}
+		return s + " " + unit.name
+	}
+	return strconv.FormatUint(n, 10) + " B"
+}
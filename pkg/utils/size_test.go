@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		err      error
+	}{
+		{"0", 0, nil},
+		{"512", 512, nil},
+		{"512B", 512, nil},
+		{"20MB", 20000000, nil},
+		{"20 MiB", 20 << 20, nil},
+		{"20m", 20 << 20, nil},
+		{"1KB", 1000, nil},
+		{"1kib", 1024, nil},
+		{" 1.5GiB ", 3 << 29, nil},
+		{"1.5GB", 1500000000, nil},
+		{"0.5 KiB", 512, nil},
+		{".5K", 512, nil},
+		{"1.0001B", 1, nil},
+		{"2TB", 2000000000000, nil},
+		{"9223372036854775807", math.MaxInt64, nil},
+
+		{"", 0, ErrInvalidSize},
+		{"MB", 0, ErrInvalidSize},
+		{"20 XB", 0, ErrInvalidSize},
+		{"1.2.3MB", 0, ErrInvalidSize},
+		{"1e3", 0, ErrInvalidSize},
+		{"20 MB extra", 0, ErrInvalidSize},
+		{"-1", 0, ErrNegativeSize},
+		{" -20MB", 0, ErrNegativeSize},
+		{"9223372036854775808", 0, ErrSizeOverflow},
+		{"8388608TiB", 0, ErrSizeOverflow},
+		{"8388608.5TiB", 0, ErrSizeOverflow},
+		{"99999999999999999999.5", 0, ErrSizeOverflow},
+	}
+	for _, test := range tests {
+		size, err := ParseSize(test.input)
+		assert.Equal(t, test.err, err, test.input)
+		assert.Equal(t, test.expected, size, test.input)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1 KiB"},
+		{1536, "1.5 KiB"},
+		{10*1024 - 1, "10 KiB"},
+		{100 << 20, "100 MiB"},
+		{312<<20 + 12345, "312 MiB"},
+		{3 << 29, "1.5 GiB"},
+		{2 << 40, "2 TiB"},
+		{-1536, "-1.5 KiB"},
+		{math.MinInt64, "-8388608 TiB"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, FormatSize(test.size))
+	}
+
+	// ParseSize gives back the formatted sizes
+	for _, size := range []int64{0, 1024, 1536, 100 << 20, 3 << 29} {
+		parsed, err := ParseSize(FormatSize(size))
+		assert.NoError(t, err)
+		assert.Equal(t, size, parsed)
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+type clockKey struct{}
+
+// ContextWithClock returns a context that carries a clock, used by SleepCtx,
+// WithDeadline and Every instead of the real clock. It is mostly useful for
+// the tests, with a FakeClock.
+func ContextWithClock(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, clock)
+}
+
+// ClockFromContext returns the clock carried by the context, or the real
+// clock if there is none.
+func ClockFromContext(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return clock
+	}
+	return RealClock
+}
+
+// SleepCtx waits for the given duration, or until the context is done. In
+// this case, it returns the error of the context.
+func SleepCtx(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := ClockFromContext(ctx).NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithDeadline calls fn, but gives up if it has not returned after the given
+// duration: context.DeadlineExceeded is returned, and the context given to fn
+// is canceled so that it can stop. It also gives up if the parent context is
+// done, with its error.
+func WithDeadline(ctx context.Context, d time.Duration, fn func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := ClockFromContext(ctx).NewTimer(d)
+	defer timer.Stop()
+	done := make(chan error, 1)
+	go func() { done <- runTask(ctx, fn) }()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.Chan():
+		return context.DeadlineExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Every calls fn after each interval, until the context is done or fn returns
+// an error. It returns the error of fn or of the context.
+func Every(ctx context.Context, interval time.Duration, fn func(context.Context) error) error {
+	for {
+		if err := SleepCtx(ctx, interval); err != nil {
+			return err
+		}
+		if err := fn(ctx); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockFromContext(t *testing.T) {
+	assert.Equal(t, RealClock, ClockFromContext(context.Background()))
+	clock := NewFakeClock(epoch)
+	ctx := ContextWithClock(context.Background(), clock)
+	assert.Equal(t, clock, ClockFromContext(ctx))
+}
+
+func TestSleepCtx(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	ctx, cancel := context.WithCancel(ContextWithClock(context.Background(), clock))
+	done := make(chan error)
+	go func() { done <- SleepCtx(ctx, time.Hour) }()
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	assert.NoError(t, <-done)
+
+	go func() { done <- SleepCtx(ctx, time.Hour) }()
+	clock.BlockUntil(1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	// A done context returns immediately
+	assert.Equal(t, context.Canceled, SleepCtx(ctx, time.Hour))
+}
+
+func TestWithDeadline(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	ctx := ContextWithClock(context.Background(), clock)
+	errFoo := errors.New("foo")
+	assert.Equal(t, errFoo, WithDeadline(ctx, time.Minute, func(ctx context.Context) error {
+		return errFoo
+	}))
+
+	stopped := make(chan error, 1)
+	done := make(chan error)
+	go func() {
+		done <- WithDeadline(ctx, time.Minute, func(ctx context.Context) error {
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return nil
+		})
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+	assert.Equal(t, context.Canceled, <-stopped)
+
+	parent, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, WithDeadline(parent, time.Minute, func(ctx context.Context) error {
+		select {}
+	}))
+}
+
+func TestEvery(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	ctx, cancel := context.WithCancel(ContextWithClock(context.Background(), clock))
+	ticks := make(chan time.Time)
+	done := make(chan error)
+	go func() {
+		done <- Every(ctx, time.Second, func(ctx context.Context) error {
+			ticks <- clock.Now()
+			return nil
+		})
+	}()
+	for i := 1; i <= 3; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		assert.Equal(t, epoch.Add(time.Duration(i)*time.Second), <-ticks)
+	}
+	clock.BlockUntil(1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	errFoo := errors.New("foo")
+	go func() {
+		done <- Every(ContextWithClock(context.Background(), clock), time.Second, func(ctx context.Context) error {
+			return errFoo
+		})
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	assert.Equal(t, errFoo, <-done)
+}
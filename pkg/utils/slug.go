@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+const (
+	// MinSlugLength is the minimal length of a slug
+	MinSlugLength = 2
+	// MaxSlugLength is the maximal length of a slug: it is used as a label of
+	// a domain name, which can't be longer than 63 characters
+	MaxSlugLength = 63
+)
+
+// ErrInvalidSlug is returned when a slug doesn't follow the rules of
+// ValidateSlug
+var ErrInvalidSlug = errors.New("Invalid slug name")
+
+// reservedSlugs are the names that can't be used as slugs, as they have a
+// special meaning in the routes of the applications, like the fixed segments
+// of the /apps and /konnectors routes that would shadow an application
+var reservedSlugs = map[string]bool{
+	"icon":          true,
+	"manifest":      true,
+	"updates":       true,
+	"categories":    true,
+	"_capabilities": true,
+	"_summary":      true,
+}
+
+// ValidateSlug checks that a slug can be used as the name of an application:
+// it must have between MinSlugLength and MaxSlugLength characters, which are
+// lowercase letters, digits and hyphens, it must not start or end with a
+// hyphen, and it must not be a reserved name.
+func ValidateSlug(slug string) error {
+	if len(slug) < MinSlugLength || len(slug) > MaxSlugLength {
+		return ErrInvalidSlug
+	}
+	if slug[0] == '-' || slug[len(slug)-1] == '-' {
+		return ErrInvalidSlug
+	}
+	for i := 0; i < len(slug); i++ {
+		c := slug[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ErrInvalidSlug
+		}
+	}
+	if reservedSlugs[slug] {
+		return ErrInvalidSlug
+	}
+	return nil
+}
+
+// slugTransliterations are the replacements of the accented letters for
+// Slugify
+var slugTransliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i",
+	'î': "i", 'ï': "i", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o",
+	'ö': "o", 'ø': "o", 'œ': "oe", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'ÿ': "y", 'ß': "ss",
+}
+
+// Slugify returns a valid slug for the given display name, like
+// "my-photos" for "My Photos!".
+func Slugify(name string) string {
+	var b bytes.Buffer
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		s := slugTransliterations[r]
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			s = string(r)
+		}
+		if s == "" {
+			hyphen = b.Len() > 0
+			continue
+		}
+		if hyphen {
+			b.WriteByte('-')
+			hyphen = false
+		}
+		b.WriteString(s)
+	}
+	slug := b.String()
+	if len(slug) > MaxSlugLength {
+		slug = strings.TrimRight(slug[:MaxSlugLength], "-")
+	}
+	if slug == "" {
+		return "app"
+	}
+	if len(slug) < MinSlugLength || reservedSlugs[slug] {
+		slug += "-app"
+	}
+	return slug
+}
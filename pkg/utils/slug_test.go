@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSlug(t *testing.T) {
+	valids := []string{"mini", "photos", "cozy-collect", "app2", "42", "a1", strings.Repeat("a", 63)}
+	for _, slug := range valids {
+		assert.NoError(t, ValidateSlug(slug), slug)
+	}
+
+	invalids := []string{
+		"", "a", strings.Repeat("a", 64),
+		"Mini", "mini app", "mini_app", "mini/", "../mini", "café",
+		"-mini", "mini-", "-",
+		"icon", "manifest", "updates", "categories", "_capabilities", "_summary",
+	}
+	for _, slug := range invalids {
+		assert.Equal(t, ErrInvalidSlug, ValidateSlug(slug), slug)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"My Photos!", "my-photos"},
+		{"  Cozy   Collect  ", "cozy-collect"},
+		{"Éditeur de texte", "editeur-de-texte"},
+		{"Œuvres & Cœur", "oeuvres-coeur"},
+		{"mini_app.v2", "mini-app-v2"},
+		{"Icon", "icon-app"},
+		{"Categories", "categories-app"},
+		{"X", "x-app"},
+		{"!!!", "app"},
+		{"日本", "app"},
+		{strings.Repeat("ab-", 40), strings.TrimRight(strings.Repeat("ab-", 21), "-")},
+	}
+	for _, test := range tests {
+		slug := Slugify(test.name)
+		assert.Equal(t, test.expected, slug, test.name)
+		assert.NoError(t, ValidateSlug(slug), test.name)
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+)
+
+// StringSet is a set of strings. Its zero value is not usable, NewStringSet
+// must be used to create one.
+type StringSet map[string]struct{}
+
+// NewStringSet returns a set with the given items
+func NewStringSet(items ...string) StringSet {
+	s := make(StringSet, len(items))
+	s.Add(items...)
+	return s
+}
+
+// Add adds the items to the set
+func (s StringSet) Add(items ...string) {
+	for _, item := range items {
+		s[item] = struct{}{}
+	}
+}
+
+// Has returns true if the item is in the set
+func (s StringSet) Has(item string) bool {
+	_, ok := s[item]
+	return ok
+}
+
+// Delete removes the items from the set
+func (s StringSet) Delete(items ...string) {
+	for _, item := range items {
+		delete(s, item)
+	}
+}
+
+// Len returns the number of items in the set
+func (s StringSet) Len() int {
+	return len(s)
+}
+
+// ToSortedSlice returns the items of the set, sorted
+func (s StringSet) ToSortedSlice() []string {
+	items := make([]string, 0, len(s))
+	for item := range s {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// UniqueStrings returns the strings without the duplicates, in the order of
+// their first occurrence. Like Intersect and Difference, it keeps the order of
+// its input so that the results are stable, and it never returns nil, so that
+// the result is encoded as [] in JSON.
+func UniqueStrings(items []string) []string {
+	seen := make(StringSet, len(items))
+	unique := make([]string, 0, len(items))
+	for _, item := range items {
+		if !seen.Has(item) {
+			seen.Add(item)
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+// Intersect returns the unique strings of a that are also in b
+func Intersect(a, b []string) []string {
+	inB := NewStringSet(b...)
+	result := []string{}
+	for _, item := range UniqueStrings(a) {
+		if inB.Has(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Difference returns the unique strings of a that are not in b
+func Difference(a, b []string) []string {
+	inB := NewStringSet(b...)
+	result := []string{}
+	for _, item := range UniqueStrings(a) {
+		if !inB.Has(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ContainsFold returns true if the list contains the string, ignoring the
+// case.
+func ContainsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringSet(t *testing.T) {
+	s := NewStringSet("io.cozy.files", "io.cozy.contacts", "io.cozy.files")
+	assert.Equal(t, 2, s.Len())
+	assert.True(t, s.Has("io.cozy.files"))
+	assert.False(t, s.Has("io.cozy.jobs"))
+
+	s.Add("io.cozy.jobs", "io.cozy.apps")
+	s.Delete("io.cozy.contacts", "io.cozy.unknown")
+	assert.Equal(t, []string{"io.cozy.apps", "io.cozy.files", "io.cozy.jobs"}, s.ToSortedSlice())
+	assert.Equal(t, []string{}, NewStringSet().ToSortedSlice())
+}
+
+func TestSliceOperations(t *testing.T) {
+	a := []string{"c", "a", "b", "a", "d"}
+	b := []string{"d", "b", "e"}
+	assert.Equal(t, []string{"c", "a", "b", "d"}, UniqueStrings(a))
+	assert.Equal(t, []string{"b", "d"}, Intersect(a, b))
+	assert.Equal(t, []string{"c", "a"}, Difference(a, b))
+	assert.Equal(t, []string{"e"}, Difference(b, a))
+
+	// The results are never nil
+	for _, result := range [][]string{UniqueStrings(nil), Intersect(a, nil), Difference(nil, b)} {
+		j, _ := json.Marshal(result)
+		assert.Equal(t, "[]", string(j))
+	}
+}
+
+func TestContainsFold(t *testing.T) {
+	assert.True(t, ContainsFold([]string{"https", "Git"}, "GIT"))
+	assert.False(t, ContainsFold([]string{"https", "git"}, "http"))
+	assert.False(t, ContainsFold(nil, ""))
+}
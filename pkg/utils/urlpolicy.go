@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrURLInvalid is returned when the URL can't be parsed or has no host
+	ErrURLInvalid = errors.New("Invalid URL")
+	// ErrURLScheme is returned when the scheme of the URL is not allowed
+	ErrURLScheme = errors.New("The scheme of the URL is not allowed")
+	// ErrURLUserinfo is returned when the URL has a user or a password, and it
+	// is not allowed
+	ErrURLUserinfo = errors.New("The URL must not have credentials")
+	// ErrURLHostNotAllowed is returned when the host doesn't match the allowed
+	// hosts
+	ErrURLHostNotAllowed = errors.New("The host of the URL is not allowed")
+	// ErrURLHostBlocked is returned when the host matches a blocked host
+	ErrURLHostBlocked = errors.New("The host of the URL is blocked")
+	// ErrURLPrivateIP is returned when the host is, or resolves to, a private
+	// IP address, and it is not allowed
+	ErrURLPrivateIP = errors.New("The URL targets a private address")
+	// ErrURLLoopbackIP is returned when the host is, or resolves to, a
+	// loopback IP address, and it is not allowed
+	ErrURLLoopbackIP = errors.New("The URL targets a loopback address")
+	// ErrURLUnresolvable is returned when the host can't be resolved to check
+	// its IP addresses
+	ErrURLUnresolvable = errors.New("The host of the URL can't be resolved")
+)
+
+// URLPolicy describes the URLs accepted by ValidateURL
+type URLPolicy struct {
+	// Schemes are the allowed schemes (all the schemes if empty)
+	Schemes []string
+	// AllowedHosts are globs for the allowed hosts, like "*.cozy.io" (all the
+	// hosts if empty)
+	AllowedHosts []string
+	// BlockedHosts are globs for the hosts that are refused, even if they
+	// match AllowedHosts
+	BlockedHosts []string
+	// AllowPrivate allows the private, link-local and unspecified addresses
+	AllowPrivate bool
+	// AllowLoopback allows the loopback addresses, like 127.0.0.1
+	AllowLoopback bool
+	// AllowUserinfo allows a user and a password in the URL
+	AllowUserinfo bool
+}
+
+// lookupIP resolves a hostname. It is a variable for the tests.
+var lookupIP = net.LookupIP
+
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+var loopbackNetworks = parseCIDRs(
+	"127.0.0.0/8",
+	"::1/128",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// urlHostname returns the host of the URL, without the port and the brackets
+// of an IPv6 address.
+// TODO use u.Hostname() when we will no longer support go 1.7
+func urlHostname(u *url.URL) string {
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// ValidateURL parses a URL and checks it against the policy. The errors are
+// the ErrURL* variables, so that the callers can tell which rule has been
+// violated.
+//
+// When the private or the loopback addresses are not allowed, a hostname is
+// resolved to check its addresses. Note that it doesn't protect against a DNS
+// server that would give another address when the URL is really used: the
+// address of the connection can be checked with CheckIP for that.
+func ValidateURL(raw string, policy URLPolicy) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || urlHostname(u) == "" {
+		return nil, ErrURLInvalid
+	}
+	if len(policy.Schemes) > 0 && !ContainsFold(policy.Schemes, u.Scheme) {
+		return nil, ErrURLScheme
+	}
+	if u.User != nil && !policy.AllowUserinfo {
+		return nil, ErrURLUserinfo
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(urlHostname(u), "."))
+	if len(policy.AllowedHosts) > 0 && !matchHost(policy.AllowedHosts, host) {
+		return nil, ErrURLHostNotAllowed
+	}
+	if matchHost(policy.BlockedHosts, host) {
+		return nil, ErrURLHostBlocked
+	}
+
+	if policy.AllowPrivate && policy.AllowLoopback {
+		return u, nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = lookupIP(host); err != nil || len(ips) == 0 {
+			return nil, ErrURLUnresolvable
+		}
+	}
+	for _, ip := range ips {
+		if err = CheckIP(ip, policy); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// CheckIP checks an IP address against the private and loopback rules of the
+// policy. It returns ErrURLLoopbackIP or ErrURLPrivateIP if the address is
+// not allowed.
+func CheckIP(ip net.IP, policy URLPolicy) error {
+	if !policy.AllowLoopback && inNetworks(loopbackNetworks, ip) {
+		return ErrURLLoopbackIP
+	}
+	if !policy.AllowPrivate && inNetworks(privateNetworks, ip) {
+		return ErrURLPrivateIP
+	}
+	return nil
+}
+
+func matchHost(globs []string, host string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(strings.ToLower(glob), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
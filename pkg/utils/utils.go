@@ -1,36 +1,16 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
 )
 
-func init() {
-	// So that we do not generate the same IDs upon restart
-	rand.Seed(time.Now().UTC().UnixNano())
-}
-
-// RandomString returns a string of random alpha characters of the specified
-// length.
-//
-// TODO(optim): check the usage of the global locked rng does not become a
-// bottleneck.
-func RandomString(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, n)
-	lenLetters := len(letters)
-	for i := 0; i < n; i++ {
-		b[i] = letters[rand.Intn(lenLetters)]
-	}
-	return string(b)
-}
-
 // StripPort extract the domain name from a domain:port string.
 func StripPort(domain string) string {
 	if strings.Contains(domain, ":") {
@@ -93,35 +73,130 @@ func DirExists(name string) (bool, error) {
 	return true, nil
 }
 
-// UserHomeDir returns the user's home directory
+// UserHomeDir returns the user's home directory. If the environment variables
+// are empty (like for some init systems), the home directory of the current
+// user from the system is used.
 func UserHomeDir() string {
+	var home string
 	if runtime.GOOS == "windows" {
-		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
+		home = os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
 		if home == "" {
 			home = os.Getenv("USERPROFILE")
 		}
-		return home
+	} else {
+		home = os.Getenv("HOME")
 	}
-	return os.Getenv("HOME")
+	if home == "" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+	return home
 }
 
-// AbsPath returns an absolute path relative.
-func AbsPath(inPath string) string {
-	if strings.HasPrefix(inPath, "~") {
-		inPath = UserHomeDir() + inPath[len("~"):]
-	} else if strings.HasPrefix(inPath, "$HOME") {
-		inPath = UserHomeDir() + inPath[len("$HOME"):]
+// AbsPath returns the absolute and cleaned path of inPath, after the
+// expansion of the ~ prefix (or ~username on Unix) and of the environment
+// variables ($VAR or ${VAR}, and %VAR% on Windows). An error is returned if a
+// variable or a user is not defined.
+func AbsPath(inPath string) (string, error) {
+	inPath, err := expandTilde(inPath)
+	if err != nil {
+		return "", err
+	}
+
+	if runtime.GOOS == "windows" {
+		if inPath, err = expandPercentVars(inPath); err != nil {
+			return "", err
+		}
 	}
 
-	if strings.HasPrefix(inPath, "$") {
-		end := strings.Index(inPath, string(os.PathSeparator))
-		inPath = os.Getenv(inPath[1:end]) + inPath[end:]
+	inPath = os.Expand(inPath, func(name string) string {
+		if name == "HOME" {
+			if home := UserHomeDir(); home != "" {
+				return home
+			}
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("Environment variable %s is not defined", name)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
 	}
 
 	p, err := filepath.Abs(inPath)
-	if err == nil {
-		return filepath.Clean(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(p), nil
+}
+
+// expandTilde replaces the ~ prefix by the home directory of the current
+// user, and ~username by the home directory of this user (not on Windows).
+func expandTilde(inPath string) (string, error) {
+	if !strings.HasPrefix(inPath, "~") {
+		return inPath, nil
 	}
+	end := strings.IndexAny(inPath, "/"+string(os.PathSeparator))
+	if end < 0 {
+		end = len(inPath)
+	}
+	if end == 1 {
+		home := UserHomeDir()
+		if home == "" {
+			return "", errors.New("The home directory is unknown")
+		}
+		return home + inPath[end:], nil
+	}
+	if runtime.GOOS == "windows" {
+		return inPath, nil
+	}
+	name := inPath[1:end]
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("Unknown user %s", name)
+	}
+	return u.HomeDir + inPath[end:], nil
+}
 
-	return ""
+// expandPercentVars replaces the %VAR% references, as written on Windows, by
+// the values of the environment variables. A lone % is kept as is.
+func expandPercentVars(inPath string) (string, error) {
+	var buf []byte
+	for {
+		start := strings.Index(inPath, "%")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(inPath[start+1:], "%")
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		name := inPath[start+1 : end]
+		if name == "" || strings.ContainsAny(name, "/\\") {
+			buf = append(buf, inPath[:end]...)
+			inPath = inPath[end:]
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not defined", name)
+		}
+		buf = append(buf, inPath[:start]...)
+		buf = append(buf, value...)
+		inPath = inPath[end+1:]
+	}
+	return string(buf) + inPath, nil
+}
+
+// MustAbsPath is like AbsPath, but panics if the path can't be resolved.
+func MustAbsPath(inPath string) string {
+	p, err := AbsPath(inPath)
+	if err != nil {
+		panic(err)
+	}
+	return p
 }
@@ -1,8 +1,10 @@
 package utils
 
 import (
-	"math/rand"
 	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 
@@ -10,11 +12,11 @@ import (
 )
 
 func TestRandomString(t *testing.T) {
-	rand.Seed(42)
+	rng.Seed(42)
 	s1 := RandomString(10)
 	s2 := RandomString(20)
 
-	rand.Seed(42)
+	rng.Seed(42)
 	s3 := RandomString(10)
 	s4 := RandomString(20)
 
@@ -92,16 +94,113 @@ func TestFileExists(t *testing.T) {
 func TestAbsPath(t *testing.T) {
 	home := UserHomeDir()
 	assert.NotEmpty(t, home)
-	assert.Equal(t, home, AbsPath("~"))
-	foo := AbsPath("foo")
 	wd, _ := os.Getwd()
-	assert.Equal(t, wd+"/foo", foo)
-	bar := AbsPath("~/bar")
-	assert.Equal(t, home+"/bar", bar)
-	baz := AbsPath("$HOME/baz")
-	assert.Equal(t, home+"/baz", baz)
-	qux := AbsPath("/qux")
-	assert.Equal(t, "/qux", qux)
-	quux := AbsPath("////qux//quux/../quux")
-	assert.Equal(t, "/qux/quux", quux)
+	os.Setenv("COZY_TEST_DIR", "/var/lib/cozy")
+	os.Setenv("COZY_TEST_NESTED", "/var/lib/cozy/$COZY_TEST_DIR")
+	os.Setenv("COZY_TEST_EMPTY", "")
+	defer os.Unsetenv("COZY_TEST_DIR")
+	defer os.Unsetenv("COZY_TEST_NESTED")
+	defer os.Unsetenv("COZY_TEST_EMPTY")
+
+	backslash := "/var/lib/cozy\\apps"
+	if runtime.GOOS == "windows" {
+		backslash = "/var/lib/cozy/apps"
+	}
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"~", home},
+		{"~/bar", home + "/bar"},
+		{"foo", wd + "/foo"},
+		{"$HOME", home},
+		{"$HOME/baz", home + "/baz"},
+		{"${HOME}/baz", home + "/baz"},
+		{"/qux", "/qux"},
+		{"////qux//quux/../quux", "/qux/quux"},
+		{"$COZY_TEST_DIR", "/var/lib/cozy"},
+		{"${COZY_TEST_DIR}", "/var/lib/cozy"},
+		{"$COZY_TEST_DIR/apps", "/var/lib/cozy/apps"},
+		{"/srv/${COZY_TEST_DIR}/apps", "/srv/var/lib/cozy/apps"},
+		{"${COZY_TEST_DIR}apps", "/var/lib/cozyapps"},
+		{"$COZY_TEST_DIR/../data", "/var/lib/data"},
+		{"$COZY_TEST_DIR\\apps", backslash},
+		{"$COZY_TEST_NESTED", "/var/lib/cozy/$COZY_TEST_DIR"},
+		{"/foo$COZY_TEST_EMPTY/bar", "/foo/bar"},
+	}
+	for _, test := range tests {
+		out, err := AbsPath(test.in)
+		if assert.NoError(t, err, test.in) {
+			assert.Equal(t, filepath.FromSlash(test.out), out, test.in)
+		}
+	}
+
+	_, err := AbsPath("$COZY_TEST_UNDEFINED/foo")
+	assert.Error(t, err)
+	_, err = AbsPath("/foo/${COZY_TEST_UNDEFINED}")
+	assert.Error(t, err)
+	assert.Panics(t, func() { MustAbsPath("$COZY_TEST_UNDEFINED") })
+	assert.Equal(t, "/qux", MustAbsPath("/qux"))
+}
+
+func TestExpandPercentVars(t *testing.T) {
+	os.Setenv("COZY_TEST_PROFILE", `C:\Users\cozy`)
+	defer os.Unsetenv("COZY_TEST_PROFILE")
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`%COZY_TEST_PROFILE%\.cozy`, `C:\Users\cozy\.cozy`},
+		{`%COZY_TEST_PROFILE%`, `C:\Users\cozy`},
+		{`D:\%COZY_TEST_PROFILE%%COZY_TEST_PROFILE%`, `D:\C:\Users\cozyC:\Users\cozy`},
+		{`C:\100%\foo`, `C:\100%\foo`},
+		{`C:\100%\foo%bar`, `C:\100%\foo%bar`},
+		{`%%`, `%%`},
+		{`no vars`, `no vars`},
+	}
+	for _, test := range tests {
+		out, err := expandPercentVars(test.in)
+		if assert.NoError(t, err, test.in) {
+			assert.Equal(t, test.out, out, test.in)
+		}
+	}
+	_, err := expandPercentVars(`%COZY_TEST_UNDEFINED%\foo`)
+	assert.Error(t, err)
+}
+
+func TestAbsPathUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("~username is not expanded on Windows")
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("the current user is unknown")
+	}
+	p, err := AbsPath("~" + u.Username + "/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(u.HomeDir, "foo"), p)
+	p, err = AbsPath("~" + u.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Clean(u.HomeDir), p)
+	_, err = AbsPath("~cozy-no-such-user/foo")
+	assert.Error(t, err)
+}
+
+func TestUserHomeDirFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fallback is tested on Unix")
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("the current user is unknown")
+	}
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "")
+	assert.Equal(t, u.HomeDir, UserHomeDir())
+	p, err := AbsPath("~/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(u.HomeDir, "foo"), p)
 }
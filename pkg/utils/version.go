@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidVersion is returned when a version can't be parsed
+	ErrInvalidVersion = errors.New("Invalid version")
+	// ErrInvalidVersionConstraint is returned when a version constraint can't
+	// be parsed
+	ErrInvalidVersionConstraint = errors.New("Invalid version constraint")
+)
+
+// Version is a semantic version, like 3.1.2-beta.4
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease []string
+	Build      string
+}
+
+// ParseVersion parses a semantic version. As the manifests of the
+// applications are not always strict, it accepts a leading "v" and missing
+// minor or patch numbers: "v1.2" is the same as "1.2.0".
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	s = strings.TrimSpace(s)
+	if len(s) > 0 && (s[0] == 'v' || s[0] == 'V') {
+		s = s[1:]
+	}
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		if !validIdentifiers(v.Build) {
+			return Version{}, ErrInvalidVersion
+		}
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		pre := s[i+1:]
+		s = s[:i]
+		if !validIdentifiers(pre) {
+			return Version{}, ErrInvalidVersion
+		}
+		v.Prerelease = strings.Split(pre, ".")
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, ErrInvalidVersion
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		if !isNumeric(part) {
+			return Version{}, ErrInvalidVersion
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Version{}, ErrInvalidVersion
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+// String returns the canonical form of the version
+func (v Version) String() string {
+	s := strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor) + "." + strconv.Itoa(v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if the version is lower than, equal to or
+// greater than the other version, with the precedence rules of semver: a
+// prerelease is lower than the release, and the build metadata are ignored.
+func (v Version) Compare(other Version) int {
+	if c := compareInts(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+	return comparePrereleases(v.Prerelease, other.Prerelease)
+}
+
+// LessThan returns true if the version is lower than the other version
+func (v Version) LessThan(other Version) bool {
+	return v.Compare(other) < 0
+}
+
+// MatchesConstraint returns true if the version satisfies the constraint. A
+// constraint is a list of comparisons that must all be true, like
+// ">=1.2.0 <2.0.0", and several constraints can be separated by "||". The
+// operators are =, !=, >, >=, <, <=, ~ (same minor version) and ^ (same major
+// version, or same minor version for 0.x versions).
+func (v Version) MatchesConstraint(constraint string) (bool, error) {
+	var alternatives [][]constraintTerm
+	for _, alternative := range strings.Split(constraint, "||") {
+		terms, err := parseConstraintTerms(alternative)
+		if err != nil {
+			return false, err
+		}
+		alternatives = append(alternatives, terms)
+	}
+	for _, terms := range alternatives {
+		ok := true
+		for _, term := range terms {
+			if !term.matches(v) {
+				ok = false
+			}
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type constraintTerm struct {
+	op      string
+	version Version
+}
+
+var constraintOperators = []string{">=", "<=", "!=", "==", ">", "<", "=", "~", "^"}
+
+func parseConstraintTerms(s string) ([]constraintTerm, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, ErrInvalidVersionConstraint
+	}
+	var terms []constraintTerm
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		op := "="
+		for _, o := range constraintOperators {
+			if strings.HasPrefix(field, o) {
+				op = o
+				field = field[len(o):]
+				break
+			}
+		}
+		// ">= 1.2.0" is accepted like ">=1.2.0"
+		if field == "" && i+1 < len(fields) {
+			i++
+			field = fields[i]
+		}
+		version, err := ParseVersion(field)
+		if err != nil {
+			return nil, ErrInvalidVersionConstraint
+		}
+		terms = append(terms, constraintTerm{op, version})
+	}
+	return terms, nil
+}
+
+func (t constraintTerm) matches(v Version) bool {
+	c := v.Compare(t.version)
+	switch t.op {
+	case "=", "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "~":
+		upper := Version{Major: t.version.Major, Minor: t.version.Minor + 1}
+		return c >= 0 && v.LessThan(upper)
+	case "^":
+		upper := Version{Major: t.version.Major + 1}
+		if t.version.Major == 0 {
+			upper = Version{Minor: t.version.Minor + 1}
+		}
+		return c >= 0 && v.LessThan(upper)
+	}
+	return false
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func comparePrereleases(a, b []string) int {
+	// A version without prerelease has a higher precedence
+	if len(a) == 0 || len(b) == 0 {
+		return -compareInts(len(a), len(b))
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		aNum, bNum := isNumeric(a[i]), isNumeric(b[i])
+		switch {
+		case aNum && bNum:
+			x, _ := strconv.Atoi(a[i])
+			y, _ := strconv.Atoi(b[i])
+			if c := compareInts(x, y); c != 0 {
+				return c
+			}
+		case aNum:
+			return -1
+		case bNum:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validIdentifiers checks the dot-separated identifiers of a prerelease or
+// of build metadata
+func validIdentifiers(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, r := range id {
+			if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1.2.3", "1.2.3"},
+		{"v1.2.3", "1.2.3"},
+		{"V2.0.0", "2.0.0"},
+		{" 1.2.3 ", "1.2.3"},
+		{"1.2", "1.2.0"},
+		{"v3", "3.0.0"},
+		{"3.1.2-beta.4", "3.1.2-beta.4"},
+		{"1.0.0-rc1+build.42", "1.0.0-rc1+build.42"},
+		{"0.1.0-alpha-2", "0.1.0-alpha-2"},
+		{"1.0+20170601", "1.0.0+20170601"},
+	}
+	for _, test := range tests {
+		v, err := ParseVersion(test.input)
+		assert.NoError(t, err, test.input)
+		assert.Equal(t, test.expected, v.String(), test.input)
+	}
+
+	invalids := []string{"", "v", "latest", "1.2.3.4", "1..2", "1.2.x", "-1.0.0", "1.0.0-", "1.0.0-beta..1", "1.0.0+", "1.0.0-béta"}
+	for _, input := range invalids {
+		_, err := ParseVersion(input)
+		assert.Equal(t, ErrInvalidVersion, err, input)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// The example of semver.org, sorted by precedence
+	sorted := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.9.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i := range sorted {
+		a, err := ParseVersion(sorted[i])
+		assert.NoError(t, err)
+		for j := i + 1; j < len(sorted); j++ {
+			b, _ := ParseVersion(sorted[j])
+			assert.True(t, a.LessThan(b), sorted[i]+" < "+sorted[j])
+			assert.Equal(t, 1, b.Compare(a), sorted[j]+" > "+sorted[i])
+		}
+	}
+
+	a, _ := ParseVersion("v1.2")
+	b, _ := ParseVersion("1.2.0+build")
+	assert.Equal(t, 0, a.Compare(b))
+	assert.False(t, a.LessThan(b))
+	assert.False(t, b.LessThan(a))
+}
+
+func TestMatchesConstraint(t *testing.T) {
+	tests := []struct {
+		version    string
+		constraint string
+		expected   bool
+	}{
+		{"1.2.0", ">=1.2.0 <2.0.0", true},
+		{"1.9.9", ">=1.2.0 <2.0.0", true},
+		{"2.0.0", ">=1.2.0 <2.0.0", false},
+		{"1.1.9", ">=1.2.0 <2.0.0", false},
+		{"1.5.0", ">= 1.2.0 < 2.0.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "=v1.2.3", true},
+		{"1.2.3", "!=1.2.3", false},
+		{"1.2.3", ">1.2.3", false},
+		{"1.2.3", "<=1.2.3", true},
+		{"1.2.9", "~1.2.3", true},
+		{"1.3.0", "~1.2.3", false},
+		{"1.9.0", "^1.2.3", true},
+		{"2.0.0", "^1.2.3", false},
+		{"0.2.5", "^0.2.3", true},
+		{"0.3.0", "^0.2.3", false},
+		{"3.0.0", "<2.0.0 || >=3.0.0", true},
+		{"2.5.0", "<2.0.0 || >=3.0.0", false},
+		{"2.0.0-beta.1", "<2.0.0", true},
+	}
+	for _, test := range tests {
+		v, err := ParseVersion(test.version)
+		assert.NoError(t, err)
+		ok, err := v.MatchesConstraint(test.constraint)
+		assert.NoError(t, err, test.constraint)
+		assert.Equal(t, test.expected, ok, test.version+" "+test.constraint)
+	}
+
+	v, _ := ParseVersion("1.0.0")
+	for _, constraint := range []string{"", ">=", ">=foo", "1.0.0 ||", "~>1.0"} {
+		_, err := v.MatchesConstraint(constraint)
+		assert.Equal(t, ErrInvalidVersionConstraint, err, constraint)
+	}
+}
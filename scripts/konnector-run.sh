@@ -5,3 +5,4 @@ echo "COZY_DOMAIN=${COZY_DOMAIN}"
 echo "COZY_FIELDS=${COZY_FIELDS}"
 echo "COZY_CREDENTIALS=${COZY_CREDENTIALS}"
 echo "SLUG=${1}"
+echo "COZY_KONNECTOR_DIR=${COZY_KONNECTOR_DIR}"
@@ -4,27 +4,40 @@ package apps
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5" // #nosec
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/cozy-stack/web/sse"
 	"github.com/labstack/echo"
 )
 
 // JSMimeType is the content-type for javascript
 const JSMimeType = "application/javascript"
 
-const typeTextEventStream = "text/event-stream"
-
 // installHandler handles all POST /:slug request and tries to install
 // or update the application with the given Source.
 func installHandler(installerType apps.AppType) echo.HandlerFunc {
@@ -34,33 +47,49 @@ func installHandler(installerType apps.AppType) echo.HandlerFunc {
 		if err := permissions.AllowInstallApp(c, installerType, permissions.POST); err != nil {
 			return err
 		}
-		var w http.ResponseWriter
-		isEventStream := c.Request().Header.Get("Accept") == typeTextEventStream
+		var w *sse.Writer
+		isEventStream := c.Request().Header.Get("Accept") == sse.ContentType
+		if !isEventStream {
+			if _, err := jsonapi.Negotiate(c.Request()); err != nil {
+				return err
+			}
+		}
+		installContext, err := bindInstallContext(c, installerType)
+		if err != nil {
+			return err
+		}
 		if isEventStream {
-			w = c.Response().Writer
-			w.Header().Set("Content-Type", typeTextEventStream)
-			w.WriteHeader(200)
+			w = sse.NewWriter(c.Response().Writer)
 		}
 
 		inst, err := apps.NewInstaller(instance, instance.AppsFS(installerType),
 			&apps.InstallerOptions{
-				Operation: apps.Install,
-				Type:      installerType,
-				SourceURL: c.QueryParam("Source"),
-				Slug:      slug,
+				Operation:      apps.Install,
+				Type:           installerType,
+				SourceURL:      c.QueryParam("Source"),
+				Slug:           slug,
+				OfflineOk:      c.QueryParam("OfflineOk") == "true",
+				TermsAccepted:  c.QueryParam("TermsAccepted"),
+				InstallContext: installContext,
+				Subject:        permissions.InstallSubject(c),
+				SubDirectory:   c.QueryParam("SubDirectory"),
+				Strict:         c.QueryParam("Strict") == "true",
+				TakeOver:       c.QueryParam("TakeOver") == "true",
 			},
 		)
 		if err != nil {
 			if isEventStream {
 				var b []byte
 				if b, err = json.Marshal(err.Error()); err == nil {
-					writeStream(w, "error", string(b))
+					if err = w.Event("error", string(b)); err != nil {
+						log.Errorf("[apps] could not write the event stream: %v", err)
+					}
 				}
 			}
 			return wrapAppsError(err)
 		}
 
-		go inst.Install()
+		apps.RunInBackground(inst.Install)
 		return pollInstaller(c, isEventStream, w, slug, inst)
 	}
 }
@@ -75,39 +104,54 @@ func updateHandler(installerType apps.AppType) echo.HandlerFunc {
 			return err
 		}
 
-		var w http.ResponseWriter
-		isEventStream := c.Request().Header.Get("Accept") == typeTextEventStream
+		var w *sse.Writer
+		isEventStream := c.Request().Header.Get("Accept") == sse.ContentType
+		if !isEventStream {
+			if _, err := jsonapi.Negotiate(c.Request()); err != nil {
+				return err
+			}
+		}
+		installContext, err := bindInstallContext(c, installerType)
+		if err != nil {
+			return err
+		}
 		if isEventStream {
-			w = c.Response().Writer
-			w.Header().Set("Content-Type", typeTextEventStream)
-			w.WriteHeader(200)
+			w = sse.NewWriter(c.Response().Writer)
 		}
 
 		inst, err := apps.NewInstaller(instance, instance.AppsFS(installerType),
 			&apps.InstallerOptions{
-				Operation: apps.Update,
-				Type:      installerType,
-				Slug:      slug,
+				Operation:      apps.Update,
+				Type:           installerType,
+				Slug:           slug,
+				TermsAccepted:  c.QueryParam("TermsAccepted"),
+				InstallContext: installContext,
+				Subject:        permissions.InstallSubject(c),
+				Strict:         c.QueryParam("Strict") == "true",
+				IfMatch:        ifMatch(c),
 			},
 		)
 		if err != nil {
 			if isEventStream {
 				var b []byte
 				if b, err = json.Marshal(err.Error()); err == nil {
-					writeStream(w, "error", string(b))
+					if err = w.Event("error", string(b)); err != nil {
+						log.Errorf("[apps] could not write the event stream: %v", err)
+					}
 				}
 				return nil
 			}
 			return wrapAppsError(err)
 		}
 
-		go inst.Update()
+		apps.RunInBackground(inst.Update)
 		return pollInstaller(c, isEventStream, w, slug, inst)
 	}
 }
 
 // deleteHandler handles all DELETE /:slug used to delete an application with
-// the specified slug.
+// the specified slug. Like an install, the deletion runs in the background,
+// as removing the files of a large application can take a long time.
 func deleteHandler(installerType apps.AppType) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		instance := middlewares.GetInstance(c)
@@ -115,35 +159,291 @@ func deleteHandler(installerType apps.AppType) echo.HandlerFunc {
 		if err := permissions.AllowInstallApp(c, installerType, permissions.DELETE); err != nil {
 			return err
 		}
+
+		var w *sse.Writer
+		isEventStream := c.Request().Header.Get("Accept") == sse.ContentType
+		if isEventStream {
+			w = sse.NewWriter(c.Response().Writer)
+		}
+
 		inst, err := apps.NewInstaller(instance, instance.AppsFS(installerType),
 			&apps.InstallerOptions{
 				Operation: apps.Delete,
 				Type:      installerType,
 				Slug:      slug,
+				Force:     c.QueryParam("Force") == "true",
+				IamSure:   c.QueryParam("IamSure"),
+				IfMatch:   ifMatch(c),
 			},
 		)
 		if err != nil {
+			if isEventStream {
+				var b []byte
+				if b, err = json.Marshal(err.Error()); err == nil {
+					if err = w.Event("error", string(b)); err != nil {
+						log.Errorf("[apps] could not write the event stream: %v", err)
+					}
+				}
+				return nil
+			}
 			return wrapAppsError(err)
 		}
-		man, err := inst.Delete()
+
+		apps.RunInBackground(inst.Uninstall)
+		return pollInstaller(c, isEventStream, w, slug, inst)
+	}
+}
+
+// bulkDeletionType is the JSON-API type of the outcomes of a bulk delete
+const bulkDeletionType = "io.cozy.apps.deletions"
+
+// apiBulkDeletion is the outcome of the deletion of an application in a bulk
+// delete, as a JSON-API object
+type apiBulkDeletion struct {
+	*apps.BulkDeleteResult
+}
+
+func (d *apiBulkDeletion) ID() string                             { return d.Slug }
+func (d *apiBulkDeletion) Rev() string                            { return "" }
+func (d *apiBulkDeletion) DocType() string                        { return bulkDeletionType }
+func (d *apiBulkDeletion) SetID(_ string)                         {}
+func (d *apiBulkDeletion) SetRev(_ string)                        {}
+func (d *apiBulkDeletion) Relationships() jsonapi.RelationshipMap { return nil }
+func (d *apiBulkDeletion) Included() []jsonapi.Object             { return nil }
+func (d *apiBulkDeletion) Links() *jsonapi.LinksList              { return nil }
+
+// bulkDeleteHandler handles DELETE / requests, to delete the applications of
+// the slugs parameter, or all of them with all=true. The confirm parameter
+// must then be the domain of the instance. The protected applications are
+// only deleted if they are listed in the protected parameter.
+func bulkDeleteHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		if err := permissions.AllowInstallApp(c, installerType, permissions.DELETE); err != nil {
+			return err
+		}
+		opts := &apps.BulkDeleteOptions{
+			All:       c.QueryParam("all") == "true",
+			Protected: splitQueryList(c.QueryParam("protected")),
+			Force:     c.QueryParam("Force") == "true",
+		}
+		if opts.All {
+			if c.QueryParam("confirm") != instance.Domain {
+				return jsonapi.InvalidParameter("confirm",
+					errors.New("The domain of the instance must be given to delete all the applications"))
+			}
+		} else {
+			opts.Slugs = splitQueryList(c.QueryParam("slugs"))
+			if len(opts.Slugs) == 0 {
+				return jsonapi.InvalidParameter("slugs",
+					errors.New("The slugs of the applications to delete are missing"))
+			}
+		}
+		results, err := apps.BulkDelete(instance, instance.AppsFS(installerType), installerType, opts)
 		if err != nil {
 			return wrapAppsError(err)
 		}
-		return jsonapi.Data(c, http.StatusOK, man, nil)
+		objs := make([]jsonapi.Object, len(results))
+		for i, result := range results {
+			objs[i] = &apiBulkDeletion{result}
+		}
+		return jsonapi.DataList(c, http.StatusOK, objs, nil)
+	}
+}
+
+// splitQueryList splits a comma-separated list of a query parameter
+func splitQueryList(param string) []string {
+	var list []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
+
+// ifMatch returns the revision given in the If-Match header, if any, for the
+// IfMatch option of the installers. The `*` value matches any revision of an
+// installed application.
+func ifMatch(c echo.Context) string {
+	rev := c.Request().Header.Get("If-Match")
+	return strings.Trim(strings.TrimPrefix(rev, "W/"), `"`)
+}
+
+// withProgress adds the progress of an installer in the meta of the manifest
+// of an application, and the changes of the manifest and the figures of the
+// operation at the end of an update or an install. The links of the resource object point to the state of the operation, to
+// follow it.
+type withProgress struct {
+	apps.Manifest
+	progress    apps.Progress
+	operationID string
+	changes     []*apps.ManifestChange
+	warmUp      *apps.WarmUpReport
+	sync        *apps.SyncReport
+	metrics     *apps.OperationMetrics
+}
+
+func (m *withProgress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Manifest)
 }
 
-func pollInstaller(c echo.Context, isEventStream bool, w http.ResponseWriter, slug string, inst *apps.Installer) error {
+func (m *withProgress) Warnings() []string {
+	if w, ok := m.Manifest.(jsonapi.Warner); ok {
+		return w.Warnings()
+	}
+	return nil
+}
+
+func (m *withProgress) Progress() interface{} {
+	return m.progress
+}
+
+func (m *withProgress) OperationID() string {
+	return m.operationID
+}
+
+func (m *withProgress) Links() *jsonapi.LinksList {
+	links := m.Manifest.Links()
+	if links == nil || m.operationID == "" {
+		return links
+	}
+	base := links.Self
+	links.Self = base + "/state"
+	links.Events = base + "/events?operation_id=" + url.QueryEscape(m.operationID)
+	return links
+}
+
+func (m *withProgress) Changes() interface{} {
+	if len(m.changes) == 0 {
+		return nil
+	}
+	return m.changes
+}
+
+func (m *withProgress) WarmUp() interface{} {
+	if m.warmUp == nil {
+		return nil
+	}
+	return m.warmUp
+}
+
+func (m *withProgress) Sync() interface{} {
+	if m.sync == nil {
+		return nil
+	}
+	return m.sync
+}
+
+func (m *withProgress) LastOperationMetrics() interface{} {
+	if m.metrics == nil {
+		return nil
+	}
+	return m.metrics
+}
+
+// withLastOperation adds the figures of the last install or update of an
+// application in the meta of its resource object, as last_operation.
+type withLastOperation struct {
+	apps.Manifest
+}
+
+func (m *withLastOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Manifest)
+}
+
+func (m *withLastOperation) Warnings() []string {
+	if w, ok := m.Manifest.(jsonapi.Warner); ok {
+		return w.Warnings()
+	}
+	return nil
+}
+
+func (m *withLastOperation) LastOperationMetrics() interface{} {
+	if metrics := m.Manifest.LastOperation(); metrics != nil {
+		return metrics
+	}
+	return nil
+}
+
+// withLastExecution adds the result of the last execution of a konnector in
+// its attributes, as last_execution (null if it has never run).
+type withLastExecution struct {
+	apps.Manifest
+	result *apps.KonnectorResult
+}
+
+// lastExecution is the last_execution attribute of a konnector
+type lastExecution struct {
+	Date  time.Time `json:"date"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+}
+
+func (m *withLastExecution) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(m.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string]json.RawMessage
+	if err = json.Unmarshal(b, &attrs); err != nil {
+		return nil, err
+	}
+	var exec *lastExecution
+	if r := m.result; r != nil {
+		exec = &lastExecution{Date: r.Date, State: r.State, Error: r.Error}
+	}
+	if attrs["last_execution"], err = json.Marshal(exec); err != nil {
+		return nil, err
+	}
+	return json.Marshal(attrs)
+}
+
+func (m *withLastExecution) Warnings() []string {
+	if w, ok := m.Manifest.(jsonapi.Warner); ok {
+		return w.Warnings()
+	}
+	return nil
+}
+
+// withDisabled marks a konnector as disabled in its attributes, when the
+// konnectors are disabled on the instance, as they are still listed.
+type withDisabled struct {
+	apps.Manifest
+}
+
+func (m *withDisabled) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(m.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string]json.RawMessage
+	if err = json.Unmarshal(b, &attrs); err != nil {
+		return nil, err
+	}
+	attrs["disabled"] = json.RawMessage("true")
+	return json.Marshal(attrs)
+}
+
+func (m *withDisabled) Warnings() []string {
+	if w, ok := m.Manifest.(jsonapi.Warner); ok {
+		return w.Warnings()
+	}
+	return nil
+}
+
+func pollInstaller(c echo.Context, isEventStream bool, w *sse.Writer, slug string, inst *apps.Installer) error {
 	if !isEventStream {
 		man, _, err := inst.Poll()
 		if err != nil {
 			return wrapAppsError(err)
 		}
+		progress := inst.Progress()
 		go func() {
 			for {
 				_, done, err := inst.Poll()
 				if err != nil {
-					log.Errorf("[apps] %s could not be installed: %v", slug, err)
+					log.Errorf("[apps] the operation on %s has failed: %v", slug, err)
 					break
 				}
 				if done {
@@ -151,21 +451,68 @@ func pollInstaller(c echo.Context, isEventStream bool, w http.ResponseWriter, sl
 				}
 			}
 		}()
-		return jsonapi.Data(c, http.StatusAccepted, man, nil)
+		return sendData(c, http.StatusAccepted, &withProgress{
+			Manifest:    man,
+			progress:    progress,
+			operationID: inst.OperationID(),
+		})
 	}
 
+	// The stream is kept alive while the installer is working, as some steps
+	// can take a long time without any new state.
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	pinging := make(chan struct{})
+	go func() {
+		w.KeepAlive(ctx, sseHeartbeatInterval)
+		close(pinging)
+	}()
+	defer func() {
+		cancel()
+		<-pinging
+	}()
+
+	// When the client has gone away, the installer is still polled until it
+	// has finished, but nothing is written anymore.
+	gone := false
 	for {
-		man, done, err := inst.Poll()
+		man, progress, done, err := inst.PollThrottled(config.GetConfig().Apps.ProgressInterval)
 		if err != nil {
 			var b []byte
-			if b, err = json.Marshal(err.Error()); err == nil {
-				writeStream(w, "error", string(b))
+			if b, err = json.Marshal(err.Error()); err == nil && !gone {
+				err = w.Event("error", string(b))
+			}
+			if err != nil {
+				log.Errorf("[apps] could not write the event stream: %v", err)
 			}
 			break
 		}
-		buf := new(bytes.Buffer)
-		if err := jsonapi.WriteData(buf, man, nil); err == nil {
-			writeStream(w, "state", buf.String())
+		// Before the manifest has been read, only the progress can be sent
+		event, buf := "progress", new(bytes.Buffer)
+		if man == nil {
+			err = json.NewEncoder(buf).Encode(progress)
+		} else {
+			event = "state"
+			state := &withProgress{
+				Manifest:    man,
+				progress:    progress,
+				operationID: inst.OperationID(),
+			}
+			if done {
+				state.changes, state.warmUp = inst.Changes(), inst.WarmUp()
+				state.sync, state.metrics = inst.Sync(), man.LastOperation()
+			}
+			// A deleted application has no state to wait for
+			if done && man.State() == apps.Deleting {
+				event = "done"
+			}
+			err = jsonapi.WriteData(buf, state, nil)
+		}
+		if err == nil && !gone {
+			data := strings.TrimSuffix(buf.String(), "\n")
+			if err = w.Event(event, data); err != nil {
+				log.Errorf("[apps] could not write the event stream: %v", err)
+				gone = true
+			}
 		}
 		if done {
 			break
@@ -174,38 +521,756 @@ func pollInstaller(c echo.Context, isEventStream bool, w http.ResponseWriter, sl
 	return nil
 }
 
-func writeStream(w http.ResponseWriter, event string, b string) {
-	s := fmt.Sprintf("event: %s\r\ndata: %s\r\n\r\n", event, b)
-	_, err := w.Write([]byte(s))
+// sseHeartbeatInterval is the interval between two pings on the event
+// streams of the installations and updates
+const sseHeartbeatInterval = 15 * time.Second
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listHandler handles all GET / requests which can be used to list
+// installed applications.
+//
+// The type query parameter can be used to list the webapps (default), the
+// konnectors, or all of them. With all, the categories that can not be read
+// with the current permissions are skipped.
+func listHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	format, err := jsonapi.Negotiate(c.Request())
+	if err != nil {
+		return err
+	}
+
+	wantWebapps, wantKonnectors, skipForbidden, err := wantedTypes(c)
+	if err != nil {
+		return err
+	}
+
+	var docs []apps.Manifest
+	found := false
+	if wantWebapps {
+		if err := permissions.AllowWholeType(c, permissions.GET, consts.Apps); err != nil {
+			if !skipForbidden {
+				return err
+			}
+		} else {
+			webapps, err := apps.ListWebapps(instance)
+			if err != nil {
+				return wrapAppsError(err)
+			}
+			includeKonnectors := wantsInclude(c, "konnectors") && apps.KonnectorsEnabled(instance)
+			for _, d := range webapps {
+				d.Instance = instance
+				if includeKonnectors {
+					if err = d.IncludeKonnectors(instance); err != nil {
+						return err
+					}
+				}
+				docs = append(docs, d)
+			}
+			found = true
+		}
+	}
+	if wantKonnectors {
+		if err := permissions.AllowWholeType(c, permissions.GET, consts.Konnectors); err != nil {
+			if !skipForbidden {
+				return err
+			}
+		} else {
+			konnectors, err := apps.ListKonnectors(instance)
+			if err != nil {
+				return wrapAppsError(err)
+			}
+			var results map[string]*apps.KonnectorResult
+			includeJobs := c.QueryParam("include_jobs") != "false"
+			if includeJobs {
+				if results, err = apps.GetKonnectorResults(instance); err != nil {
+					return err
+				}
+			}
+			disabled := !apps.KonnectorsEnabled(instance)
+			for _, d := range konnectors {
+				if includeJobs {
+					d = &withLastExecution{d, results[d.Slug()]}
+				}
+				if disabled {
+					d = &withDisabled{d}
+				}
+				docs = append(docs, d)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	docs = filterManifests(c, docs)
+	sort.Sort(byID(docs))
+
+	total := len(docs)
+	docs, next, err := paginateManifests(c, docs)
 	if err != nil {
-		return
+		return err
 	}
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+
+	etag := listETag(docs, format, total)
+	c.Response().Header().Set("Etag", etag)
+	c.Response().Header().Add("Vary", echo.HeaderAccept)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
+
+	if format == jsonapi.PlainJSONContentType {
+		objs := make([]jsonapi.Object, len(docs))
+		for i, d := range docs {
+			objs[i] = jsonapi.Object(d)
+		}
+		return jsonapi.PlainDataList(c, http.StatusOK, objs)
+	}
+	var links *jsonapi.LinksList
+	if next != "" {
+		links = &jsonapi.LinksList{Next: next}
+	}
+	return jsonapi.DataListStream(c, http.StatusOK, manifestsIterator(docs), links)
 }
 
-// listHandler handles all GET / requests which can be used to list
-// installed applications.
-func listHandler(c echo.Context) error {
+// wantedTypes returns the types of applications asked by the type query
+// parameter. For type=all, the types that the permissions do not allow to
+// read can be skipped.
+func wantedTypes(c echo.Context) (webapps, konnectors, skipForbidden bool, err error) {
+	switch c.QueryParam("type") {
+	case "", "webapp":
+		webapps = true
+	case "konnector":
+		konnectors = true
+	case "all":
+		webapps, konnectors, skipForbidden = true, true, true
+	default:
+		err = jsonapi.InvalidParameter("type", errors.New("Unknown type"))
+	}
+	return
+}
+
+// categoryCount is the number of installed applications in a category
+type categoryCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// categoriesHandler handles GET /categories requests, and returns the
+// categories of the installed applications, with the number of applications
+// in each of them. An application can be in several categories.
+func categoriesHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
+	wantWebapps, wantKonnectors, skipForbidden, err := wantedTypes(c)
+	if err != nil {
+		return err
+	}
+
+	var docs []apps.Manifest
+	found := false
+	for _, t := range []struct {
+		want    bool
+		doctype string
+		list    func(couchdb.Database) ([]apps.Manifest, error)
+	}{
+		{wantWebapps, consts.Apps, listWebapps},
+		{wantKonnectors, consts.Konnectors, apps.ListKonnectors},
+	} {
+		if !t.want {
+			continue
+		}
+		if err := permissions.AllowWholeType(c, permissions.GET, t.doctype); err != nil {
+			if !skipForbidden {
+				return err
+			}
+			continue
+		}
+		mans, err := t.list(instance)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		docs = append(docs, mans...)
+		found = true
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	counts := make(map[string]int)
+	for _, d := range docs {
+		for _, category := range d.Categories() {
+			counts[category]++
+		}
+	}
+	categories := make([]*categoryCount, 0, len(counts))
+	for name, count := range counts {
+		categories = append(categories, &categoryCount{Name: name, Count: count})
+	}
+	sort.Sort(byCategoryName(categories))
+	return c.JSON(http.StatusOK, categories)
+}
 
+// capabilitiesHandler handles GET /_capabilities requests, and returns the
+// sources accepted by the installer of this stack and if the konnectors are
+// enabled on the instance, with the same permission as the list of the
+// webapps.
+func capabilitiesHandler(c echo.Context) error {
 	if err := permissions.AllowWholeType(c, permissions.GET, consts.Apps); err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, apps.GetCapabilities(middlewares.GetInstance(c)))
+}
+
+// summaryHandler handles GET /_summary requests, and returns the figures of
+// the installed applications for the settings: the numbers of webapps and
+// konnectors, their size, and how many have an update available or are
+// errored. Like for the list with type=all, the types of applications that
+// can not be read with the current permissions are not counted.
+func summaryHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	summary := &apps.Summary{}
+	found := false
+	for _, t := range []struct {
+		appType apps.AppType
+		doctype string
+	}{
+		{apps.Webapp, consts.Apps},
+		{apps.Konnector, consts.Konnectors},
+	} {
+		if err := permissions.AllowWholeType(c, permissions.GET, t.doctype); err != nil {
+			continue
+		}
+		if err := summary.Count(instance, t.appType); err != nil {
+			return wrapAppsError(err)
+		}
+		found = true
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return c.JSON(http.StatusOK, summary)
+}
+
+func listWebapps(db couchdb.Database) ([]apps.Manifest, error) {
+	webapps, err := apps.ListWebapps(db)
+	if err != nil {
+		return nil, err
+	}
+	mans := make([]apps.Manifest, len(webapps))
+	for i, w := range webapps {
+		mans[i] = w
+	}
+	return mans, nil
+}
+
+type byCategoryName []*categoryCount
+
+func (c byCategoryName) Len() int           { return len(c) }
+func (c byCategoryName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c byCategoryName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// checkUpdatesHandler handles POST /updates/check requests, to check the
+// sources of the applications for newer versions. The result is recorded on
+// the documents of the applications, with update_available, and also
+// returned in the response. Nothing is installed.
+func checkUpdatesHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		if err := permissions.AllowInstallApp(c, installerType, permissions.POST); err != nil {
+			return err
+		}
+		report, err := apps.CheckUpdates(instance, instance.AppsFS(installerType), installerType)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+}
 
-	docs, err := apps.ListWebapps(instance)
+// recomputeSizeHandler handles POST /:slug/recompute-size requests, to
+// compute again the size of the files of an application.
+func recomputeSizeHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	if err := permissions.AllowInstallApp(c, apps.Webapp, permissions.POST); err != nil {
+		return err
+	}
+	app, err := apps.GetWebappBySlug(instance, slug)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return wrapAppsError(apps.ErrNotFound)
+		}
+		return err
+	}
+	if err = apps.ComputeSize(instance, instance.AppsFS(apps.Webapp), app); err != nil {
+		return err
+	}
+	app.Instance = instance
+	return sendData(c, http.StatusOK, app)
+}
+
+// bindInstallContext reads the install_context attribute of the JSON-API
+// document in the body of an install or update request. The body is optional.
+func bindInstallContext(c echo.Context, installerType apps.AppType) (map[string]interface{}, error) {
+	if c.Request().Header.Get(echo.HeaderContentType) == "" {
+		return nil, nil
+	}
+	doctype := consts.Apps
+	if installerType == apps.Konnector {
+		doctype = consts.Konnectors
+	}
+	var attrs struct {
+		InstallContext map[string]interface{} `json:"install_context"`
+	}
+	if _, err := jsonapi.BindResource(c, doctype, &attrs); err != nil {
+		return nil, err
+	}
+	return attrs.InstallContext, nil
+}
+
+// contextHandler handles GET /:slug/context requests, and returns the install
+// context of an application.
+func contextHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		man, err := apps.GetBySlug(instance, c.Param("slug"), installerType)
+		if err = allowReadApp(c, man, err); err != nil {
+			return err
+		}
+		ctx := man.InstallContext()
+		if ctx == nil {
+			ctx = make(map[string]interface{})
+		}
+		return c.JSON(http.StatusOK, ctx)
+	}
+}
+
+// stateHandler handles GET /:slug/state requests, and returns the state of
+// an application with its pending operation, to follow an install or an
+// update.
+func stateHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		man, err := apps.GetBySlug(instance, c.Param("slug"), installerType)
+		if err = allowReadApp(c, man, err); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, apps.NewOperationState(man))
+	}
+}
+
+// eventsHandler handles GET /:slug/events requests. It sends the state of an
+// application in an event stream each time it changes, until the operation
+// given by the operation_id parameter (or any operation without it) is no
+// longer pending, or a done event with the last state when the application
+// has been deleted. Unlike the stream of POST, PUT and DELETE /:slug, it can
+// be opened by any process of the stack.
+func eventsHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		man, err := apps.GetBySlug(instance, slug, installerType)
+		if err = allowReadApp(c, man, err); err != nil {
+			return err
+		}
+
+		id := c.QueryParam("operation_id")
+		interval := config.GetConfig().Apps.ProgressInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		ctx := c.Request().Context()
+		w := sse.NewWriter(c.Response().Writer)
+		state := apps.NewOperationState(man)
+		var last []byte
+		for {
+			b, err := json.Marshal(state)
+			if err != nil {
+				return nil
+			}
+			if !bytes.Equal(b, last) {
+				if err = w.Event("state", string(b)); err != nil {
+					return nil
+				}
+				last = b
+			}
+			if !state.Pending(id) {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+			prev := state
+			if state, err = apps.GetOperationState(instance, slug, installerType); err != nil {
+				// The end of a deletion is the deletion of the document
+				if couchdb.IsNotFoundError(err) && prev.State == apps.Deleting {
+					w.Event("done", string(last))
+					return nil
+				}
+				if b, err = json.Marshal(err.Error()); err == nil {
+					w.Event("error", string(b))
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// logsContentType is the content-type of the logs of the konnectors as JSON
+// lines
+const logsContentType = "application/x-ndjson"
+
+// logsHandler handles GET /konnectors/:slug/logs requests. It sends the log
+// of the last execution of the konnector, or of the execution of the job_id
+// parameter, as plain text or as JSON lines, depending on the Accept header.
+func logsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	man, err := apps.GetKonnectorBySlug(instance, slug)
+	if err = allowReadApp(c, man, err); err != nil {
+		return err
+	}
+	run, err := apps.GetKonnectorLog(instance, man.Slug(), c.QueryParam("job_id"))
 	if err != nil {
 		return wrapAppsError(err)
 	}
 
-	objs := make([]jsonapi.Object, len(docs))
-	for i, d := range docs {
-		d.Instance = instance
-		objs[i] = jsonapi.Object(d)
+	res := c.Response()
+	res.Header().Set("Last-Modified", run.Date.Format(http.TimeFormat))
+	if !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), logsContentType) {
+		res.Header().Set(echo.HeaderContentType, "text/plain; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		for _, line := range run.Lines {
+			if _, err = io.WriteString(res, line+"\n"); err != nil {
+				return nil
+			}
+		}
+		return nil
+	}
+	res.Header().Set(echo.HeaderContentType, logsContentType)
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	for _, line := range run.Lines {
+		err = enc.Encode(map[string]string{
+			"job_id":  run.JobID,
+			"message": line,
+		})
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// migrateHandler handles POST /:slug/migrate-to-successor requests, to
+// replace a deprecated application by its successor. The response is the
+// report of the steps of the migration, even if one of them has failed.
+func migrateHandler(installerType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		if err := permissions.AllowInstallApp(c, installerType, permissions.POST); err != nil {
+			return err
+		}
+		report, err := apps.MigrateToSuccessor(instance, instance.AppsFS(installerType),
+			installerType, slug, &apps.MigrationOptions{
+				CopySettings:  c.QueryParam("CopySettings") == "true",
+				TermsAccepted: c.QueryParam("TermsAccepted"),
+				Subject:       permissions.InstallSubject(c),
+			})
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// manifestsIterator returns a jsonapi.ObjectIterator on the manifests.
+func manifestsIterator(docs []apps.Manifest) jsonapi.ObjectIterator {
+	i := 0
+	return func() (jsonapi.Object, error) {
+		if i >= len(docs) {
+			return nil, nil
+		}
+		d := docs[i]
+		i++
+		exposeProtected(d)
+		return d, nil
+	}
+}
+
+// exposeProtected sets the protected flag of an application that is
+// protected by the configuration, so that the clients can hide its delete
+// button. The document is not saved.
+func exposeProtected(man apps.Manifest) {
+	man.SetProtected(apps.IsProtected(man))
+}
+
+// sendData sends a single object, as JSON-API or plain JSON depending on the
+// Accept header of the request.
+func sendData(c echo.Context, statusCode int, o jsonapi.Object) error {
+	format, err := jsonapi.Negotiate(c.Request())
+	if err != nil {
+		return err
+	}
+	if format == jsonapi.PlainJSONContentType {
+		return jsonapi.PlainData(c, statusCode, o)
+	}
+	return jsonapi.Data(c, statusCode, o, nil)
+}
+
+// errAppForbidden is used when a token that can read some applications
+// can't read the requested one
+var errAppForbidden = errors.New("The token doesn't allow to read this application")
+
+// allowReadApp checks that the request can read an application, looked up
+// with the given error. A caller with some permissions on the applications
+// (io.cozy.apps or io.cozy.konnectors) gets a 403 with the app_forbidden code
+// for an application it can't read, and a 404 if it is not installed. For the
+// other callers, like the anonymous ones, both are a 404, so that they can't
+// know which applications are installed.
+func allowReadApp(c echo.Context, man apps.Manifest, lookupErr error) error {
+	if lookupErr != nil && !couchdb.IsNotFoundError(lookupErr) {
+		return lookupErr
+	}
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil || !hasAppsPermission(pdoc.Permissions) || lookupErr != nil {
+		return wrapAppsError(apps.ErrNotFound)
+	}
+	if !pdoc.Permissions.Allow(permissions.GET, man) {
+		return jsonapi.NewError(http.StatusForbidden, errAppForbidden).WithCode("app_forbidden")
+	}
+	return nil
+}
+
+func hasAppsPermission(set pkgperm.Set) bool {
+	return set.Some(func(r pkgperm.Rule) bool {
+		return r.Type == consts.Apps || r.Type == consts.Konnectors
+	})
+}
+
+// showHandler handles GET /:slug requests and gives the manifest of the
+// installed webapp with the given slug.
+func showHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	app, err := apps.GetWebappBySlug(instance, slug)
+	if err = allowReadApp(c, app, err); err != nil {
+		return err
+	}
+
+	app.Instance = instance
+	if wantsInclude(c, "konnectors") && apps.KonnectorsEnabled(instance) {
+		if err = app.IncludeKonnectors(instance); err != nil {
+			return err
+		}
+	}
+	exposeProtected(app)
+	return sendData(c, http.StatusOK, &withLastOperation{app})
+}
+
+// webappPatch is the list of the attributes of a webapp that can be changed
+// with a PATCH request.
+type webappPatch struct {
+	Maintenance *string     `json:"maintenance"`
+	AutoUpdate  *bool       `json:"auto_update"`
+	State       *apps.State `json:"state"`
+	Protected   *bool       `json:"protected"`
+}
+
+// patchHandler handles PATCH /:slug requests, to change some attributes of
+// an installed webapp.
+func patchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	if err := permissions.AllowInstallApp(c, apps.Webapp, permissions.PATCH); err != nil {
+		return err
+	}
+	var patch webappPatch
+	if _, err := jsonapi.BindResource(c, consts.Apps, &patch); err != nil {
+		return err
+	}
+
+	app, err := apps.GetWebappBySlug(instance, slug)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return wrapAppsError(apps.ErrNotFound)
+		}
+		return err
+	}
+	// The document is saved with the expected revision, so that CouchDB
+	// refuses the change if it has been modified meanwhile
+	rev := ifMatch(c)
+	if rev == "*" {
+		rev = ""
+	}
+	if rev != "" && rev != app.Rev() {
+		return wrapAppsError(&apps.RevisionMismatchError{Expected: rev, Current: app.Rev()})
+	}
+	if patch.Maintenance != nil {
+		app.Maintenance = *patch.Maintenance
+	}
+	if patch.AutoUpdate != nil {
+		app.SetAutoUpdate(*patch.AutoUpdate)
+	}
+	if patch.Protected != nil {
+		return jsonapi.NewError(http.StatusForbidden,
+			errors.New("The protection of an application can only be changed by the administrator")).
+			WithCode("admin_only")
+	}
+	if patch.State != nil {
+		// The users can only disable an application, and enable it again
+		if *patch.State != apps.Inactive && *patch.State != apps.Ready {
+			return jsonapi.InvalidAttribute("state", errors.New("The state can only be inactive or ready"))
+		}
+		if err = apps.Transition(app, *patch.State); err != nil {
+			return wrapAppsError(err)
+		}
+	}
+	if err = couchdb.UpdateDoc(instance, app); err != nil {
+		if rev != "" && couchdb.IsConflictError(err) {
+			if current, errg := apps.GetWebappBySlug(instance, slug); errg == nil {
+				return wrapAppsError(&apps.RevisionMismatchError{Expected: rev, Current: current.Rev()})
+			}
+		}
+		return err
+	}
+	app.Instance = instance
+	exposeProtected(app)
+	return sendData(c, http.StatusOK, app)
+}
+
+// wantsInclude returns true if the given relationship is asked in the include
+// query parameter.
+func wantsInclude(c echo.Context, rel string) bool {
+	for _, inc := range utils.SplitTrimString(c.QueryParam("include"), ",") {
+		if inc == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// filterManifests keeps only the manifests matching the filter[slug],
+// filter[state] and filter[category] query parameters.
+func filterManifests(c echo.Context, docs []apps.Manifest) []apps.Manifest {
+	filters := make(map[string]string)
+	for _, field := range []string{"slug", "state", "category"} {
+		if value := c.QueryParam("filter[" + field + "]"); value != "" {
+			filters[field] = value
+		}
+	}
+	if len(filters) == 0 {
+		return docs
+	}
+	filtered := docs[:0]
+	for _, d := range docs {
+		keep := true
+		for field, value := range filters {
+			if !d.Valid(field, value) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// paginateManifests returns the page of the sorted manifests selected by
+// the page[cursor] and page[limit] query parameters, with the link to the
+// next page if there is one. The cursor is the ID of the last manifest of
+// the previous page.
+func paginateManifests(c echo.Context, docs []apps.Manifest) ([]apps.Manifest, string, error) {
+	limit := defaultListLimit
+	if l := c.QueryParam("page[limit]"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return nil, "", jsonapi.InvalidParameter("page[limit]", errors.New("page limit is not a positive number"))
+		}
+		limit = n
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	if cursor := c.QueryParam("page[cursor]"); cursor != "" {
+		start := sort.Search(len(docs), func(i int) bool {
+			return docs[i].ID() > cursor
+		})
+		docs = docs[start:]
+	}
+	if len(docs) <= limit {
+		return docs, "", nil
+	}
+	docs = docs[:limit]
+	q := c.QueryParams()
+	q.Set("page[cursor]", docs[limit-1].ID())
+	q.Set("page[limit]", strconv.Itoa(limit))
+	return docs, "/apps/?" + q.Encode(), nil
+}
+
+type byID []apps.Manifest
+
+func (a byID) Len() int           { return len(a) }
+func (a byID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byID) Less(i, j int) bool { return a[i].ID() < a[j].ID() }
+
+// listETag computes an ETag for a page of the list of applications. Every
+// change of the application documents (state, version, error...) bumps their
+// revision, so a hash over the identifiers and revisions is enough to detect
+// any of them. The included documents, the format of the response and the
+// number of applications in the whole list (the page can stay the same when
+// an application is added after it) are also taken into account.
+func listETag(docs []apps.Manifest, format string, total int) string {
+	h := md5.New() // #nosec
+	io.WriteString(h, format)
+	io.WriteString(h, strconv.Itoa(total))
+	for _, d := range docs {
+		io.WriteString(h, d.ID())
+		io.WriteString(h, d.Rev())
+		for _, inc := range d.Included() {
+			io.WriteString(h, "+"+inc.ID())
+			io.WriteString(h, inc.Rev())
+		}
+		// The konnectors are marked as disabled by a setting of the instance
+		if w, ok := d.(*withDisabled); ok {
+			io.WriteString(h, "+disabled")
+			d = w.Manifest
+		}
+		// The result of the last execution of a konnector is in another
+		// document
+		if w, ok := d.(*withLastExecution); ok {
+			io.WriteString(h, "+last_execution")
+			if w.result != nil {
+				io.WriteString(h, w.result.Rev())
+			}
+		}
 	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
 
-	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+// etagMatches returns true if the given If-None-Match header value contains
+// the etag.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // iconHandler gives the icon of an application
@@ -213,16 +1278,71 @@ func iconHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	slug := c.Param("slug")
 	app, err := apps.GetWebappBySlug(instance, slug)
+	if isPublicIconRequest(c) {
+		if couchdb.IsNotFoundError(err) {
+			return wrapAppsError(apps.ErrNotFound)
+		}
+	} else {
+		err = allowReadApp(c, app, err)
+	}
 	if err != nil {
 		return err
 	}
 
-	if err = permissions.Allow(c, permissions.GET, app); err != nil {
+	// Only the files declared by the manifest are served, and the icon
+	// must be one of them.
+	if app.Icon == "" || !app.ServesAsset(app.Icon) {
+		return echo.NewHTTPError(http.StatusNotFound, "No icon")
+	}
+	return serveAsset(c, instance, app, app.Icon)
+}
+
+// assetHandler gives a file declared by the manifest of an application as a
+// screenshot or an asset
+func assetHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	app, err := apps.GetWebappBySlug(instance, c.Param("slug"))
+	if err = allowReadApp(c, app, err); err != nil {
 		return err
 	}
+	// The path is checked against the list of the declared assets before any
+	// access to the files of the app, so that no other file can be served.
+	name := c.Param("*")
+	if !app.ServesAsset(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such asset")
+	}
+	return serveAsset(c, instance, app, name)
+}
 
-	filepath := path.Join("/", slug, app.Icon)
-	fs := instance.AppsFS(apps.Webapp)
+// serveAsset serves a file of a webapp, with a cache in memory for the small
+// ones.
+func serveAsset(c echo.Context, i *instance.Instance, app *apps.WebappManifest, name string) error {
+	// The paths of the manifest are relative to the directory of the app,
+	// even if they start with a slash, and must not escape it. During an
+	// update, it is still the directory of the installed version.
+	filepath, err := utils.SafeJoinSlash(apps.FilesDir(app), strings.TrimLeft(name, "/"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	// The revision of the document changes on each update of the app, so the
+	// cached file of a previous version is never served.
+	key := cacheKey(i, filepath, app.Rev())
+	// The ETag is the same for the cached and the uncached file, so that a
+	// client can resume a download with If-Range whatever the path it took.
+	c.Response().Header().Set("ETag", iconETag(filepath, app.Rev()))
+	// The assets are files of the app served on the domain of the stack, so
+	// they can't be run by the browser as a page: only the images and fonts
+	// keep their type, and the SVG are sandboxed.
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	c.Response().Header().Set("Content-Security-Policy", "sandbox")
+	if cached, ok := iconCache.Get(key); ok {
+		icon := cached.(*cachedIcon)
+		c.Response().Header().Set(echo.HeaderContentType, icon.mime)
+		http.ServeContent(c.Response(), c.Request(), filepath, icon.modTime, bytes.NewReader(icon.content))
+		return nil
+	}
+
+	fs := i.AppsFS(apps.Webapp)
 	s, err := fs.Stat(filepath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -236,47 +1356,419 @@ func iconHandler(c echo.Context) error {
 		return err
 	}
 	defer r.Close()
-	http.ServeContent(c.Response(), c.Request(), filepath, s.ModTime(), r)
+	// The content-type is detected from the content, as http.ServeContent
+	// trusts the extension, and the file may have none or a wrong one.
+	mime, err := utils.DetectMimeType(filepath, r)
+	if err != nil {
+		return err
+	}
+	mime = assetContentType(mime)
+	c.Response().Header().Set(echo.HeaderContentType, mime)
+	if s.Size() > iconCacheMaxSize {
+		http.ServeContent(c.Response(), c.Request(), filepath, s.ModTime(), r)
+		return nil
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	iconCache.Set(key, &cachedIcon{content: content, mime: mime, modTime: s.ModTime()}, iconCacheTTL)
+	http.ServeContent(c.Response(), c.Request(), filepath, s.ModTime(), bytes.NewReader(content))
 	return nil
 }
 
+// assetFontTypes are the content-types of the fonts that can be served as
+// assets, as they are not all under font/
+var assetFontTypes = utils.NewStringSet(
+	"application/font-woff",
+	"application/font-sfnt",
+	"application/vnd.ms-fontobject",
+	"application/x-font-opentype",
+	"application/x-font-ttf",
+)
+
+// assetContentType returns the content-type to serve an asset with, from
+// its detected type. Only the images and the fonts keep it, the other files
+// (like an HTML page) are served as binary data.
+func assetContentType(mime string) string {
+	base := strings.TrimSpace(strings.SplitN(mime, ";", 2)[0])
+	if strings.HasPrefix(base, "image/") || strings.HasPrefix(base, "font/") || assetFontTypes.Has(base) {
+		return mime
+	}
+	return "application/octet-stream"
+}
+
+// iconETag computes the ETag of the icon of an application, from its path and
+// the revision of the document of the application.
+func iconETag(filepath, rev string) string {
+	h := md5.New() // #nosec
+	io.WriteString(h, filepath)
+	io.WriteString(h, rev)
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+const (
+	// iconCacheMaxEntries is the number of icons kept in memory
+	iconCacheMaxEntries = 1000
+	// iconCacheMaxSize is the size in bytes above which an icon is not cached
+	iconCacheMaxSize = 100 << 10
+	// iconCacheTTL is how long an icon is kept in memory
+	iconCacheTTL = 10 * time.Minute
+)
+
+// iconCache keeps the content of the icons of the webapps, as they are
+// requested each time the home or the bar of cozy is displayed.
+var iconCache = newInstancesCache("icons", iconCacheMaxEntries)
+
+type cachedIcon struct {
+	content []byte
+	mime    string
+	modTime time.Time
+}
+
+// Size returns the size of the content of the icon
+func (c *cachedIcon) Size() int64 { return int64(len(c.content)) }
+
+// newInstancesCache returns a cache shared by the instances, registered with
+// the given name for its metrics. The counters are kept by instance, with
+// the keys built by cacheKey.
+func newInstancesCache(name string, maxEntries int) *utils.Cache {
+	c := utils.NewCache(maxEntries, nil)
+	c.SetBucketFunc(domainOfKey)
+	return utils.RegisterCache(name, c)
+}
+
+// cacheKey returns the key of an entry of the icon and index caches for an
+// instance. The domain can have a port, so it is separated from the rest of
+// the key by a |, that can't be in a domain.
+func cacheKey(i *instance.Instance, parts ...string) string {
+	return i.Domain + "|" + strings.Join(parts, ":")
+}
+
+// domainOfKey returns the domain of the instance of a key built by cacheKey
+func domainOfKey(key string) string {
+	if pos := strings.IndexByte(key, '|'); pos >= 0 {
+		return key[:pos]
+	}
+	return ""
+}
+
+// installersShutdownTimeout is how long the shutdown of the stack waits for
+// the installations and updates in progress
+const installersShutdownTimeout = time.Minute
+
+// RegisterShutdown starts the janitors of the icon and index caches, the
+// automatic updates, the reaper and the maintenance, and registers in the
+// shutdown group the stop of the background work of the apps: the automatic
+// updates, the reaper, the maintenance and the installations and updates in
+// progress are awaited, and then the janitors are stopped.
+func RegisterShutdown(g *utils.ShutdownGroup) {
+	iconCache.StartJanitor(iconCacheTTL)
+	indexCache.StartJanitor(indexCacheTTL)
+	updater := apps.NewAutoUpdater(forEachInstance)
+	updater.Start(g.Context())
+	g.Register("apps auto-updates", 5, installersShutdownTimeout, updater.Wait)
+	reaper := apps.NewReaper(forEachInstance)
+	reaper.Start(g.Context())
+	g.Register("apps reaper", 5, installersShutdownTimeout, reaper.Wait)
+	maintenance := apps.NewMaintenance(forEachInstance)
+	maintenance.Start(g.Context())
+	g.Register("apps maintenance", 5, installersShutdownTimeout, maintenance.Wait)
+	g.Register("apps installers", 10, installersShutdownTimeout, apps.WaitInstallers)
+	g.Register("icon cache", 20, time.Second, func(ctx context.Context) error {
+		iconCache.StopJanitor()
+		indexCache.StopJanitor()
+		return nil
+	})
+}
+
+// forEachInstance iterates over the instances for the automatic updates
+func forEachInstance(fn func(apps.AutoUpdateTarget) error) error {
+	return instance.ForeachInstances(func(in *instance.Instance) error {
+		return fn(in)
+	})
+}
+
+// isPublicIconRequest returns true if the icon can be served without checking
+// the permissions: it must be enabled in the configuration, and the request
+// must be a safe one coming from a page on the instance's own origin.
+func isPublicIconRequest(c echo.Context) bool {
+	if !config.GetConfig().Apps.PublicIcons {
+		return false
+	}
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	instance := middlewares.GetInstance(c)
+	if utils.StripPort(req.Host) != utils.StripPort(instance.Domain) {
+		return false
+	}
+	if origin := req.Header.Get(echo.HeaderOrigin); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || utils.StripPort(u.Host) != utils.StripPort(instance.Domain) {
+			return false
+		}
+	}
+	return true
+}
+
 // WebappsRoutes sets the routing for the web apps service
 func WebappsRoutes(router *echo.Group) {
-	router.GET("/", listHandler)
-	router.POST("/:slug", installHandler(apps.Webapp))
-	router.PUT("/:slug", updateHandler(apps.Webapp))
-	router.DELETE("/:slug", deleteHandler(apps.Webapp))
-	router.GET("/:slug/icon", iconHandler)
+	list := middlewares.AppsCORS(echo.GET, echo.HEAD)
+	root := middlewares.AppsCORS(echo.GET, echo.HEAD, echo.DELETE)
+	// The root is the same with and without its trailing slash
+	for _, p := range []string{"", "/"} {
+		router.GET(p, listHandler, root)
+		router.DELETE(p, bulkDeleteHandler(apps.Webapp), root)
+		router.OPTIONS(p, middlewares.PreflightHandler, root)
+	}
+	router.GET("/categories", categoriesHandler, list)
+	router.OPTIONS("/categories", middlewares.PreflightHandler, list)
+	router.GET("/_capabilities", capabilitiesHandler, list)
+	router.OPTIONS("/_capabilities", middlewares.PreflightHandler, list)
+	router.GET("/_summary", summaryHandler, list)
+	router.OPTIONS("/_summary", middlewares.PreflightHandler, list)
+	updates := middlewares.AppsCORS(echo.POST)
+	router.POST("/updates/check", checkUpdatesHandler(apps.Webapp), updates)
+	router.OPTIONS("/updates/check", middlewares.PreflightHandler, updates)
+
+	app := middlewares.AppsCORS(echo.GET, echo.HEAD, echo.POST, echo.PUT, echo.PATCH, echo.DELETE)
+	router.GET("/:slug", showHandler, app, validSlug)
+	router.POST("/:slug", installHandler(apps.Webapp), app, validSlug)
+	router.PUT("/:slug", updateHandler(apps.Webapp), app, validSlug)
+	router.PATCH("/:slug", patchHandler, app, validSlug)
+	router.DELETE("/:slug", deleteHandler(apps.Webapp), app, validSlug)
+	router.OPTIONS("/:slug", middlewares.PreflightHandler, app)
+	router.POST("/:slug/recompute-size", recomputeSizeHandler, app, validSlug)
+	router.OPTIONS("/:slug/recompute-size", middlewares.PreflightHandler, app)
+	router.POST("/:slug/migrate-to-successor", migrateHandler(apps.Webapp), app, validSlug)
+	router.OPTIONS("/:slug/migrate-to-successor", middlewares.PreflightHandler, app)
+
+	icon := middlewares.AppsCORS(echo.GET, echo.HEAD)
+	router.GET("/:slug/icon", iconHandler, icon, validSlug)
+	router.OPTIONS("/:slug/icon", middlewares.PreflightHandler, icon)
+	router.GET("/:slug/assets/*", assetHandler, icon, validSlug)
+	router.OPTIONS("/:slug/assets/*", middlewares.PreflightHandler, icon)
+	router.GET("/:slug/context", contextHandler(apps.Webapp), icon, validSlug)
+	router.OPTIONS("/:slug/context", middlewares.PreflightHandler, icon)
+	router.GET("/:slug/state", stateHandler(apps.Webapp), icon, validSlug)
+	router.OPTIONS("/:slug/state", middlewares.PreflightHandler, icon)
+	router.GET("/:slug/events", eventsHandler(apps.Webapp), icon, validSlug)
+	router.OPTIONS("/:slug/events", middlewares.PreflightHandler, icon)
 }
 
-// KonnectorRoutes sets the routing for the konnectors service
+// KonnectorRoutes sets the routing for the konnectors service. All the
+// routes are refused when the konnectors are disabled on the instance,
+// except the deletion: the konnectors installed before can still be removed.
 func KonnectorRoutes(router *echo.Group) {
-	router.POST("/:slug", installHandler(apps.Konnector))
-	router.PUT("/:slug", updateHandler(apps.Konnector))
-	router.DELETE("/:slug", deleteHandler(apps.Konnector))
+	konn := middlewares.AppsCORS(echo.POST, echo.PUT, echo.DELETE)
+	router.POST("/:slug", installHandler(apps.Konnector), konn, konnectorsEnabled, validSlug)
+	router.PUT("/:slug", updateHandler(apps.Konnector), konn, konnectorsEnabled, validSlug)
+	router.DELETE("/:slug", deleteHandler(apps.Konnector), konn, validSlug)
+	router.OPTIONS("/:slug", middlewares.PreflightHandler, konn)
+	router.POST("/:slug/migrate-to-successor", migrateHandler(apps.Konnector), konn, konnectorsEnabled, validSlug)
+	router.OPTIONS("/:slug/migrate-to-successor", middlewares.PreflightHandler, konn)
+	updates := middlewares.AppsCORS(echo.POST)
+	router.POST("/updates/check", checkUpdatesHandler(apps.Konnector), updates, konnectorsEnabled)
+	router.OPTIONS("/updates/check", middlewares.PreflightHandler, updates)
+
+	read := middlewares.AppsCORS(echo.GET, echo.HEAD)
+	router.GET("/:slug/context", contextHandler(apps.Konnector), read, konnectorsEnabled, validSlug)
+	router.OPTIONS("/:slug/context", middlewares.PreflightHandler, read)
+	router.GET("/:slug/logs", logsHandler, read, konnectorsEnabled, validSlug)
+	router.OPTIONS("/:slug/logs", middlewares.PreflightHandler, read)
+	router.GET("/:slug/state", stateHandler(apps.Konnector), read, konnectorsEnabled, validSlug)
+	router.OPTIONS("/:slug/state", middlewares.PreflightHandler, read)
+	router.GET("/:slug/events", eventsHandler(apps.Konnector), read, konnectorsEnabled, validSlug)
+	router.OPTIONS("/:slug/events", middlewares.PreflightHandler, read)
+}
+
+// konnectorsEnabled is a middleware that refuses the requests with a 403
+// Forbidden when the konnectors are disabled on the instance. The setting is
+// read on each request, so a change is effective without a restart.
+func konnectorsEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !apps.KonnectorsEnabled(middlewares.GetInstance(c)) {
+			return wrapAppsError(apps.ErrKonnectorsDisabled)
+		}
+		return next(c)
+	}
+}
+
+// validSlug is a middleware that canonicalizes the :slug parameter to
+// lowercase, and rejects the requests where it is not a valid application
+// slug, before any lookup is done in CouchDB or on the file system.
+func validSlug(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		names := c.ParamNames()
+		values := c.ParamValues()
+		for i, name := range names {
+			if name != "slug" || i >= len(values) {
+				continue
+			}
+			slug, err := decodeSlug(c.Request(), values[i])
+			if err != nil {
+				return wrapAppsError(apps.ErrInvalidSlugName)
+			}
+			values[i] = slug
+		}
+		c.SetParamValues(values...)
+		// The slug of a new install is checked by the installer, with the
+		// stricter rules of ValidSlug
+		if !apps.ValidInstalledSlug(c.Param("slug")) {
+			return wrapAppsError(apps.ErrInvalidSlugName)
+		}
+		return next(c)
+	}
+}
+
+// decodeSlug returns the slug of a path parameter, decoded exactly once and
+// in lowercase. The router matches the escaped path of the request when it
+// differs from the decoded one (like with %2e or %2F), and the parameter is
+// then still encoded. After the decoding, a slug with a path separator is
+// refused, even if ValidInstalledSlug would also refuse it.
+func decodeSlug(req *http.Request, value string) (string, error) {
+	slug := value
+	if req.URL.RawPath != "" {
+		// TODO use PathUnescape when we will no longer support go 1.7
+		var err error
+		if slug, err = url.QueryUnescape(strings.Replace(value, "+", "%2B", -1)); err != nil {
+			return "", err
+		}
+	}
+	if strings.ContainsAny(slug, "/\\") {
+		return "", apps.ErrInvalidSlugName
+	}
+	return strings.ToLower(slug), nil
 }
 
 func wrapAppsError(err error) error {
 	switch err {
 	case apps.ErrInvalidSlugName:
-		return jsonapi.InvalidParameter("slug", err)
+		return jsonapi.InvalidParameter("slug", err).WithCode("invalid_slug")
 	case apps.ErrAlreadyExists:
-		return jsonapi.Conflict(err)
+		return jsonapi.Conflict(err).WithCode("already_exists")
 	case apps.ErrNotFound:
-		return jsonapi.NotFound(err)
+		return jsonapi.NotFound(err).WithCode("not_installed")
 	case apps.ErrNotSupportedSource:
-		return jsonapi.InvalidParameter("Source", err)
+		return jsonapi.InvalidParameter("Source", err).WithCode("unsupported_source")
 	case apps.ErrManifestNotReachable:
-		return jsonapi.NotFound(err)
+		return jsonapi.NotFound(err).WithCode("manifest_not_reachable")
 	case apps.ErrSourceNotReachable:
-		return jsonapi.BadRequest(err)
-	case apps.ErrBadManifest:
-		return jsonapi.BadRequest(err)
+		return jsonapi.BadRequest(err).WithCode("source_not_reachable")
+	case apps.ErrSourceNotAllowed:
+		return jsonapi.InvalidParameter("Source", err).WithCode("source_not_allowed")
+	case apps.ErrBadManifest, apps.ErrManifestTooDeep:
+		return jsonapi.BadRequest(err).WithCode("bad_manifest")
+	case apps.ErrManifestTooLarge:
+		err = fmt.Errorf("%s: the limit is %s", err, utils.FormatSize(apps.ManifestSizeLimit()))
+		return jsonapi.BadRequest(err).WithCode("bad_manifest")
 	case apps.ErrMissingSource:
-		return jsonapi.BadRequest(err)
+		return jsonapi.BadRequest(err).WithCode("missing_source")
+	case apps.ErrTarballTooLarge:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err).WithCode("source_too_large")
+	case apps.ErrMissingSignature:
+		return jsonapi.NewError(http.StatusForbidden, err).WithCode("missing_signature")
+	case apps.ErrInvalidSignature:
+		return jsonapi.NewError(http.StatusForbidden, err).WithCode("invalid_signature")
+	case apps.ErrInvalidChecksum:
+		return jsonapi.BadRequest(err).WithCode("invalid_checksum")
+	case apps.ErrNoSuccessor:
+		return jsonapi.BadRequest(err).WithCode("no_successor")
+	case apps.ErrProtected:
+		return jsonapi.NewError(http.StatusForbidden, err).WithCode("protected_app")
+	case apps.ErrKonnectorLogNotFound:
+		return jsonapi.NotFound(err).WithCode("log_not_found")
+	case apps.ErrManifestConflict:
+		return jsonapi.Conflict(err).WithCode("manifest_conflict")
+	case apps.ErrKonnectorsDisabled:
+		return jsonapi.NewError(http.StatusForbidden, err).WithCode("feature_disabled")
+	case apps.ErrInvalidSubDirectory:
+		return jsonapi.InvalidParameter("SubDirectory", err).WithCode("invalid_subdirectory")
+	case apps.ErrSubDirectoryNotSupported:
+		return jsonapi.InvalidParameter("SubDirectory", err).WithCode("unsupported_subdirectory")
+	}
+	if e, ok := err.(*apps.RateLimitError); ok {
+		jerr := jsonapi.NewError(http.StatusTooManyRequests, err).WithCode("rate_limited")
+		if !e.Reset.IsZero() {
+			jerr = jerr.WithMeta("reset_at", e.Reset)
+		}
+		return jerr
+	}
+	if e, ok := err.(*apps.TermsError); ok {
+		return jsonapi.InvalidParameter("TermsAccepted", err).
+			WithCode("terms_not_accepted").
+			WithMeta("terms_url", e.URL).
+			WithMeta("terms_version", e.Version)
+	}
+	if _, ok := err.(*apps.HookError); ok {
+		return jsonapi.NewError(http.StatusForbidden, err).WithCode("aborted_by_hook")
+	}
+	if e, ok := err.(*apps.TransitionError); ok {
+		return jsonapi.Conflict(err).
+			WithCode("invalid_transition").
+			WithMeta("from", e.From).
+			WithMeta("to", e.To)
+	}
+	if e, ok := err.(*apps.SubDirectoryError); ok {
+		jerr := jsonapi.NotFound(err).
+			WithCode("subdirectory_not_found").
+			WithMeta("directory", e.Dir)
+		if e.File != "" {
+			jerr = jerr.WithMeta("file", e.File)
+		}
+		return jerr
+	}
+	if e, ok := err.(*apps.DependentsError); ok {
+		return jsonapi.Conflict(err).
+			WithCode("has_dependents").
+			WithMeta("dependents", e.Slugs)
+	}
+	if e, ok := err.(*apps.NamespaceConflictError); ok {
+		return jsonapi.Conflict(err).
+			WithCode("namespace_taken").
+			WithMeta("namespace", e.Namespace).
+			WithMeta("slug", e.Slug)
+	}
+	if e, ok := err.(*apps.BulkInvalidSlugsError); ok {
+		return jsonapi.InvalidParameter("slugs", err).
+			WithCode("invalid_slug").
+			WithMeta("slugs", e.Slugs)
+	}
+	if e, ok := err.(*apps.BulkInProgressError); ok {
+		return jsonapi.Conflict(err).
+			WithCode("operation_in_progress").
+			WithMeta("slugs", e.Slugs)
+	}
+	if e, ok := err.(*apps.RevisionMismatchError); ok {
+		return jsonapi.PreconditionFailed("If-Match", err).WithMeta("rev", e.Current)
+	}
+	if e, ok := err.(*apps.OperationInProgressError); ok {
+		return jsonapi.Conflict(err).
+			WithCode("operation_in_progress").
+			WithMeta("operation", e.Operation.Name).
+			WithMeta("started_at", e.Operation.StartedAt)
+	}
+	if errs, ok := err.(apps.ContextErrors); ok {
+		list := make(jsonapi.ErrorList, len(errs))
+		for i, e := range errs {
+			list[i] = jsonapi.InvalidAttribute("install_context"+e.Field, errors.New(e.Reason)).
+				WithCode(e.Code)
+		}
+		return list
+	}
+	if errs, ok := err.(apps.ManifestErrors); ok {
+		list := make(jsonapi.ErrorList, len(errs))
+		for i, e := range errs {
+			list[i] = jsonapi.InvalidPointer(e.Field, errors.New(e.Reason)).
+				WithCode(e.Code).
+				WithMeta("document", "manifest")
+		}
+		return list
 	}
 	if _, ok := err.(*url.Error); ok {
-		return jsonapi.InvalidParameter("Source", err)
+		return jsonapi.InvalidParameter("Source", err).WithCode("invalid_source")
 	}
 	return err
 }
@@ -4,27 +4,37 @@
 package apps_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/apps/apptest"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/intents"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web"
@@ -39,8 +49,13 @@ const slug = "mini"
 var ts *httptest.Server
 var testInstance *instance.Instance
 var token string
+var otherAppToken string
+var filesToken string
 var manifest *apps.WebappManifest
 
+// fixtures serves the applications installed by the tests
+var fixtures *apptest.Server
+
 var jar http.CookieJar
 var client *http.Client
 
@@ -57,11 +72,16 @@ func createFile(dir, filename, content string) error {
 
 func installMiniApp() error {
 	manifest = &apps.WebappManifest{
-		Name:      "Mini",
-		Icon:      "icon.svg",
-		DocSlug:   slug,
-		DocSource: "git://github.com/cozy/mini.git",
-		DocState:  apps.Ready,
+		DocSchema:     apps.SchemaVersion,
+		Name:          "Mini",
+		Icon:          "icon.svg",
+		DocSlug:       slug,
+		DocSource:     "git://github.com/cozy/mini.git",
+		DocCommit:     "8d6a4d5e1a636a93b9e5c5d6e1d1e66bf50f2b4a",
+		DocState:      apps.Ready,
+		Konnectors:    []string{"mini-konnector"},
+		DocTags:       []string{"notes"},
+		DocCategories: []string{"productivity"},
 		Intents: []apps.Intent{
 			apps.Intent{
 				Action: "PICK",
@@ -191,6 +211,36 @@ func TestServe(t *testing.T) {
 	assertNotFound(t, "/public/hello.html")
 }
 
+func TestServeErrored(t *testing.T) {
+	man, err := apps.GetWebappBySlug(testInstance, slug)
+	if !assert.NoError(t, err) {
+		return
+	}
+	man.DocState = apps.Errored
+	man.SetError(apps.ErrMissingFiles)
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, man))
+	defer func() {
+		man.DocState = apps.Ready
+		assert.NoError(t, couchdb.UpdateDoc(testInstance, man))
+	}()
+
+	res, err := doGet("/foo/", true)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, 503, res.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Contains(t, string(body), "missing_files")
+		assert.Contains(t, string(body), `href="https://settings.cozywithapps.example.net/#/apps/mini"`)
+	}
+
+	res, err = doGet("/foo/hello.html", true)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 503, res.StatusCode)
+	}
+}
+
 func TestCozyBar(t *testing.T) {
 	assertAuthGet(t, "/bar/", "text/html; charset=utf-8", ``+
 		`<link rel="stylesheet" type="text/css" href="//cozywithapps.example.net/assets/css/cozy-bar.min.css">`+
@@ -286,6 +336,408 @@ func TestOauthAppCantUpdateApp(t *testing.T) {
 	assert.Equal(t, 403, res.StatusCode)
 }
 
+// doAppsRequest sends a request to the /apps routes with the token of the
+// CLI, that can install, update and delete the applications
+func doAppsRequest(method, path string) (*http.Response, error) {
+	return doAppsRequestIfMatch(method, path, "")
+}
+
+// doAppsRequestIfMatch is like doAppsRequest, with an If-Match header if rev
+// is not empty
+func doAppsRequestIfMatch(method, path, rev string) (*http.Response, error) {
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest(method, ts.URL+path, nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Header.Add("Accept", "application/vnd.api+json")
+	if rev != "" {
+		req.Header.Add("If-Match", rev)
+	}
+	req.Host = testInstance.Domain
+	return client.Do(req)
+}
+
+func TestInstallUpdateDeleteApp(t *testing.T) {
+	const fixture = "fixture-app"
+	v1 := &apptest.App{
+		Manifest: `{"name": "Fixture", "version": "1.0.0", "permissions": {}}`,
+		Files: map[string]string{
+			"index.html": "<html>v1</html>",
+			"old.js":     "alert(1)",
+		},
+	}
+	fixtures.Set(fixture, v1)
+	defer fixtures.Remove(fixture)
+	defer func() {
+		if man, err := apps.GetBySlug(testInstance, fixture, apps.Webapp); err == nil {
+			couchdb.DeleteDoc(testInstance, man)
+		}
+	}()
+	fs := testInstance.AppsFS(apps.Webapp)
+
+	res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture)
+	if !assert.NotNil(t, man) {
+		return
+	}
+	assert.Equal(t, apps.Ready, man.State())
+	assert.Equal(t, "1.0.0", apps.VersionOf(man))
+	apptest.AssertTree(t, fs, fixture, v1.Tree())
+
+	v2 := &apptest.App{
+		Manifest: `{"name": "Fixture", "version": "2.0.0", "permissions": {}}`,
+		Files: map[string]string{
+			"index.html": "<html>v2</html>",
+			"new.js":     "alert(2)",
+		},
+	}
+	fixtures.Set(fixture, v2)
+	res, err = doAppsRequest("PUT", "/apps/"+fixture)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	man = apptest.WaitApp(t, testInstance, apps.Webapp, fixture)
+	if assert.NotNil(t, man) {
+		assert.Equal(t, apps.Ready, man.State())
+		assert.Equal(t, "2.0.0", apps.VersionOf(man))
+		apptest.AssertTree(t, fs, apps.FilesDir(man), v2.Tree())
+	}
+
+	// The figures of the update are in the meta of the application
+	res, err = doAppsRequest("GET", "/apps/"+fixture)
+	if assert.NoError(t, err) {
+		var doc struct {
+			Data struct {
+				Meta struct {
+					LastOperation *apps.OperationMetrics `json:"last_operation"`
+				} `json:"meta"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&doc))
+		res.Body.Close()
+		if metrics := doc.Data.Meta.LastOperation; assert.NotNil(t, metrics) {
+			assert.Equal(t, "update", metrics.Name)
+			assert.True(t, metrics.Succeeded)
+			assert.EqualValues(t, len(v2.Tarball()), metrics.DownloadedBytes)
+		}
+	}
+
+	res, err = doAppsRequest("DELETE", "/apps/"+fixture)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	apptest.WaitNoApp(t, testInstance, apps.Webapp, fixture)
+	apptest.AssertNoTree(t, fs, fixture)
+}
+
+func TestIfMatch(t *testing.T) {
+	const fixture = "fixture-if-match"
+	fixtures.Set(fixture, &apptest.App{
+		Manifest: `{"name": "Fixture", "version": "1.0.0", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html></html>"},
+	})
+	defer fixtures.Remove(fixture)
+	defer func() {
+		if man, err := apps.GetBySlug(testInstance, fixture, apps.Webapp); err == nil {
+			couchdb.DeleteDoc(testInstance, man)
+		}
+	}()
+
+	res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture)
+	if !assert.NotNil(t, man) {
+		return
+	}
+	stale := man.Rev()
+
+	// Without If-Match, the update is not checked
+	res, err = doAppsRequest("PUT", "/apps/"+fixture)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	man = apptest.WaitApp(t, testInstance, apps.Webapp, fixture)
+	if !assert.NotNil(t, man) || !assert.NotEqual(t, stale, man.Rev()) {
+		return
+	}
+
+	// A stale revision is refused for an update and for a deletion
+	for _, method := range []string{"PUT", "DELETE"} {
+		res, err = doAppsRequestIfMatch(method, "/apps/"+fixture, `"`+stale+`"`)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var result map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		res.Body.Close()
+		assert.Equal(t, 412, res.StatusCode, method)
+		if errs, ok := result["errors"].([]interface{}); assert.True(t, ok) {
+			first := errs[0].(map[string]interface{})
+			assert.Contains(t, first["detail"], man.Rev())
+			if meta, ok := first["meta"].(map[string]interface{}); assert.True(t, ok) {
+				assert.Equal(t, man.Rev(), meta["rev"])
+			}
+		}
+	}
+	current, err := apps.GetBySlug(testInstance, fixture, apps.Webapp)
+	if assert.NoError(t, err) {
+		assert.Equal(t, man.Rev(), current.Rev())
+	}
+
+	// Any revision matches *
+	res, err = doAppsRequestIfMatch("PUT", "/apps/"+fixture, "*")
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	man = apptest.WaitApp(t, testInstance, apps.Webapp, fixture)
+	if !assert.NotNil(t, man) {
+		return
+	}
+
+	// The current revision allows the deletion
+	res, err = doAppsRequestIfMatch("DELETE", "/apps/"+fixture, `"`+man.Rev()+`"`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	apptest.WaitNoApp(t, testInstance, apps.Webapp, fixture)
+
+	// * doesn't match an application that is not installed
+	res, err = doAppsRequestIfMatch("DELETE", "/apps/"+fixture, "*")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 404, res.StatusCode)
+	}
+}
+
+func TestDeleteWithEventStream(t *testing.T) {
+	const fixture = "sse-delete"
+	fixtures.Set(fixture, &apptest.App{
+		Manifest: `{"name": "Delete", "version": "1.0.0", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html></html>", "js/app.js": "alert(1)"},
+	})
+	defer fixtures.Remove(fixture)
+	fs := testInstance.AppsFS(apps.Webapp)
+
+	res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); !assert.NotNil(t, man) {
+		return
+	}
+
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest("DELETE", ts.URL+"/apps/"+fixture, nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Header.Add("Accept", "text/event-stream")
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Contains(t, string(events), "event: state")
+	assert.Contains(t, string(events), `"state":"deleting"`)
+	assert.Contains(t, string(events), "event: done")
+	assert.NotContains(t, string(events), "event: error")
+	apptest.AssertNoApp(t, testInstance, apps.Webapp, fixture)
+	apptest.AssertNoTree(t, fs, fixture)
+}
+
+func TestInstallFromBrokenSource(t *testing.T) {
+	const fixture = "broken-app"
+	defer fixtures.Remove(fixture)
+	for _, c := range []struct {
+		app  *apptest.App
+		code string
+	}{
+		{&apptest.App{Manifest: `{"name": "Broken"}`, BadChecksum: true}, "invalid_checksum"},
+		{&apptest.App{Manifest: `{"name": "Broken"}`, FailAfter: 20}, "source_not_reachable"},
+		{&apptest.App{Manifest: `{"name": "Broken"}`, Status: 503}, "source_not_reachable"},
+	} {
+		fixtures.Set(fixture, c.app)
+		res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Contains(t, string(body), c.code)
+		apptest.AssertNoApp(t, testInstance, apps.Webapp, fixture)
+	}
+}
+
+func TestUpdateFromBrokenSource(t *testing.T) {
+	const fixture = "flaky-app"
+	v1 := &apptest.App{
+		Manifest: `{"name": "Flaky", "version": "1.0.0", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html>v1</html>"},
+	}
+	fixtures.Set(fixture, v1)
+	defer fixtures.Remove(fixture)
+	defer func() {
+		if man, err := apps.GetBySlug(testInstance, fixture, apps.Webapp); err == nil {
+			couchdb.DeleteDoc(testInstance, man)
+		}
+	}()
+	fs := testInstance.AppsFS(apps.Webapp)
+
+	res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); !assert.NotNil(t, man) {
+		return
+	}
+
+	// The download of the new version is cut in the middle: the application
+	// is errored, but its files are kept
+	fixtures.Set(fixture, &apptest.App{
+		Manifest:  `{"name": "Flaky", "version": "2.0.0", "permissions": {}}`,
+		Files:     map[string]string{"index.html": "<html>v2</html>"},
+		FailAfter: 20,
+	})
+	res, err = doAppsRequest("PUT", "/apps/"+fixture)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); assert.NotNil(t, man) {
+		assert.Equal(t, apps.Errored, man.State())
+		assert.Equal(t, "1.0.0", apps.VersionOf(man))
+	}
+	apptest.AssertTree(t, fs, fixture, v1.Tree())
+
+	// Once the source is fixed, the update works
+	v2 := &apptest.App{
+		Manifest: `{"name": "Flaky", "version": "2.0.0", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html>v2</html>"},
+		Latency:  10 * time.Millisecond,
+	}
+	fixtures.Set(fixture, v2)
+	res, err = doAppsRequest("PUT", "/apps/"+fixture)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); assert.NotNil(t, man) {
+		assert.Equal(t, apps.Ready, man.State())
+		assert.Equal(t, "2.0.0", apps.VersionOf(man))
+		apptest.AssertTree(t, fs, apps.FilesDir(man), v2.Tree())
+	}
+}
+
+func TestIconDuringUpdate(t *testing.T) {
+	const fixture = "icon-update"
+	v1 := &apptest.App{
+		Manifest: `{"name": "Icon", "version": "1.0.0", "icon": "icon.svg", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html>v1</html>", "icon.svg": "<svg>v1</svg>"},
+	}
+	fixtures.Set(fixture, v1)
+	defer fixtures.Remove(fixture)
+	defer func() {
+		if man, err := apps.GetBySlug(testInstance, fixture, apps.Webapp); err == nil {
+			couchdb.DeleteDoc(testInstance, man)
+		}
+	}()
+
+	res, err := doAppsRequest("POST", "/apps/"+fixture+"?Source="+url.QueryEscape(fixtures.Source(fixture)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); !assert.NotNil(t, man) {
+		return
+	}
+
+	// The icon is requested all along a slow update: it is always the one of
+	// a complete version
+	fixtures.Set(fixture, &apptest.App{
+		Manifest: `{"name": "Icon", "version": "2.0.0", "icon": "icon.svg", "permissions": {}}`,
+		Files:    map[string]string{"index.html": "<html>v2</html>", "icon.svg": "<svg>v2</svg>"},
+		Latency:  50 * time.Millisecond,
+	})
+	done := make(chan struct{})
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	bodies := make(map[string]int)
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", ts.URL+"/apps/"+fixture+"/icon", nil)
+				req.Header.Add("Authorization", "Bearer "+token)
+				req.Host = testInstance.Domain
+				res, err := client.Do(req)
+				if err != nil {
+					continue
+				}
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				mu.Lock()
+				statuses[res.StatusCode]++
+				if res.StatusCode == 200 {
+					bodies[string(body)]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	res, err = doAppsRequest("PUT", "/apps/"+fixture)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		if man := apptest.WaitApp(t, testInstance, apps.Webapp, fixture); assert.NotNil(t, man) {
+			assert.Equal(t, "2.0.0", apps.VersionOf(man))
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Zero(t, statuses[404], "statuses: %v", statuses)
+	assert.NotZero(t, statuses[200])
+	for body := range bodies {
+		assert.Contains(t, []string{"<svg>v1</svg>", "<svg>v2</svg>"}, body)
+	}
+}
+
 func TestListApps(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/apps/", nil)
 	req.Header.Add("Authorization", "Bearer "+token)
@@ -310,6 +762,9 @@ func TestListApps(t *testing.T) {
 	assert.Equal(t, "Mini", name)
 	slug := attrs["slug"].(string)
 	assert.Equal(t, "mini", slug)
+	assert.Equal(t, "8d6a4d5e1a636a93b9e5c5d6e1d1e66bf50f2b4a", attrs["source_commit"])
+	assert.Equal(t, false, attrs["update_available"])
+	assert.Equal(t, false, attrs["protected"])
 
 	links := data["links"].(map[string]interface{})
 	self := links["self"].(string)
@@ -320,6 +775,436 @@ func TestListApps(t *testing.T) {
 	assert.Equal(t, "/apps/mini/icon", icon)
 }
 
+// doPatchApp sends a PATCH request for the given webapp, with the token of
+// the CLI and the attributes as a JSON-API document
+func doPatchApp(slug, attrs string) (*http.Response, error) {
+	body := `{"data": {"type": "io.cozy.apps", "attributes": ` + attrs + `}}`
+	req, _ := http.NewRequest("PATCH", ts.URL+"/apps/"+slug, strings.NewReader(body))
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Accept", "application/vnd.api+json")
+	req.Host = testInstance.Domain
+	return client.Do(req)
+}
+
+func TestPatchApp(t *testing.T) {
+	defer func() {
+		if app, err := apps.GetWebappBySlug(testInstance, slug); err == nil {
+			app.Maintenance = ""
+			app.DocAutoUpdate = nil
+			couchdb.UpdateDoc(testInstance, app)
+		}
+	}()
+
+	res, err := doPatchApp(slug, `{"maintenance": "Back soon", "auto_update": false}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var doc struct {
+		Data struct {
+			Attributes struct {
+				Slug        string     `json:"slug"`
+				State       apps.State `json:"state"`
+				Maintenance string     `json:"maintenance"`
+				AutoUpdate  *bool      `json:"auto_update"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&doc))
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	attrs := doc.Data.Attributes
+	assert.Equal(t, slug, attrs.Slug)
+	assert.Equal(t, apps.Ready, attrs.State)
+	assert.Equal(t, "Back soon", attrs.Maintenance)
+	if assert.NotNil(t, attrs.AutoUpdate) {
+		assert.False(t, *attrs.AutoUpdate)
+	}
+	app, err := apps.GetWebappBySlug(testInstance, slug)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Back soon", app.Maintenance)
+		assert.False(t, app.AutoUpdate())
+	}
+
+	// The attributes that are not sent are kept
+	res, err = doPatchApp(slug, `{"auto_update": true}`)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	app, err = apps.GetWebappBySlug(testInstance, slug)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Back soon", app.Maintenance)
+		assert.True(t, app.AutoUpdate())
+	}
+}
+
+func TestPatchInvalidStateIsRejected(t *testing.T) {
+	before, err := apps.GetWebappBySlug(testInstance, slug)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := doPatchApp(slug, `{"state": "installing", "maintenance": "Back soon"}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 422, res.StatusCode)
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	if errs, ok := result["errors"].([]interface{}); assert.True(t, ok) {
+		source := errs[0].(map[string]interface{})["source"].(map[string]interface{})
+		assert.Equal(t, "/data/attributes/state", source["pointer"])
+	}
+
+	// Nothing has been saved
+	app, err := apps.GetWebappBySlug(testInstance, slug)
+	if assert.NoError(t, err) {
+		assert.Equal(t, before.Rev(), app.Rev())
+		assert.Equal(t, apps.Ready, app.State())
+		assert.Empty(t, app.Maintenance)
+	}
+}
+
+func TestPatchProtectedIsRefused(t *testing.T) {
+	res, err := doPatchApp(slug, `{"protected": false}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	// The protection can only be changed on the admin port
+	assert.Equal(t, 403, res.StatusCode)
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	if errs, ok := result["errors"].([]interface{}); assert.True(t, ok) {
+		assert.Equal(t, "admin_only", errs[0].(map[string]interface{})["code"])
+	}
+}
+
+func TestListAppsRelatedLinks(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Subdomains
+	defer func() { cfg.Subdomains = was }()
+
+	for mode, expected := range map[string]string{
+		config.NestedSubdomains: "https://mini.cozywithapps.example.net/",
+		config.FlatSubdomains:   "https://cozywithapps-mini.example.net/",
+	} {
+		cfg.Subdomains = mode
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		var results map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&results)
+		assert.NoError(t, err)
+		objs := results["data"].([]interface{})
+		assert.Len(t, objs, 1)
+		links := objs[0].(map[string]interface{})["links"].(map[string]interface{})
+		assert.Equal(t, expected, links["related"])
+		assert.Equal(t, "/apps/mini/icon", links["icon"])
+	}
+}
+
+func TestListAllApps(t *testing.T) {
+	// The token can only read io.cozy.apps, the konnectors are skipped
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/?type=all&filter[state]=ready", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	var results map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&results)
+	assert.NoError(t, err)
+	objs := results["data"].([]interface{})
+	assert.Len(t, objs, 1)
+	data := objs[0].(map[string]interface{})
+	assert.Equal(t, "io.cozy.apps", data["type"].(string))
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/?type=all&filter[state]=errored", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	err = json.NewDecoder(res.Body).Decode(&results)
+	assert.NoError(t, err)
+	assert.Len(t, results["data"].([]interface{}), 0)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/?type=konnector", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
+func TestListAppsByCategory(t *testing.T) {
+	for category, count := range map[string]int{"productivity": 1, "Productivity": 1, "finance": 0} {
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/?filter[category]="+category, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		var results map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&results)
+		assert.NoError(t, err)
+		objs := results["data"].([]interface{})
+		if assert.Len(t, objs, count) && count > 0 {
+			attrs := objs[0].(map[string]interface{})["attributes"].(map[string]interface{})
+			assert.Equal(t, []interface{}{"productivity"}, attrs["categories"])
+			assert.Equal(t, []interface{}{"notes"}, attrs["tags"])
+		}
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/categories", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var categories []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&categories)
+	assert.NoError(t, err)
+	if assert.Len(t, categories, 1) {
+		assert.Equal(t, "productivity", categories[0]["name"])
+		assert.Equal(t, 1.0, categories[0]["count"])
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	cfg := config.GetConfig()
+	was := cfg.Apps.RequireSignatures
+	defer func() { cfg.Apps.RequireSignatures = was }()
+	cfg.Apps.RequireSignatures = true
+
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/_capabilities", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var caps map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&caps)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"http", "https", "github", "gitlab"}, caps["source_schemes"])
+	assert.Equal(t, false, caps["file_sources"])
+	assert.Equal(t, true, caps["require_signatures"])
+	assert.EqualValues(t, apps.TarballMaxSize, caps["tarball_max_size"])
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/_capabilities", nil)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+}
+
+func TestSummary(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/_summary", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	var summary apps.Summary
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&summary))
+	res.Body.Close()
+	webapps, err := apps.ListWebapps(testInstance)
+	assert.NoError(t, err)
+	assert.Equal(t, len(webapps), summary.Webapps)
+	assert.True(t, summary.Webapps >= 1)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/_summary", nil)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+}
+
+func TestKonnectorsDisabled(t *testing.T) {
+	disabled := false
+	testInstance.KonnectorsSetting = &disabled
+	defer func() { testInstance.KonnectorsSetting = nil }()
+
+	for _, r := range []struct{ method, path string }{
+		{"POST", "/konnectors/mini-konnector?Source=git://github.com/cozy/mini-konnector.git"},
+		{"GET", "/konnectors/mini-konnector/state"},
+		{"POST", "/konnectors/updates/check"},
+	} {
+		req, _ := http.NewRequest(r.method, ts.URL+r.path, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 403, res.StatusCode, r.path)
+		var result map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		res.Body.Close()
+		if errs, ok := result["errors"].([]interface{}); assert.True(t, ok, r.path) {
+			assert.Equal(t, "feature_disabled", errs[0].(map[string]interface{})["code"])
+		}
+	}
+
+	// The konnectors installed before can still be deleted
+	req, _ := http.NewRequest("DELETE", ts.URL+"/konnectors/not-installed", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 404, res.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/_capabilities", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		var caps map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&caps))
+		res.Body.Close()
+		assert.Equal(t, false, caps["konnectors_enabled"])
+	}
+
+	// The konnectors of the webapp are not included
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/mini?include=konnectors", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		var result map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		res.Body.Close()
+		data := result["data"].(map[string]interface{})
+		rels, _ := data["relationships"].(map[string]interface{})
+		assert.Nil(t, rels["konnectors"])
+	}
+
+	// The flag is read on each request
+	testInstance.KonnectorsSetting = nil
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/_capabilities", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		var caps map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&caps))
+		res.Body.Close()
+		assert.Equal(t, true, caps["konnectors_enabled"])
+	}
+}
+
+func TestListAppsAsPlainJSON(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "application/json")
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	var results []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&results)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "io.cozy.apps/mini", results[0]["id"])
+	assert.Equal(t, "io.cozy.apps", results[0]["type"])
+	assert.Equal(t, "Mini", results[0]["name"])
+
+	req.Header.Set("Accept", "text/html")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 406, res.StatusCode)
+}
+
+func TestListAppsWithETag(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	etag := res.Header.Get("Etag")
+	assert.NotEmpty(t, etag)
+	assert.Contains(t, res.Header.Get("Vary"), "Accept")
+
+	req.Header.Set("If-None-Match", etag)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 304, res.StatusCode)
+
+	req.Header.Set("If-None-Match", `"not-the-etag"`)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	// The same list in another format has another ETag
+	req.Header.Set("If-None-Match", etag)
+	req.Header.Set("Accept", "application/json")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("Etag"))
+}
+
+func TestInstallKonnectorWithSlugOfWebapp(t *testing.T) {
+	// The webapp mini is installed, and its namespace can't be claimed by a
+	// konnector
+	res, err := doAppsRequest("POST", "/konnectors/mini?Source=git://github.com/cozy/mini-konnector.git")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 409, res.StatusCode)
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	if errs, ok := result["errors"].([]interface{}); assert.True(t, ok) {
+		e := errs[0].(map[string]interface{})
+		assert.Equal(t, "namespace_taken", e["code"])
+		if meta, ok := e["meta"].(map[string]interface{}); assert.True(t, ok) {
+			assert.Equal(t, "mini", meta["slug"])
+		}
+	}
+}
+
+func TestShowAppWithKonnectors(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini?include=konnectors", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	rels := data["relationships"].(map[string]interface{})
+	konns := rels["konnectors"].(map[string]interface{})
+	ids := konns["data"].([]interface{})
+	assert.Len(t, ids, 1)
+	ri := ids[0].(map[string]interface{})
+	assert.Equal(t, "io.cozy.konnectors/mini-konnector", ri["id"])
+	assert.Equal(t, "io.cozy.konnectors", ri["type"])
+	// The konnector is not installed, so it is not included
+	assert.Empty(t, result["included"])
+}
+
 func TestIconForApp(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
 	req.Header.Add("Authorization", "Bearer "+token)
@@ -327,10 +1212,556 @@ func TestIconForApp(t *testing.T) {
 	res, err := client.Do(req)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
 	body, _ := ioutil.ReadAll(res.Body)
 	assert.Equal(t, "<svg>...</svg>", string(body))
 }
 
+func TestIconContentType(t *testing.T) {
+	icon := manifest.Icon
+	appdir := path.Join(vfs.WebappsDirName, slug)
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	icons := []struct {
+		name        string
+		content     string
+		contentType string
+	}{
+		{"icon.jpg", png, "image/png"},
+		{"icon-file", "<svg>...</svg>", "image/svg+xml"},
+	}
+	defer func() {
+		manifest.Icon = icon
+		couchdb.UpdateDoc(testInstance, manifest)
+	}()
+
+	for _, i := range icons {
+		assert.NoError(t, createFile(appdir, i.name, i.content))
+		manifest.Icon = i.name
+		assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, i.contentType, res.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, i.content, string(body))
+		assert.NoError(t, vfs.Remove(testInstance.VFS(), path.Join(appdir, i.name)))
+	}
+}
+
+func TestIconRanges(t *testing.T) {
+	icon := manifest.Icon
+	appdir := path.Join(vfs.WebappsDirName, slug)
+	small := "0123456789abcdefghij"
+	large := strings.Repeat("0123456789", 11<<10)
+	defer func() {
+		manifest.Icon = icon
+		couchdb.UpdateDoc(testInstance, manifest)
+	}()
+
+	iconRequest := func(header ...string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return res
+	}
+
+	for _, content := range []string{small, large} {
+		name := fmt.Sprintf("icon-%d.svg", len(content))
+		assert.NoError(t, createFile(appdir, name, content))
+		manifest.Icon = name
+		assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+		size := len(content)
+
+		// The first request of the small icon reads it from the file system,
+		// and the next ones are served from the cache.
+		var etag string
+		for i := 0; i < 2; i++ {
+			res := iconRequest("Range", "bytes=2-5")
+			assert.Equal(t, 206, res.StatusCode)
+			assert.Equal(t, fmt.Sprintf("bytes 2-5/%d", size), res.Header.Get("Content-Range"))
+			assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+			body, _ := ioutil.ReadAll(res.Body)
+			assert.Equal(t, content[2:6], string(body))
+			if etag == "" {
+				etag = res.Header.Get("ETag")
+				assert.NotEmpty(t, etag)
+			} else {
+				assert.Equal(t, etag, res.Header.Get("ETag"))
+			}
+		}
+
+		res := iconRequest("Range", "bytes=0-1,4-5")
+		assert.Equal(t, 206, res.StatusCode)
+		assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "multipart/byteranges"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Contains(t, string(body), content[0:2])
+		assert.Contains(t, string(body), fmt.Sprintf("bytes 4-5/%d", size))
+
+		res = iconRequest("Range", fmt.Sprintf("bytes=%d-", size+10))
+		assert.Equal(t, 416, res.StatusCode)
+		assert.Equal(t, fmt.Sprintf("bytes */%d", size), res.Header.Get("Content-Range"))
+
+		res = iconRequest("Range", "bytes=2-5", "If-Range", etag)
+		assert.Equal(t, 206, res.StatusCode)
+		body, _ = ioutil.ReadAll(res.Body)
+		assert.Equal(t, content[2:6], string(body))
+
+		res = iconRequest("Range", "bytes=2-5", "If-Range", `"stale"`)
+		assert.Equal(t, 200, res.StatusCode)
+		body, _ = ioutil.ReadAll(res.Body)
+		assert.Equal(t, content, string(body))
+
+		assert.NoError(t, vfs.Remove(testInstance.VFS(), path.Join(appdir, name)))
+	}
+}
+
+func TestIconOutsideOfApp(t *testing.T) {
+	icon := manifest.Icon
+	manifest.Icon = "../mini/../other/icon.svg"
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+	defer func() {
+		manifest.Icon = icon
+		couchdb.UpdateDoc(testInstance, manifest)
+	}()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestAssets(t *testing.T) {
+	appdir := path.Join(vfs.WebappsDirName, slug)
+	assert.NoError(t, createFile(appdir, "home.png", "\x89PNG"))
+	manifest.Screenshots = []string{"/home.png"}
+	manifest.DocAssets = []string{"home.png", "icon.svg"}
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+	defer func() {
+		manifest.Screenshots, manifest.DocAssets = nil, nil
+		couchdb.UpdateDoc(testInstance, manifest)
+		vfs.Remove(testInstance.VFS(), path.Join(appdir, "home.png"))
+	}()
+
+	assetRequest := func(p string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+p, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		res.Body.Close()
+		return res
+	}
+	assert.Equal(t, 200, assetRequest("/apps/mini/assets/home.png").StatusCode)
+	assert.Equal(t, 200, assetRequest("/apps/mini/assets/icon.svg").StatusCode)
+	// index.html is a file of the app, but it is not a declared asset
+	assert.Equal(t, 404, assetRequest("/apps/mini/assets/index.html").StatusCode)
+	assert.Equal(t, 404, assetRequest("/apps/mini/assets/bar/../index.html").StatusCode)
+
+	// The icon is served only if it is in the list of the declared assets
+	manifest.DocAssets = []string{"home.png"}
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+	assert.Equal(t, 404, assetRequest("/apps/mini/icon").StatusCode)
+}
+
+func TestAssetsContentType(t *testing.T) {
+	appdir := path.Join(vfs.WebappsDirName, slug)
+	page := "<html><script>alert(document.cookie)</script></html>"
+	assert.NoError(t, createFile(appdir, "page.html", page))
+	assert.NoError(t, createFile(appdir, "shot.png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	manifest.DocAssets = []string{"page.html", "shot.png", "icon.svg"}
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, manifest))
+	defer func() {
+		manifest.DocAssets = nil
+		couchdb.UpdateDoc(testInstance, manifest)
+		vfs.Remove(testInstance.VFS(), path.Join(appdir, "page.html"))
+		vfs.Remove(testInstance.VFS(), path.Join(appdir, "shot.png"))
+	}()
+
+	for _, asset := range []struct {
+		name        string
+		contentType string
+	}{
+		{"page.html", "application/octet-stream"},
+		{"shot.png", "image/png"},
+		{"icon.svg", "image/svg+xml"},
+	} {
+		// The second request is served from the cache
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/assets/"+asset.name, nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Host = testInstance.Domain
+			res, err := client.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			res.Body.Close()
+			assert.Equal(t, 200, res.StatusCode)
+			assert.Equal(t, asset.contentType, res.Header.Get("Content-Type"), asset.name)
+			assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+			assert.Equal(t, "sandbox", res.Header.Get("Content-Security-Policy"))
+		}
+	}
+}
+
+func TestPublicIconForApp(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/mini/icon", nil)
+	req.Host = testInstance.Domain
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 200, res.StatusCode)
+
+	config.GetConfig().Apps.PublicIcons = true
+	defer func() { config.GetConfig().Apps.PublicIcons = false }()
+
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "<svg>...</svg>", string(body))
+
+	req.Header.Set("Origin", "https://evil.example.org")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 200, res.StatusCode)
+}
+
+func TestReadAppPermissions(t *testing.T) {
+	// The callers that can read some applications see the difference between
+	// a forbidden and a missing application, but not the other callers
+	tests := []struct {
+		name    string
+		token   string
+		mini    int
+		missing int
+	}{
+		{"owner", token, 200, 404},
+		{"scoped on another app", otherAppToken, 403, 404},
+		{"without apps permissions", filesToken, 404, 404},
+		{"anonymous", "", 404, 404},
+	}
+	for _, test := range tests {
+		for _, suffix := range []string{"", "/icon", "/state"} {
+			for _, app := range []string{"mini", "missing-app"} {
+				req, _ := http.NewRequest("GET", ts.URL+"/apps/"+app+suffix, nil)
+				if test.token != "" {
+					req.Header.Add("Authorization", "Bearer "+test.token)
+				}
+				req.Host = testInstance.Domain
+				res, err := http.DefaultClient.Do(req)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				var body map[string][]map[string]interface{}
+				json.NewDecoder(res.Body).Decode(&body)
+				res.Body.Close()
+				expected := test.missing
+				if app == "mini" {
+					expected = test.mini
+				}
+				msg := test.name + " on " + app + suffix
+				assert.Equal(t, expected, res.StatusCode, msg)
+				if expected == 200 || !assert.Len(t, body["errors"], 1, msg) {
+					continue
+				}
+				code := body["errors"][0]["code"]
+				if expected == 403 {
+					assert.Equal(t, "app_forbidden", code, msg)
+				} else {
+					assert.Equal(t, "not_installed", code, msg)
+				}
+			}
+		}
+	}
+}
+
+func TestRecomputeSize(t *testing.T) {
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/apps/mini/recompute-size", nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	attrs := result["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	files := []string{
+		"<svg>...</svg>",
+		`this is index.html. <a lang="{{.Locale}}" href="https://{{.Domain}}/status/">Status</a>`,
+		"{{.CozyBar}}",
+		"world {{.Token}}",
+		"this is a file in public/",
+	}
+	size := 0
+	for _, f := range files {
+		size += len(f)
+	}
+	assert.EqualValues(t, len(files), attrs["files_count"])
+	assert.EqualValues(t, size, attrs["size"])
+}
+
+func TestInvalidSlug(t *testing.T) {
+	for _, path := range []string{"/apps/mini_app", "/apps/mini%20app/icon", "/apps/..%2Fmini/icon"} {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Host = testInstance.Domain
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 422, res.StatusCode, path)
+		var result map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		assert.NoError(t, err)
+		errs := result["errors"].([]interface{})
+		assert.Equal(t, "invalid_slug", errs[0].(map[string]interface{})["code"])
+		res.Body.Close()
+	}
+}
+
+func TestRoutesNormalization(t *testing.T) {
+	// The root of the apps is served with and without its trailing slash
+	for _, p := range []string{"/apps", "/apps/"} {
+		res, err := doAppsRequest("GET", p)
+		if assert.NoError(t, err) {
+			res.Body.Close()
+			assert.Equal(t, 200, res.StatusCode, p)
+		}
+		res, err = doAppsRequest("DELETE", p)
+		if assert.NoError(t, err) {
+			res.Body.Close()
+			assert.Equal(t, 422, res.StatusCode, p)
+		}
+	}
+
+	// The slug is decoded once before it is validated
+	res, err := doAppsRequest("GET", "/apps/%6Dini")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	invalid := []string{
+		"/apps/%2e%2e", "/apps/..%2Fmini", "/apps/mini%2F..", "/apps/mini%5C..",
+		"/apps/%256Dini", "/konnectors/%2e%2e", "/konnectors/mini%2Fkonn",
+	}
+	for _, p := range invalid {
+		for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+			// The konnectors are only read with the routes of the apps
+			if (method == "GET" || method == "PATCH") && strings.HasPrefix(p, "/konnectors/") {
+				continue
+			}
+			res, err := doAppsRequest(method, p)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.Equal(t, 422, res.StatusCode, "%s %s", method, p)
+			res.Body.Close()
+		}
+	}
+	for _, p := range []string{"/apps/%2e%2e/icon", "/apps/..%2Fmini/icon", "/apps/%2E%2E/state", "/konnectors/%2e%2e/logs"} {
+		res, err := doAppsRequest("GET", p)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 422, res.StatusCode, p)
+			res.Body.Close()
+		}
+	}
+}
+
+func TestSlugIsCanonicalized(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/MiNi", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.apps/mini", data["id"])
+}
+
+func TestInstallWithEventStreamIsNotCompressed(t *testing.T) {
+	// The manifest is served over HTTP, but the git clone will fail, so the
+	// installer sends some progress and state events, and then an error event.
+	fixtures.Set("sse-app", &apptest.App{Manifest: `{"name": "SSE", "permissions": {}}`})
+	defer fixtures.Remove("sse-app")
+
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A raw connection is used to see how the events are split in chunks
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /apps/sse-app?Source=%s HTTP/1.1\r\n", fixtures.GitSource("sse-app"))
+	fmt.Fprintf(conn, "Host: %s\r\n", testInstance.Domain)
+	fmt.Fprintf(conn, "Authorization: Bearer %s\r\n", cliToken)
+	fmt.Fprintf(conn, "Accept: text/event-stream\r\n")
+	fmt.Fprintf(conn, "Accept-Encoding: gzip\r\n")
+	fmt.Fprintf(conn, "Connection: close\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+
+	// http.ReadResponse has not consumed the body, read the chunks by hand:
+	// each event must have been flushed in its own chunk.
+	var events []string
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(r, chunk); !assert.NoError(t, err) {
+			return
+		}
+		event := string(chunk[:size])
+		assert.True(t, strings.HasSuffix(event, "\r\n\r\n"), event)
+		assert.Equal(t, 1, strings.Count(event, "event: "), event)
+		events = append(events, strings.SplitN(event, "\r\n", 2)[0])
+	}
+	if assert.True(t, len(events) >= 2, "%v", events) {
+		assert.Equal(t, "event: error", events[len(events)-1])
+		assert.Contains(t, events, "event: state")
+		for _, event := range events[:len(events)-1] {
+			assert.Contains(t, []string{"event: progress", "event: state"}, event)
+		}
+	}
+
+	if man, err := apps.GetBySlug(testInstance, "sse-app", apps.Webapp); err == nil {
+		couchdb.DeleteDoc(testInstance, man)
+	}
+}
+
+func TestInstallLinks(t *testing.T) {
+	fixtures.Set("links-app", &apptest.App{Manifest: `{"name": "Links", "permissions": {}}`})
+	defer fixtures.Remove("links-app")
+	defer func() {
+		if man, err := apps.GetBySlug(testInstance, "links-app", apps.Webapp); err == nil {
+			couchdb.DeleteDoc(testInstance, man)
+		}
+	}()
+
+	cliToken, err := testInstance.MakeJWT(permissions.CLIAudience, "CLI", consts.Apps, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/apps/links-app?Source="+fixtures.GitSource("links-app"), nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Header.Add("Accept", "application/vnd.api+json")
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+	var body struct {
+		Data struct {
+			Links struct {
+				Self   string `json:"self"`
+				Events string `json:"events"`
+			} `json:"links"`
+			Meta struct {
+				OperationID string `json:"operation_id"`
+			} `json:"meta"`
+		} `json:"data"`
+	}
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&body)) {
+		return
+	}
+	id := body.Data.Meta.OperationID
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "/apps/links-app/state", body.Data.Links.Self)
+	assert.Equal(t, "/apps/links-app/events?operation_id="+id, body.Data.Links.Events)
+
+	// The events link follows the operation until it has failed on the git
+	// clone, and the state link gives the result
+	req, _ = http.NewRequest("GET", ts.URL+body.Data.Links.Events, nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Contains(t, string(events), "event: state")
+	assert.Contains(t, string(events), `"slug":"links-app"`)
+
+	req, _ = http.NewRequest("GET", ts.URL+body.Data.Links.Self, nil)
+	req.Header.Add("Authorization", "Bearer "+cliToken)
+	req.Host = testInstance.Domain
+	res, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var state apps.OperationState
+	if assert.NoError(t, json.NewDecoder(res.Body).Decode(&state)) {
+		assert.Equal(t, "links-app", state.Slug)
+		assert.Equal(t, apps.Errored, state.State)
+		assert.Nil(t, state.Operation)
+		assert.NotEmpty(t, state.ErrorCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	group := utils.NewShutdownGroup()
+	webApps.RegisterShutdown(group)
+	finished := false
+	apps.RunInBackground(func() {
+		time.Sleep(50 * time.Millisecond)
+		finished = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, group.Shutdown(ctx))
+	assert.True(t, finished)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	config.GetConfig().Assets = "../../assets"
@@ -343,6 +1774,9 @@ func TestMain(m *testing.M) {
 	was := cfg.Subdomains
 	cfg.Subdomains = config.NestedSubdomains
 	defer func() { cfg.Subdomains = was }()
+	cfg.Gzip = true
+	// The fixtures are served on the loopback interface
+	cfg.Apps.AllowPrivateSources = true
 
 	testInstance = setup.GetTestInstance(&instance.Options{Domain: domain})
 	pass := "aephe2Ei"
@@ -363,6 +1797,12 @@ func TestMain(m *testing.M) {
 			c.SetCookie(cookie)
 			return c.HTML(http.StatusOK, "OK")
 		})
+		webApps.KonnectorRoutes(r.Group("/konnectors", func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("instance", testInstance)
+				return next(c)
+			}
+		}))
 		router, err := web.CreateSubdomainProxy(r, webApps.Serve)
 		if err != nil {
 			setup.CleanupAndDie("Cant start subdoman proxy", err)
@@ -379,6 +1819,14 @@ func TestMain(m *testing.M) {
 	client.Do(req)
 
 	_, token = setup.GetTestClient(consts.Apps)
+	_, otherAppToken = setup.GetTestClient(consts.Apps + ":GET:" + consts.Apps + "/other-app")
+	_, filesToken = setup.GetTestClient(consts.Files)
+
+	fixtures = apptest.NewServer()
+	setup.AddCleanup(func() error {
+		fixtures.Close()
+		return nil
+	})
 
 	os.Exit(setup.Run())
 }
@@ -2,6 +2,7 @@ package apps
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"io/ioutil"
@@ -45,10 +46,78 @@ func Serve(c echo.Context) error {
 		}
 		return err
 	}
+	if app.State() == apps.Errored {
+		return serveErrorPage(c, i, app)
+	}
 	if app.State() != apps.Ready {
 		return echo.NewHTTPError(http.StatusServiceUnavailable, "Application is not ready")
 	}
-	return ServeAppFile(c, i, NewServer(i.AppsFS(apps.Webapp), nil), app)
+	return ServeAppFile(c, i, NewServer(i.AppsFS(apps.Webapp), filesPath(app)), app)
+}
+
+// errorPageTemplate is the page served for the routes of a webapp in the
+// errored state. It is rendered by the stack, and not stored with the files of
+// the app, as they can be the ones that are missing.
+var errorPageTemplate = template.Must(template.New("app-error").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{.Title}}</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <link rel="stylesheet" href="//{{.Domain}}/assets/styles/stack.css">
+  </head>
+  <body>
+    <main role="application">
+      <section class="popup">
+        <div class="container">
+          <h1>{{.Title}}</h1>
+          <footer>
+            <div class="error">
+              <div class="alert">
+                <h2>{{.Message}}</h2>
+                <p>{{.Code}}</p>
+              </div>
+              <a href="{{.RetryURL}}">{{.Retry}}</a>
+            </div>
+          </footer>
+        </div>
+      </section>
+    </main>
+  </body>
+</html>
+`))
+
+// serveErrorPage responds with the error page of an errored webapp, in the
+// locale of the instance. This page is served for all the routes of the app,
+// until it goes back to the ready state after an update.
+func serveErrorPage(c echo.Context, i *instance.Instance, app *apps.WebappManifest) error {
+	// The apps that were errored before the codes were recorded have none
+	code := app.ErrorCode()
+	if code == "" {
+		code = "internal_error"
+	}
+	name := app.Name
+	if name == "" {
+		name = app.Slug()
+	}
+	retry := i.SubDomain(consts.StoreSlug)
+	retry.Fragment = "/apps/" + app.Slug()
+	res := c.Response()
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusServiceUnavailable)
+	if c.Request().Method == "HEAD" {
+		return nil
+	}
+	return errorPageTemplate.Execute(res, echo.Map{
+		"Locale":   i.Locale,
+		"Domain":   i.Domain,
+		"Title":    i.Translate("App Error Title"),
+		"Message":  i.Translate("App Error Message %s", name),
+		"Code":     i.Translate("App Error Code %s", code),
+		"Retry":    i.Translate("App Error Retry"),
+		"RetryURL": retry.String(),
+	})
 }
 
 func onboarding(c echo.Context) bool {
@@ -128,18 +197,11 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 	}
 	// For index file, we inject the locale, the stack domain, and a token if the
 	// user is connected
-	content, err := fs.Open(slug, route.Folder, file)
+	tmpl, err := indexTemplate(i, fs, app, route.Folder, file)
 	if err != nil {
 		return err
 	}
-	defer content.Close()
-	buf, err := ioutil.ReadAll(content)
-	if err != nil {
-		return err
-	}
-	tmpl, err := template.New(file).Parse(string(buf))
-	if err != nil {
-		log.Warnf("[apps] %s cannot be parsed as a template: %s", file, err)
+	if tmpl == nil {
 		return fs.ServeFileContent(c.Response(), c.Request(), modtime, slug, route.Folder, file)
 	}
 	token := "" // #nosec
@@ -160,6 +222,81 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs AppFileServer, app *a
 	})
 }
 
+const (
+	// indexCacheMaxEntries is the number of index templates kept in memory
+	indexCacheMaxEntries = 1000
+	// indexCacheTTL is how long an index template is kept in memory
+	indexCacheTTL = 10 * time.Minute
+)
+
+// indexCache keeps the parsed templates of the index files of the webapps.
+// An index that is not a valid template is cached as a nil template.
+var indexCache = newInstancesCache("indexes", indexCacheMaxEntries)
+
+type cachedIndex struct {
+	tmpl *template.Template
+	size int64
+}
+
+// Size returns the size of the index file, as an estimation of the memory
+// used by its template
+func (c *cachedIndex) Size() int64 { return c.size }
+
+// indexTemplate returns the parsed template of an index file of the webapp,
+// or nil if the file is not a valid template. As for the icons, the revision
+// of the document is in the key of the cache, so an update of the app is
+// never served with the index of its previous version. The applications
+// without revision, like the ones served for development, are not cached.
+func indexTemplate(i *instance.Instance, fs AppFileServer, app *apps.WebappManifest, folder, file string) (*template.Template, error) {
+	key := cacheKey(i, app.Slug(), app.Rev(), path.Join(folder, file))
+	if app.Rev() != "" {
+		if cached, ok := indexCache.Get(key); ok {
+			return cached.(*cachedIndex).tmpl, nil
+		}
+	}
+	content, err := fs.Open(app.Slug(), folder, file)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	buf, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(file).Parse(string(buf))
+	if err != nil {
+		log.Warnf("[apps] %s cannot be parsed as a template: %s", file, err)
+		tmpl = nil
+	}
+	if app.Rev() != "" {
+		indexCache.Set(key, &cachedIndex{tmpl, int64(len(buf))}, indexCacheTTL)
+	}
+	return tmpl, nil
+}
+
+func init() {
+	apps.RegisterWarmUp(warmUpWebapp)
+}
+
+// warmUpWebapp parses the index of the main route of a webapp that has been
+// installed or updated, so that the first visit of the user doesn't have to.
+func warmUpWebapp(ctx context.Context, db couchdb.Database, man apps.Manifest) error {
+	app, ok := man.(*apps.WebappManifest)
+	if !ok {
+		return nil
+	}
+	i, ok := db.(*instance.Instance)
+	if !ok {
+		return nil
+	}
+	route, file := app.FindRoute("/")
+	if route.NotFound() || file != "" || route.Index == "" {
+		return nil
+	}
+	_, err := indexTemplate(i, NewServer(i.AppsFS(apps.Webapp), filesPath(app)), app, route.Folder, route.Index)
+	return err
+}
+
 // AppFileServer interface defines a way to access and serve the application's
 // data files.
 type AppFileServer interface {
@@ -205,6 +342,15 @@ func defaultMakePath(slug, folder, file string) string {
 	return path.Join("/", slug, folder, file)
 }
 
+// filesPath returns the makePath function for the files of the installed
+// version of a webapp, in the directory given by its document.
+func filesPath(app *apps.WebappManifest) func(slug, folder, file string) string {
+	dir := apps.FilesDir(app)
+	return func(_, folder, file string) string {
+		return path.Join(dir, folder, file)
+	}
+}
+
 // ServeFileContent uses the standard http.ServeContent method to serve the
 // application file data.
 func (s *Server) ServeFileContent(w http.ResponseWriter, req *http.Request, modtime time.Time, slug, folder, file string) error {
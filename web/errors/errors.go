@@ -38,6 +38,21 @@ func ErrorHandler(err error, c echo.Context) {
 		return
 	}
 
+	if list, ok := err.(jsonapi.ErrorList); ok {
+		// #nosec
+		if !res.Committed {
+			if c.Request().Method == http.MethodHead {
+				c.NoContent(list.Status())
+			} else {
+				jsonapi.DataErrorList(c, list...)
+			}
+		}
+		if config.IsDevRelease() {
+			log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
+		}
+		return
+	}
+
 	if os.IsExist(err) {
 		je = jsonapi.Conflict(err)
 	} else if os.IsNotExist(err) {
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// gracefulServer is an HTTP server that can be stopped without interrupting
+// the requests in progress: its listener is closed, and the stop waits for
+// the requests being served.
+// TODO use http.Server.Shutdown when we will no longer support go 1.7
+type gracefulServer struct {
+	server   *http.Server
+	listener net.Listener
+	handler  http.Handler
+
+	mu      sync.Mutex
+	active  int
+	closing bool
+	idle    chan struct{} // closed when there is no more active request
+}
+
+// newGracefulServer starts to listen on the given address
+func newGracefulServer(addr string, handler http.Handler) (*gracefulServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &gracefulServer{listener: l, handler: handler}
+	g.server = &http.Server{Handler: g}
+	return g, nil
+}
+
+// Serve accepts the connections until the server is stopped. It returns nil
+// once the server has been stopped.
+func (g *gracefulServer) Serve() error {
+	err := g.server.Serve(g.listener)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return nil
+	}
+	return err
+}
+
+func (g *gracefulServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	g.active++
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.active--
+		if g.active == 0 && g.idle != nil {
+			close(g.idle)
+			g.idle = nil
+		}
+		g.mu.Unlock()
+	}()
+	g.handler.ServeHTTP(w, r)
+}
+
+// Shutdown closes the listener, and waits for the requests in progress until
+// the context is done. The connections kept alive are closed after their
+// next request. It can be called again, to wait for the requests.
+func (g *gracefulServer) Shutdown(ctx context.Context) error {
+	g.server.SetKeepAlivesEnabled(false)
+	g.mu.Lock()
+	closing := g.closing
+	g.closing = true
+	g.mu.Unlock()
+	var err error
+	if !closing {
+		err = g.listener.Close()
+	}
+
+	g.mu.Lock()
+	if g.active == 0 {
+		g.mu.Unlock()
+		return err
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+	select {
+	case <-idle:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulServer(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g, err := newGracefulServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	served := make(chan error, 1)
+	go func() { served <- g.Serve() }()
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + g.listener.Addr().String() + "/")
+		if !assert.NoError(t, err) {
+			body <- ""
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	// The shutdown waits for the request in progress, until its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, g.Shutdown(ctx))
+	assert.NoError(t, <-served)
+
+	// No new connection is accepted, but the request is finished
+	_, err = http.Get("http://" + g.listener.Addr().String() + "/")
+	assert.Error(t, err)
+	close(release)
+	assert.Equal(t, "done", <-body)
+	assert.NoError(t, g.Shutdown(context.Background()))
+}
@@ -1,9 +1,17 @@
 package instances
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -12,15 +20,19 @@ import (
 	"github.com/labstack/echo"
 )
 
+// ndjsonContentType is the content-type for the streams of JSON lines
+const ndjsonContentType = "application/x-ndjson"
+
 func createHandler(c echo.Context) error {
 	in, err := instance.Create(&instance.Options{
-		Domain:     c.QueryParam("Domain"),
-		Locale:     c.QueryParam("Locale"),
-		Timezone:   c.QueryParam("Timezone"),
-		Email:      c.QueryParam("Email"),
-		PublicName: c.QueryParam("PublicName"),
-		Apps:       utils.SplitTrimString(c.QueryParam("Apps"), ","),
-		Dev:        (c.QueryParam("Dev") == "true"),
+		Domain:      c.QueryParam("Domain"),
+		Locale:      c.QueryParam("Locale"),
+		Timezone:    c.QueryParam("Timezone"),
+		Email:       c.QueryParam("Email"),
+		PublicName:  c.QueryParam("PublicName"),
+		Apps:        utils.SplitTrimString(c.QueryParam("Apps"), ","),
+		Dev:         (c.QueryParam("Dev") == "true"),
+		AppsChannel: c.QueryParam("AppsChannel"),
 	})
 	if err != nil {
 		return wrapError(err)
@@ -61,6 +73,9 @@ func deleteHandler(c echo.Context) error {
 	if err != nil {
 		return wrapError(err)
 	}
+	for _, rc := range utils.RegisteredCaches() {
+		rc.Cache.ResetBucketStats(i.Domain)
+	}
 	return jsonapi.Data(c, http.StatusOK, i, nil)
 }
 
@@ -114,6 +129,329 @@ func registerClient(c echo.Context) error {
 	return c.String(http.StatusOK, client.ClientID)
 }
 
+// gcAppsHandler handles POST /:domain/apps/gc requests, to find the
+// directories of the applications without a document, and the documents
+// without directory. It is a dry-run, except with the fix=true parameter.
+func gcAppsHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	fix := c.QueryParam("fix") == "true"
+	reports := make(map[string]*apps.GCReport)
+	for name, appType := range map[string]apps.AppType{
+		"webapps":    apps.Webapp,
+		"konnectors": apps.Konnector,
+	} {
+		report, err := apps.GarbageCollect(in, in.AppsFS(appType), appType, fix)
+		if err != nil {
+			return err
+		}
+		reports[name] = report
+	}
+	return c.JSON(http.StatusOK, reports)
+}
+
+// appsMaintenanceHandler handles POST /apps/maintenance requests, to run the
+// maintenance of the applications now, instead of waiting for its next run:
+// the orphan compressed files are removed, and the source cache is trimmed.
+// With the domain parameter, only the applications of this instance are
+// compacted.
+func appsMaintenanceHandler(c echo.Context) error {
+	forEach := func(fn func(apps.AutoUpdateTarget) error) error {
+		return instance.ForeachInstances(func(in *instance.Instance) error {
+			return fn(in)
+		})
+	}
+	if domain := c.QueryParam("domain"); domain != "" {
+		in, err := instance.Get(domain)
+		if err != nil {
+			return wrapError(err)
+		}
+		forEach = func(fn func(apps.AutoUpdateTarget) error) error {
+			return fn(in)
+		}
+	}
+	report := apps.NewMaintenance(forEach).Run(c.Request().Context())
+	return c.JSON(http.StatusOK, report)
+}
+
+// appsChannelHandler handles PUT /:domain/apps/channel?channel=beta requests,
+// to change the default channel of the applications of an instance. The
+// installed applications are not updated.
+func appsChannelHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = in.SetAppsChannel(c.QueryParam("channel")); err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"apps_channel": in.DefaultAppsChannel()})
+}
+
+// konnectorsEnabledHandler handles PUT /:domain/konnectors/enabled requests,
+// with enabled=true or enabled=false, to change the konnectors_enabled setting
+// of an instance. Without the parameter, the setting is removed and the
+// default of the configuration is used. The installed konnectors are kept.
+func konnectorsEnabledHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	var enabled *bool
+	if param := c.QueryParam("enabled"); param != "" {
+		b, err := strconv.ParseBool(param)
+		if err != nil {
+			return jsonapi.InvalidParameter("enabled", err)
+		}
+		enabled = &b
+	}
+	if err = in.SetKonnectorsEnabled(enabled); err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"konnectors_enabled": in.KonnectorsEnabled()})
+}
+
+// appProtectedHandler handles PUT /:domain/apps/:slug/protected and PUT
+// /:domain/konnectors/:slug/protected requests, with protected=true or
+// protected=false, to set or remove the protection of an application against
+// the deletion.
+func appProtectedHandler(appType apps.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		in, err := instance.Get(c.Param("domain"))
+		if err != nil {
+			return wrapError(err)
+		}
+		slug := c.Param("slug")
+		if !apps.ValidInstalledSlug(slug) {
+			return jsonapi.InvalidParameter("slug", apps.ErrInvalidSlugName)
+		}
+		protected, err := strconv.ParseBool(c.QueryParam("protected"))
+		if err != nil {
+			return jsonapi.InvalidParameter("protected", err)
+		}
+		man, err := apps.SetProtected(in, slug, appType, protected)
+		if err == apps.ErrNotFound {
+			return jsonapi.NotFound(err)
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, echo.Map{
+			"slug":      man.Slug(),
+			"protected": apps.IsProtected(man),
+		})
+	}
+}
+
+// normalizeStatesHandler handles POST /:domain/apps/normalize-states
+// requests, to find the applications with an unknown state or stuck in an
+// interrupted operation. It is a dry-run, except with the fix=true parameter.
+func normalizeStatesHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	fix := c.QueryParam("fix") == "true"
+	reports := make(map[string]*apps.StatesReport)
+	for name, appType := range map[string]apps.AppType{
+		"webapps":    apps.Webapp,
+		"konnectors": apps.Konnector,
+	} {
+		report, err := apps.NormalizeStates(in, appType, fix)
+		if err != nil {
+			return err
+		}
+		reports[name] = report
+	}
+	return c.JSON(http.StatusOK, reports)
+}
+
+// appsHealthHandler handles GET /:domain/apps/_health requests, to check
+// that the manifest file of every installed application of the instance is
+// readable.
+func appsHealthHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	healthy := true
+	reports := make(map[string]interface{})
+	for name, appType := range map[string]apps.AppType{
+		"webapps":    apps.Webapp,
+		"konnectors": apps.Konnector,
+	} {
+		report, err := apps.CheckHealth(in, in.AppsFS(appType), appType)
+		if err != nil {
+			return err
+		}
+		healthy = healthy && report.Healthy
+		reports[name] = report
+	}
+	reports["healthy"] = healthy
+	return c.JSON(http.StatusOK, reports)
+}
+
+// cacheDump is the part of the response of GET /:domain/caches for a cache
+type cacheDump struct {
+	MaxEntries int              `json:"max_entries"`
+	Stats      utils.CacheStats `json:"stats"`
+	Entries    []cacheEntryDump `json:"entries"`
+}
+
+// cacheEntryDump is the metadata of an entry of a cache, without its value
+type cacheEntryDump struct {
+	Key       string     `json:"key"`
+	Size      int64      `json:"size"`
+	AgeSecs   float64    `json:"age_seconds"`
+	AddedAt   time.Time  `json:"added_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// cachesHandler handles GET /:domain/caches requests, to dump the metadata
+// of the entries of the in-memory caches for an instance, like the icons of
+// the webapps, with the counters of the instance. The values are not given.
+func cachesHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	now := time.Now()
+	dumps := make(map[string]cacheDump)
+	for _, rc := range utils.RegisteredCaches() {
+		entries := rc.Cache.Entries(in.Domain)
+		dump := cacheDump{
+			MaxEntries: rc.Cache.MaxEntries(),
+			Stats:      rc.Cache.StatsOfBucket(in.Domain),
+			Entries:    make([]cacheEntryDump, len(entries)),
+		}
+		for i, entry := range entries {
+			dump.Entries[i] = cacheEntryDump{
+				Key:     entry.Key,
+				Size:    entry.Size,
+				AgeSecs: now.Sub(entry.AddedAt).Seconds(),
+				AddedAt: entry.AddedAt,
+			}
+			if !entry.ExpiresAt.IsZero() {
+				expires := entry.ExpiresAt
+				dump.Entries[i].ExpiresAt = &expires
+			}
+		}
+		dumps[rc.Name] = dump
+	}
+	return c.JSON(http.StatusOK, dumps)
+}
+
+// autoUpdateStatus is the response of the /apps/auto-update routes
+type autoUpdateStatus struct {
+	Paused bool `json:"paused"`
+}
+
+// autoUpdateHandler handles GET /apps/auto-update requests, to know if the
+// automatic updates of the applications are paused.
+func autoUpdateHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, autoUpdateStatus{Paused: apps.AutoUpdatesPaused()})
+}
+
+// pauseAutoUpdateHandler handles PUT /apps/auto-update?paused=true requests:
+// it is the kill switch of the automatic updates, for all the instances.
+func pauseAutoUpdateHandler(c echo.Context) error {
+	paused, err := strconv.ParseBool(c.QueryParam("paused"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid value for paused")
+	}
+	apps.PauseAutoUpdates(paused)
+	return c.JSON(http.StatusOK, autoUpdateStatus{Paused: apps.AutoUpdatesPaused()})
+}
+
+// appLine is a line of the response of GET /instances/apps, for an instance
+type appLine struct {
+	Domain    string     `json:"domain"`
+	Slug      string     `json:"slug"`
+	Version   string     `json:"version,omitempty"`
+	State     apps.State `json:"state,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// appNotInstalled is the state of the lines for the instances without the
+// application
+const appNotInstalled apps.State = "not-installed"
+
+// appsEndLine is the last line of the response of GET /instances/apps. As
+// the status is sent before the instances are listed, it tells the client
+// if the listing is complete, or the error that has interrupted it.
+type appsEndLine struct {
+	Done      bool   `json:"done"`
+	Instances int    `json:"instances"`
+	Error     string `json:"error,omitempty"`
+}
+
+// appsAcrossHandler handles GET /instances/apps?slug=drive requests, to know
+// which version of an application each instance is running. The response is
+// streamed as NDJSON, with one line per instance, and a last line that
+// tells if the listing is complete. The instances without the application
+// are skipped, unless the missing=true parameter is given.
+func appsAcrossHandler(c echo.Context) error {
+	slug := strings.ToLower(c.QueryParam("slug"))
+	if !apps.ValidInstalledSlug(slug) {
+		return jsonapi.InvalidParameter("slug", apps.ErrInvalidSlugName)
+	}
+	appType := apps.Webapp
+	switch c.QueryParam("type") {
+	case "", "webapp":
+	case "konnector":
+		appType = apps.Konnector
+	default:
+		return jsonapi.InvalidParameter("type", errors.New("The type must be webapp or konnector"))
+	}
+	missing := c.QueryParam("missing") == "true"
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, ndjsonContentType)
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	end := appsEndLine{}
+	err := instance.ForeachInstances(func(in *instance.Instance) error {
+		end.Instances++
+		line := appLine{Domain: in.Domain, Slug: slug}
+		man, err := apps.GetBySlug(in, slug, appType)
+		switch {
+		case err == nil:
+			line.Version = apps.VersionOf(man)
+			line.State = man.State()
+			if t := man.UpdatedAt(); !t.IsZero() {
+				line.UpdatedAt = &t
+			}
+		case couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err):
+			if !missing {
+				return nil
+			}
+			line.State = appNotInstalled
+		default:
+			line.Error = err.Error()
+		}
+		if err = enc.Encode(line); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	})
+	if err != nil {
+		// The status has already been sent, the error is given in the last
+		// line
+		log.Errorf("[instances] Can't list the app %s on all the instances: %s", slug, err)
+		end.Error = err.Error()
+	}
+	end.Done = err == nil
+	if err = enc.Encode(end); err != nil {
+		log.Errorf("[instances] Can't end the list of the app %s on all the instances: %s", slug, err)
+	}
+	res.Flush()
+	return nil
+}
+
 func wrapError(err error) error {
 	switch err {
 	case instance.ErrNotFound:
@@ -130,6 +468,8 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrInvalidPassphrase:
 		return jsonapi.BadRequest(err)
+	case instance.ErrInvalidAppsChannel:
+		return jsonapi.BadRequest(err)
 	}
 	return err
 }
@@ -137,8 +477,20 @@ func wrapError(err error) error {
 // Routes sets the routing for the instances service
 func Routes(router *echo.Group) {
 	router.GET("", listHandler)
+	router.GET("/apps", appsAcrossHandler)
+	router.GET("/apps/auto-update", autoUpdateHandler)
+	router.PUT("/apps/auto-update", pauseAutoUpdateHandler)
+	router.POST("/apps/maintenance", appsMaintenanceHandler)
 	router.POST("", createHandler)
 	router.DELETE("/:domain", deleteHandler)
+	router.POST("/:domain/apps/gc", gcAppsHandler)
+	router.POST("/:domain/apps/normalize-states", normalizeStatesHandler)
+	router.PUT("/:domain/apps/channel", appsChannelHandler)
+	router.GET("/:domain/apps/_health", appsHealthHandler)
+	router.GET("/:domain/caches", cachesHandler)
+	router.PUT("/:domain/apps/:slug/protected", appProtectedHandler(apps.Webapp))
+	router.PUT("/:domain/konnectors/enabled", konnectorsEnabledHandler)
+	router.PUT("/:domain/konnectors/:slug/protected", appProtectedHandler(apps.Konnector))
 	router.POST("/token", createToken)
 	router.POST("/oauth_client", registerClient)
 }
@@ -0,0 +1,98 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// MaxBodySize is the maximal size, in bytes, of the JSON-API documents that
+// can be read by BindResource and BindRelationships.
+var MaxBodySize int64 = 1 << 20 // 1MB
+
+// BindResource reads the JSON-API document from the body of the request. It
+// checks the content-type, the size of the body, and that the resource object
+// has the expected type. Its attributes are unmarshaled into attrs. The
+// errors are well-formed JSON-API errors.
+func BindResource(c echo.Context, doctype string, attrs interface{}) (*ObjectMarshalling, error) {
+	doc, err := readDocument(c.Request())
+	if err != nil {
+		return nil, err
+	}
+	var obj *ObjectMarshalling
+	if err = json.Unmarshal(*doc.Data, &obj); err != nil || obj == nil {
+		return nil, BadJSON()
+	}
+	if obj.Type != doctype {
+		return nil, &Error{
+			Status: http.StatusConflict,
+			Code:   "type_mismatch",
+			Title:  "Conflict",
+			Detail: "The type of the resource object should be " + doctype,
+			Source: SourceError{Pointer: "/data/type"},
+		}
+	}
+	if obj.Attributes != nil && attrs != nil {
+		if err = json.Unmarshal(*obj.Attributes, attrs); err != nil {
+			return nil, InvalidAttribute("", err)
+		}
+	}
+	return obj, nil
+}
+
+// BindRelationships reads a list of resource identifiers from the JSON-API
+// document in the body of the request, with the same checks as BindResource.
+// A single resource identifier is accepted as a list of one element.
+func BindRelationships(c echo.Context) ([]ResourceIdentifier, error) {
+	doc, err := readDocument(c.Request())
+	if err != nil {
+		return nil, err
+	}
+	var out []ResourceIdentifier
+	if err = json.Unmarshal(*doc.Data, &out); err != nil {
+		var ri ResourceIdentifier
+		if err = json.Unmarshal(*doc.Data, &ri); err != nil {
+			return nil, BadJSON()
+		}
+		out = []ResourceIdentifier{ri}
+	}
+	for _, ri := range out {
+		if ri.ID == "" || ri.Type == "" {
+			return nil, BadJSON()
+		}
+	}
+	return out, nil
+}
+
+func readDocument(req *http.Request) (*Document, error) {
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	if err != nil || mediatype != ContentType {
+		return nil, &Error{
+			Status: http.StatusUnsupportedMediaType,
+			Code:   "unsupported_media_type",
+			Title:  "Unsupported Media Type",
+			Detail: "The content-type should be " + ContentType,
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	if int64(len(body)) > MaxBodySize {
+		return nil, &Error{
+			Status: http.StatusRequestEntityTooLarge,
+			Code:   "body_too_large",
+			Title:  "Request Entity Too Large",
+			Detail: "The request body is too large",
+		}
+	}
+	var doc *Document
+	if err = json.Unmarshal(body, &doc); err != nil || doc == nil || doc.Data == nil {
+		return nil, BadJSON()
+	}
+	return doc, nil
+}
@@ -16,7 +16,63 @@ type Object interface {
 
 // Meta is a container for the couchdb revision, in JSON-API land
 type Meta struct {
-	Rev string `json:"rev,omitempty"`
+	Rev      string      `json:"rev,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Progress interface{} `json:"progress,omitempty"`
+	Changes  interface{} `json:"changes,omitempty"`
+	WarmUp   interface{} `json:"warm_up,omitempty"`
+	Sync     interface{} `json:"sync,omitempty"`
+
+	LastOperation interface{} `json:"last_operation,omitempty"`
+	OperationID   string      `json:"operation_id,omitempty"`
+}
+
+// Warner is an optional interface for the objects that can have some
+// warnings to send in the meta of their resource object.
+type Warner interface {
+	Warnings() []string
+}
+
+// Progresser is an optional interface for the objects that have a progress
+// to send in the meta of their resource object, like an application being
+// installed.
+type Progresser interface {
+	Progress() interface{}
+}
+
+// Changer is an optional interface for the objects that have a list of
+// changes to send in the meta of their resource object, like an application
+// that has been updated.
+type Changer interface {
+	Changes() interface{}
+}
+
+// WarmUpper is an optional interface for the objects that have the result of
+// a warm-up to send in the meta of their resource object, like an
+// application that has been installed.
+type WarmUpper interface {
+	WarmUp() interface{}
+}
+
+// Syncer is an optional interface for the objects that have the number of
+// files written and deleted to send in the meta of their resource object,
+// like an application that has been updated.
+type Syncer interface {
+	Sync() interface{}
+}
+
+// Metricer is an optional interface for the objects that have the figures of
+// their last operation to send in the meta of their resource object, like the
+// duration of the last install of an application.
+type Metricer interface {
+	LastOperationMetrics() interface{}
+}
+
+// Operationer is an optional interface for the objects that are the subject
+// of an operation in progress, whose identifier is sent in the meta of their
+// resource object, like an application being installed.
+type Operationer interface {
+	OperationID() string
 }
 
 // LinksList is the common links used in JSON-API for the top-level or a
@@ -29,6 +85,7 @@ type LinksList struct {
 	Next    string `json:"next,omitempty"`
 	Icon    string `json:"icon,omitempty"`
 	Perms   string `json:"permissions,omitempty"`
+	Events  string `json:"events,omitempty"`
 }
 
 // ResourceIdentifier is an object, used in relationships, to identify an
@@ -112,5 +169,26 @@ func MarshalObject(o Object) (json.RawMessage, error) {
 		Links:         links,
 		Relationships: rels,
 	}
+	if w, ok := o.(Warner); ok {
+		data.Meta.Warnings = w.Warnings()
+	}
+	if p, ok := o.(Progresser); ok {
+		data.Meta.Progress = p.Progress()
+	}
+	if c, ok := o.(Changer); ok {
+		data.Meta.Changes = c.Changes()
+	}
+	if w, ok := o.(WarmUpper); ok {
+		data.Meta.WarmUp = w.WarmUp()
+	}
+	if s, ok := o.(Syncer); ok {
+		data.Meta.Sync = s.Sync()
+	}
+	if m, ok := o.(Metricer); ok {
+		data.Meta.LastOperation = m.LastOperationMetrics()
+	}
+	if op, ok := o.(Operationer); ok {
+		data.Meta.OperationID = op.OperationID()
+	}
 	return json.Marshal(data)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 // SourceError contains references to the source of the error
@@ -16,19 +17,64 @@ type SourceError struct {
 // while performing an operation.
 // See http://jsonapi.org/format/#error-objects
 type Error struct {
-	Status int         `json:"status,string"`
-	Title  string      `json:"title"`
-	Detail string      `json:"detail"`
-	Source SourceError `json:"source,omitempty"`
+	Status int                    `json:"status,string"`
+	Code   string                 `json:"code,omitempty"`
+	Title  string                 `json:"title"`
+	Detail string                 `json:"detail"`
+	Source SourceError            `json:"source,omitempty"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
 }
 
-// ErrorList is just an array of error objects
+// ErrorList is just an array of error objects. It can be returned by the
+// handlers to send several errors in the same response.
 type ErrorList []*Error
 
 func (e *Error) Error() string {
 	return e.Title + "(" + strconv.Itoa(e.Status) + ")" + ": " + e.Detail
 }
 
+// WithCode sets the application-specific code of the error.
+func (e *Error) WithCode(code string) *Error {
+	e.Code = code
+	return e
+}
+
+// WithMeta adds a non-standard meta-information to the error.
+func (e *Error) WithMeta(key string, value interface{}) *Error {
+	if e.Meta == nil {
+		e.Meta = make(map[string]interface{})
+	}
+	e.Meta[key] = value
+	return e
+}
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Status returns the HTTP status code for the list of errors: the status of
+// the errors if they all have the same, or the most general class of them
+// (400 or 500) otherwise.
+func (l ErrorList) Status() int {
+	if len(l) == 0 {
+		return http.StatusInternalServerError
+	}
+	status := l[0].Status
+	for _, e := range l[1:] {
+		if e.Status != status {
+			if e.Status >= 500 || status >= 500 {
+				return http.StatusInternalServerError
+			}
+			status = http.StatusBadRequest
+		}
+	}
+	return status
+}
+
 // NewError creates a new generic Error
 func NewError(status int, msg ...interface{}) *Error {
 	je := &Error{
@@ -124,3 +170,17 @@ func InvalidAttribute(attribute string, err error) *Error {
 		},
 	}
 }
+
+// InvalidPointer returns a 422 formatted error when the value at the given
+// JSON pointer of a document is invalid. The document is not necessarily the
+// request body: it can be, for example, the manifest of an application.
+func InvalidPointer(pointer string, err error) *Error {
+	return &Error{
+		Status: http.StatusUnprocessableEntity,
+		Title:  "Invalid Attribute",
+		Detail: err.Error(),
+		Source: SourceError{
+			Pointer: pointer,
+		},
+	}
+}
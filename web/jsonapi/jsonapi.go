@@ -59,31 +59,102 @@ func Data(c echo.Context, statusCode int, o Object, links *LinksList) error {
 }
 
 // DataList can be called to send an multiple-value answer with a
-// JSON-API document contains multiple objects.
+// JSON-API document contains multiple objects. The objects included by them
+// are added, only once, to the included list of the document.
 func DataList(c echo.Context, statusCode int, objs []Object, links *LinksList) error {
-	objsMarshaled := make([]json.RawMessage, len(objs))
-	for i, o := range objs {
-		j, err := MarshalObject(o)
-		if err != nil {
-			return InternalServerError(err)
-		}
-		objsMarshaled[i] = j
-	}
+	return DataListStream(c, statusCode, SliceIterator(objs), links)
+}
 
-	data, err := json.Marshal(objsMarshaled)
-	if err != nil {
-		return InternalServerError(err)
-	}
+// ObjectIterator gives the objects of a collection one at a time. It returns
+// a nil object when there are no more objects.
+type ObjectIterator func() (Object, error)
 
-	doc := Document{
-		Data:  (*json.RawMessage)(&data),
-		Links: links,
+// SliceIterator returns an ObjectIterator on the given slice of objects.
+func SliceIterator(objs []Object) ObjectIterator {
+	i := 0
+	return func() (Object, error) {
+		if i >= len(objs) {
+			return nil, nil
+		}
+		o := objs[i]
+		i++
+		return o, nil
 	}
+}
 
+// DataListStream is like DataList, but the objects are taken from an
+// iterator and encoded one at a time in the response, instead of building
+// the whole document in memory.
+func DataListStream(c echo.Context, statusCode int, next ObjectIterator, links *LinksList) error {
 	resp := c.Response()
 	resp.Header().Set("Content-Type", ContentType)
 	resp.WriteHeader(statusCode)
-	return json.NewEncoder(resp).Encode(doc)
+	return WriteDataList(resp, next, links)
+}
+
+// WriteDataList writes a JSON-API document with the objects given by the
+// iterator into an io.Writer. The output is the same as the one of a
+// json.Encoder for the equivalent Document.
+func WriteDataList(w io.Writer, next ObjectIterator, links *LinksList) error {
+	var included []json.RawMessage
+	seen := make(map[string]struct{})
+	if _, err := io.WriteString(w, `{"data":[`); err != nil {
+		return err
+	}
+	for first := true; ; first = false {
+		o, err := next()
+		if err != nil {
+			return err
+		}
+		if o == nil {
+			break
+		}
+		data, err := MarshalObject(o)
+		if err != nil {
+			return err
+		}
+		if !first {
+			data = append([]byte{','}, data...)
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		for _, inc := range o.Included() {
+			key := inc.DocType() + "/" + inc.ID()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			data, err := MarshalObject(inc)
+			if err != nil {
+				return err
+			}
+			included = append(included, data)
+		}
+	}
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
+	}
+	if links != nil {
+		b, err := json.Marshal(links)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, `,"links":`+string(b)); err != nil {
+			return err
+		}
+	}
+	if len(included) > 0 {
+		b, err := json.Marshal(included)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, `,"included":`+string(b)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
 }
 
 // DataRelations can be called to send a Relations page,
@@ -123,7 +194,7 @@ func DataErrorList(c echo.Context, errs ...*Error) error {
 	}
 	resp := c.Response()
 	resp.Header().Set("Content-Type", ContentType)
-	resp.WriteHeader(errs[0].Status)
+	resp.WriteHeader(ErrorList(errs).Status())
 	return json.NewEncoder(resp).Encode(doc)
 }
 
@@ -1,10 +1,14 @@
 package jsonapi
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -143,6 +147,278 @@ func TestData(t *testing.T) {
 	assert.Equal(t, qux["id"], "qux")
 }
 
+func TestDataList(t *testing.T) {
+	res, err := http.Get(ts.URL + "/foos")
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	assert.Contains(t, body, "data")
+	data := body["data"].([]interface{})
+	assert.Len(t, data, 2)
+
+	// Both foos include qux, but it must be present only once
+	assert.Contains(t, body, "included")
+	included := body["included"].([]interface{})
+	assert.Len(t, included, 1)
+	qux, _ := included[0].(map[string]interface{})
+	assert.Equal(t, qux["id"], "qux")
+}
+
+func assertGolden(t *testing.T, name string, actual []byte) {
+	expected, err := ioutil.ReadFile("../../tests/fixtures/jsonapi/" + name + ".golden")
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+func TestWriteDataListGolden(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := WriteDataList(buf, SliceIterator(nil), nil)
+	assert.NoError(t, err)
+	assertGolden(t, "empty-list", buf.Bytes())
+
+	buf.Reset()
+	courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+	bar := &Foo{FID: "bar", FRev: "2-def", Bar: "baz"}
+	links := &LinksList{Next: "/foos?page[cursor]=bar"}
+	err = WriteDataList(buf, SliceIterator([]Object{courge, bar}), links)
+	assert.NoError(t, err)
+	assertGolden(t, "foos-list", buf.Bytes())
+}
+
+func TestWriteDataListSameAsEncoder(t *testing.T) {
+	courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "<baz & co>"}
+	links := &LinksList{Self: "/foos", Next: "/foos?page[cursor]=courge"}
+
+	buf := new(bytes.Buffer)
+	err := WriteDataList(buf, SliceIterator([]Object{courge}), links)
+	assert.NoError(t, err)
+
+	obj, err := MarshalObject(courge)
+	assert.NoError(t, err)
+	inc, err := MarshalObject(courge.Included()[0])
+	assert.NoError(t, err)
+	data, err := json.Marshal([]json.RawMessage{obj})
+	assert.NoError(t, err)
+	doc := Document{
+		Data:     (*json.RawMessage)(&data),
+		Links:    links,
+		Included: []interface{}{&inc},
+	}
+	expected := new(bytes.Buffer)
+	err = json.NewEncoder(expected).Encode(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.String(), buf.String())
+}
+
+func TestErrorList(t *testing.T) {
+	err1 := InvalidAttribute("name", errors.New("missing")).WithCode("missing_field")
+	err2 := InvalidParameter("slug", errors.New("invalid")).WithMeta("slug", "a b")
+	list := ErrorList{err1, err2}
+	assert.Equal(t, http.StatusUnprocessableEntity, list.Status())
+	assert.Equal(t, "/data/attributes/name", list[0].Source.Pointer)
+	assert.Equal(t, "missing_field", list[0].Code)
+	assert.Equal(t, "a b", list[1].Meta["slug"])
+
+	list = append(list, NotFound(errors.New("not found")))
+	assert.Equal(t, http.StatusBadRequest, list.Status())
+	list = append(list, InternalServerError(errors.New("oops")))
+	assert.Equal(t, http.StatusInternalServerError, list.Status())
+}
+
+func postFoo(contentType, body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", ts.URL+"/foos", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return http.DefaultClient.Do(req)
+}
+
+func TestBindResource(t *testing.T) {
+	res, err := postFoo(ContentType, `{"data": {"type": "io.cozy.foos", "attributes": {"bar": "quux"}}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var foo Foo
+	err = json.NewDecoder(res.Body).Decode(&foo)
+	assert.NoError(t, err)
+	assert.Equal(t, "quux", foo.Bar)
+
+	res, err = postFoo("text/plain", `{"data": {"type": "io.cozy.foos", "attributes": {"bar": "quux"}}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+
+	res, err = postFoo(ContentType, `{"data": {"type": "io.cozy.bars", "attributes": {"bar": "quux"}}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, err = postFoo(ContentType, `{"data": `)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	was := MaxBodySize
+	MaxBodySize = 16
+	defer func() { MaxBodySize = was }()
+	res, err = postFoo(ContentType, `{"data": {"type": "io.cozy.foos", "attributes": {"bar": "quux"}}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestBindRelationships(t *testing.T) {
+	post := func(body string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", ts.URL+"/foos/relationships", strings.NewReader(body))
+		req.Header.Set("Content-Type", ContentType)
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err := post(`{"data": [{"type": "io.cozy.foos", "id": "courge"}, {"type": "io.cozy.bars", "id": "bar"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var out []ResourceIdentifier
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(t, []ResourceIdentifier{
+		{ID: "courge", Type: "io.cozy.foos"},
+		{ID: "bar", Type: "io.cozy.bars"},
+	}, out)
+
+	// A single resource identifier is a list of one element
+	res, err = post(`{"data": {"type": "io.cozy.foos", "id": "courge"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	out = nil
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(t, []ResourceIdentifier{{ID: "courge", Type: "io.cozy.foos"}}, out)
+
+	// An empty list is accepted, but not a resource identifier without an id
+	res, err = post(`{"data": []}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	res, err = post(`{"data": [{"type": "io.cozy.foos"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, err = post(`{"data": "courge"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestNegotiate(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/foos", nil)
+	format, err := Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ContentType, format)
+
+	req.Header.Set("Accept", "application/json")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, PlainJSONContentType, format)
+
+	// The quality of the types is used
+	req.Header.Set("Accept", "application/json, */*;q=0.8")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, PlainJSONContentType, format)
+
+	req.Header.Set("Accept", "application/json, application/vnd.api+json;q=0")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, PlainJSONContentType, format)
+
+	req.Header.Set("Accept", "application/json;q=0, application/vnd.api+json")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ContentType, format)
+
+	req.Header.Set("Accept", "application/json;q=0.5, application/*;q=0.9")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ContentType, format)
+
+	req.Header.Set("Accept", "application/vnd.api+json;q=0.2, application/json;q=0.4")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, PlainJSONContentType, format)
+
+	// JSON-API is used on a tie
+	req.Header.Set("Accept", "application/json, */*")
+	format, err = Negotiate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ContentType, format)
+
+	req.Header.Set("Accept", "*/*;q=0")
+	_, err = Negotiate(req)
+	assert.Error(t, err)
+
+	req.Header.Set("Accept", "text/html")
+	_, err = Negotiate(req)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotAcceptable, err.(*Error).Status)
+}
+
+func TestFlatten(t *testing.T) {
+	foo := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+	flat, err := Flatten(foo)
+	assert.NoError(t, err)
+	assert.Equal(t, "courge", flat["id"])
+	assert.Equal(t, "io.cozy.foos", flat["type"])
+	assert.Equal(t, "baz", flat["bar"])
+}
+
+type warnedFoo struct {
+	*Foo
+}
+
+func (f *warnedFoo) Warnings() []string { return []string{"careful"} }
+
+func TestMetaWarnings(t *testing.T) {
+	b, err := MarshalObject(&warnedFoo{&Foo{FID: "courge", FRev: "1-abc"}})
+	assert.NoError(t, err)
+	var data ObjectMarshalling
+	assert.NoError(t, json.Unmarshal(b, &data))
+	assert.Equal(t, "1-abc", data.Meta.Rev)
+	assert.Equal(t, []string{"careful"}, data.Meta.Warnings)
+}
+
+type progressingFoo struct {
+	*Foo
+}
+
+func (f *progressingFoo) Progress() interface{} {
+	return map[string]interface{}{"phase": "downloading"}
+}
+
+func TestMetaProgress(t *testing.T) {
+	b, err := MarshalObject(&progressingFoo{&Foo{FID: "courge", FRev: "1-abc"}})
+	assert.NoError(t, err)
+	var data ObjectMarshalling
+	assert.NoError(t, json.Unmarshal(b, &data))
+	assert.Equal(t, map[string]interface{}{"phase": "downloading"}, data.Meta.Progress)
+
+	b, err = MarshalObject(&Foo{FID: "courge", FRev: "1-abc"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "progress")
+}
+
+type changedFoo struct {
+	*Foo
+}
+
+func (f *changedFoo) Changes() interface{} {
+	return []map[string]interface{}{{"field": "version", "kind": "modified"}}
+}
+
+func TestMetaChanges(t *testing.T) {
+	b, err := MarshalObject(&changedFoo{&Foo{FID: "courge", FRev: "1-abc"}})
+	assert.NoError(t, err)
+	var data ObjectMarshalling
+	assert.NoError(t, json.Unmarshal(b, &data))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"field": "version", "kind": "modified"},
+	}, data.Meta.Changes)
+
+	b, err = MarshalObject(&Foo{FID: "courge", FRev: "1-abc"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "changes")
+}
+
 func TestPagination(t *testing.T) {
 	res, err := http.Get(ts.URL + "/paginated")
 	assert.NoError(t, err)
@@ -186,6 +462,25 @@ func TestMain(m *testing.M) {
 		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
 		return Data(c, 200, courge, nil)
 	})
+	router.GET("/foos", func(c echo.Context) error {
+		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+		bar := &Foo{FID: "bar", FRev: "2-def", Bar: "baz"}
+		return DataList(c, 200, []Object{courge, bar}, nil)
+	})
+	router.POST("/foos", func(c echo.Context) error {
+		var foo Foo
+		if _, err := BindResource(c, "io.cozy.foos", &foo); err != nil {
+			return DataError(c, err.(*Error))
+		}
+		return c.JSON(200, foo)
+	})
+	router.POST("/foos/relationships", func(c echo.Context) error {
+		out, err := BindRelationships(c)
+		if err != nil {
+			return DataError(c, err.(*Error))
+		}
+		return c.JSON(200, out)
+	})
 	router.GET("/paginated", func(c echo.Context) error {
 		cursor, err := ExtractPaginationCursor(c, 13)
 		if err != nil {
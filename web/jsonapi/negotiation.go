@@ -0,0 +1,133 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// PlainJSONContentType is the mime-type used for the plain JSON
+// representation of the objects, without the JSON-API envelope.
+const PlainJSONContentType = "application/json"
+
+// Negotiate returns the content-type to use for the response, based on the
+// Accept header of the request: the one with the highest quality, JSON-API
+// on a tie or without the header, or plain JSON if asked explicitly. A 406
+// Not Acceptable error is returned if none of them can be used.
+func Negotiate(req *http.Request) (string, error) {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return ContentType, nil
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, mime := range []string{ContentType, PlainJSONContentType} {
+		if q := quality(ranges, mime); q > bestQ {
+			best, bestQ = mime, q
+		}
+	}
+	if best == "" {
+		return "", NewError(http.StatusNotAcceptable,
+			"Supported types are "+ContentType+" and "+PlainJSONContentType)
+	}
+	return best, nil
+}
+
+// acceptRange is a media range of an Accept header, with its quality
+type acceptRange struct {
+	mime string
+	q    float64
+}
+
+// parseAccept returns the media ranges of an Accept header. A range without
+// a valid q parameter has the quality 1.
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := acceptRange{mime: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q >= 0 && q <= 1 {
+				r.q = q
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// quality returns the quality of a media type for the ranges of an Accept
+// header: the one of the most specific range that matches it (the type, then
+// type/*, then */*), or 0 if it is not acceptable.
+func quality(ranges []acceptRange, mime string) float64 {
+	wildcard := mime[:strings.Index(mime, "/")] + "/*"
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch r.mime {
+		case mime:
+			s = 2
+		case wildcard:
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// Flatten returns the plain JSON representation of an object: its attributes
+// merged with its id and type.
+func Flatten(o Object) (map[string]interface{}, error) {
+	raw, err := MarshalObject(o)
+	if err != nil {
+		return nil, err
+	}
+	var obj ObjectMarshalling
+	if err = json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]interface{})
+	if obj.Attributes != nil {
+		if err = json.Unmarshal(*obj.Attributes, &flat); err != nil {
+			return nil, err
+		}
+	}
+	flat["id"] = obj.ID
+	flat["type"] = obj.Type
+	return flat, nil
+}
+
+// PlainData can be called to send an answer with the plain JSON
+// representation of a single object.
+func PlainData(c echo.Context, statusCode int, o Object) error {
+	flat, err := Flatten(o)
+	if err != nil {
+		return InternalServerError(err)
+	}
+	return c.JSON(statusCode, flat)
+}
+
+// PlainDataList can be called to send an answer with the plain JSON
+// representation of a list of objects, as an array.
+func PlainDataList(c echo.Context, statusCode int, objs []Object) error {
+	list := make([]map[string]interface{}, len(objs))
+	for i, o := range objs {
+		flat, err := Flatten(o)
+		if err != nil {
+			return InternalServerError(err)
+		}
+		list[i] = flat
+	}
+	return c.JSON(statusCode, list)
+}
@@ -0,0 +1,87 @@
+// Package metrics exposes the metrics of the stack, in the text format of
+// Prometheus, on the admin port
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/labstack/echo"
+)
+
+// contentType is the content-type of the text format of Prometheus
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// cacheMetric is a metric computed from the counters of a cache
+type cacheMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s utils.CacheStats) int64
+}
+
+var cacheMetrics = []cacheMetric{
+	{"cozy_cache_hits_total", "counter", "The number of reads that have found an entry",
+		func(s utils.CacheStats) int64 { return s.Hits }},
+	{"cozy_cache_misses_total", "counter", "The number of reads that have found no entry, or an expired one",
+		func(s utils.CacheStats) int64 { return s.Misses }},
+	{"cozy_cache_evictions_total", "counter", "The number of entries evicted to make room for new ones",
+		func(s utils.CacheStats) int64 { return s.Evictions }},
+	{"cozy_cache_expirations_total", "counter", "The number of expired entries that have been removed",
+		func(s utils.CacheStats) int64 { return s.Expirations }},
+	{"cozy_cache_entries", "gauge", "The number of entries in the cache",
+		func(s utils.CacheStats) int64 { return int64(s.Entries) }},
+	{"cozy_cache_bytes", "gauge", "The size in bytes of the entries in the cache",
+		func(s utils.CacheStats) int64 { return s.Bytes }},
+}
+
+// metricsHandler handles GET /metrics requests. The counters of the caches
+// are given by cache and by shard of the instances, so that the caches can
+// be sized without a label per instance. The caches without buckets are
+// only given by cache. The exact figures of an instance are in the dump of
+// its caches, on the admin port too.
+func metricsHandler(c echo.Context) error {
+	caches := utils.RegisteredCaches()
+	var buf bytes.Buffer
+	writeHeader(&buf, "cozy_cache_max_entries", "gauge", "The maximal number of entries of the cache, 0 for no limit")
+	for _, rc := range caches {
+		fmt.Fprintf(&buf, "cozy_cache_max_entries{cache=\"%s\"} %d\n", escapeLabel(rc.Name), rc.Cache.MaxEntries())
+	}
+	stats := make([][]utils.CacheStats, len(caches))
+	for i, rc := range caches {
+		stats[i] = rc.Cache.ShardStats()
+	}
+	for _, m := range cacheMetrics {
+		writeHeader(&buf, m.name, m.kind, m.help)
+		for i, rc := range caches {
+			name := escapeLabel(rc.Name)
+			if len(stats[i]) == 0 {
+				fmt.Fprintf(&buf, "%s{cache=\"%s\"} %d\n", m.name, name, m.value(rc.Cache.Stats()))
+				continue
+			}
+			for shard, s := range stats[i] {
+				fmt.Fprintf(&buf, "%s{cache=\"%s\",shard=\"%d\"} %d\n",
+					m.name, name, shard, m.value(s))
+			}
+		}
+	}
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+func writeHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// Routes sets the routing for the metrics
+func Routes(router *echo.Group) {
+	router.GET("", metricsHandler)
+}
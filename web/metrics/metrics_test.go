@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	byInstance := utils.NewCache(10, nil)
+	byInstance.SetBucketFunc(func(key string) string { return strings.Split(key, "|")[0] })
+	utils.RegisterCache("test-instances", byInstance)
+	byInstance.Set("alice.cozy.tools|icon.svg", "<svg/>", 0)
+	byInstance.Get("alice.cozy.tools|icon.svg")
+	byInstance.Get("bob.cozy.tools:8080|icon.svg")
+	plain := utils.RegisterCache("test-plain", utils.NewCache(0, nil))
+	plain.Get("foo")
+
+	handler := echo.New()
+	Routes(handler.Group("/metrics"))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, contentType, res.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	lines := strings.Split(string(body), "\n")
+	alice := utils.ShardOfBucket("alice.cozy.tools")
+	bob := utils.ShardOfBucket("bob.cozy.tools:8080")
+	for _, line := range []string{
+		`# TYPE cozy_cache_hits_total counter`,
+		`cozy_cache_max_entries{cache="test-instances"} 10`,
+		fmt.Sprintf(`cozy_cache_hits_total{cache="test-instances",shard="%d"} 1`, alice),
+		fmt.Sprintf(`cozy_cache_entries{cache="test-instances",shard="%d"} 1`, alice),
+		`cozy_cache_misses_total{cache="test-plain"} 1`,
+	} {
+		assert.Contains(t, lines, line)
+	}
+	if alice != bob {
+		assert.Contains(t, lines, fmt.Sprintf(`cozy_cache_misses_total{cache="test-instances",shard="%d"} 1`, bob))
+	}
+
+	// The instances are not in the labels
+	assert.NotContains(t, string(body), "alice.cozy.tools")
+	shards := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, `cozy_cache_hits_total{cache="test-instances",`) {
+			shards++
+		}
+	}
+	assert.Equal(t, utils.CacheShards, shards)
+}
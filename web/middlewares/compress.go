@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/web/sse"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+var gzipMiddleware = middleware.GzipWithConfig(middleware.GzipConfig{
+	Skipper: skipCompression,
+})
+
+// Compress is a middleware that compresses the HTTP responses with gzip, when
+// the client accepts it. The event streams are never compressed, as the
+// compressor would buffer the events until the end of the stream, and neither
+// are the responses to range requests, as the Content-Range header gives the
+// offsets in the uncompressed content.
+func Compress(next echo.HandlerFunc) echo.HandlerFunc {
+	return gzipMiddleware(next)
+}
+
+func skipCompression(c echo.Context) bool {
+	return isEventStream(c) || isRangeRequest(c)
+}
+
+// isRangeRequest returns true if the client has asked for only some parts of
+// the content.
+func isRangeRequest(c echo.Context) bool {
+	return c.Request().Header.Get("Range") != ""
+}
+
+// isEventStream returns true if the client has asked for an event stream. The
+// decision to compress or not must be taken before the handler has set the
+// Content-Type of the response, so it relies on the Accept header.
+func isEventStream(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), sse.ContentType)
+}
@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressSkipsRanges(t *testing.T) {
+	e := echo.New()
+	h := Compress(func(c echo.Context) error {
+		return c.String(http.StatusOK, "<svg>...</svg>")
+	})
+
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local/apps/mini/icon", nil)
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+
+	req.Header.Set("Range", "bytes=0-4")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, "<svg>...</svg>", rec.Body.String())
+}
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -9,9 +10,12 @@ import (
 	"github.com/labstack/echo"
 )
 
-// corsBlackList list all routes prefix that are not eligible to CORS
+// corsBlackList list all routes prefix that are not eligible to CORS. The
+// apps and konnectors routes use the stricter AppsCORS middleware instead.
 var corsBlackList = []string{
 	"/auth/",
+	"/apps/",
+	"/konnectors/",
 }
 
 // MaxAgeCORS is used to cache the CORS header for 12 hours
@@ -65,3 +69,60 @@ func CORS(next echo.HandlerFunc) echo.HandlerFunc {
 		return c.NoContent(http.StatusNoContent)
 	}
 }
+
+// AppsCORS returns a CORS middleware that only allows the origins of the
+// applications of the instance (ie its sub-domains), with credentials, for the
+// given methods. The preflight requests must be routed to a handler that
+// sends a 204 No Content response, like PreflightHandler.
+func AppsCORS(methods ...string) echo.MiddlewareFunc {
+	allowed := strings.Join(append(methods, echo.OPTIONS), ",")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderOrigin)
+
+			origin := req.Header.Get(echo.HeaderOrigin)
+			if origin == "" || !isAppOrigin(c, origin) {
+				return next(c)
+			}
+
+			res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
+			res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+			if req.Method != echo.OPTIONS {
+				res.Header().Set(echo.HeaderAccessControlExposeHeaders, "Etag")
+				return next(c)
+			}
+
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+			res.Header().Set(echo.HeaderAccessControlAllowMethods, allowed)
+			if h := req.Header.Get(echo.HeaderAccessControlRequestHeaders); h != "" {
+				res.Header().Set(echo.HeaderAccessControlAllowHeaders, h)
+			}
+			res.Header().Set(echo.HeaderAccessControlMaxAge, MaxAgeCORS)
+			return next(c)
+		}
+	}
+}
+
+// PreflightHandler is the handler for the OPTIONS requests of the routes that
+// use the AppsCORS middleware.
+func PreflightHandler(c echo.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// isAppOrigin returns true if the origin is the one of an application of the
+// current instance.
+func isAppOrigin(c echo.Context, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Path != "" {
+		return false
+	}
+	i := GetInstance(c)
+	if u.Scheme != i.Scheme() {
+		return false
+	}
+	parent, slug, _ := SplitHost(u.Host)
+	return slug != "" && parent == i.Domain
+}
@@ -5,6 +5,8 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,3 +33,52 @@ func TestCORSMiddlewareNotAuth(t *testing.T) {
 	h(c)
 	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
 }
+
+func TestAppsCORSMiddleware(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	was := cfg.Subdomains
+	defer func() { cfg.Subdomains = was }()
+	cfg.Subdomains = config.NestedSubdomains
+
+	e := echo.New()
+	inst := &instance.Instance{Domain: "joe.example.net"}
+	h := AppsCORS(echo.GET)(PreflightHandler)
+
+	for origin, allowed := range map[string]bool{
+		"https://calendar.joe.example.net": true,
+		"http://calendar.joe.example.net":  false,
+		"https://joe.example.net":          false,
+		"https://calendar.bob.example.net": false,
+		"https://joe.example.net.evil.org": false,
+		"null":                             false,
+	} {
+		req, _ := http.NewRequest(echo.OPTIONS, "https://joe.example.net/apps/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set(echo.HeaderAccessControlRequestHeaders, "Authorization")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("instance", inst)
+		assert.NoError(t, h(c))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Contains(t, rec.Header()[echo.HeaderVary], echo.HeaderOrigin)
+		if allowed {
+			assert.Equal(t, origin, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+			assert.Equal(t, "true", rec.Header().Get(echo.HeaderAccessControlAllowCredentials))
+			assert.Equal(t, "GET,OPTIONS", rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+			assert.Equal(t, "Authorization", rec.Header().Get(echo.HeaderAccessControlAllowHeaders))
+		} else {
+			assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin), origin)
+			assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowCredentials), origin)
+		}
+	}
+
+	req, _ := http.NewRequest(echo.GET, "https://joe.example.net/apps/", nil)
+	req.Header.Set("Origin", "https://calendar.joe.example.net")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("instance", inst)
+	assert.NoError(t, h(c))
+	assert.Equal(t, "https://calendar.joe.example.net", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+}
@@ -109,3 +109,13 @@ func AllowLogout(c echo.Context) bool {
 	}
 	return pdoc.Type == permissions.TypeApplication
 }
+
+// InstallSubject returns the subject of an operation on an application, from
+// the permission checked by AllowInstallApp.
+func InstallSubject(c echo.Context) *apps.Subject {
+	pdoc, err := GetPermission(c)
+	if err != nil {
+		return nil
+	}
+	return apps.SubjectOf(pdoc)
+}
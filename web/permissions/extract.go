@@ -119,20 +119,24 @@ func extract(c echo.Context) (*permissions.Permission, error) {
 
 }
 
-// GetPermission extracts the permission from the echo context and checks their validity
-func GetPermission(c echo.Context) (*permissions.Permission, error) {
+// permissionResult is the permission extracted from a request, or the error
+// of the extraction
+type permissionResult struct {
+	pdoc *permissions.Permission
+	err  error
+}
 
-	pdoc, ok := c.Get(contextPermissionDoc).(*permissions.Permission)
-	if ok && pdoc != nil {
-		return pdoc, nil
+// GetPermission extracts the permission from the echo context and checks their
+// validity. The result is memoized in the context on the first call, even
+// when it is an error, so that the token is parsed and the permission looked
+// up only once per request, whatever the number of checks. The echo contexts
+// are reset between two requests, so nothing is shared between them.
+func GetPermission(c echo.Context) (*permissions.Permission, error) {
+	if res, ok := c.Get(contextPermissionDoc).(*permissionResult); ok {
+		return res.pdoc, res.err
 	}
 
 	pdoc, err := extract(c)
-	if err != nil {
-		return nil, err
-	}
-
-	c.Set(contextPermissionDoc, pdoc)
-
-	return pdoc, nil
+	c.Set(contextPermissionDoc, &permissionResult{pdoc: pdoc, err: err})
+	return pdoc, err
 }
@@ -18,6 +18,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
@@ -115,6 +116,36 @@ func TestBadPermissionsBearer(t *testing.T) {
 	assert.Equal(t, res.StatusCode, http.StatusBadRequest)
 }
 
+func TestGetPermissionIsMemoized(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest("GET", "/apps/", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set("instance", testInstance)
+	pdoc, err := GetPermission(c)
+	if !assert.NoError(t, err) {
+		return
+	}
+	again, err := GetPermission(c)
+	assert.NoError(t, err)
+	assert.True(t, pdoc == again, "the permission should be parsed once")
+
+	// The errors are memoized too
+	bad, _ := http.NewRequest("GET", "/apps/", nil)
+	bad.Header.Add("Authorization", "Bearer garbage")
+	c.Reset(bad, httptest.NewRecorder())
+	c.Set("instance", testInstance)
+	_, err = GetPermission(c)
+	assert.Equal(t, permissions.ErrInvalidToken, err)
+	bad.Header.Set("Authorization", "Bearer "+token)
+	assert.Error(t, AllowWholeType(c, permissions.GET, "io.cozy.contacts"))
+
+	// Nothing leaks from a request to the next one on the same context
+	c.Reset(req, httptest.NewRecorder())
+	c.Set("instance", testInstance)
+	assert.NoError(t, AllowWholeType(c, permissions.GET, "io.cozy.contacts"))
+}
+
 func TestCreateSubPermission(t *testing.T) {
 	_, codes, err := createTestSubPermissions(token, "alice,bob")
 	if !assert.NoError(t, err) {
@@ -471,3 +502,20 @@ func createTestEvent(i *instance.Instance) (*couchdb.JSONDoc, error) {
 	err := couchdb.CreateDoc(i, e)
 	return e, err
 }
+
+func BenchmarkAllowWholeTypeOnAList(b *testing.B) {
+	e := echo.New()
+	req, _ := http.NewRequest("GET", "/apps/", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.Set("instance", testInstance)
+		// Like the serialization of a list of 100 applications
+		for j := 0; j < 100; j++ {
+			if err := AllowWholeType(c, permissions.GET, "io.cozy.contacts"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
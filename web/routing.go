@@ -21,6 +21,7 @@ import (
 	"github.com/cozy/cozy-stack/web/instances"
 	"github.com/cozy/cozy-stack/web/intents"
 	"github.com/cozy/cozy-stack/web/jobs"
+	"github.com/cozy/cozy-stack/web/metrics"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/cozy-stack/web/settings"
@@ -150,6 +151,9 @@ func SetupRoutes(router *echo.Echo) error {
 	})
 
 	router.Use(secure, middlewares.CORS)
+	if config.GetConfig().Gzip {
+		router.Use(middlewares.Compress)
+	}
 
 	mws := []echo.MiddlewareFunc{
 		middlewares.NeedInstance,
@@ -182,6 +186,8 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	}
 
 	instances.Routes(router.Group("/instances"))
+	metrics.Routes(router.Group("/metrics"))
+	status.AdminRoutes(router.Group("/status"))
 	version.Routes(router.Group("/version"))
 
 	setupRecover(router)
@@ -4,12 +4,17 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
@@ -75,7 +80,10 @@ func ListenAndServe(noAdmin bool) error {
 // permissions.
 func ListenAndServeWithAppDir(appsdir map[string]string) error {
 	for slug, dir := range appsdir {
-		dir = utils.AbsPath(dir)
+		dir, err := utils.AbsPath(dir)
+		if err != nil {
+			return err
+		}
 		appsdir[slug] = dir
 		exists, err := utils.DirExists(dir)
 		if err != nil {
@@ -162,16 +170,48 @@ security features. Please do not use this binary as your production server.
 		}))
 	}
 
-	errs := make(chan error)
+	errs := make(chan error, 2)
+	group := utils.NewShutdownGroup()
 
 	if !noAdmin {
 		admin := echo.New()
 		if err = SetupAdminRoutes(admin); err != nil {
 			return err
 		}
-		go func() { errs <- admin.Start(config.AdminServerAddr()) }()
+		adminServer, err := newGracefulServer(config.AdminServerAddr(), admin)
+		if err != nil {
+			return err
+		}
+		group.Register("admin server", 0, serverShutdownTimeout, adminServer.Shutdown)
+		go func() { errs <- adminServer.Serve() }()
+	}
+
+	mainServer, err := newGracefulServer(config.ServerAddr(), main)
+	if err != nil {
+		return err
 	}
+	group.Register("main server", 0, serverShutdownTimeout, mainServer.Shutdown)
+	webapps.RegisterShutdown(group)
+	go func() { errs <- mainServer.Serve() }()
 
-	go func() { errs <- main.Start(config.ServerAddr()) }()
-	return <-errs
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		return err
+	case <-sigs:
+	}
+	log.Infof("Shutting down, hit Ctrl+C again to force it")
+	signal.Stop(sigs)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDeadline)
+	defer cancel()
+	return group.Shutdown(ctx)
 }
+
+const (
+	// serverShutdownTimeout is how long the shutdown waits for the requests
+	// in progress on an HTTP server
+	serverShutdownTimeout = 10 * time.Second
+	// shutdownDeadline is the maximal duration of the shutdown of the stack
+	shutdownDeadline = 2 * time.Minute
+)
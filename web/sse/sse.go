@@ -0,0 +1,102 @@
+// Package sse is for writing Server-Sent Events streams, as described in
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+package sse
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// ContentType is the mime-type of the event streams
+const ContentType = "text/event-stream"
+
+// Event is an event sent on the stream. The Name and ID fields are optional.
+type Event struct {
+	ID   string
+	Name string
+	Data string
+}
+
+// Writer writes the events of a stream into an http.ResponseWriter. Each
+// event is flushed right after being written. It is safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+// NewWriter sets the headers of the HTTP response for an event stream, sends
+// them with a 200 status code, and returns a Writer for the events.
+func NewWriter(w http.ResponseWriter) *Writer {
+	h := w.Header()
+	h.Set("Content-Type", ContentType)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &Writer{w: w}
+}
+
+// Event writes an event with the given name and data.
+func (w *Writer) Event(name, data string) error {
+	return w.Send(&Event{Name: name, Data: data})
+}
+
+// Send writes the given event. A data with several lines is sent as several
+// data fields.
+func (w *Writer) Send(e *Event) error {
+	var buf bytes.Buffer
+	if e.ID != "" {
+		buf.WriteString("id: " + e.ID + "\r\n")
+	}
+	if e.Name != "" {
+		buf.WriteString("event: " + e.Name + "\r\n")
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		buf.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	return w.write(buf.Bytes())
+}
+
+// Ping writes a comment on the stream, that is ignored by the clients, but
+// can be used to keep the connection alive.
+func (w *Writer) Ping() error {
+	return w.write([]byte(": ping\r\n\r\n"))
+}
+
+// KeepAlive pings the stream at the given interval, so that the proxies don't
+// close the connection when there is no event for a long time. It returns
+// when the context is done, or when a ping can't be written.
+func (w *Writer) KeepAlive(ctx context.Context, interval time.Duration) error {
+	return utils.Every(ctx, interval, func(ctx context.Context) error {
+		return w.Ping()
+	})
+}
+
+func (w *Writer) write(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+type errFlusher interface {
+	Flush() error
+}
+
+func (w *Writer) flush() error {
+	switch f := w.w.(type) {
+	case errFlusher:
+		return f.Flush()
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
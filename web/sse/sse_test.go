@@ -0,0 +1,80 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewWriter(rec)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "no", rec.Header().Get("X-Accel-Buffering"))
+}
+
+func TestEventFraming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewWriter(rec)
+	assert.NoError(t, w.Event("state", `{"data":{}}`))
+	assert.Equal(t, "event: state\r\ndata: {\"data\":{}}\r\n\r\n", rec.Body.String())
+	assert.True(t, rec.Flushed)
+
+	rec.Body.Reset()
+	assert.NoError(t, w.Send(&Event{ID: "42", Name: "error", Data: "foo\nbar"}))
+	assert.Equal(t, "id: 42\r\nevent: error\r\ndata: foo\r\ndata: bar\r\n\r\n", rec.Body.String())
+
+	rec.Body.Reset()
+	assert.NoError(t, w.Send(&Event{Data: "baz"}))
+	assert.Equal(t, "data: baz\r\n\r\n", rec.Body.String())
+
+	rec.Body.Reset()
+	assert.NoError(t, w.Ping())
+	assert.Equal(t, ": ping\r\n\r\n", rec.Body.String())
+}
+
+type failingWriter struct {
+	http.ResponseWriter
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWriteError(t *testing.T) {
+	w := NewWriter(&failingWriter{httptest.NewRecorder()})
+	assert.Error(t, w.Event("state", "foo"))
+	assert.Error(t, w.Ping())
+}
+
+func TestKeepAlive(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(utils.ContextWithClock(context.Background(), clock))
+	rec := httptest.NewRecorder()
+	w := NewWriter(rec)
+	done := make(chan error)
+	go func() { done <- w.KeepAlive(ctx, 15*time.Second) }()
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(15 * time.Second)
+	}
+	clock.BlockUntil(1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, ": ping\r\n\r\n: ping\r\n\r\n", rec.Body.String())
+
+	// It stops when the client has gone away
+	w = NewWriter(&failingWriter{httptest.NewRecorder()})
+	go func() { done <- w.KeepAlive(utils.ContextWithClock(context.Background(), clock), time.Second) }()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	assert.Error(t, <-done)
+}
@@ -0,0 +1,105 @@
+package status
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/labstack/echo"
+	"github.com/spf13/afero"
+)
+
+// fsProbe is the result of the probe of a file system backend
+type fsProbe struct {
+	Backend   string  `json:"backend"`
+	Healthy   bool    `json:"healthy"`
+	Skipped   bool    `json:"skipped,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// FSStatus responds with the status of the file system backends. For each
+// of them, a small file is written, read and deleted, and the time taken is
+// reported. As it writes on the storage, it is only served on the admin port.
+func FSStatus(c echo.Context) error {
+	message := "OK"
+	probes := probeBackends()
+	for _, p := range probes {
+		if !p.Healthy && !p.Skipped {
+			message = "KO"
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"message":  message,
+		"backends": probes,
+	})
+}
+
+// probeBackends probes the file system backends of the configuration. The
+// files of the instances and of their applications share the same backend.
+// With the mem scheme, the files of the applications are still written on
+// the disk, in the path of the URL (see Instance.AppsFS), and it is this
+// directory that is probed.
+func probeBackends() []*fsProbe {
+	fsURL := config.FsURL()
+	name := (&url.URL{Scheme: fsURL.Scheme, Host: fsURL.Host, Path: fsURL.Path}).String()
+	switch fsURL.Scheme {
+	case "file", "mem":
+		root := fsURL.Path
+		if root == "" {
+			root = "."
+		}
+		return []*fsProbe{probeFS(name, afero.NewBasePathFs(afero.NewOsFs(), root))}
+	}
+	return []*fsProbe{{
+		Backend: name,
+		Skipped: true,
+		Error:   fmt.Sprintf("The probe is not supported for %s", fsURL.Scheme),
+	}}
+}
+
+// probeFS writes a probe file on the file system, reads it back and deletes
+// it. The latency is the time taken by the three operations.
+func probeFS(name string, fs afero.Fs) *fsProbe {
+	p := &fsProbe{Backend: name}
+	filename := "/.probe-" + utils.RandomString(16)
+	content := []byte(utils.RandomString(32))
+	start := time.Now()
+	err := probeFile(fs, filename, content)
+	p.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		p.Error = err.Error()
+	} else {
+		p.Healthy = true
+	}
+	return p
+}
+
+func probeFile(fs afero.Fs, filename string, content []byte) error {
+	if err := afero.WriteFile(fs, filename, content, 0600); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	f, err := fs.Open(filename)
+	if err != nil {
+		fs.Remove(filename)
+		return fmt.Errorf("read: %s", err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err == nil && !bytes.Equal(b, content) {
+		err = fmt.Errorf("the content of %s has changed", filename)
+	}
+	if err != nil {
+		fs.Remove(filename)
+		return fmt.Errorf("read: %s", err)
+	}
+	if err = fs.Remove(filename); err != nil {
+		return fmt.Errorf("delete: %s", err)
+	}
+	return nil
+}
@@ -39,3 +39,8 @@ func Routes(router *echo.Group) {
 	router.GET("/", Status)
 	router.HEAD("/", Status)
 }
+
+// AdminRoutes sets the routing for the status service on the admin port
+func AdminRoutes(router *echo.Group) {
+	router.GET("/fs", FSStatus)
+}
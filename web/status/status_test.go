@@ -1,6 +1,7 @@
 package status
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +11,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/labstack/echo"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,6 +37,61 @@ func TestRoutes(t *testing.T) {
 	testRequest(t, ts.URL+"/status")
 }
 
+func TestFSStatus(t *testing.T) {
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	Routes(handler.Group("/status"))
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// The probe is not served on the public routes
+	res, err := http.Get(ts.URL + "/status/fs")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	}
+
+	admin := echo.New()
+	admin.HTTPErrorHandler = errors.ErrorHandler
+	AdminRoutes(admin.Group("/status"))
+
+	ts2 := httptest.NewServer(admin)
+	defer ts2.Close()
+
+	res, err = http.Get(ts2.URL + "/status/fs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var body struct {
+		Message  string     `json:"message"`
+		Backends []*fsProbe `json:"backends"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, "OK", body.Message)
+	if assert.Len(t, body.Backends, 1) {
+		assert.Equal(t, "mem://test", body.Backends[0].Backend)
+		assert.True(t, body.Backends[0].Healthy)
+		assert.Empty(t, body.Backends[0].Error)
+	}
+}
+
+func TestProbeFS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	p := probeFS("mem://probe", fs)
+	assert.True(t, p.Healthy)
+	assert.True(t, p.LatencyMS >= 0)
+	infos, err := afero.ReadDir(fs, "/")
+	assert.NoError(t, err)
+	assert.Empty(t, infos, "the probe file should be deleted")
+
+	p = probeFS("ro://probe", afero.NewReadOnlyFs(fs))
+	assert.False(t, p.Healthy)
+	assert.Contains(t, p.Error, "write:")
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	os.Exit(m.Run())